@@ -0,0 +1,199 @@
+// Copyright 2020 Nik Silver
+//
+// Licensed under the GPL v3.0. See file LICENCE.txt for details.
+
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// Secret an operator must give in the X-Admin-Secret header to use the
+// admin endpoints. If it's empty they're turned off.
+var adminSecret = ""
+
+// Largest announcement an operator can send
+var maxAnnouncementBytes = 16 * 1024
+
+// Secret a service must give in the X-Send-Secret header to send a
+// message into a room without connecting. If it's empty that's turned
+// off. And the ID the message is from, which is always reserved.
+var sendSecret = ""
+var sendFromID = systemID("server")
+
+// roomHandler handles everything for game rooms: a POST to a room's
+// path plus /send sends a message into it, and anything else connects
+// a client to it.
+func roomHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/send") {
+		sendHandler(w, r)
+		return
+	}
+	bounceHandler(w, r)
+}
+
+// sendHandler sends the body of a POST request into an existing room
+// as a peer message, for a service that doesn't want to stay connected.
+// The room's path is the request's path without the /send.
+func sendHandler(w http.ResponseWriter, r *http.Request) {
+	if sendSecret == "" {
+		http.NotFound(w, r)
+		return
+	}
+	secret := r.Header.Get("X-Send-Secret")
+	if subtle.ConstantTimeCompare([]byte(secret), []byte(sendSecret)) != 1 {
+		aLog.Warn("Send request with bad secret", "path", r.URL.Path)
+		http.Error(w, "Bad secret", http.StatusUnauthorized)
+		return
+	}
+
+	room := strings.TrimSuffix(r.URL.Path, "/send")
+	h := Shub.Existing(room)
+	if h == nil {
+		http.NotFound(w, r)
+		return
+	}
+	limit := h.settings.ReadLimit
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, int64(limit)+1))
+	if err != nil || len(body) == 0 || len(body) > limit {
+		http.Error(w, "Body must be given, and not too big",
+			http.StatusBadRequest)
+		return
+	}
+
+	if !h.post(&Message{
+		FromID: sendFromID,
+		Intent: "Send",
+		Body:   body,
+		Type:   websocket.TextMessage,
+	}) {
+		http.NotFound(w, r)
+		return
+	}
+	aLog.Info("Sent message into room", "room", room, "from", sendFromID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// adminBroadcastHandler sends the JSON in a POST request to every client
+// in every room, as an Announcement, such as to say the server is about
+// to restart. It says how many rooms it went to.
+func adminBroadcastHandler(w http.ResponseWriter, r *http.Request) {
+	if !adminAllowed(w, r, http.MethodPost) {
+		return
+	}
+
+	body, err := ioutil.ReadAll(
+		io.LimitReader(r.Body, int64(maxAnnouncementBytes)+1))
+	if err != nil || len(body) > maxAnnouncementBytes || !json.Valid(body) {
+		http.Error(w, "Body must be JSON, and not too big",
+			http.StatusBadRequest)
+		return
+	}
+
+	rooms := Shub.Announce(body)
+	aLog.Info("Sent announcement", "rooms", rooms)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Rooms int
+	}{
+		Rooms: rooms,
+	})
+}
+
+// adminRoomsHandler gives JSON saying how each room is doing, by name,
+// including what it's keeping in case envelopes need to be resent.
+func adminRoomsHandler(w http.ResponseWriter, r *http.Request) {
+	if !adminAllowed(w, r, http.MethodGet) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Rooms map[string]*Stats
+	}{
+		Rooms: Shub.RoomStats(),
+	})
+}
+
+// adminRoomHandler handles an operator's requests about one room, whose
+// path follows /admin/rooms: a DELETE closes it, and anything else is
+// about its clients.
+func adminRoomHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodDelete {
+		adminCloseRoomHandler(w, r)
+		return
+	}
+	adminRoomClientsHandler(w, r)
+}
+
+// adminCloseRoomHandler closes a room for a DELETE to /admin/rooms
+// followed by the room's path, such as if it's got into a bad state.
+// The room's clients are thrown out and it starts again empty. It's
+// accepted before the room has finished closing, and it's not found if
+// there's no such room.
+func adminCloseRoomHandler(w http.ResponseWriter, r *http.Request) {
+	if !adminAllowed(w, r, http.MethodDelete) {
+		return
+	}
+	room := strings.TrimPrefix(r.URL.Path, "/admin/rooms")
+	if !Shub.ForceClose(room) {
+		http.NotFound(w, r)
+		return
+	}
+	aLog.Info("Closing room for operator", "room", room)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// adminRoomClientsHandler gives JSON saying how each client a room's
+// tracking is doing, for a GET to /admin/rooms followed by the room's
+// path and /clients. It's not found if there's no such room.
+func adminRoomClientsHandler(w http.ResponseWriter, r *http.Request) {
+	if !adminAllowed(w, r, http.MethodGet) {
+		return
+	}
+	room := strings.TrimPrefix(r.URL.Path, "/admin/rooms")
+	if !strings.HasSuffix(room, "/clients") {
+		http.NotFound(w, r)
+		return
+	}
+	room = strings.TrimSuffix(room, "/clients")
+	clients, okay := Shub.RoomClients(room)
+	if !okay {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Clients []*ClientStats
+	}{
+		Clients: clients,
+	})
+}
+
+// adminAllowed says if a request to an admin endpoint can go ahead, as
+// admin requests are turned on, the request uses the given method and
+// it has the right secret. If not it gives the error response.
+func adminAllowed(w http.ResponseWriter, r *http.Request, method string) bool {
+	if adminSecret == "" {
+		http.NotFound(w, r)
+		return false
+	}
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+	secret := r.Header.Get("X-Admin-Secret")
+	if subtle.ConstantTimeCompare([]byte(secret), []byte(adminSecret)) != 1 {
+		aLog.Warn("Admin request with bad secret", "path", r.URL.Path)
+		http.Error(w, "Bad secret", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,614 @@
+// Copyright 2020 Nik Silver
+//
+// Licensed under the GPL v3.0. See file LICENCE.txt for details.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestAdmin_BroadcastGoesToEveryRoom(t *testing.T) {
+	// Just for this test, lower the reconnection timeout so that a
+	// Leaver message is triggered reasonably quickly, and have an
+	// admin secret
+	useSuperhub(t, 250*time.Millisecond)
+	oldAdminSecret := adminSecret
+	adminSecret = "s3cret"
+	defer func() {
+		adminSecret = oldAdminSecret
+	}()
+
+	serv := newTestServer(bounceHandler)
+	defer serv.Close()
+
+	// Connect a client to each of two rooms
+
+	twss := make([]*tConn, 0)
+	for _, d := range []struct {
+		room string
+		id   string
+	}{
+		{"/admin.room.1", "ADM1"},
+		{"/admin.room.2", "ADM2"},
+	} {
+		ws, _, err := dial(serv, d.room, d.id, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tws := newTConn(ws, d.id)
+		defer tws.close()
+		if err := tws.swallow("Welcome"); err != nil {
+			t.Fatal(err)
+		}
+		twss = append(twss, tws)
+	}
+
+	post := func(method string, secret string, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/admin/broadcast",
+			strings.NewReader(body))
+		if secret != "" {
+			req.Header.Set("X-Admin-Secret", secret)
+		}
+		w := httptest.NewRecorder()
+		adminBroadcastHandler(w, req)
+		return w
+	}
+
+	// Bad requests are refused, and no-one hears anything
+
+	data := []struct {
+		desc   string
+		method string
+		secret string
+		body   string
+		status int
+	}{
+		{"No secret", "POST", "", `"Hello"`, http.StatusUnauthorized},
+		{"Wrong secret", "POST", "guess", `"Hello"`, http.StatusUnauthorized},
+		{"Not POST", "GET", "s3cret", "", http.StatusMethodNotAllowed},
+		{"Not JSON", "POST", "s3cret", "Hello", http.StatusBadRequest},
+		{"Too big", "POST", "s3cret",
+			`"` + strings.Repeat("x", maxAnnouncementBytes) + `"`,
+			http.StatusBadRequest},
+	}
+	for _, d := range data {
+		if w := post(d.method, d.secret, d.body); w.Code != d.status {
+			t.Errorf("%s: Expected status %d but got %d",
+				d.desc, d.status, w.Code)
+		}
+	}
+	for _, tws := range twss {
+		if err := tws.expectNoMessage(200); err != nil {
+			t.Errorf("%s: %s", tws.id, err)
+		}
+	}
+
+	// A good request goes to everyone
+
+	w := post("POST", "s3cret", `{"text":"Restarting in 5 minutes"}`)
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status 200 but got %d", w.Code)
+	}
+	for _, tws := range twss {
+		env, err := tws.readEnvelope(500, "%s expecting Announcement", tws.id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if env.Intent != "Announcement" || env.Num < 0 ||
+			string(env.Body) != `{"text":"Restarting in 5 minutes"}` {
+			t.Errorf("%s got unexpected envelope: %#v", tws.id, env)
+		}
+	}
+
+	// With no secret the endpoint isn't there
+
+	adminSecret = ""
+	if w := post("POST", "", `"Hello"`); w.Code != http.StatusNotFound {
+		t.Errorf("With no secret expected status 404 but got %d", w.Code)
+	}
+
+	// Tidy up, and check everything in the main app finishes
+	for _, tws := range twss {
+		tws.close()
+	}
+	WG.Wait()
+}
+
+func TestAdmin_SendGoesIntoOneRoom(t *testing.T) {
+	// Just for this test, lower the reconnection timeout so that a
+	// Leaver message is triggered reasonably quickly, and have a
+	// send secret
+	useSuperhub(t, 250*time.Millisecond)
+	oldSendSecret := sendSecret
+	sendSecret = "s3cret"
+	defer func() {
+		sendSecret = oldSendSecret
+	}()
+
+	serv := newTestServer(roomHandler)
+	defer serv.Close()
+
+	// Connect two clients to one room and one client to another
+
+	room := "/admin.send.room"
+	twss := make([]*tConn, 0)
+	for _, d := range []struct {
+		room string
+		id   string
+	}{
+		{room, "SND1"},
+		{room, "SND2"},
+		{"/admin.send.other", "SND3"},
+	} {
+		ws, _, err := dial(serv, d.room, d.id, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tws := newTConn(ws, d.id)
+		defer tws.close()
+		if err := tws.swallow("Welcome"); err != nil {
+			t.Fatal(err)
+		}
+		twss = append(twss, tws)
+	}
+	if err := twss[0].swallow("Joiner"); err != nil {
+		t.Fatal(err)
+	}
+
+	post := func(path string, secret string, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", path, strings.NewReader(body))
+		if secret != "" {
+			req.Header.Set("X-Send-Secret", secret)
+		}
+		w := httptest.NewRecorder()
+		roomHandler(w, req)
+		return w
+	}
+
+	// Bad requests are refused, and no-one hears anything
+
+	data := []struct {
+		desc   string
+		path   string
+		secret string
+		body   string
+		status int
+	}{
+		{"No secret", room + "/send", "", `"Hello"`, http.StatusUnauthorized},
+		{"Wrong secret", room + "/send", "guess", `"Hello"`,
+			http.StatusUnauthorized},
+		{"No body", room + "/send", "s3cret", "", http.StatusBadRequest},
+		{"Too big", room + "/send", "s3cret",
+			strings.Repeat("x", readLimit+1), http.StatusBadRequest},
+		{"No room", "/admin.send.nowhere/send", "s3cret", `"Hello"`,
+			http.StatusNotFound},
+	}
+	for _, d := range data {
+		if w := post(d.path, d.secret, d.body); w.Code != d.status {
+			t.Errorf("%s: Expected status %d but got %d",
+				d.desc, d.status, w.Code)
+		}
+	}
+	for _, tws := range twss {
+		if err := tws.expectNoMessage(200); err != nil {
+			t.Errorf("%s: %s", tws.id, err)
+		}
+	}
+	if h := Shub.Existing("/admin.send.nowhere"); h != nil {
+		t.Errorf("Sending to a missing room created a hub")
+	}
+
+	// A good request goes to everyone in that room only, from the
+	// server
+
+	w := post(room+"/send", "s3cret", `{"score":12}`)
+	if w.Code != http.StatusNoContent {
+		t.Errorf("Expected status 204 but got %d", w.Code)
+	}
+	for _, tws := range twss[:2] {
+		env, err := tws.readEnvelope(500, "%s expecting Peer", tws.id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if env.Intent != "Peer" || env.Num < 0 ||
+			!sameElements(env.From, []string{sendFromID}) ||
+			string(env.Body) != `{"score":12}` {
+			t.Errorf("%s got unexpected envelope: %#v", tws.id, env)
+		}
+	}
+	if err := twss[2].expectNoMessage(200); err != nil {
+		t.Errorf("SND3: %s", err)
+	}
+
+	// With no secret the endpoint isn't there
+
+	sendSecret = ""
+	if w := post(room+"/send", "", `"Hello"`); w.Code != http.StatusNotFound {
+		t.Errorf("With no secret expected status 404 but got %d", w.Code)
+	}
+
+	// Tidy up, and check everything in the main app finishes
+	for _, tws := range twss {
+		tws.close()
+	}
+	WG.Wait()
+}
+
+func TestAdmin_ClientsCantPretendToBeTheServer(t *testing.T) {
+	serv := newTestServer(bounceHandler)
+	defer serv.Close()
+
+	for _, id := range []string{"%23server", "%23", "%23SND1"} {
+		ws, resp, err := dial(serv, "/admin.impersonate", id, -1)
+		if err == nil {
+			ws.Close()
+			t.Errorf("ID %s: Expected error, but didn't get one", id)
+			continue
+		}
+		if resp == nil || resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("ID %s: Expected 400 but got %v", id, resp)
+		}
+	}
+
+	// Whatever ID messages are sent from, it's one no client can have
+	for _, d := range []struct {
+		name string
+		exp  string
+	}{
+		{"server", "#server"},
+		{"#server", "#server"},
+		{"scores", "#scores"},
+	} {
+		if got := systemID(d.name); got != d.exp || !reservedID(got) {
+			t.Errorf("%q gave system ID %q", d.name, got)
+		}
+	}
+	if !reservedID(sendFromID) {
+		t.Errorf("Messages are sent from %q, which isn't reserved",
+			sendFromID)
+	}
+
+	// Check everything in the main app finishes
+	WG.Wait()
+}
+
+func TestAdmin_RoomsSayHowTheyreDoing(t *testing.T) {
+	// Just for this test, lower the reconnection timeout so that a
+	// Leaver message is triggered reasonably quickly, and have an
+	// admin secret
+	useSuperhub(t, 250*time.Millisecond)
+	oldAdminSecret := adminSecret
+	adminSecret = "s3cret"
+	defer func() {
+		adminSecret = oldAdminSecret
+	}()
+
+	serv := newTestServer(bounceHandler)
+	defer serv.Close()
+
+	// A room with two clients, one of whom sends a message
+
+	start := nowMs()
+	room := "/admin.stats"
+	ws1, _, err := dial(serv, room, "ADS1", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws1 := newTConn(ws1, "ADS1")
+	defer tws1.close()
+	if err := tws1.swallow("Welcome"); err != nil {
+		t.Fatal(err)
+	}
+	ws2, _, err := dial(serv, room, "ADS2", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws2 := newTConn(ws2, "ADS2")
+	defer tws2.close()
+	if err = swallowMany(
+		intentExp{"ADS2 joining, ws2", tws2, "Welcome"},
+		intentExp{"ADS2 joining, ws1", tws1, "Joiner"},
+	); err != nil {
+		t.Fatal(err)
+	}
+	if err := ws1.WriteMessage(websocket.TextMessage, []byte(`"Hello"`)); err != nil {
+		t.Fatal(err)
+	}
+	if err = swallowMany(
+		intentExp{"ADS1 sending, ws1", tws1, "Peer"},
+		intentExp{"ADS1 sending, ws2", tws2, "Peer"},
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(secret string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/admin/rooms", nil)
+		req.Header.Set("X-Admin-Secret", secret)
+		w := httptest.NewRecorder()
+		adminRoomsHandler(w, req)
+		return w
+	}
+
+	getStats := func() *Stats {
+		w := get("s3cret")
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status 200 but got %d", w.Code)
+		}
+		out := struct {
+			Rooms map[string]*Stats
+		}{}
+		if err := json.NewDecoder(w.Body).Decode(&out); err != nil {
+			t.Fatal(err)
+		}
+		return out.Rooms[room]
+	}
+
+	// Only an operator can see the room, and it's keeping the
+	// envelopes it's sent. The highest num is the Peer message ADS1
+	// got, after its Welcome and ADS2's Joiner.
+
+	if w := get("guess"); w.Code != http.StatusUnauthorized {
+		t.Errorf("Wrong secret: Expected status 401 but got %d", w.Code)
+	}
+	st := getStats()
+	if st == nil || st.Members != 2 || st.Messages != 1 ||
+		st.Buffered < 4 || st.BufferedBytes < len(`"Hello"`) ||
+		st.OldestBufferedMs < 0 || st.Num != 2 ||
+		st.Connected != 2 || st.Reconnecting != 0 ||
+		st.LastActive < start || st.LastActive > nowMs() {
+		t.Errorf("Room has unexpected stats %#v", st)
+	}
+
+	// When one client's connection drops it may still reconnect, and
+	// the other is sent an Away
+
+	tws2.close()
+	if err := tws1.swallow("Away"); err != nil {
+		t.Fatal(err)
+	}
+	st = getStats()
+	if st == nil || st.Members != 2 || st.Num != 3 ||
+		st.Connected != 1 || st.Reconnecting != 1 {
+		t.Errorf("Room has unexpected stats after drop %#v", st)
+	}
+
+	// Tidy up, and check everything in the main app finishes
+	tws1.close()
+	tws2.close()
+	WG.Wait()
+}
+
+func TestAdmin_RoomClientsSayWhosThere(t *testing.T) {
+	// Just for this test, lower the reconnection timeout so that a
+	// Leaver message is triggered reasonably quickly, and have an
+	// admin secret
+	useSuperhub(t, 250*time.Millisecond)
+	oldAdminSecret := adminSecret
+	adminSecret = "s3cret"
+	defer func() {
+		adminSecret = oldAdminSecret
+	}()
+
+	serv := newTestServer(bounceHandler)
+	defer serv.Close()
+
+	// A room with two clients, one of whom drops its connection,
+	// and one who's only tracked, because its lastnum is bad
+
+	start := time.Now()
+	room := "/admin.clients"
+	ws1, _, err := dial(serv, room, "ADC1", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws1 := newTConn(ws1, "ADC1")
+	defer tws1.close()
+	if err := tws1.swallow("Welcome"); err != nil {
+		t.Fatal(err)
+	}
+	ws2, _, err := dial(serv, room, "ADC2", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws2 := newTConn(ws2, "ADC2")
+	defer tws2.close()
+	if err = swallowMany(
+		intentExp{"ADC2 joining, ws2", tws2, "Welcome"},
+		intentExp{"ADC2 joining, ws1", tws1, "Joiner"},
+	); err != nil {
+		t.Fatal(err)
+	}
+	tws2.close()
+	if err := tws1.swallow("Away"); err != nil {
+		t.Fatal(err)
+	}
+	ws3, _, err := dial(serv, room, "ADC3", 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws3 := newTConn(ws3, "ADC3")
+	defer tws3.close()
+	if err := tws3.expectClose(CloseBadLastnum, 500); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(path string, secret string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("X-Admin-Secret", secret)
+		w := httptest.NewRecorder()
+		adminRoomClientsHandler(w, req)
+		return w
+	}
+	path := "/admin/rooms" + room + "/clients"
+
+	// Only an operator can see the clients, and only for a room
+	// that's there
+
+	if w := get(path, "guess"); w.Code != http.StatusUnauthorized {
+		t.Errorf("Wrong secret: Expected status 401 but got %d", w.Code)
+	}
+	w := get("/admin/rooms/admin.nowhere/clients", "s3cret")
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Unknown room: Expected status 404 but got %d", w.Code)
+	}
+	if w := get("/admin/rooms"+room, "s3cret"); w.Code != http.StatusNotFound {
+		t.Errorf("No /clients: Expected status 404 but got %d", w.Code)
+	}
+
+	w = get(path, "s3cret")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200 but got %d", w.Code)
+	}
+	out := struct {
+		Clients []*ClientStats
+	}{}
+	if err := json.NewDecoder(w.Body).Decode(&out); err != nil {
+		t.Fatal(err)
+	}
+	if len(out.Clients) != 3 {
+		t.Fatalf("Expected 3 clients but got %d", len(out.Clients))
+	}
+	exps := []struct {
+		id     string
+		status string
+		num    int
+	}{
+		{"ADC1", "CONNECTED", 2},
+		{"ADC2", "MAYRECONNECT", 0},
+		{"ADC3", "TRACKEDONLY", -1},
+	}
+	maxAge := time.Since(start).Milliseconds()
+	for i, exp := range exps {
+		cs := out.Clients[i]
+		if cs.ID != exp.id || cs.Status != exp.status || cs.Num != exp.num ||
+			cs.Ref == "" || cs.Buffered != exp.num+1 ||
+			cs.AgeMs < 0 || cs.AgeMs > maxAge {
+			t.Errorf("Client %d expected ID %s, status %s, num %d, "+
+				"but got %#v", i, exp.id, exp.status, exp.num, cs)
+		}
+	}
+
+	// Tidy up, and check everything in the main app finishes
+	tws1.close()
+	tws2.close()
+	tws3.close()
+	WG.Wait()
+}
+
+func TestAdmin_OperatorCanCloseRoom(t *testing.T) {
+	// Just for this test, lower the reconnection timeout so that a
+	// Leaver message is triggered reasonably quickly, and have an
+	// admin secret
+	useSuperhub(t, 250*time.Millisecond)
+	oldAdminSecret := adminSecret
+	adminSecret = "s3cret"
+	defer func() {
+		adminSecret = oldAdminSecret
+	}()
+
+	serv := newTestServer(bounceHandler)
+	defer serv.Close()
+
+	// A room with two clients, one of whom sends a message
+
+	room := "/admin.close"
+	ws1, _, err := dial(serv, room, "ADX1", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws1 := newTConn(ws1, "ADX1")
+	defer tws1.close()
+	if err := tws1.swallow("Welcome"); err != nil {
+		t.Fatal(err)
+	}
+	ws2, _, err := dial(serv, room, "ADX2", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws2 := newTConn(ws2, "ADX2")
+	defer tws2.close()
+	if err = swallowMany(
+		intentExp{"ADX2 joining, ws2", tws2, "Welcome"},
+		intentExp{"ADX2 joining, ws1", tws1, "Joiner"},
+	); err != nil {
+		t.Fatal(err)
+	}
+	if err := ws1.WriteMessage(websocket.TextMessage, []byte(`"Hello"`)); err != nil {
+		t.Fatal(err)
+	}
+	if err = swallowMany(
+		intentExp{"ADX1 sending, ws1", tws1, "Peer"},
+		intentExp{"ADX1 sending, ws2", tws2, "Peer"},
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	del := func(path string, secret string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("DELETE", path, nil)
+		req.Header.Set("X-Admin-Secret", secret)
+		w := httptest.NewRecorder()
+		adminRoomHandler(w, req)
+		return w
+	}
+
+	// Only an operator can close a room, and only one that's there
+
+	w := del("/admin/rooms"+room, "guess")
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Wrong secret: Expected status 401 but got %d", w.Code)
+	}
+	w = del("/admin/rooms/admin.nowhere", "s3cret")
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Unknown room: Expected status 404 but got %d", w.Code)
+	}
+	if w := del("/admin/rooms"+room, "s3cret"); w.Code != http.StatusAccepted {
+		t.Fatalf("Expected status 202 but got %d", w.Code)
+	}
+
+	// Both clients are told, and thrown out
+
+	for _, tws := range []*tConn{tws1, tws2} {
+		env, err := tws.readEnvelope(500, "%s expecting Closing", tws.id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if env.Intent != "Closing" || env.Reason != "operator" {
+			t.Errorf("%s expected Closing for operator, got %#v",
+				tws.id, env)
+		}
+		if err := tws.expectClose(CloseForceClosed, 500); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// Carrying on from where it was, a client finds the room's empty
+	// and starts again
+
+	ws3, _, err := dial(serv, room, "ADX1", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws3 := newTConn(ws3, "ADX1")
+	defer tws3.close()
+	env, err := tws3.readEnvelope(500, "ADX1 expecting Welcome again")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Intent != "Welcome" || env.Num != 0 || len(env.From) != 0 {
+		t.Errorf("ADX1 expected Welcome to an empty room, got %#v", env)
+	}
+
+	// Tidy up, and check everything in the main app finishes
+	tws1.close()
+	tws2.close()
+	tws3.close()
+	WG.Wait()
+}
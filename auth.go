@@ -0,0 +1,106 @@
+// Copyright 2020 Nik Silver
+//
+// Licensed under the GPL v3.0. See file LICENCE.txt for details.
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Checks who a client is when it connects, if set. It gives the
+// client's ID, which overrides any the client asks for, or an error if
+// the client mustn't connect.
+var authHook func(r *http.Request) (clientID string, err error)
+
+// Why a JWT might not let a client in
+var (
+	errNoJWT      = fmt.Errorf("No JWT")
+	errBadJWT     = fmt.Errorf("Bad JWT")
+	errJWTExpired = fmt.Errorf("JWT expired")
+)
+
+// jwtClaims are the parts of a JWT's payload we care about. Times are
+// in seconds since the epoch, and zero if not given.
+type jwtClaims struct {
+	Sub string // The client's ID
+	Exp int64  // When the token expires
+	Nbf int64  // When the token starts being valid
+}
+
+// JWTAuth gives an auth hook which expects a JWT signed with HS256 and
+// the given key, either in the Authorization header as a bearer token
+// or in the jwt query parameter. The token's subject is the client's
+// ID. Its expiry and not-before times are respected if it gives them.
+func JWTAuth(key []byte) func(r *http.Request) (string, error) {
+	return func(r *http.Request) (string, error) {
+		token := r.URL.Query().Get("jwt")
+		if auth := r.Header.Get("Authorization"); auth != "" {
+			if !strings.HasPrefix(auth, "Bearer ") {
+				return "", errBadJWT
+			}
+			token = strings.TrimPrefix(auth, "Bearer ")
+		}
+		if token == "" {
+			return "", errNoJWT
+		}
+		return checkJWT(key, token, nowMs()/1000)
+	}
+}
+
+// checkJWT checks a JWT was signed with HS256 and the given key, and
+// is valid at the given time, in seconds since the epoch. It gives the
+// token's subject.
+func checkJWT(key []byte, token string, now int64) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", errBadJWT
+	}
+
+	header := struct{ Alg string }{}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return "", errBadJWT
+	}
+	if header.Alg != "HS256" {
+		return "", errBadJWT
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", errBadJWT
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return "", errBadJWT
+	}
+
+	claims := jwtClaims{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return "", errBadJWT
+	}
+	if claims.Sub == "" {
+		return "", errBadJWT
+	}
+	if claims.Exp != 0 && claims.Exp <= now {
+		return "", errJWTExpired
+	}
+	if claims.Nbf != 0 && claims.Nbf > now {
+		return "", errBadJWT
+	}
+	return claims.Sub, nil
+}
+
+// decodeJWTPart decodes the header or payload of a JWT into v.
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,188 @@
+// Copyright 2020 Nik Silver
+//
+// Licensed under the GPL v3.0. See file LICENCE.txt for details.
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// mintJWT makes a JWT with the given header and payload, signed with
+// HS256 and the given key.
+func mintJWT(key []byte, header string, payload string) string {
+	enc := base64.RawURLEncoding
+	signed := enc.EncodeToString([]byte(header)) + "." +
+		enc.EncodeToString([]byte(payload))
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(signed))
+	return signed + "." + enc.EncodeToString(mac.Sum(nil))
+}
+
+func TestAuth_JWTMustBeSignedAndCurrent(t *testing.T) {
+	key := []byte("static-key")
+	hdr := `{"alg":"HS256","typ":"JWT"}`
+	now := time.Now().Unix()
+
+	sub, err := checkJWT(key, mintJWT(key, hdr, `{"sub":"PLAYER1"}`), now)
+	if err != nil || sub != "PLAYER1" {
+		t.Errorf("Simple JWT gave %q and error %v", sub, err)
+	}
+
+	good := mintJWT(key, hdr, `{"sub":"PLAYER1","exp":`+
+		itoa64(now+60)+`,"nbf":`+itoa64(now-60)+`}`)
+	parts := strings.Split(good, ".")
+	other := strings.Split(mintJWT(key, hdr, `{"sub":"PLAYER2"}`), ".")
+
+	data := []struct {
+		desc  string
+		token string
+		now   int64
+		err   error
+	}{
+		{"Good", good, now, nil},
+		{"Expired", good, now + 61, errJWTExpired},
+		{"Not yet valid", good, now - 61, errBadJWT},
+		{"Tampered payload", parts[0] + "." + other[1] + "." + parts[2],
+			now, errBadJWT},
+		{"Other key", mintJWT([]byte("other-key"), hdr, `{"sub":"PLAYER1"}`),
+			now, errBadJWT},
+		{"Unsigned", mintJWT(key, `{"alg":"none"}`, `{"sub":"PLAYER1"}`),
+			now, errBadJWT},
+		{"No subject", mintJWT(key, hdr, `{"exp":`+itoa64(now+60)+`}`),
+			now, errBadJWT},
+		{"Too few parts", parts[0] + "." + parts[1], now, errBadJWT},
+		{"Bad signature", parts[0] + "." + parts[1] + ".%%%", now, errBadJWT},
+		{"Bad payload", mintJWT(key, hdr, `{"sub":`), now, errBadJWT},
+	}
+	for _, d := range data {
+		if _, err := checkJWT(key, d.token, d.now); err != d.err {
+			t.Errorf("%s: Expected error %v but got %v", d.desc, d.err, err)
+		}
+	}
+}
+
+func TestAuth_JWTGivesClientsTheirIDs(t *testing.T) {
+	// Just for this test, lower the reconnection timeout so that a
+	// Leaver message is triggered reasonably quickly, and check JWTs
+	key := []byte("static-key")
+	useSuperhub(t, 250*time.Millisecond)
+	oldAuthHook := authHook
+	authHook = JWTAuth(key)
+	defer func() {
+		authHook = oldAuthHook
+	}()
+
+	serv := newTestServer(bounceHandler)
+	defer serv.Close()
+
+	room := "/auth.room"
+	hdr := `{"alg":"HS256"}`
+
+	// Clients without a good JWT are refused before the upgrade
+
+	bad := mintJWT([]byte("other-key"), hdr, `{"sub":"AUTH1"}`)
+	for _, d := range []struct {
+		desc   string
+		params url.Values
+		header http.Header
+	}{
+		{"No JWT", nil, nil},
+		{"Bad JWT in query", url.Values{"jwt": {bad}}, nil},
+		{"Bad JWT in header", nil, http.Header{"Authorization": {"Bearer " + bad}}},
+		{"Not a bearer token", nil, http.Header{"Authorization": {"Basic abc"}}},
+	} {
+		ws, resp, err := dialWith(serv, room, "AUTH1", -1, d.params, d.header)
+		if err == nil {
+			ws.Close()
+			t.Errorf("%s: Expected error, but didn't get one", d.desc)
+			continue
+		}
+		if resp == nil || resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("%s: Expected 401 but got %v", d.desc, resp)
+		}
+	}
+
+	// Not even a good JWT lets a client take a reserved ID
+
+	ws, resp, err := dialWith(serv, room, "", -1, url.Values{
+		"jwt": {mintJWT(key, hdr, `{"sub":"#server"}`)},
+	}, nil)
+	if err == nil {
+		ws.Close()
+		t.Error("Reserved subject: Expected error, but didn't get one")
+	} else if resp == nil || resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Reserved subject: Expected 400 but got %v", resp)
+	}
+
+	// Nor an ID it couldn't ask for itself
+
+	long := strings.Repeat("A", maxIDLength+1)
+	for _, sub := range []string{"A,B", "A\\u0007B", long} {
+		ws, resp, err := dialWith(serv, room, "", -1, url.Values{
+			"jwt": {mintJWT(key, hdr, `{"sub":"`+sub+`"}`)},
+		}, nil)
+		if err == nil {
+			ws.Close()
+			t.Errorf("Subject %q: Expected error, but didn't get one", sub)
+		} else if resp == nil || resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("Subject %q: Expected 401 but got %v", sub, resp)
+		}
+	}
+
+	// The JWT's subject is the client's ID, whatever it asks for, and
+	// the JWT can come in the header or the query
+
+	ws1, _, err := dialWith(serv, room, "ASKED1", -1, nil, http.Header{
+		"Authorization": {"Bearer " + mintJWT(key, hdr, `{"sub":"AUTH1"}`)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws1 := newTConn(ws1, "AUTH1")
+	defer tws1.close()
+	env, err := tws1.readEnvelope(500, "AUTH1 expecting Welcome")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Intent != "Welcome" || env.You != "AUTH1" {
+		t.Errorf("AUTH1 got unexpected envelope %#v", env)
+	}
+
+	ws2, _, err := dialWith(serv, room, "", -1, url.Values{
+		"jwt": {mintJWT(key, hdr, `{"sub":"AUTH2"}`)},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws2 := newTConn(ws2, "AUTH2")
+	defer tws2.close()
+	env, err = tws2.readEnvelope(500, "AUTH2 expecting Welcome")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Intent != "Welcome" || env.You != "AUTH2" {
+		t.Errorf("AUTH2 got unexpected envelope %#v", env)
+	}
+	if err := tws1.swallow("Joiner"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Tidy up, and check everything in the main app finishes
+	tws1.close()
+	tws2.close()
+	WG.Wait()
+}
+
+// itoa64 gives an int64 as a string.
+func itoa64(n int64) string {
+	return strconv.FormatInt(n, 10)
+}
@@ -0,0 +1,103 @@
+// Copyright 2020 Nik Silver
+//
+// Licensed under the GPL v3.0. See file LICENCE.txt for details.
+
+package main
+
+import (
+	"encoding/json"
+)
+
+// Broadcast describes something the hub sends out to one or more
+// clients. The hub fills it in once, and the envelope for each recipient
+// is derived from it, so that peer messages and their receipts
+// (for example) can't drift apart.
+type Broadcast struct {
+	From     []string // Client ids this is from
+	To       []string // Ids of all clients this is going to
+	Time     int64    // Server time when sent, in milliseconds since the epoch
+	Intent   string   // What the envelopes are intended to convey
+	Body     []byte   // Original raw message from the sending client
+	Reason   string   // Why a client left, for a Leaver
+	Version  int      // Protocol version the server speaks, for a Welcome
+	Encoding string   // How the Body appears in JSON: as is, text or base64
+	Missed   []int    // First and last nums missed, for a Missed
+	Token    string   // Echoed back to the client, such as for a Time
+	Limits   *Limits  // What the server allows, for a Welcome or Error
+	TTL      int64    // Milliseconds until it's not worth resending
+	Leader   string   // Client that leads, for a Welcome or Leader
+	Retired  string   // ID a client no longer goes by, if it's changed
+	OldName  string   // Name a client no longer goes by, for a Renamed
+	Link     string   // For spectators to join with, for a SpectatorLink
+	Key      string   // Key of the state that's changed, for a State
+	Seed     uint64   // Random seed, for a Welcome or Seed
+	Roll     *Roll    // What was rolled and how it came out, for a Rolled
+	Turn     string   // Client whose turn it is, for a Welcome or Turn
+	Stats    *Stats   // How the room's doing, for a Stats
+	You      string   // ID of the recipient, for a Welcome
+	RetryMs  int64    // How long to wait to reconnect, for a Closing
+	Members  []Member // Players in the room, for a Roster
+
+	// All the room's state, for a Welcome
+	State map[string]json.RawMessage
+	// Display names of the players it's from and to, for a Welcome,
+	// Joiner, Leaver or Renamed
+	Names map[string]string
+	// Metadata of the players it's from and to, for a Welcome or Joiner
+	Metas map[string]json.RawMessage
+}
+
+// newBroadcast creates a broadcast with the given intent, from and to
+// the given client IDs, with the current time. Each envelope gets its
+// num as it's buffered for its recipient.
+func (h *Hub) newBroadcast(intent string, from []string, to []string) *Broadcast {
+	return &Broadcast{
+		From:   from,
+		To:     to,
+		Time:   nowMs(),
+		Intent: intent,
+	}
+}
+
+// newSystemBroadcast is like newBroadcast, but from something on the
+// server side, such as "server", rather than a client. It's given a
+// reserved ID, so no client can be mistaken for it.
+func (h *Hub) newSystemBroadcast(intent string, from string, to []string) *Broadcast {
+	return h.newBroadcast(intent, []string{systemID(from)}, to)
+}
+
+// Envelope derives an envelope for a recipient of the broadcast.
+// A receipt is the envelope going back to the client that sent
+// the original message.
+func (b *Broadcast) Envelope(receipt bool) *Envelope {
+	return &Envelope{
+		From:     b.From,
+		To:       b.To,
+		Time:     b.Time,
+		Intent:   b.Intent,
+		Receipt:  receipt,
+		Body:     b.Body,
+		Reason:   b.Reason,
+		Version:  b.Version,
+		Encoding: b.Encoding,
+		Missed:   b.Missed,
+		Token:    b.Token,
+		Limits:   b.Limits,
+		TTL:      b.TTL,
+		Leader:   b.Leader,
+		Retired:  b.Retired,
+		OldName:  b.OldName,
+		Link:     b.Link,
+		Key:      b.Key,
+		State:    b.State,
+		Seed:     b.Seed,
+		Roll:     b.Roll,
+		Turn:     b.Turn,
+		Stats:    b.Stats,
+		You:      b.You,
+		RetryMs:  b.RetryMs,
+		Members:  b.Members,
+		Names:    b.Names,
+		Metas:    b.Metas,
+	}
+}
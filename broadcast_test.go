@@ -0,0 +1,110 @@
+// Copyright 2020 Nik Silver
+//
+// Licensed under the GPL v3.0. See file LICENCE.txt for details.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// nonZero returns a non-zero value of the given type, for the kinds of
+// field found in a broadcast.
+func nonZero(t *testing.T, typ reflect.Type, name string) reflect.Value {
+	v := reflect.New(typ).Elem()
+	switch typ.Kind() {
+	case reflect.String:
+		v.SetString("val-" + name)
+	case reflect.Int, reflect.Int64:
+		v.SetInt(int64(len(name)) + 100)
+	case reflect.Uint64:
+		v.SetUint(uint64(len(name)) + 100)
+	case reflect.Bool:
+		v.SetBool(true)
+	case reflect.Ptr:
+		v.Set(reflect.New(typ.Elem()))
+	case reflect.Slice:
+		switch typ.Elem().Kind() {
+		case reflect.String:
+			v.Set(reflect.ValueOf([]string{"val-" + name}))
+		case reflect.Uint8:
+			v.Set(reflect.ValueOf([]byte("val-" + name)))
+		case reflect.Int:
+			v.Set(reflect.ValueOf([]int{len(name), 100}))
+		case reflect.Struct:
+			v.Set(reflect.Append(v, reflect.New(typ.Elem()).Elem()))
+		default:
+			t.Fatalf("Don't know how to fill field %s of type %s", name, typ)
+		}
+	case reflect.Map:
+		v.Set(reflect.MakeMap(typ))
+		v.SetMapIndex(nonZero(t, typ.Key(), name), nonZero(t, typ.Elem(), name))
+	default:
+		t.Fatalf("Don't know how to fill field %s of type %s", name, typ)
+	}
+	return v
+}
+
+func TestBroadcast_EveryFieldReachesPeerAndReceipt(t *testing.T) {
+	// Fill in every field of a broadcast
+	b := &Broadcast{}
+	bVal := reflect.ValueOf(b).Elem()
+	bType := bVal.Type()
+	for i := 0; i < bType.NumField(); i++ {
+		f := bType.Field(i)
+		bVal.Field(i).Set(nonZero(t, f.Type, f.Name))
+	}
+
+	peer := reflect.ValueOf(b.Envelope(false)).Elem()
+	receipt := reflect.ValueOf(b.Envelope(true)).Elem()
+
+	// Each field of the broadcast should appear in both envelopes
+	for i := 0; i < bType.NumField(); i++ {
+		name := bType.Field(i).Name
+		exp := bVal.Field(i).Interface()
+		for _, env := range []struct {
+			desc string
+			val  reflect.Value
+		}{
+			{"peer", peer},
+			{"receipt", receipt},
+		} {
+			got := env.val.FieldByName(name)
+			if !got.IsValid() {
+				t.Errorf("Envelope has no field %s", name)
+				continue
+			}
+			if !reflect.DeepEqual(got.Interface(), exp) {
+				t.Errorf("%s envelope field %s is %v but expected %v",
+					env.desc, name, got.Interface(), exp)
+			}
+		}
+	}
+
+	// The only difference should be the receipt flag
+	if peer.FieldByName("Receipt").Bool() {
+		t.Errorf("Peer envelope is marked as a receipt")
+	}
+	if !receipt.FieldByName("Receipt").Bool() {
+		t.Errorf("Receipt envelope is not marked as a receipt")
+	}
+}
+
+func TestBroadcast_EveryEnvelopeFieldComesFromBroadcast(t *testing.T) {
+	// If an envelope field is added, the broadcast needs to carry it too,
+	// otherwise it can only be set on some envelopes by hand.
+	bType := reflect.TypeOf(Broadcast{})
+	eType := reflect.TypeOf(Envelope{})
+	for i := 0; i < eType.NumField(); i++ {
+		name := eType.Field(i).Name
+		if name == "Receipt" || name == "Num" || name == "NextNum" ||
+			name == "Tag" {
+			// These are set per recipient
+			continue
+		}
+		if _, ok := bType.FieldByName(name); !ok {
+			t.Errorf("Envelope field %s is not in Broadcast", name)
+		}
+	}
+}
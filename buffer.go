@@ -5,112 +5,382 @@
 package main
 
 import (
-	"fmt"
+	"sync/atomic"
 	"time"
 )
 
+// Most envelopes, and most bytes of envelope bodies, a buffer keeps for
+// each client ID, however recent. Any more and the oldest are dropped.
+var maxBuffered = 10000
+var maxBufferedBytes = 16 * 1024 * 1024
+
+// Most bytes of envelope bodies all the buffers together should keep.
+// Any more and the superhub has the oldest trimmed from the buffers
+// that hold them.
+var maxBufferedTotal = 256 * 1024 * 1024
+
+// Bytes of envelope bodies kept in all the buffers together
+var bufferedTotal int64
+
+// BufferStore is where a hub keeps envelopes for each client (by ID)
+// which may need to be sent or resent at a later time, numbering each
+// client's envelopes. The Buffer keeps them in memory, and the
+// redisBuffer keeps them in Redis, so they can be shared by several
+// servers.
+type BufferStore interface {
+	Add(id string, e *Envelope) *Envelope
+	AddAt(id string, e *Envelope, at int64) *Envelope
+	Resent(id string, num int, at int64)
+	Next(id string) int
+	Clean()
+	Oldest(id string) int
+	Queue(id string, num int) *Queue
+	Available(id string, num int) bool
+	Remove(id string)
+	Keep()
+	Close()
+	Stats() BufferStats
+}
+
+// BufferStats describes what's in a buffer, for seeing how a room's
+// doing.
+type BufferStats struct {
+	Envelopes int   // How many envelopes, counting each shared one once
+	Bytes     int   // Bytes of their bodies
+	OldestAt  int64 // When the oldest counts as sent, in ms, or 0
+}
+
+// newBufferStore gives a room's hub somewhere to keep its envelopes,
+// for clients who have the given time to reconnect. It's in Redis if
+// we have it, otherwise in memory.
+func newBufferStore(room string, window time.Duration) BufferStore {
+	if redisClient != nil {
+		return newRedisBuffer(room, window)
+	}
+	return NewBufferFor(window)
+}
+
 // Buffer holds envelopes for each client (by ID) which may need to be
-// sent or resent at a later time.
+// sent or resent at a later time. It also numbers each client's envelopes.
+// Envelopes are cleaned away when they're too old for a reconnection to
+// need them, or when their time to live runs out, and the oldest are
+// dropped if a client ID has too many. A client reconnecting just
+// doesn't get any that have expired, but it can't continue from before
+// any that are too old or have been dropped.
+//
+// An envelope going to many clients is kept once, and shared. Each
+// client ID has its places in the envelopes, in order of num, without
+// gaps up to the next num, so a place is found by its num, and a
+// client's own numbered copy is only made when it's needed. An
+// envelope that's expired leaves its place behind, empty, until it's
+// old enough to be cleaned away.
 type Buffer struct {
-	buf map[string][]*Envelope
+	buf    map[string][]buffered
+	next   map[string]int    // Num of the next envelope for each client ID
+	floor  map[string]int    // Lowest num each client ID can continue from
+	bytes  map[string]int    // Bytes of envelope bodies for each client ID
+	refs   map[*Envelope]int // How many places each envelope has
+	total  int               // Bytes of envelope bodies, each counted once
+	window time.Duration     // How long a client has to reconnect
+	store  *store            // Where changes are written out, if anywhere
+	shub   *Superhub         // Which keeps it within budget, if any
+
+	// For the superhub, which mustn't touch the rest: when the oldest
+	// envelope counts as sent (or 0 if there are none), and the time
+	// before which it wants envelopes trimmed (or 0)
+	oldestAt   int64
+	trimBefore int64
 }
 
-// Queue holds a queue of envelopes from some num onwards.
-type Queue struct {
-	q []*Envelope
+// buffered is a client's place in the buffer: the shared, unnumbered
+// envelope, and the time it counts as sent to the client, in
+// milliseconds since the epoch, for cleaning away when it's too old.
+// The envelope is nil if it's expired.
+type buffered struct {
+	env *Envelope
+	at  int64
 }
 
-// NewBuffer creates a new buffer with no unsent messages
+// NewBuffer creates a new buffer with no unsent messages, for clients
+// who have the default time to reconnect.
 func NewBuffer() *Buffer {
+	return NewBufferFor(defaultReconnection)
+}
+
+// NewBufferFor creates a new buffer with no unsent messages, for
+// clients who have the given time to reconnect.
+func NewBufferFor(window time.Duration) *Buffer {
 	return &Buffer{
-		buf: make(map[string][]*Envelope, 0),
+		buf:    make(map[string][]buffered, 0),
+		next:   make(map[string]int, 0),
+		floor:  make(map[string]int, 0),
+		bytes:  make(map[string]int, 0),
+		refs:   make(map[*Envelope]int, 0),
+		window: window,
+	}
+}
+
+// Add an envelope for a given client, numbered next in that client's
+// sequence. The same envelope may be going to other clients, so it's
+// kept as it is, and shared, and the client gets a copy with the num.
+// The envelope mustn't be changed after it's added.
+func (b *Buffer) Add(id string, e *Envelope) *Envelope {
+	return b.AddAt(id, e, e.Time)
+}
+
+// AddAt is like Add, but the envelope counts as sent at the given time,
+// in milliseconds since the epoch, rather than its own time. It's for
+// an envelope that's being sent again some time after it was first
+// sent, so it's not cleaned away too soon.
+func (b *Buffer) AddAt(id string, e *Envelope, at int64) *Envelope {
+	eNum := *e
+	eNum.Num = b.next[id]
+	b.next[id]++
+	b.place(id, e, at)
+	b.trim(id)
+	if b.store != nil {
+		b.store.add(id, &eNum, at)
+	}
+	if b.shub != nil &&
+		atomic.LoadInt64(&bufferedTotal) > int64(maxBufferedTotal) {
+		b.shub.checkBudget()
+	}
+	return &eNum
+}
+
+// restore an envelope kept from before a restart for some client ID,
+// with its own num, counting as sent at the given time. If any nums
+// were lost in between, nothing can continue from before it.
+func (b *Buffer) restore(id string, e *Envelope, at int64) {
+	if e.Num < b.next[id] {
+		return
+	}
+	if e.Num > b.next[id] {
+		b.drop(id, len(b.buf[id]))
+		b.next[id] = e.Num
+		b.floor[id] = e.Num
+	}
+	b.next[id]++
+	b.place(id, e, at)
+	b.trim(id)
+}
+
+// place an envelope at the end of some client ID's places.
+func (b *Buffer) place(id string, e *Envelope, at int64) {
+	b.buf[id] = append(b.buf[id], buffered{env: e, at: at})
+	b.bytes[id] += len(e.Body)
+	b.refs[e]++
+	if b.refs[e] == 1 {
+		b.total += len(e.Body)
+		atomic.AddInt64(&bufferedTotal, int64(len(e.Body)))
+	}
+	if old := atomic.LoadInt64(&b.oldestAt); old == 0 || at < old {
+		atomic.StoreInt64(&b.oldestAt, at)
+	}
+}
+
+// empty some client ID's place, letting go of its envelope.
+func (b *Buffer) empty(id string, p *buffered) {
+	if p.env == nil {
+		return
+	}
+	b.bytes[id] -= len(p.env.Body)
+	b.refs[p.env]--
+	if b.refs[p.env] == 0 {
+		delete(b.refs, p.env)
+		b.total -= len(p.env.Body)
+		atomic.AddInt64(&bufferedTotal, -int64(len(p.env.Body)))
+	}
+	p.env = nil
+}
+
+// trim drops the oldest envelopes for some client ID while it has too
+// many, or too many bytes of them, but always keeps the newest. Nothing
+// can continue from before what's left.
+func (b *Buffer) trim(id string) {
+	es := b.buf[id]
+	drop := 0
+	bytes := b.bytes[id]
+	for len(es)-drop > 1 &&
+		(len(es)-drop > maxBuffered || bytes > maxBufferedBytes) {
+		if es[drop].env != nil {
+			bytes -= len(es[drop].env.Body)
+		}
+		drop++
 	}
+	b.drop(id, drop)
 }
 
-// Add an envelope for a given client.
-func (b *Buffer) Add(id string, e *Envelope) {
-	es, ok := b.buf[id]
-	if !ok {
-		b.buf[id] = []*Envelope{e}
+// drop the first n places for some client ID, so nothing can continue
+// from before what's left.
+func (b *Buffer) drop(id string, n int) {
+	if n == 0 {
 		return
 	}
-	b.buf[id] = append(es, e)
+	es := b.buf[id]
+	for i := 0; i < n; i++ {
+		b.empty(id, &es[i])
+	}
+	b.buf[id] = es[n:]
+	b.floor[id] = b.first(id)
+}
+
+// first gives the num of the first place kept for some client ID. Nums
+// run on without gaps, so a place is found by its num less this.
+func (b *Buffer) first(id string) int {
+	return b.next[id] - len(b.buf[id])
+}
+
+// from gives the places kept for some client ID from the given num
+// onwards.
+func (b *Buffer) from(id string, num int) []buffered {
+	es := b.buf[id]
+	i := num - b.first(id)
+	switch {
+	case i < 0:
+		i = 0
+	case i > len(es):
+		i = len(es)
+	}
+	return es[i:]
+}
+
+// Resent says the envelopes for some client ID from the given num
+// onwards count as sent at the given time, in milliseconds since the
+// epoch, so they're not cleaned away too soon.
+func (b *Buffer) Resent(id string, num int, at int64) {
+	es := b.from(id, num)
+	for i := range es {
+		if es[i].at < at {
+			es[i].at = at
+		}
+	}
 }
 
-// Clean the buffer of all envelopes older than reconnectionTimeout
-// (plus a bit for safety).
+// Next gives the num the next envelope for some client ID will have.
+func (b *Buffer) Next(id string) int {
+	return b.next[id]
+}
+
+// Clean the buffer of all envelopes older than the time clients have
+// to reconnect (plus a bit for safety), and all envelopes that have
+// expired. Each client ID keeps no more than the most envelopes, or
+// bytes of them, it's allowed, in case those limits have been lowered
+// since they were added. If the superhub has asked for envelopes to be trimmed to
+// keep within the budget for all buffers then older ones go, too,
+// except the newest for each client ID.
 func (b *Buffer) Clean() {
-	keep := time.Now().Add(reconnectionTimeout * -11 / 10)
+	keep := time.Now().Add(b.window * -11 / 10)
 	keepMs := keep.UnixNano() / 1000000
+	now := nowMs()
+	before := atomic.SwapInt64(&b.trimBefore, 0)
+	oldest := int64(0)
 	for id, es := range b.buf {
+		drop := 0
+		if before > 0 {
+			for drop < len(es)-1 && es[drop].at < before {
+				drop++
+			}
+		}
+		for drop < len(es) && es[drop].at < keepMs {
+			// Nothing can continue from an envelope that's too old
+			drop++
+		}
+		b.drop(id, drop)
+		b.trim(id)
+
+		es = b.buf[id]
 		for i := range es {
-			if es[i].Time >= keepMs {
-				b.buf[id] = es[i:]
-				break
+			switch {
+			case es[i].env == nil:
+				continue
+			case es[i].env.expired(now):
+				b.empty(id, &es[i])
+			case oldest == 0 || es[i].at < oldest:
+				oldest = es[i].at
 			}
 		}
 	}
+	atomic.StoreInt64(&b.oldestAt, oldest)
+}
+
+// Oldest gives the lowest num some client ID can continue from. It may
+// be the next num if there are no envelopes kept for it.
+func (b *Buffer) Oldest(id string) int {
+	return b.floor[id]
 }
 
-// Queue extracts a queue from a given num onwards, for some client ID.
+// Queue extracts a queue from a given num onwards, for some client ID,
+// leaving out any envelopes that have expired. Each is the client's own
+// numbered copy.
 func (b *Buffer) Queue(id string, num int) *Queue {
-	es, ok := b.buf[id]
-	if !ok {
-		return NewQueue()
-	}
-	for i := range es {
-		if es[i].Num == num {
-			from := b.buf[id][i:]
-			to := make([]*Envelope, len(from))
-			copy(to, from)
-			return &Queue{q: to}
+	now := nowMs()
+	q := NewQueue()
+	es := b.from(id, num)
+	n := b.next[id] - len(es)
+	for i, e := range es {
+		if e.env != nil && !e.env.expired(now) {
+			eNum := *e.env
+			eNum.Num = n + i
+			q.Add(&eNum)
 		}
 	}
-	return NewQueue()
+	return q
 }
 
-// Available says if a specific num envelope is available for some client ID.
+// Available says if a client can continue from a specific num. A client's
+// nums run on without gaps, and cleaning for age or trimming for size
+// removes the earliest envelopes first, so everything after it is
+// available, too, unless it's expired.
 func (b *Buffer) Available(id string, num int) bool {
-	es, ok := b.buf[id]
-	if !ok {
-		return false
-	}
-	for i := range es {
-		if es[i].Num == num {
-			return true
-		}
+	return b.floor[id] <= num && num < b.next[id]
+}
+
+// Stats says what's in the buffer. The oldest time is as of the last
+// cleaning, or the oldest added since.
+func (b *Buffer) Stats() BufferStats {
+	return BufferStats{
+		Envelopes: len(b.refs),
+		Bytes:     b.total,
+		OldestAt:  atomic.LoadInt64(&b.oldestAt),
 	}
-	return false
 }
 
-// Remove all the entries of a given client ID
+// Remove all the entries of a given client ID, and start its nums again.
 func (b *Buffer) Remove(id string) {
+	if b.store != nil {
+		b.store.remove(id)
+	}
+	es := b.buf[id]
+	for i := range es {
+		b.empty(id, &es[i])
+	}
 	delete(b.buf, id)
+	delete(b.next, id)
+	delete(b.floor, id)
+	delete(b.bytes, id)
 }
 
-// NewQueue returns a new and empty queue.
-func NewQueue() *Queue {
-	return &Queue{
-		q: []*Envelope{},
+// Keep what's been written out of the buffer, as it is now, for when
+// the room's next needed, and write out no more changes. It's for when
+// the server's shutting down.
+func (b *Buffer) Keep() {
+	if b.store != nil {
+		b.store.close(true)
+		b.store = nil
 	}
 }
 
-// Get the first item in the queue, or return an error.
-func (q *Queue) Get() (*Envelope, error) {
-	if len(q.q) == 0 {
-		return nil, fmt.Errorf("Queue is empty")
+// Close empties the buffer, so none of it counts against the budget
+// for all buffers, and forgets anything written out. It's for when the
+// buffer's not needed any more.
+func (b *Buffer) Close() {
+	if b.store != nil {
+		b.store.close(false)
+		b.store = nil
 	}
-	e := q.q[0]
-	q.q = q.q[1:]
-	return e, nil
-}
-
-// Add an envelope to the back of the queue.
-func (q *Queue) Add(e *Envelope) {
-	q.q = append(q.q, e)
-}
-
-// Empty tests if the queue is empty
-func (q *Queue) Empty() bool {
-	return len(q.q) == 0
+	for id := range b.next {
+		b.Remove(id)
+	}
+	atomic.StoreInt64(&b.oldestAt, 0)
 }
@@ -0,0 +1,437 @@
+// Copyright 2020 Nik Silver
+//
+// Licensed under the GPL v3.0. See file LICENCE.txt for details.
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBuffer_ExpiredEnvelopesAreSkippedButNumsContinue(t *testing.T) {
+	b := NewBuffer()
+	now := nowMs()
+	b.Add("A", &Envelope{Time: now})
+	b.Add("A", &Envelope{Time: now - 1000, TTL: 500})
+	b.Add("A", &Envelope{Time: now - 1000, TTL: 5000})
+	b.Add("A", &Envelope{Time: now - 1000, TTL: 500})
+
+	// Expired envelopes shouldn't be queued, before or after cleaning,
+	// but a client should still be able to continue from their nums
+
+	for _, cleaned := range []bool{false, true} {
+		if cleaned {
+			b.Clean()
+		}
+		if got := drain(b.Queue("A", 0)); !sameInts(got, []int{0, 2}) {
+			t.Errorf("Cleaned %v: Expected nums [0 2] from 0 but got %v",
+				cleaned, got)
+		}
+		if got := drain(b.Queue("A", 1)); !sameInts(got, []int{2}) {
+			t.Errorf("Cleaned %v: Expected nums [2] from 1 but got %v",
+				cleaned, got)
+		}
+		for num := 0; num <= 3; num++ {
+			if !b.Available("A", num) {
+				t.Errorf("Cleaned %v: Num %d not available", cleaned, num)
+			}
+		}
+		if b.Available("A", 4) {
+			t.Errorf("Cleaned %v: Num 4 should not be available yet", cleaned)
+		}
+		if b.Oldest("A") != 0 {
+			t.Errorf("Cleaned %v: Expected oldest 0 but got %d",
+				cleaned, b.Oldest("A"))
+		}
+	}
+}
+
+func TestBuffer_HugeTTLNeverExpires(t *testing.T) {
+	b := NewBuffer()
+	now := nowMs()
+	b.Add("A", &Envelope{Time: now, TTL: math.MaxInt64})
+	b.Add("A", &Envelope{Time: now - 1000, TTL: math.MaxInt64})
+	b.Clean()
+
+	if got := drain(b.Queue("A", 0)); !sameInts(got, []int{0, 1}) {
+		t.Errorf("Expected nums [0 1] but got %v", got)
+	}
+}
+
+func TestBuffer_TooOldEnvelopesCantBeContinuedFrom(t *testing.T) {
+	// Envelopes get old quickly
+	b := NewBufferFor(250 * time.Millisecond)
+	now := nowMs()
+	b.Add("A", &Envelope{Time: now - 1000})
+	b.Add("A", &Envelope{Time: now - 1000, TTL: 100})
+	b.Add("A", &Envelope{Time: now, TTL: 100})
+	b.Add("A", &Envelope{Time: now})
+	b.Clean()
+
+	// Envelopes 0 and 1 are too old, but 2 is just short-lived
+
+	if b.Oldest("A") != 2 {
+		t.Errorf("Expected oldest 2 but got %d", b.Oldest("A"))
+	}
+	for num, exp := range []bool{false, false, true, true, false} {
+		if b.Available("A", num) != exp {
+			t.Errorf("Expected num %d available %v", num, exp)
+		}
+	}
+	if got := drain(b.Queue("A", 2)); !sameInts(got, []int{2, 3}) {
+		t.Errorf("Expected nums [2 3] but got %v", got)
+	}
+}
+
+func TestBuffer_TooManyEnvelopesCantBeContinuedFrom(t *testing.T) {
+	// Just for this test, keep very few envelopes
+	oldMaxBuffered := maxBuffered
+	oldMaxBufferedBytes := maxBufferedBytes
+	maxBuffered = 3
+	maxBufferedBytes = 10
+	defer func() {
+		maxBuffered = oldMaxBuffered
+		maxBufferedBytes = oldMaxBufferedBytes
+	}()
+
+	// Too many envelopes for one ID loses the oldest, but not for
+	// another ID
+
+	b := NewBuffer()
+	now := nowMs()
+	for i := 0; i < 5; i++ {
+		b.Add("A", &Envelope{Time: now})
+	}
+	b.Add("B", &Envelope{Time: now})
+	if b.Oldest("A") != 2 || b.Oldest("B") != 0 {
+		t.Errorf("Expected oldest 2 and 0 but got %d and %d",
+			b.Oldest("A"), b.Oldest("B"))
+	}
+	for num, exp := range []bool{false, false, true, true, true, false} {
+		if b.Available("A", num) != exp {
+			t.Errorf("Expected num %d available %v", num, exp)
+		}
+	}
+	if got := drain(b.Queue("A", 2)); !sameInts(got, []int{2, 3, 4}) {
+		t.Errorf("Expected nums [2 3 4] but got %v", got)
+	}
+
+	// Too many bytes loses the oldest, too, but the newest is always
+	// kept
+
+	b.Add("B", &Envelope{Time: now, Body: []byte("1234")})
+	b.Add("B", &Envelope{Time: now, Body: []byte("5678")})
+	b.Add("B", &Envelope{Time: now, Body: []byte("90")})
+	if got := drain(b.Queue("B", 0)); !sameInts(got, []int{1, 2, 3}) {
+		t.Errorf("Expected nums [1 2 3] but got %v", got)
+	}
+	b.Add("B", &Envelope{Time: now, Body: []byte("abcdefghijkl")})
+	if got := drain(b.Queue("B", 0)); !sameInts(got, []int{4}) {
+		t.Errorf("Expected nums [4] but got %v", got)
+	}
+	if b.Oldest("B") != 4 {
+		t.Errorf("Expected oldest 4 but got %d", b.Oldest("B"))
+	}
+}
+
+func TestBuffer_EnvelopesSentAgainAreKeptFromThen(t *testing.T) {
+	// Envelopes get old quickly
+	b := NewBufferFor(250 * time.Millisecond)
+	now := nowMs()
+	b.Add("A", &Envelope{Time: now})
+	b.AddAt("A", &Envelope{Time: now - 1000}, now)
+	b.AddAt("A", &Envelope{Time: now - 1000, TTL: 100}, now)
+	b.Clean()
+
+	// The old envelope sent again is kept, but the expired one isn't
+
+	if b.Oldest("A") != 0 {
+		t.Errorf("Expected oldest 0 but got %d", b.Oldest("A"))
+	}
+	if got := drain(b.Queue("A", 0)); !sameInts(got, []int{0, 1}) {
+		t.Errorf("Expected nums [0 1] but got %v", got)
+	}
+}
+
+func TestBuffer_ResentEnvelopesAreKeptFromThen(t *testing.T) {
+	// Envelopes get old quickly
+	b := NewBufferFor(250 * time.Millisecond)
+	now := nowMs()
+	b.Add("A", &Envelope{Time: now - 1000})
+	b.Add("A", &Envelope{Time: now - 1000})
+	b.Add("A", &Envelope{Time: now - 1000})
+	b.Resent("A", 1, now)
+	b.Clean()
+
+	// Only the envelope that wasn't resent is too old
+
+	if b.Oldest("A") != 1 {
+		t.Errorf("Expected oldest 1 but got %d", b.Oldest("A"))
+	}
+	if got := drain(b.Queue("A", 0)); !sameInts(got, []int{1, 2}) {
+		t.Errorf("Expected nums [1 2] but got %v", got)
+	}
+}
+
+func TestBuffer_AllBuffersKeepWithinBudget(t *testing.T) {
+	// Just for this test, have a small budget that can be checked at any
+	// time. The buffers' superhub isn't the one giving out hubs, so it's
+	// only their own that can keep them within it.
+	useSuperhub(t, defaultReconnection)
+	sh := NewSuperhub()
+	oldMaxBufferedTotal := maxBufferedTotal
+	oldBudgetCheckFreq := budgetCheckFreq
+	maxBufferedTotal = 1024 * 1024
+	budgetCheckFreq = 0
+	defer func() {
+		maxBufferedTotal = oldMaxBufferedTotal
+		budgetCheckFreq = oldBudgetCheckFreq
+	}()
+
+	// Lots of buffers each get lots of envelopes, older ones first, and
+	// each cleans after every one, as its hub would. Altogether they're
+	// given ten times the budget.
+
+	start := atomic.LoadInt64(&bufferedTotal)
+	body := make([]byte, 1024)
+	now := nowMs()
+	bufs := make([]*Buffer, 0)
+	for i := 0; i < 200; i++ {
+		b := NewBufferFor(time.Hour)
+		sh.register(b, fmt.Sprintf("/room%d", i))
+		bufs = append(bufs, b)
+	}
+	for j := 0; j < 25; j++ {
+		for _, b := range bufs {
+			for _, id := range []string{"A", "B"} {
+				b.Add(id, &Envelope{Body: body, Time: now - 50000 + int64(j*1000)})
+				b.Clean()
+			}
+		}
+	}
+
+	// Adding to the buffers had their superhub ask them to trim, so
+	// they've kept close to the budget
+
+	if total := atomic.LoadInt64(&bufferedTotal) - start; total >
+		int64(maxBufferedTotal)*11/10 {
+		t.Errorf("Buffers kept %d bytes while adding, budget is %d",
+			total, maxBufferedTotal)
+	}
+
+	// Buffers only trim when they're asked, so it may take a round or
+	// two more of cleaning for them all to get within budget
+
+	for i := 0; i < 5; i++ {
+		sh.checkBudget()
+		for _, b := range bufs {
+			b.Clean()
+		}
+	}
+	total := atomic.LoadInt64(&bufferedTotal) - start
+	if total > int64(maxBufferedTotal)*11/10 {
+		t.Errorf("Buffers kept %d bytes, budget is %d",
+			total, maxBufferedTotal)
+	}
+
+	// The newest envelopes are still there, and nothing older can be
+	// continued from if it's gone
+
+	for i, b := range bufs {
+		for _, id := range []string{"A", "B"} {
+			if !b.Available(id, 24) {
+				t.Fatalf("Buffer %d, id %s, lost its newest envelope", i, id)
+			}
+			oldest := b.Oldest(id)
+			if q := b.Queue(id, oldest); q.Len() != 25-oldest {
+				t.Fatalf("Buffer %d, id %s, from %d, has %d envelopes",
+					i, id, oldest, q.Len())
+			}
+		}
+	}
+
+	// Once the buffers are finished with they don't count
+
+	for _, b := range bufs {
+		b.Close()
+		sh.unregister(b)
+	}
+	if total := atomic.LoadInt64(&bufferedTotal); total != start {
+		t.Errorf("Closed buffers left total %d, expected %d", total, start)
+	}
+}
+
+func TestBuffer_EnvelopesGoByAgeAndByCount(t *testing.T) {
+	oldMaxBuffered := maxBuffered
+	maxBuffered = 4
+	defer func() {
+		maxBuffered = oldMaxBuffered
+	}()
+
+	// Too old, and envelopes go even if there's room for more. Recent,
+	// and only the most recent are kept if there are too many.
+
+	b := NewBufferFor(time.Minute)
+	now := nowMs()
+	old := now - time.Hour.Milliseconds()
+	for _, at := range []int64{old, old, now, now} {
+		b.Add("A", &Envelope{Time: at})
+	}
+	for i := 0; i < 6; i++ {
+		b.Add("B", &Envelope{Time: now})
+	}
+	b.Clean()
+	for _, d := range []struct {
+		id     string
+		oldest int
+		count  int
+	}{
+		{"A", 2, 2},
+		{"B", 2, 4},
+	} {
+		oldest := b.Oldest(d.id)
+		q := b.Queue(d.id, 0)
+		if oldest != d.oldest || q.Len() != d.count {
+			t.Errorf("%s has oldest %d and %d envelopes, expected %d and %d",
+				d.id, oldest, q.Len(), d.oldest, d.count)
+		}
+	}
+
+	// If fewer are allowed, that applies at the next cleaning
+
+	maxBuffered = 3
+	b.Clean()
+	if b.Oldest("B") != 3 || !b.Available("B", 5) {
+		t.Errorf("B has oldest %d after lowering the limit", b.Oldest("B"))
+	}
+	if b.Oldest("A") != 2 {
+		t.Errorf("A has oldest %d after lowering the limit", b.Oldest("A"))
+	}
+}
+
+func TestBuffer_AllStaleEnvelopesAreCleaned(t *testing.T) {
+	b := NewBufferFor(100 * time.Millisecond)
+	start := atomic.LoadInt64(&bufferedTotal)
+	for i := 0; i < 3; i++ {
+		b.Add("A", &Envelope{Body: []byte("abc"), Time: nowMs()})
+	}
+
+	// Nothing new comes, and once they're all too old they all go
+
+	time.Sleep(150 * time.Millisecond)
+	b.Clean()
+	if q := b.Queue("A", 0); q.Len() != 0 {
+		t.Errorf("Queue has %d envelopes", q.Len())
+	}
+	if b.Oldest("A") != 3 || b.Next("A") != 3 || b.Available("A", 2) {
+		t.Errorf("Oldest is %d and next is %d", b.Oldest("A"), b.Next("A"))
+	}
+	if total := atomic.LoadInt64(&bufferedTotal) - start; total != 0 {
+		t.Errorf("Buffer still counts %d bytes", total)
+	}
+}
+
+func TestBuffer_EnvelopeForManyClientsIsKeptOnce(t *testing.T) {
+	b := NewBufferFor(time.Hour)
+	start := atomic.LoadInt64(&bufferedTotal)
+	b.Add("A", &Envelope{Time: nowMs()})
+
+	// The same envelope goes to lots of clients, who each get it with
+	// their own num, but its body only counts once
+
+	env := &Envelope{Intent: "Peer", Body: make([]byte, 1000), Time: nowMs()}
+	for i := 0; i < 50; i++ {
+		if eNum := b.Add(fmt.Sprint(i), env); eNum.Num != 0 || eNum == env {
+			t.Fatalf("Client %d got envelope %#v", i, eNum)
+		}
+	}
+	if eNum := b.Add("A", env); eNum.Num != 1 {
+		t.Errorf("A got num %d", eNum.Num)
+	}
+	if total := atomic.LoadInt64(&bufferedTotal) - start; total != 1000 {
+		t.Errorf("Buffer counts %d bytes, expected 1000", total)
+	}
+	q := b.Queue("A", 0)
+	e0, _ := q.Get()
+	e1, _ := q.Get()
+	if e0.Num != 0 || e1.Num != 1 || e1.Intent != "Peer" {
+		t.Errorf("A's queue has %#v then %#v", e0, e1)
+	}
+
+	// It's only let go once no-one has it
+
+	for i := 0; i < 50; i++ {
+		b.Remove(fmt.Sprint(i))
+	}
+	if total := atomic.LoadInt64(&bufferedTotal) - start; total != 1000 {
+		t.Errorf("Buffer counts %d bytes with A left, expected 1000", total)
+	}
+	b.Remove("A")
+	if total := atomic.LoadInt64(&bufferedTotal) - start; total != 0 || len(b.refs) != 0 {
+		t.Errorf("Buffer counts %d bytes and %d envelopes when empty",
+			total, len(b.refs))
+	}
+}
+
+func TestBuffer_StatsSayWhatsKept(t *testing.T) {
+	b := NewBufferFor(time.Hour)
+	if st := b.Stats(); st != (BufferStats{}) {
+		t.Errorf("Empty buffer has stats %#v", st)
+	}
+
+	now := nowMs()
+	shared := &Envelope{Body: []byte("abcd"), Time: now - 1000}
+	b.Add("A", shared)
+	b.Add("B", shared)
+	b.Add("B", &Envelope{Body: []byte("ef"), Time: now})
+	exp := BufferStats{Envelopes: 2, Bytes: 6, OldestAt: now - 1000}
+	if st := b.Stats(); st != exp {
+		t.Errorf("Expected stats %#v but got %#v", exp, st)
+	}
+
+	b.Remove("B")
+	exp = BufferStats{Envelopes: 1, Bytes: 4, OldestAt: now - 1000}
+	if st := b.Stats(); st != exp {
+		t.Errorf("After removing B expected stats %#v but got %#v", exp, st)
+	}
+}
+
+// fullBuffer gives a buffer with n envelopes for client ID "A".
+func fullBuffer(n int) *Buffer {
+	b := NewBufferFor(time.Hour)
+	now := nowMs()
+	for i := 0; i < n; i++ {
+		b.Add("A", &Envelope{Time: now})
+	}
+	return b
+}
+
+func BenchmarkBuffer_QueueFromNearTheEnd(b *testing.B) {
+	buf := fullBuffer(maxBuffered)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf.Queue("A", maxBuffered-5)
+	}
+}
+
+func BenchmarkBuffer_ResentNearTheEnd(b *testing.B) {
+	buf := fullBuffer(maxBuffered)
+	at := nowMs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf.Resent("A", maxBuffered-5, at+int64(i))
+	}
+}
+
+func BenchmarkBuffer_AddWhenFull(b *testing.B) {
+	buf := fullBuffer(maxBuffered)
+	now := nowMs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf.Add("A", &Envelope{Time: now})
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright 2020 Nik Silver
+//
+// Licensed under the GPL v3.0. See file LICENCE.txt for details.
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Largest message a client may send in chunks, once reassembled, unless
+// the room says otherwise
+var chunkedLimit = 1024 * 1024
+
+// How long to wait for the next chunk of a message before giving up
+var chunkTimeout = 5 * time.Second
+
+// chunker reassembles a message a client sends in chunks, each like
+// {"intent":"Chunk","token":"m1","index":0,"count":3,"body":"..."}.
+// The token names the message, and mustn't be empty. The bodies are
+// strings which are joined together to make the message. Chunks must
+// come in order, and only one message can be assembled at a time. If
+// anything goes wrong the client gets an Error envelope and the message
+// is abandoned, but the connection carries on.
+type chunker struct {
+	c     *Client
+	token string // Token of the message being assembled, if any
+	next  int    // Index of the chunk we expect next
+	count int    // Number of chunks we expect altogether
+	data  []byte // What we've assembled so far
+	gen   int    // Incremented for each chunk, to spot stale timeouts
+	timer *time.Timer
+	done  bool // If the client has stopped reading
+	mux   sync.Mutex
+}
+
+// newChunker creates a chunker for messages coming from client c.
+func newChunker(c *Client) *chunker {
+	return &chunker{
+		c:   c,
+		mux: sync.Mutex{},
+	}
+}
+
+// add takes the next chunk from the client. It returns the complete
+// message and true if this was the last chunk, otherwise nil and false.
+func (ch *chunker) add(ctrl *control) ([]byte, bool) {
+	ch.mux.Lock()
+	defer ch.mux.Unlock()
+
+	ch.gen++
+	if ch.timer != nil {
+		ch.timer.Stop()
+	}
+
+	switch {
+	case ctrl.Token == "" || ctrl.Count < 1 ||
+		ctrl.Index < 0 || ctrl.Index >= ctrl.Count:
+		ch.abandon(ctrl.Token, "Bad chunk")
+		return nil, false
+	case ch.token == "" && ctrl.Index == 0:
+		ch.token = ctrl.Token
+		ch.count = ctrl.Count
+		ch.next = 0
+		ch.data = []byte{}
+	case ch.token == "" || ctrl.Token != ch.token ||
+		ctrl.Index != ch.next || ctrl.Count != ch.count:
+		token := ch.token
+		if token == "" {
+			token = ctrl.Token
+		}
+		ch.abandon(token, "Chunk out of order")
+		return nil, false
+	}
+
+	if len(ch.data)+len(ctrl.Body) > ch.c.Hub.settings.ChunkedLimit {
+		ch.abandon(ch.token, "Chunked message too large")
+		return nil, false
+	}
+	ch.data = append(ch.data, ctrl.Body...)
+	ch.next++
+
+	if ch.next == ch.count {
+		msg := ch.data
+		ch.reset()
+		return msg, true
+	}
+
+	gen := ch.gen
+	ch.timer = time.AfterFunc(chunkTimeout, func() {
+		ch.timeout(gen)
+	})
+	return nil, false
+}
+
+// timeout abandons the message being assembled, if we've not had another
+// chunk since generation gen.
+func (ch *chunker) timeout(gen int) {
+	ch.mux.Lock()
+	defer ch.mux.Unlock()
+
+	if ch.done || ch.gen != gen || ch.token == "" {
+		return
+	}
+	ch.abandon(ch.token, "Chunks timed out")
+}
+
+// stop says the client has stopped reading, so there must be no more
+// messages sent to the hub on its behalf.
+func (ch *chunker) stop() {
+	ch.mux.Lock()
+	defer ch.mux.Unlock()
+
+	ch.done = true
+	if ch.timer != nil {
+		ch.timer.Stop()
+	}
+}
+
+// abandon gives up on the message being assembled, telling the client
+// why. The lock must be held.
+func (ch *chunker) abandon(token string, reason string) {
+	aLog.Debug("Abandoning chunked message", "fn", "chunker.abandon",
+		"id", ch.c.currentID(), "c", ch.c.Ref, "token", token, "reason", reason)
+	ch.reset()
+	ch.c.Hub.Pending <- &Message{
+		From:   ch.c,
+		Intent: "Error",
+		Token:  token,
+		Reason: reason,
+	}
+}
+
+// reset clears the message being assembled. The lock must be held.
+func (ch *chunker) reset() {
+	ch.token = ""
+	ch.next = 0
+	ch.count = 0
+	ch.data = nil
+}
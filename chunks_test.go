@@ -0,0 +1,290 @@
+// Copyright 2020 Nik Silver
+//
+// Licensed under the GPL v3.0. See file LICENCE.txt for details.
+
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// chunkMsg makes a message carrying one chunk of a larger message.
+func chunkMsg(t *testing.T, token string, index, count int, body string) []byte {
+	msg, err := json.Marshal(map[string]interface{}{
+		"intent": "Chunk",
+		"token":  token,
+		"index":  index,
+		"count":  count,
+		"body":   body,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func TestChunks_LargeMessageArrivesWhole(t *testing.T) {
+	// Just for this test, lower the reconnection timeout so that a
+	// Leaver message is triggered reasonably quickly.
+	useSuperhub(t, 250*time.Millisecond)
+
+	serv := newTestServer(bounceHandler)
+	defer serv.Close()
+
+	room := "/chunks.whole"
+
+	// Connect two clients
+
+	ws1, _, err := dial(serv, room, "CHW1", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws1 := newTConn(ws1, "CHW1")
+	defer tws1.close()
+	if err := tws1.swallow("Welcome"); err != nil {
+		t.Fatalf("Welcome error for ws1: %s", err)
+	}
+
+	ws2, _, err := dial(serv, room, "CHW2", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws2 := newTConn(ws2, "CHW2")
+	defer tws2.close()
+	if err := tws2.swallow("Welcome"); err != nil {
+		t.Fatalf("Welcome error for ws2: %s", err)
+	}
+	if err := tws1.swallow("Joiner"); err != nil {
+		t.Fatalf("Joiner error for ws1: %s", err)
+	}
+
+	// The first client sends a message too big to send in one go,
+	// in three chunks
+
+	whole := `{"state":"` + strings.Repeat("x", 2*readLimit) + `"}`
+	third := len(whole) / 3
+	parts := []string{whole[:third], whole[third : 2*third], whole[2*third:]}
+	for i, part := range parts {
+		msg := chunkMsg(t, "big", i, len(parts), part)
+		if err := ws1.WriteMessage(websocket.TextMessage, msg); err != nil {
+			t.Fatalf("Error writing chunk %d: %s", i, err.Error())
+		}
+	}
+
+	// Both clients should get the whole message, once
+
+	env, err := tws2.readEnvelope(500, "ws2 expecting Peer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Intent != "Peer" || string(env.Body) != whole {
+		t.Errorf("ws2 got unexpected envelope with intent %s and body length %d",
+			env.Intent, len(env.Body))
+	}
+	env, err = tws1.readEnvelope(500, "ws1 expecting Receipt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Intent != "Peer" || !env.Receipt || string(env.Body) != whole {
+		t.Errorf("ws1 got unexpected envelope with intent %s and body length %d",
+			env.Intent, len(env.Body))
+	}
+	if err := tws2.expectNoMessage(100); err != nil {
+		t.Error(err)
+	}
+
+	// Tidy up, and check everything in the main app finishes
+	tws1.close()
+	tws2.close()
+	WG.Wait()
+}
+
+func TestChunks_BadChunksGiveErrorButKeepConnection(t *testing.T) {
+	// Just for this test, lower the reconnection timeout so that a
+	// Leaver message is triggered reasonably quickly, and lower the
+	// chunked message limit so we can exceed it easily.
+	useSuperhub(t, 250*time.Millisecond)
+	oldChunkedLimit := chunkedLimit
+	chunkedLimit = 10
+	defer func() {
+		chunkedLimit = oldChunkedLimit
+	}()
+
+	serv := newTestServer(bounceHandler)
+	defer serv.Close()
+
+	room := "/chunks.bad"
+
+	// Connect two clients
+
+	ws1, _, err := dial(serv, room, "CHB1", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws1 := newTConn(ws1, "CHB1")
+	defer tws1.close()
+	if err := tws1.swallow("Welcome"); err != nil {
+		t.Fatalf("Welcome error for ws1: %s", err)
+	}
+
+	ws2, _, err := dial(serv, room, "CHB2", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws2 := newTConn(ws2, "CHB2")
+	defer tws2.close()
+	if err := tws2.swallow("Welcome"); err != nil {
+		t.Fatalf("Welcome error for ws2: %s", err)
+	}
+	if err := tws1.swallow("Joiner"); err != nil {
+		t.Fatalf("Joiner error for ws1: %s", err)
+	}
+
+	// Each sequence of chunks should give the first client an error
+
+	data := []struct {
+		desc   string
+		chunks [][]byte
+		token  string
+		reason string
+	}{
+		{
+			"Starting with the wrong chunk",
+			[][]byte{chunkMsg(t, "m1", 1, 2, "ab")},
+			"m1", "Chunk out of order",
+		},
+		{
+			"Skipping a chunk",
+			[][]byte{
+				chunkMsg(t, "m2", 0, 3, "ab"),
+				chunkMsg(t, "m2", 2, 3, "cd"),
+			},
+			"m2", "Chunk out of order",
+		},
+		{
+			"Switching messages",
+			[][]byte{
+				chunkMsg(t, "m3", 0, 2, "ab"),
+				chunkMsg(t, "m4", 1, 2, "cd"),
+			},
+			"m3", "Chunk out of order",
+		},
+		{
+			"Body isn't a string",
+			[][]byte{
+				[]byte(`{"intent":"Chunk","token":"m5","index":0,"count":1,"body":7}`),
+			},
+			"m5", "Bad chunk",
+		},
+		{
+			"Too big altogether",
+			[][]byte{
+				chunkMsg(t, "m6", 0, 2, "abcdef"),
+				chunkMsg(t, "m6", 1, 2, "ghijkl"),
+			},
+			"m6", "Chunked message too large",
+		},
+	}
+
+	for _, d := range data {
+		for i, msg := range d.chunks {
+			if err := ws1.WriteMessage(websocket.TextMessage, msg); err != nil {
+				t.Fatalf("%s: Error writing chunk %d: %s", d.desc, i, err.Error())
+			}
+		}
+		env, err := tws1.readEnvelope(500, "ws1 expecting Error")
+		if err != nil {
+			t.Fatalf("%s: %s", d.desc, err)
+		}
+		if env.Intent != "Error" || env.Num != -1 ||
+			env.Token != d.token || env.Reason != d.reason {
+			t.Errorf("%s: Got unexpected envelope %#v", d.desc, env)
+		}
+	}
+
+	// The second client should have heard nothing, but the first
+	// client's connection should still be good
+
+	if err := tws2.expectNoMessage(100); err != nil {
+		t.Error(err)
+	}
+	msg := []byte(`{"move":"e4"}`)
+	if err := ws1.WriteMessage(websocket.TextMessage, msg); err != nil {
+		t.Fatalf("Error writing peer message: %s", err.Error())
+	}
+	env, err := tws2.readEnvelope(500, "ws2 expecting Peer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Intent != "Peer" || string(env.Body) != string(msg) {
+		t.Errorf("ws2 got unexpected envelope %#v", env)
+	}
+
+	// Tidy up, and check everything in the main app finishes
+	tws1.close()
+	tws2.close()
+	WG.Wait()
+}
+
+func TestChunks_MissingChunkTimesOut(t *testing.T) {
+	// Just for this test, lower the reconnection timeout so that a
+	// Leaver message is triggered reasonably quickly, and lower the
+	// chunk timeout so we don't wait long for it.
+	useSuperhub(t, 250*time.Millisecond)
+	oldChunkTimeout := chunkTimeout
+	chunkTimeout = 100 * time.Millisecond
+	defer func() {
+		chunkTimeout = oldChunkTimeout
+	}()
+
+	serv := newTestServer(bounceHandler)
+	defer serv.Close()
+
+	ws, _, err := dial(serv, "/chunks.timeout", "CHT", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws := newTConn(ws, "CHT")
+	defer tws.close()
+	if err := tws.swallow("Welcome"); err != nil {
+		t.Fatalf("Welcome error: %s", err)
+	}
+
+	// Send only the first of two chunks, and we should get an error
+
+	msg := chunkMsg(t, "slow", 0, 2, "ab")
+	if err := ws.WriteMessage(websocket.TextMessage, msg); err != nil {
+		t.Fatalf("Error writing chunk: %s", err.Error())
+	}
+	env, err := tws.readEnvelope(500, "expecting Error")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Intent != "Error" || env.Token != "slow" ||
+		env.Reason != "Chunks timed out" {
+		t.Errorf("Got unexpected envelope %#v", env)
+	}
+
+	// The second chunk now is too late
+	msg = chunkMsg(t, "slow", 1, 2, "cd")
+	if err := ws.WriteMessage(websocket.TextMessage, msg); err != nil {
+		t.Fatalf("Error writing late chunk: %s", err.Error())
+	}
+	env, err = tws.readEnvelope(500, "expecting second Error")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Intent != "Error" || env.Token != "slow" ||
+		env.Reason != "Chunk out of order" {
+		t.Errorf("Got unexpected second envelope %#v", env)
+	}
+
+	// Tidy up, and check everything in the main app finishes
+	tws.close()
+	WG.Wait()
+}
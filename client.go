@@ -5,30 +5,154 @@
 package main
 
 import (
+	"bytes"
+	"compress/flate"
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"math/rand"
-	"net/http"
-	"net/url"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"github.com/gorilla/websocket"
 )
 
-// How often we send pings
+// How often we send pings, unless the client asks for something else
 var pingFreq = 60 * time.Second
 
-// How long we time out waiting for a pong or other data. Must be more
-// than pingFreq.
+// Least and most often a client can ask us to send pings
+var minPingFreq = 1 * time.Second
+var maxPingFreq = 120 * time.Second
+
+// How long we time out waiting for a pong or other data, unless the
+// client asks for something else. Must be more than pingFreq.
 var pongTimeout = (pingFreq * 5) / 4
 
+// Least and most time a client can ask us to wait for a pong
+var minPongTimeout = 1 * time.Second
+var maxPongTimeout = 600 * time.Second
+
 // How long to allow to write to the websocket.
 var writeTimeout = 10 * time.Second
 
-// How long to allow for a reconnection if we lose the client
-var reconnectionTimeout = 5 * time.Second
+// How many queued envelopes to send in one go, before checking for
+// new messages from the hub and pings.
+var queueBatchSize = 10
+
+// Largest message we'll read from a client, unless the room says
+// otherwise. If the connection is compressed this is the size after
+// decompression.
+var readLimit = 60 * 1024
+
+// Largest message any room can allow.
+var maxReadLimit = 256 * 1024
+
+// Why a message from the client wasn't read: it was over the room's
+// read limit
+var errTooBig = fmt.Errorf("Message too big")
+
+// Compression level for connections that use compression.
+var compressionLevel = flate.BestSpeed
+
+// How long to allow for a reconnection if we lose the client, unless
+// the superhub or the room says otherwise
+const defaultReconnection = 5 * time.Second
+
+// Longest any room can allow for a reconnection
+var maxReconnect = 60 * time.Second
+
+// Longest any room can let a player go without sending a peer message,
+// and how long after it's warned about that it's closed
+var maxClientIdle = 24 * time.Hour
+var clientIdleGrace = time.Minute
+
+// Most Echo requests a client may make in a second. Any more are dropped.
+var echoLimit = 5
+
+// Most Stats requests a client may make in a second. Any more get an
+// Error.
+var statsLimit = 2
+
+// Most Rename requests a client may make in renameWindow. Any more get
+// an Error.
+var renameLimit = 3
+var renameWindow = 10 * time.Second
 
-// Close error code for bad lastnum
-var CloseBadLastnum = 4000
+// How many messages a client may send in a second, on average, and in
+// a burst. Any more are dropped, and the client is told. If it sends
+// msgAbuseLimit more without a break its connection is closed.
+var msgRate = 20.0
+var msgBurst = 50.0
+var msgAbuseLimit = 50
+
+// Most envelopes, and most bytes of envelope bodies, the hub may have
+// waiting for a client to send. A client which falls further behind
+// than that is closed as a slow consumer.
+var maxQueued = 256
+var maxQueuedBytes = 4 * 1024 * 1024
+
+// How many envelopes a client may have queued, or how old the oldest
+// of them may be, before we warn that it's falling behind
+var laggingQueued = 100
+var laggingAge = 5 * time.Second
+
+// How long the hub will wait for a client with maxQueued envelopes
+// waiting to take another, before it decides it's a slow consumer
+var slowConsumerWait = 1 * time.Second
+
+// Most recent peer messages a room can keep to show new joiners
+var maxHistory = 100
+
+// Most sides a die can have, and most dice a client can roll at once
+var maxDieSides = 1000
+var maxDice = 100
+
+// Close error codes, so a client can tell why its connection was
+// closed. Those from 4000 are ours; the others are standard.
+const (
+	// A lastnum we can't continue from
+	CloseBadLastnum = 4000
+	// The client is leaving deliberately. Only a client uses this.
+	CloseGoodbye = 4001
+	// A protocol version the server can't speak
+	CloseBadVersion = 4002
+	// The room's leader has thrown the client out
+	CloseKicked = 4003
+	// The room has closed, other than for being idle
+	CloseRoomClosed = 4004
+	// The client's ID is taken, in a room which won't let it take over
+	// without a lastnum
+	CloseIDTaken = 4005
+	// The room has as many clients, or observers, as it allows
+	CloseRoomFull = 4006
+	// Another connection has taken over the client's ID
+	CloseSuperseded = 4007
+	// The room has closed because it's been idle too long
+	CloseIdle = 4008
+	// The client has fallen too far behind reading its envelopes
+	CloseSlowConsumer = 4009
+	// The client hasn't sent a peer message for as long as the room
+	// allows
+	CloseClientIdle = 4010
+	// An operator has closed the room
+	CloseForceClosed = 4011
+	// The server is shutting down
+	CloseShutdown = websocket.CloseGoingAway
+	// A message over the room's read limit
+	CloseTooBig = websocket.CloseMessageTooBig
+	// Far too many messages, too quickly
+	CloseTooManyMessages = websocket.ClosePolicyViolation
+)
+
+// Longest reason a close message can give, in bytes
+const maxCloseReason = 123
+
+// Version of the protocol (the envelopes and what they mean) that the
+// server speaks. Sent in the Welcome envelope.
+const ProtocolVersion = 1
 
 func init() {
 	// Let's not generate near-identical client IDs on every restart
@@ -36,11 +160,37 @@ func init() {
 }
 
 type Client struct {
+	// Only the hub may change this, with setID. Anything else running
+	// once the client has joined should read it with currentID.
 	ID string
 	// Envelope number expected when starting, or -1
 	Num int
+	// Protocol version the client asked for, or 0 if it didn't ask
+	Version int
+	// If the client wants receipts for its own peer messages
+	Receipts bool
+	// If the client wants the Joiner message about itself
+	SelfJoin bool
+	// Display name for the other players to see, or empty if none
+	Name string
+	// Metadata for the other players to see, as JSON, or nil if none
+	Meta json.RawMessage
+	// If the client is happy to reconnect having missed some envelopes
+	BestEffort bool
+	// How often the client wants pings, or 0 for the default
+	PingFreq time.Duration
+	// How long the client wants us to wait for a pong, or 0 for the
+	// default
+	PongTimeout time.Duration
+	// If the client plays or only watches
+	Role role
+	// Websocket subprotocol agreed with the client, which says how
+	// envelopes are encoded. Empty means the default, JSON.
+	Subprotocol string
 	// Ref for tracing purposes only
 	Ref string
+	// When the client connected, for an operator to see
+	created time.Time
 	// Don't close the websocket directly. That's managed internally.
 	WS  *websocket.Conn
 	Hub *Hub
@@ -51,17 +201,113 @@ type Client struct {
 	// To receive a message from the hub. The hub will close the channel
 	// to indicate the client should disconnect and shut down.
 	Pending chan *Envelope
+	// Bytes of envelope bodies waiting in Pending. The hub adds to it
+	// and the client takes away.
+	queuedBytes int64
+	// Set by the hub if the client has fallen too far behind, so it's
+	// sent nothing more.
+	slow bool
+	// How many envelopes are in the queue, and the time of the oldest,
+	// or 0. The client sets these and the hub reads them.
+	queueDepth  int64
+	queueOldest int64
+	// If we've warned that the client is falling behind, and it hasn't
+	// caught up since
+	lagging bool
+	// When the client last sent a peer message, in milliseconds since
+	// the epoch. The client sets it and the hub reads it. Pongs don't
+	// count.
+	lastPeer int64
+	// Set by the hub if it's warned the client for not sending a peer
+	// message, and the client hasn't since
+	idleWarned bool
 	// pinger ticks for pinging
 	pinger *time.Ticker
+	// Set by the hub if the client has said goodbye, before it closes
+	// the Pending channel, so there's no need to allow a reconnection.
+	gone bool
+	// Set by the client before it reports a lost connection, if the
+	// connection was closed by the other end rather than dropped.
+	closed bool
+	// Set by the superhub, under the lock for the room, once the hub
+	// has had the client's Joiner (or the client gave up before that),
+	// once the client has released its hub, and if another client with
+	// the same ID has taken over.
+	arrived    bool
+	released   bool
+	superseded bool
+	// When the current second of Echo requests started, and how many
+	// we've had in it
+	echoStart time.Time
+	echoCount int
+	// The same for Stats requests
+	statsStart time.Time
+	statsCount int
+	// And for Rename requests, over their longer window
+	renameStart time.Time
+	renameCount int
+	// For limiting how fast the client sends messages, and how many
+	// in a row we've had to drop
+	msgBucket  bucket
+	msgDropped int
+	// For reassembling messages the client sends in chunks
+	chunks *chunker
+	// For when the hub gives the client another ID
+	idMux sync.RWMutex
 }
 
+// The part a client takes in a room
+type role int
+
+// Various client roles
+const (
+	// Client plays, so the others are told about it
+	PLAYER role = 0
+	// Client only watches, so no-one is told about it and it can't send
+	// peer messages
+	OBSERVER role = 1
+)
+
+// setID gives the client a new ID. Only the hub should do this.
+func (c *Client) setID(id string) {
+	c.idMux.Lock()
+	defer c.idMux.Unlock()
+	c.ID = id
+}
+
+// currentID gets the client's ID safely, even if the hub might be
+// changing it.
+func (c *Client) currentID() string {
+	c.idMux.RLock()
+	defer c.idMux.RUnlock()
+	return c.ID
+}
+
+// Websocket subprotocols the server can speak, in order of preference.
+// A client needn't ask for any of them.
+var subprotocols = []string{JSONProtocol, MsgpackProtocol}
+
 var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool {
-		// If set, the Origin host is in r.Header["Origin"][0])
-		// The request host is in r.Host
-		// We won't worry about the origin, to help with testing locally
+	Subprotocols:      subprotocols,
+	EnableCompression: true,
+	CheckOrigin:       originAllowed,
+}
+
+// subprotocolsAcceptable says if the server can speak one of the
+// subprotocols a client offers. If the client offers none then that's
+// fine, too.
+func subprotocolsAcceptable(offered []string) bool {
+	if len(offered) == 0 {
 		return true
-	},
+	}
+	for _, p := range offered {
+		for _, sp := range subprotocols {
+			if p == sp {
+				return true
+			}
+		}
+	}
+	return false
 }
 
 // newClientID generates a random clientID string
@@ -73,26 +319,22 @@ func newClientID() string {
 	)
 }
 
-// ClientIDOrNew returns the value of the client ID from the URL query,
-// or a new ID if there's none there.
-func ClientIDOrNew(query string) string {
-	v, err := url.ParseQuery(query)
-	if err != nil {
-		aLog.Warn("Couldn't parse query string", "query", query)
-		return newClientID()
-	}
-	gotID := v.Get("id")
-	if gotID == "" {
-		return newClientID()
-	}
-	return gotID
-}
-
 // Start announces the client to the hub and
 // kicks off its send and receive goroutines.
 func (c *Client) Start() {
 	fLog := aLog.New("fn", "client.Start", "id", c.ID, "c", c.Ref)
 
+	// Make sure we speak the protocol version the client wants
+	if c.Version != 0 && c.Version != ProtocolVersion {
+		fLog.Debug("Unsupported version", "version", c.Version)
+		rejectConnected(c, CloseBadVersion, &rejection{
+			Error:  "Unsupported version",
+			Reason: REJECTBADVERSION,
+		})
+		c.Hub.shub.Release(c.Hub, c)
+		return
+	}
+
 	// Send a joiner message to the hub
 	c.Hub.Pending <- &Message{
 		From:   c,
@@ -102,15 +344,25 @@ func (c *Client) Start() {
 	// Wait for the initial queue
 	c.queue = <-c.InitialQueue
 
-	// Immediate termination for an excessive message
-	c.WS.SetReadLimit(60 * 1024)
+	// Immediate termination for a wildly excessive message. This limits
+	// what comes over the network. Anything less is read by readMessage
+	// only up to the room's limit, even after decompressing, and then
+	// refused more politely, with an Error before the close.
+	c.WS.SetReadLimit(2 * int64(maxReadLimit))
+	if err := c.WS.SetCompressionLevel(compressionLevel); err != nil {
+		fLog.Warn("Couldn't set compression level", "err", err)
+	}
+
+	// Joining counts as activity, as far as idling goes
+	atomic.StoreInt64(&c.lastPeer, nowMs())
 
 	// Set up pinging
-	c.pinger = time.NewTicker(pingFreq)
-	c.WS.SetReadDeadline(time.Now().Add(pongTimeout))
+	freq, timeout := c.pingTimes()
+	c.pinger = time.NewTicker(freq)
+	c.WS.SetReadDeadline(time.Now().Add(timeout))
 	c.WS.SetPongHandler(func(string) error {
 		fLog.Debug("Start.SetPongHandler: Received pong")
-		c.WS.SetReadDeadline(time.Now().Add(pongTimeout))
+		c.WS.SetReadDeadline(time.Now().Add(timeout))
 		return nil
 	})
 
@@ -125,52 +377,458 @@ func (c *Client) Start() {
 	go c.receiveExt()
 }
 
+// pingTimes gives how often we ping the client, and how long we wait
+// for a pong or other data. Unless the client asked for its own ping
+// frequency these are pingFreq and pongTimeout, and if it did then we
+// wait a quarter as long again. But if the client asked us to wait a
+// particular time then we do, even if it's less than how often we ping.
+func (c *Client) pingTimes() (time.Duration, time.Duration) {
+	freq, timeout := pingFreq, pongTimeout
+	if c.PingFreq != 0 {
+		freq, timeout = c.PingFreq, (c.PingFreq*5)/4
+	}
+	if c.PongTimeout != 0 {
+		timeout = c.PongTimeout
+	}
+	return freq, timeout
+}
+
 // receiveExt is a goroutine that acts on external messages coming in.
 func (c *Client) receiveExt() {
-	fLog := aLog.New("fn", "client.receiveExt", "id", c.ID, "c", c.Ref)
+	fLog := aLog.New("fn", "client.receiveExt", "id", c.currentID(), "c", c.Ref)
 	fLog.Debug("Entering")
 
 	defer fLog.Debug("Done")
 	defer WG.Done()
 
-	// Read messages until we can no more
+	// Read messages until we can no more, or the client says goodbye
+	c.chunks = newChunker(c)
+	intent := "LostConnection"
 	for {
 		fLog.Debug("Reading")
-		_, msg, err := c.WS.ReadMessage()
+		mType, msg, err := c.readMessage()
 		if err != nil {
 			fLog.Debug("Read error", "error", err)
+			if websocket.IsCloseError(err, CloseGoodbye) {
+				intent = "Goodbye"
+			}
+			if err == errTooBig {
+				intent = "TooBig"
+			}
+			// An abnormal closure means the connection just dropped
+			if ce, ok := err.(*websocket.CloseError); ok &&
+				ce.Code != websocket.CloseAbnormalClosure {
+				c.closed = true
+			}
+			break
+		}
+		ctrl, err := parseControl(msg)
+		if err == nil && ctrl != nil && ctrl.Intent == "Goodbye" {
+			fLog.Debug("Read goodbye")
+			intent = "Goodbye"
 			break
 		}
-		// Currently just passes on the message type
-		fLog.Debug("Read is good", "content", string(msg))
+		if !c.allowMsg() {
+			fLog.Debug("Dropping message over the limit",
+				"dropped", c.msgDropped)
+			if c.msgDropped == 1 {
+				c.Hub.Pending <- &Message{
+					From:   c,
+					Intent: "Error",
+					Reason: "Too many messages",
+				}
+			}
+			if c.msgDropped > msgAbuseLimit {
+				fLog.Warn("Closing connection for too many messages")
+				c.closeWith("Too many messages", CloseTooManyMessages)
+				break
+			}
+			continue
+		}
+		if err != nil {
+			fLog.Debug("Read bad control message", "error", err)
+			c.Hub.Pending <- &Message{
+				From:   c,
+				Intent: "Error",
+				Token:  ctrl.Token,
+				Reason: err.Error(),
+			}
+			continue
+		}
+		if ctrl != nil && ctrl.Intent == "Chunk" {
+			body, ok := c.chunks.add(ctrl)
+			if !ok {
+				continue
+			}
+			fLog.Debug("Read last chunk", "token", ctrl.Token)
+			ctrl, mType, msg = nil, websocket.TextMessage, body
+		}
+		if ctrl != nil && ctrl.Intent == "Echo" && !c.allowEcho() {
+			fLog.Debug("Dropping echo over the limit")
+			continue
+		}
+		if ctrl != nil && ctrl.Intent == "Stats" && !c.allowStats() {
+			fLog.Debug("Refusing stats over the limit")
+			c.Hub.Pending <- &Message{
+				From:   c,
+				Intent: "Error",
+				Token:  ctrl.Token,
+				Reason: "Too many stats requests",
+			}
+			continue
+		}
+		if ctrl != nil && ctrl.Intent == "Rename" && !c.allowRename() {
+			fLog.Debug("Refusing rename over the limit")
+			c.Hub.Pending <- &Message{
+				From:   c,
+				Intent: "Error",
+				Token:  ctrl.Token,
+				Reason: "Too many renames",
+			}
+			continue
+		}
+		if ctrl != nil {
+			fLog.Debug("Read control message", "intent", ctrl.Intent)
+			c.Hub.Pending <- &Message{
+				From:   c,
+				Intent: ctrl.Intent,
+				Body:   ctrl.Body,
+				Token:  ctrl.Token,
+				Num:    ctrl.Num,
+				ID:     ctrl.ID,
+				As:     ctrl.As,
+				Key:    ctrl.Key,
+				Sides:  ctrl.Sides,
+				Count:  ctrl.Count,
+				Name:   ctrl.Name,
+			}
+			continue
+		}
+		if mType != websocket.TextMessage && mType != websocket.BinaryMessage {
+			fLog.Warn("Ignoring unknown message type", "type", mType)
+			continue
+		}
+		fLog.Debug("Read is good", "type", mType, "content", string(msg))
+		receipt, tag, ttl := true, "", int64(0)
+		if w := unwrap(msg); w != nil {
+			msg, receipt, tag, ttl = w.Body, w.Receipt, w.Tag, w.TTL
+		}
+		if len(tag) > maxTagLength {
+			fLog.Warn("Dropping oversized tag", "length", len(tag))
+			tag = ""
+		}
+		atomic.StoreInt64(&c.lastPeer, nowMs())
 		c.Hub.Pending <- &Message{
-			From:   c,
-			Intent: "Peer",
-			Body:   msg,
+			From:      c,
+			Intent:    "Peer",
+			Body:      msg,
+			Type:      mType,
+			NoReceipt: !receipt,
+			Tag:       tag,
+			TTL:       ttl,
 		}
 	}
 
 	// We've done reading, so announce a lost connection and set up a
-	// signal for allowing a reconnection.
+	// signal for allowing a reconnection. But if the client said
+	// goodbye then it's not expecting to reconnect. Either way,
+	// this is the last message we send to the hub.
 
-	fLog.Debug("Closing conn")
-	c.WS.Close()
+	fLog.Debug("Closing conn", "intent", intent)
+	c.chunks.stop()
+	if intent != "TooBig" {
+		// Otherwise the client's told why before its connection's closed
+		c.WS.Close()
+	}
 	c.Hub.Pending <- &Message{
 		From:   c,
-		Intent: "LostConnection",
+		Intent: intent,
+	}
+}
+
+// readMessage is like the websocket's ReadMessage, but won't read a
+// message over the read limit, even if it comes in small and compressed.
+// If it's too big we stop reading it and give errTooBig.
+func (c *Client) readMessage() (int, []byte, error) {
+	mType, r, err := c.WS.NextReader()
+	if err != nil {
+		return mType, nil, err
+	}
+	limit := c.Hub.settings.ReadLimit
+	msg, err := ioutil.ReadAll(io.LimitReader(r, int64(limit)+1))
+	if err != nil {
+		return mType, nil, err
+	}
+	if len(msg) > limit {
+		return mType, nil, errTooBig
+	}
+	return mType, msg, nil
+}
+
+// allowEcho says if the client can have another Echo request this
+// second, and counts it if so.
+func (c *Client) allowEcho() bool {
+	now := time.Now()
+	if now.Sub(c.echoStart) >= time.Second {
+		c.echoStart = now
+		c.echoCount = 0
+	}
+	if c.echoCount >= echoLimit {
+		return false
+	}
+	c.echoCount++
+	return true
+}
+
+// allowStats says if the client can have another Stats request this
+// second, and counts it if so.
+func (c *Client) allowStats() bool {
+	now := time.Now()
+	if now.Sub(c.statsStart) >= time.Second {
+		c.statsStart = now
+		c.statsCount = 0
+	}
+	if c.statsCount >= statsLimit {
+		return false
+	}
+	c.statsCount++
+	return true
+}
+
+// allowRename says if the client can have another Rename request in
+// this renameWindow, and counts it if so.
+func (c *Client) allowRename() bool {
+	now := time.Now()
+	if now.Sub(c.renameStart) >= renameWindow {
+		c.renameStart = now
+		c.renameCount = 0
+	}
+	if c.renameCount >= renameLimit {
+		return false
 	}
+	c.renameCount++
+	return true
+}
+
+// allowMsg says if the client can send another message now, using
+// up a token if so. Otherwise it counts another message dropped.
+func (c *Client) allowMsg() bool {
+	if !c.msgBucket.take(msgRate, msgBurst) {
+		c.msgDropped++
+		return false
+	}
+	c.msgDropped = 0
+	return true
+}
+
+// control is a structured message from a client for the server, rather
+// than for the other clients.
+type control struct {
+	Intent string // What the client wants the server to do
+	Token  string // Anything to echo back, such as for a Time request
+	Body   []byte // Any JSON to bounce back, for an Echo request
+	// For a Chunk, which part of the message this is, counting from 0,
+	// and how many parts there are altogether. The Body is the part of
+	// the message.
+	Index int
+	Count int
+	// Num to send envelopes from again, for a Replay request
+	Num int
+	// Client to give another ID, and the ID it should have, for a
+	// Reassign request. Or the client to throw out, for a Kick. Or
+	// whose turn it is, for a SetTurn.
+	ID string
+	As string
+	// Key of the room's state to set, for a SetState request, whose
+	// Body is the value
+	Key string
+	// How many sides each die has, for a Roll request, which uses
+	// the Count for how many dice
+	Sides int
+	// New display name, for a Rename request. Cleaned like a name
+	// given when connecting, and empty to have no name.
+	Name string
+}
+
+// Intents a client can give in a structured message
+var controlIntents = map[string]bool{
+	"Goodbye":             true,
+	"Time":                true,
+	"Echo":                true,
+	"Chunk":               true,
+	"Replay":              true,
+	"Reassign":            true,
+	"Kick":                true,
+	"CreateSpectatorLink": true,
+	"SetState":            true,
+	"Reseed":              true,
+	"Roll":                true,
+	"SetTurn":             true,
+	"PassTurn":            true,
+	"Pause":               true,
+	"Resume":              true,
+	"Rename":              true,
+	"Stats":               true,
+	"Roster":              true,
+}
+
+// parseControl parses a structured message from a client, which is a
+// JSON object with an intent, such as {"intent":"Goodbye"}, plus any
+// other fields the intent needs. It returns nil and no error if the
+// message isn't structured, so it's an ordinary message to be bounced
+// to the other clients. It returns an error if the message is
+// structured but its intent isn't one we know or its fields are wrong,
+// along with a control holding any token it could read.
+func parseControl(msg []byte) (*control, error) {
+	trimmed := bytes.TrimSpace(msg)
+	if len(trimmed) == 0 || trimmed[0] != '{' {
+		return nil, nil
+	}
+	fields := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(trimmed, &fields); err != nil {
+		return nil, nil
+	}
+	intent, ok := fields["intent"]
+	if !ok {
+		return nil, nil
+	}
+
+	ctrl := &control{}
+	if token, ok := fields["token"]; ok {
+		if err := json.Unmarshal(token, &ctrl.Token); err != nil {
+			return ctrl, fmt.Errorf("Bad token")
+		}
+	}
+	if err := json.Unmarshal(intent, &ctrl.Intent); err != nil {
+		return ctrl, fmt.Errorf("Bad intent")
+	}
+	if !controlIntents[ctrl.Intent] {
+		return ctrl, fmt.Errorf("Unknown intent")
+	}
+
+	switch ctrl.Intent {
+	case "Echo":
+		ctrl.Body = fields["body"]
+	case "Chunk":
+		var body string
+		if json.Unmarshal(fields["index"], &ctrl.Index) != nil ||
+			json.Unmarshal(fields["count"], &ctrl.Count) != nil ||
+			json.Unmarshal(fields["body"], &body) != nil {
+			return ctrl, fmt.Errorf("Bad chunk")
+		}
+		ctrl.Body = []byte(body)
+	case "Replay":
+		if json.Unmarshal(fields["num"], &ctrl.Num) != nil || ctrl.Num < 0 {
+			return ctrl, fmt.Errorf("Bad replay")
+		}
+	case "Reassign":
+		if json.Unmarshal(fields["id"], &ctrl.ID) != nil || ctrl.ID == "" ||
+			json.Unmarshal(fields["as"], &ctrl.As) != nil || ctrl.As == "" {
+			return ctrl, fmt.Errorf("Bad reassign")
+		}
+	case "Kick":
+		if json.Unmarshal(fields["id"], &ctrl.ID) != nil || ctrl.ID == "" {
+			return ctrl, fmt.Errorf("Bad kick")
+		}
+	case "SetState":
+		value, ok := fields["value"]
+		if json.Unmarshal(fields["key"], &ctrl.Key) != nil || ctrl.Key == "" ||
+			!ok {
+			return ctrl, fmt.Errorf("Bad state")
+		}
+		ctrl.Body = value
+	case "SetTurn":
+		if json.Unmarshal(fields["id"], &ctrl.ID) != nil {
+			return ctrl, fmt.Errorf("Bad turn")
+		}
+	case "Roll":
+		if json.Unmarshal(fields["sides"], &ctrl.Sides) != nil ||
+			json.Unmarshal(fields["count"], &ctrl.Count) != nil ||
+			ctrl.Sides < 2 || ctrl.Sides > maxDieSides ||
+			ctrl.Count < 1 || ctrl.Count > maxDice {
+			return ctrl, fmt.Errorf("Bad roll")
+		}
+	case "Rename":
+		var name string
+		if json.Unmarshal(fields["name"], &name) != nil {
+			return ctrl, fmt.Errorf("Bad name")
+		}
+		ctrl.Name = cleanName(name)
+		if utf8.RuneCountInString(ctrl.Name) > maxNameLength {
+			return ctrl, fmt.Errorf("Bad name")
+		}
+	}
+	return ctrl, nil
+}
+
+// Longest tag a client can put on a message for its receipt
+var maxTagLength = 64
+
+// wrapped is a message from a client wrapped to say something about how
+// it's to be sent.
+type wrapped struct {
+	Body    []byte // The message itself, which is whatever JSON was given
+	Receipt bool   // If the sender wants a receipt for just this message
+	Tag     string // Anything to copy onto the receipt, to identify it
+	TTL     int64  // Milliseconds until it's not worth resending, or 0
+}
+
+// unwrap gets the message from one wrapped like
+// {"receipt": false, "tag": "m1", "ttl": 500, "body": ...}. There must
+// be a body and at least one of the others. It returns nil if the
+// message isn't wrapped like this, in which case it's an ordinary
+// message to be sent as it is.
+func unwrap(msg []byte) *wrapped {
+	trimmed := bytes.TrimSpace(msg)
+	if len(trimmed) == 0 || trimmed[0] != '{' {
+		return nil
+	}
+	fields := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(trimmed, &fields); err != nil {
+		return nil
+	}
+	body, okB := fields["body"]
+	rcptJSON, okR := fields["receipt"]
+	tagJSON, okT := fields["tag"]
+	ttlJSON, okTTL := fields["ttl"]
+	count := 1
+	for _, ok := range []bool{okR, okT, okTTL} {
+		if ok {
+			count++
+		}
+	}
+	if !okB || count == 1 || len(fields) != count {
+		return nil
+	}
+
+	w := &wrapped{Body: []byte(body), Receipt: true}
+	if okR && (json.Unmarshal(rcptJSON, &w.Receipt) != nil ||
+		string(rcptJSON) == "null") {
+		return nil
+	}
+	if okT && (json.Unmarshal(tagJSON, &w.Tag) != nil ||
+		string(tagJSON) == "null") {
+		return nil
+	}
+	if okTTL && (json.Unmarshal(ttlJSON, &w.TTL) != nil || w.TTL < 1) {
+		return nil
+	}
+	return w
 }
 
 // sendExt is a goroutine that sends network messages out. These are
 // pings and messages that have come from the hub. It will stop
 // if its channel is closed or it can no longer write to the network.
 func (c *Client) sendExt() {
-	fLog := aLog.New("fn", "client.sendExt", "id", c.ID, "c", c.Ref)
+	fLog := aLog.New("fn", "client.sendExt", "id", c.currentID(), "c", c.Ref)
 	fLog.Debug("Entering")
 
 	defer fLog.Debug("Goroutine done")
 	defer WG.Done()
 
+	atomic.AddInt64(&Counters.activeClients, 1)
+	defer atomic.AddInt64(&Counters.activeClients, -1)
+
 	// Go through scenarios until we need to shut down this client
 	connected := true
 	if !c.queue.Empty() {
@@ -187,7 +845,7 @@ func (c *Client) sendExt() {
 	// true before continuing the shut down.
 	fLog.Debug("Closing connection")
 	c.WS.Close()
-	aLog.Info("Closed connection", "id", c.ID)
+	aLog.Info("Closed connection", "id", c.currentID())
 	c.pinger.Stop()
 	fLog.Debug("Waiting for channel close")
 	for {
@@ -198,14 +856,14 @@ func (c *Client) sendExt() {
 
 	// We're done. Tell the superhub we're done with the hub
 	fLog.Debug("Releasing hub")
-	Shub.Release(c.Hub, c)
+	c.Hub.shub.Release(c.Hub, c)
 }
 
 // connectedWithQueued is for processing messages from the hub while
 // sending messages from the queue. Returns connected flag.
 func (c *Client) connectedWithQueued() bool {
 	fLog := aLog.New("fn", "client.connectedWithQueued",
-		"id", c.ID, "ref", c.Ref)
+		"id", c.currentID(), "ref", c.Ref)
 
 	// Keep receiving internal messages
 	for {
@@ -218,9 +876,23 @@ func (c *Client) connectedWithQueued() bool {
 				fLog.Debug("Channel closed")
 				return false
 			}
+			c.took(env)
+			if c.closeFor(env) {
+				// This message is for us
+				fLog.Debug("Closed for intent", "intent", env.Intent)
+				return false
+			}
+			if env.Intent == "Resend" {
+				// This message is for us. The envelopes from this num
+				// are coming again, so we mustn't send them twice.
+				fLog.Debug("Got Resend intent", "num", env.Num)
+				c.queue.RemoveFrom(env.Num)
+				continue
+			}
 			// Message needs to go onto the queue
 			fLog.Debug("Adding to queue", "env", niceEnv(env))
 			c.queue.Add(env)
+			c.noteQueue()
 
 		case <-c.pinger.C:
 			fLog.Debug("Sending ping")
@@ -237,26 +909,29 @@ func (c *Client) connectedWithQueued() bool {
 				return false
 			}
 		default:
-			fLog.Debug("Sending envelope from queue")
-			env, err := c.queue.Get()
-			if err != nil {
-				fLog.Debug("Problem getting envelope", "err", err.Error())
+			fLog.Debug("Sending envelopes from queue")
+			envs := c.queue.GetBatch(queueBatchSize)
+			if len(envs) == 0 {
+				fLog.Debug("Problem getting envelopes from queue")
 				return false
 			}
-			fLog.Debug("Got queued envelope okay", "env", niceEnv(env))
-			if err := c.WS.SetWriteDeadline(
-				time.Now().Add(writeTimeout)); err != nil {
-				// Write error, move to disconnected state
-				fLog.Debug("Message deadline error", "err", err)
-				return false
-			}
-			if err := c.WS.WriteJSON(env); err != nil {
-				// Write error, move to disconnected state
-				fLog.Debug("Message write error", "err", err)
-				return false
+			for _, env := range envs {
+				fLog.Debug("Got queued envelope okay", "env", niceEnv(env))
+				if err := c.WS.SetWriteDeadline(
+					time.Now().Add(writeTimeout)); err != nil {
+					// Write error, move to disconnected state
+					fLog.Debug("Message deadline error", "err", err)
+					return false
+				}
+				if err := c.writeEnvelope(env); err != nil {
+					// Write error, move to disconnected state
+					fLog.Debug("Message write error", "err", err)
+					return false
+				}
 			}
 			// Send was okay
-			fLog.Debug("Sent okay")
+			fLog.Debug("Sent okay", "count", len(envs))
+			c.noteQueue()
 			if c.queue.Empty() {
 				fLog.Debug("Queue is empty; reselecting scenario")
 				return true
@@ -268,7 +943,8 @@ func (c *Client) connectedWithQueued() bool {
 // connectedNoneQueued is for processing messages from the hub when
 // the queue is empty. Returns when we're disconnected.
 func (c *Client) connectedNoneQueued() {
-	fLog := aLog.New("fn", "client.connectedNoneQueued", "id", c.ID, "c", c.Ref)
+	fLog := aLog.New("fn", "client.connectedNoneQueued",
+		"id", c.currentID(), "c", c.Ref)
 
 	// Keep receiving internal messages
 	for {
@@ -281,12 +957,25 @@ func (c *Client) connectedNoneQueued() {
 				fLog.Debug("Channel closed")
 				return
 			}
+			c.took(env)
 			if env.Intent == "BadLastnum" {
 				// This message is for us
 				fLog.Debug("Got BadLastnum intent")
-				c.closeWith("Bad lastnum", CloseBadLastnum)
+				c.closeWith(closeReason("Bad lastnum for ID ", env.You),
+					CloseBadLastnum)
+				return
+			}
+			if c.closeFor(env) {
+				// This message is for us
+				fLog.Debug("Closed for intent", "intent", env.Intent)
 				return
 			}
+			if env.Intent == "Resend" {
+				// This message is for us, but we've nothing queued
+				// that could be sent twice
+				fLog.Debug("Got Resend intent", "num", env.Num)
+				continue
+			}
 			// We should send this message
 			fLog.Debug("Got envelope", "env", niceEnv(env))
 			if err := c.WS.SetWriteDeadline(
@@ -295,12 +984,12 @@ func (c *Client) connectedNoneQueued() {
 				fLog.Debug("Deadline error", "err", err)
 				return
 			}
-			if err := c.WS.WriteJSON(env); err != nil {
+			if err := c.writeEnvelope(env); err != nil {
 				// Write error, move to disconnected state
-				fLog.Debug("WriteJSON error", "err", err)
+				fLog.Debug("Write error", "err", err)
 				return
 			}
-			fLog.Debug("Wrote JSON", "env", niceEnv(env))
+			fLog.Debug("Wrote envelope", "env", niceEnv(env))
 		case <-c.pinger.C:
 			fLog.Debug("Sending ping")
 			if err := c.WS.SetWriteDeadline(
@@ -319,15 +1008,113 @@ func (c *Client) connectedNoneQueued() {
 	}
 }
 
+// writeEnvelope sends an envelope to the client, encoded according to
+// the subprotocol agreed with it.
+func (c *Client) writeEnvelope(env *Envelope) error {
+	mType, bs, err := encodeEnvelope(env, c.Subprotocol)
+	if err != nil {
+		return err
+	}
+	if err := c.WS.WriteMessage(mType, bs); err != nil {
+		return err
+	}
+	atomic.AddInt64(&Counters.envelopesDelivered, 1)
+	return nil
+}
+
+// closeFor closes the connection if the envelope from the hub says
+// to, with the right code, and says if it did.
+func (c *Client) closeFor(env *Envelope) bool {
+	switch env.Intent {
+	case "Kicked":
+		c.closeWith("Kicked", CloseKicked)
+	case "Closed":
+		c.closeWith("Room closed", CloseRoomClosed)
+	case "IDTaken":
+		c.closeWith("ID taken", CloseIDTaken)
+	case "IdleClosed":
+		c.closeWith("Room idle", CloseIdle)
+	case "ClientIdle":
+		c.closeWith("Client idle", CloseClientIdle)
+	case "ForceClosed":
+		c.closeWith("Room closed by operator", CloseForceClosed)
+	case "Superseded":
+		c.closeWith("Superseded by reconnection", CloseSuperseded)
+	case "GoingAway":
+		c.closeWith("Server shutting down", CloseShutdown)
+	case "TooBig":
+		c.closeWith("Message too big", CloseTooBig)
+	default:
+		return false
+	}
+	return true
+}
+
 // closeWith closes the connection with the given error message and
 // and error code.
 func (c *Client) closeWith(desc string, code int) {
+	closeWebsocket(c.WS, desc, code)
+}
+
+// noteQueue records how far behind the client is with the envelopes
+// in its queue, and warns if it's fallen too far behind.
+func (c *Client) noteQueue() {
+	depth := c.queue.Len()
+	oldest := c.queue.Oldest()
+	atomic.StoreInt64(&c.queueDepth, int64(depth))
+	atomic.StoreInt64(&c.queueOldest, oldest)
+
+	age := int64(0)
+	if oldest > 0 {
+		age = nowMs() - oldest
+	}
+	lagging := depth >= laggingQueued || age >= laggingAge.Milliseconds()
+	if lagging && !c.lagging {
+		aLog.Warn("Client falling behind", "fn", "client.noteQueue",
+			"id", c.currentID(), "c", c.Ref, "queued", depth, "ageMs", age)
+	}
+	c.lagging = lagging
+}
+
+// took notes that the client has taken an envelope from Pending.
+func (c *Client) took(env *Envelope) {
+	atomic.AddInt64(&c.queuedBytes, -int64(len(env.Body)))
+}
+
+// closeSlow is a goroutine that closes the connection of a client
+// that's fallen too far behind. Its last write may still be stuck, so
+// we don't wait long to say why.
+func (c *Client) closeSlow() {
+	defer WG.Done()
 	c.WS.WriteControl(
+		websocket.CloseMessage,
+		websocket.FormatCloseMessage(CloseSlowConsumer, "Slow consumer"),
+		time.Now().Add(slowConsumerWait),
+	)
+	c.WS.Close()
+}
+
+// closeWebsocket closes a websocket with the given error message and
+// error code.
+func closeWebsocket(ws *websocket.Conn, desc string, code int) {
+	ws.WriteControl(
 		websocket.CloseMessage,
 		websocket.FormatCloseMessage(code, desc),
 		time.Now().Add(writeTimeout),
 	)
-	c.WS.Close()
+	ws.Close()
+}
+
+// closeReason gives the reason for closing a connection, which is
+// the description followed by as much of the ID as will fit in a
+// close message.
+func closeReason(desc string, id string) string {
+	reason := desc + id
+	for len(reason) > maxCloseReason {
+		_, size := utf8.DecodeLastRuneInString(reason)
+		reason = reason[:len(reason)-size]
+	}
+	return reason
 }
 
 func niceEnv(e *Envelope) string {
@@ -5,21 +5,25 @@
 package main
 
 import (
-	"github.com/gorilla/websocket"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"reflect"
 	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
 )
 
 func TestClient_CreatesNewID(t *testing.T) {
-	// Just for this test, lower the reconnectionTimeout so that a
+	// Just for this test, lower the reconnection timeout so that a
 	// Leaver message is triggered reasonably quickly.
-	oldReconnectionTimeout := reconnectionTimeout
-	reconnectionTimeout = 250 * time.Millisecond
-	defer func() {
-		reconnectionTimeout = oldReconnectionTimeout
-	}()
+	useSuperhub(t, 250*time.Millisecond)
 
 	serv := newTestServer(bounceHandler)
 	defer serv.Close()
@@ -36,7 +40,7 @@ func TestClient_CreatesNewID(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	clientID := env.To[0]
+	clientID := env.You
 	if clientID == "" {
 		t.Errorf("clientID cookie is empty or not defined")
 	}
@@ -46,15 +50,31 @@ func TestClient_CreatesNewID(t *testing.T) {
 	WG.Wait()
 }
 
+func TestClient_CloseReasonFitsInCloseMessage(t *testing.T) {
+	data := []struct {
+		id  string
+		exp string
+	}{
+		{"abc", "Bad lastnum for ID abc"},
+		{strings.Repeat("x", 200),
+			"Bad lastnum for ID " + strings.Repeat("x", maxCloseReason-19)},
+		{strings.Repeat("é", 100),
+			"Bad lastnum for ID " + strings.Repeat("é", (maxCloseReason-19)/2)},
+	}
+
+	for _, d := range data {
+		got := closeReason("Bad lastnum for ID ", d.id)
+		if got != d.exp || len(got) > maxCloseReason || !utf8.ValidString(got) {
+			t.Errorf("ID %q gave reason %q", d.id, got)
+		}
+	}
+}
+
 func TestClient_ReusesOldId(t *testing.T) {
-	// Just for this test, lower the reconnectionTimeout so that a
+	// Just for this test, lower the reconnection timeout so that a
 	// Leaver message is triggered reasonably quickly.
 
-	oldReconnectionTimeout := reconnectionTimeout
-	reconnectionTimeout = 250 * time.Millisecond
-	defer func() {
-		reconnectionTimeout = oldReconnectionTimeout
-	}()
+	useSuperhub(t, 250*time.Millisecond)
 
 	// Start a server
 	serv := newTestServer(bounceHandler)
@@ -73,7 +93,7 @@ func TestClient_ReusesOldId(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	clientID := env.To[0]
+	clientID := env.You
 	if clientID != initialClientID {
 		t.Errorf("clientID cookie: expected '%s', got '%s'",
 			clientID,
@@ -90,14 +110,10 @@ func TestClient_NewIDsAreDifferent(t *testing.T) {
 	cIDs := make([]string, 40)
 	twss := make([]*tConn, 40)
 
-	// Just for this test, lower the reconnectionTimeout so that a
+	// Just for this test, lower the reconnection timeout so that a
 	// Leaver message is triggered reasonably quickly.
 
-	oldReconnectionTimeout := reconnectionTimeout
-	reconnectionTimeout = 250 * time.Millisecond
-	defer func() {
-		reconnectionTimeout = oldReconnectionTimeout
-	}()
+	useSuperhub(t, 250*time.Millisecond)
 
 	// Start a server
 	serv := newTestServer(bounceHandler)
@@ -118,7 +134,7 @@ func TestClient_NewIDsAreDifferent(t *testing.T) {
 		if err != nil {
 			t.Fatal(err)
 		}
-		clientID := env.To[0]
+		clientID := env.You
 		cIDs[i] = clientID
 
 		if usedIDs[clientID] {
@@ -149,10 +165,9 @@ func TestClient_SendsPings(t *testing.T) {
 	pingFreq = 500 * time.Millisecond
 	pings := 0
 
-	// We'll also lower the reconnectionTimeout so that a
+	// We'll also lower the reconnection timeout so that a
 	// Leaver message is triggered reasonably quickly.
-	oldReconnectionTimeout := reconnectionTimeout
-	reconnectionTimeout = 250 * time.Millisecond
+	useSuperhub(t, 250*time.Millisecond)
 
 	// Start a server
 	serv := newTestServer(bounceHandler)
@@ -160,7 +175,6 @@ func TestClient_SendsPings(t *testing.T) {
 	// Make sure we tidy up after
 	defer func() {
 		pingFreq = oldPingFreq
-		reconnectionTimeout = oldReconnectionTimeout
 		serv.Close()
 	}()
 
@@ -219,15 +233,63 @@ func TestClient_SendsPings(t *testing.T) {
 	WG.Wait()
 }
 
+func TestClient_SendsPingsAsOftenAsAsked(t *testing.T) {
+	// Lower the reconnection timeout so that a Leaver message is
+	// triggered reasonably quickly.
+	useSuperhub(t, 250*time.Millisecond)
+
+	serv := newTestServer(bounceHandler)
+	defer serv.Close()
+
+	// Ask for pings every second, and wait for 3.5 seconds to receive
+	// at least three of them.
+	ws, _, err := dialWith(serv, "/cl.sends.pings.asked", "PINGASK", -1,
+		url.Values{"ping": {"1"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws := newTConn(ws, "PINGASK")
+	defer tws.close()
+
+	// The Welcome says how often to expect pings
+	env, err := tws.readEnvelope(500, "PINGASK expecting Welcome")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Intent != "Welcome" || env.Limits == nil ||
+		env.Limits.PingFreqMs != 1000 {
+		t.Errorf("PINGASK got unexpected envelope %#v", env)
+	}
+
+	// Count pings while reading, which is when they're handled, and
+	// answer them so we're not timed out. There should be no other
+	// messages.
+	pingC := make(chan bool, 10)
+	ws.SetPingHandler(func(data string) error {
+		pingC <- true
+		return ws.WriteControl(websocket.PongMessage, []byte(data),
+			time.Now().Add(time.Second))
+	})
+	if err := tws.expectNoMessage(3500); err != nil {
+		t.Error(err)
+	}
+	if len(pingC) < 3 {
+		t.Errorf("Expected at least 3 pings but got %d", len(pingC))
+	}
+
+	// Tidy up, and check everything in the main app finishes
+	tws.close()
+	WG.Wait()
+}
+
 func TestClient_DisconnectsIfNoPongs(t *testing.T) {
 	// Give the bounceHandler a very short pong timeout (just for this test)
 	oldPongTimeout := pongTimeout
 	pongTimeout = 500 * time.Millisecond
 
-	// Lower the reconnectionTimeout so that a
+	// Lower the reconnection timeout so that a
 	// Leaver message is triggered reasonably quickly.
-	oldReconnectionTimeout := reconnectionTimeout
-	reconnectionTimeout = 250 * time.Millisecond
+	useSuperhub(t, 250*time.Millisecond)
 
 	// Start a server
 	serv := newTestServer(bounceHandler)
@@ -235,7 +297,6 @@ func TestClient_DisconnectsIfNoPongs(t *testing.T) {
 	// Tidy up after
 	defer func() {
 		pongTimeout = oldPongTimeout
-		reconnectionTimeout = oldReconnectionTimeout
 		serv.Close()
 	}()
 
@@ -267,18 +328,69 @@ func TestClient_DisconnectsIfNoPongs(t *testing.T) {
 	WG.Wait()
 }
 
-func TestClient_NewClientWithBadLastnumGetsClosedWebsocket(t *testing.T) {
-	fLog := tLog.New("fn", "TestClient_NewClientWithBadLastnumGetsClosedWebsocket")
+func TestClient_WaitsForPongsAsLongAsAsked(t *testing.T) {
+	// Give the bounceHandler a very short pong timeout (just for this
+	// test), which the client will ask to be longer
+	oldPongTimeout := pongTimeout
+	pongTimeout = 500 * time.Millisecond
 
-	// Just for this test, lower the reconnectionTimeout so that a
+	// Lower the reconnection timeout so that a
 	// Leaver message is triggered reasonably quickly.
+	useSuperhub(t, 250*time.Millisecond)
 
-	oldReconnectionTimeout := reconnectionTimeout
-	reconnectionTimeout = 250 * time.Millisecond
+	// Start a server
+	serv := newTestServer(bounceHandler)
+
+	// Tidy up after
 	defer func() {
-		reconnectionTimeout = oldReconnectionTimeout
+		pongTimeout = oldPongTimeout
+		serv.Close()
 	}()
 
+	ws, _, err := dialWith(serv, "/cl.waits.for.pongs", "PONGASK", -1,
+		url.Values{"pong": {"2"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws := newTConn(ws, "PONGASK")
+	defer tws.close()
+
+	// The Welcome says how long the server will wait
+	env, err := tws.readEnvelope(500, "PONGASK expecting Welcome")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Intent != "Welcome" || env.Limits == nil ||
+		env.Limits.PongTimeoutMs != 2000 {
+		t.Errorf("PONGASK got unexpected envelope %#v", env)
+	}
+
+	// Well after the server's usual timeout we should still be
+	// connected, but then the peer should close.
+	if err := tws.expectNoMessage(1000); err != nil {
+		t.Error(err)
+	}
+	rr, timedOut := tws.readMessage(3000)
+	if timedOut {
+		t.Errorf("Too long waiting for peer to close")
+	}
+	if rr.err == nil {
+		t.Errorf("Wrongly got data from peer")
+	}
+
+	// Tidy up, and check everything in the main app finishes
+	ws.Close()
+	WG.Wait()
+}
+
+func TestClient_NewClientWithBadLastnumGetsClosedWebsocket(t *testing.T) {
+	fLog := tLog.New("fn", "TestClient_NewClientWithBadLastnumGetsClosedWebsocket")
+
+	// Just for this test, lower the reconnection timeout so that a
+	// Leaver message is triggered reasonably quickly.
+
+	useSuperhub(t, 250*time.Millisecond)
+
 	// Start a server
 	serv := newTestServer(bounceHandler)
 	defer serv.Close()
@@ -304,15 +416,141 @@ func TestClient_NewClientWithBadLastnumGetsClosedWebsocket(t *testing.T) {
 	WG.Wait()
 }
 
+func TestClient_EachFailureHasItsCloseCode(t *testing.T) {
+	// Just for this test, lower the reconnection timeout so that a
+	// Leaver message is triggered reasonably quickly, and let rooms
+	// go idle quickly. Only one room is left idle.
+	useSuperhub(t, 250*time.Millisecond)
+	oldIdleTimeout := idleTimeout
+	oldIdleGrace := idleGrace
+	oldIdleCheck := idleCheck
+	idleTimeout = 500 * time.Millisecond
+	idleGrace = 100 * time.Millisecond
+	idleCheck = 50 * time.Millisecond
+	defer func() {
+		idleTimeout = oldIdleTimeout
+		idleGrace = oldIdleGrace
+		idleCheck = oldIdleCheck
+	}()
+
+	serv := newTestServer(bounceHandler)
+	defer serv.Close()
+
+	// Each scenario connects what it needs in the given room, and gives
+	// the connection that should be closed. All connections are closed
+	// at the end of the scenario.
+
+	var twss []*tConn
+	connect := func(room string, id string, num int, params url.Values) *tConn {
+		ws, _, err := dialWith(serv, room, id, num, params, nil)
+		if err != nil {
+			t.Fatalf("Couldn't dial %s: %s", id, err)
+		}
+		tws := newTConn(ws, id)
+		twss = append(twss, tws)
+		return tws
+	}
+	write := func(tws *tConn, msg string) {
+		if err := tws.ws.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	welcomed := func(tws *tConn) int {
+		env, err := tws.readEnvelope(500, "%s expecting Welcome", tws.id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return env.Num
+	}
+
+	data := []struct {
+		desc  string
+		code  int
+		setup func(room string) *tConn
+	}{
+		{"Bad lastnum", CloseBadLastnum, func(room string) *tConn {
+			return connect(room, "CC1", 1029, nil)
+		}},
+		{"Bad version", CloseBadVersion, func(room string) *tConn {
+			return connect(room, "CC1", -1, url.Values{"version": {"99"}})
+		}},
+		{"Kicked", CloseKicked, func(room string) *tConn {
+			tws1 := connect(room, "CC1", -1, nil)
+			welcomed(tws1)
+			tws2 := connect(room, "CC2", -1, nil)
+			welcomed(tws2)
+			write(tws1, `{"intent":"Kick","id":"CC2"}`)
+			return tws2
+		}},
+		{"ID taken", CloseIDTaken, func(room string) *tConn {
+			tws1 := connect(room, "CC1", -1, url.Values{"strictid": {"on"}})
+			welcomed(tws1)
+			return connect(room, "CC1", -1, nil)
+		}},
+		{"Room full", CloseRoomFull, func(room string) *tConn {
+			tws1 := connect(room, "CC1", -1, url.Values{"maxclients": {"1"}})
+			welcomed(tws1)
+			return connect(room, "CC2", -1, nil)
+		}},
+		{"Superseded", CloseSuperseded, func(room string) *tConn {
+			tws1a := connect(room, "CC1", -1, nil)
+			num := welcomed(tws1a)
+			connect(room, "CC1", num, nil)
+			return tws1a
+		}},
+		{"Idle", CloseIdle, func(room string) *tConn {
+			return connect(room, "CC1", -1, nil)
+		}},
+		{"Shutdown", CloseShutdown, func(room string) *tConn {
+			tws1 := connect(room, "CC1", -1, nil)
+			welcomed(tws1)
+			Shub.Existing(room).post(&Message{Intent: "Shutdown"})
+			return tws1
+		}},
+		{"Too big", CloseTooBig, func(room string) *tConn {
+			tws1 := connect(room, "CC1", -1, url.Values{"maxmsg": {"10"}})
+			welcomed(tws1)
+			write(tws1, `"Far too long for this room"`)
+			return tws1
+		}},
+	}
+
+	for i, d := range data {
+		room := "/cl.close.codes." + strconv.Itoa(i)
+		twss = nil
+		tws := d.setup(room)
+
+		// Skip any envelopes until the connection's closed
+		for {
+			rr, timedOut := tws.readMessage(2000)
+			if timedOut {
+				t.Errorf("%s: Timed out waiting for close", d.desc)
+				break
+			}
+			if rr.err == nil {
+				continue
+			}
+			if !websocket.IsCloseError(rr.err, d.code) {
+				t.Errorf("%s: Expected close code %d but got %s",
+					d.desc, d.code, rr.err)
+			}
+			break
+		}
+
+		for _, tws := range twss {
+			tws.close()
+		}
+	}
+
+	// Check everything in the main app finishes
+	WG.Wait()
+}
+
 func TestClient_ExcessiveMessageWillCloseConnection(t *testing.T) {
-	// Just for this test, lower the reconnectionTimeout so that a
+	// Just for this test, lower the reconnection timeout so that a
 	// Leaver message is triggered reasonably quickly.
 
-	oldReconnectionTimeout := reconnectionTimeout
-	reconnectionTimeout = 250 * time.Millisecond
-	defer func() {
-		reconnectionTimeout = oldReconnectionTimeout
-	}()
+	useSuperhub(t, 250*time.Millisecond)
 
 	// Start a server
 	serv := newTestServer(bounceHandler)
@@ -338,6 +576,16 @@ func TestClient_ExcessiveMessageWillCloseConnection(t *testing.T) {
 		// We got an error, and that's probably okay
 	}
 
+	// We should be told what the limit is
+	env, err := tws.readEnvelope(500, "EXCESS1 expecting Error")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Intent != "Error" || env.Reason != "Message too big" ||
+		env.Limits == nil || env.Limits.MaxMessageBytes != readLimit {
+		t.Errorf("EXCESS1 got unexpected envelope %#v", env)
+	}
+
 	// Reading should tell us the connection has been closed by peer
 	rr, timedOut := tws.readMessage(500)
 	if timedOut {
@@ -360,3 +608,973 @@ func TestClient_ExcessiveMessageWillCloseConnection(t *testing.T) {
 	ws.Close()
 	WG.Wait()
 }
+
+func TestClient_RoomCanHaveLooserReadLimit(t *testing.T) {
+	// Just for this test, lower the reconnection timeout so that a
+	// Leaver message is triggered reasonably quickly.
+	useSuperhub(t, 250*time.Millisecond)
+
+	serv := newTestServer(bounceHandler)
+	defer serv.Close()
+
+	// A room created with a 200KB limit should take a 100KB message
+
+	params := url.Values{"maxmsg": {"200000"}}
+	ws, _, err := dialWith(serv, "/cl.maxmsg.loose", "MAXL", -1, params, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws := newTConn(ws, "MAXL")
+	defer tws.close()
+	env, err := tws.readEnvelope(500, "Expecting Welcome in loose room")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Limits == nil || env.Limits.MaxMessageBytes != 200000 {
+		t.Errorf("Got unexpected limits in loose room: %#v", env.Limits)
+	}
+
+	msg := []byte(`"` + strings.Repeat("a", 100*1024) + `"`)
+	if err := ws.WriteMessage(websocket.TextMessage, msg); err != nil {
+		t.Fatal(err)
+	}
+	env, err = tws.readEnvelope(500, "Expecting receipt in loose room")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !env.Receipt || string(env.Body) != string(msg) {
+		t.Errorf("Got unexpected envelope in loose room: %s", niceEnv(env))
+	}
+
+	// Tidy up, and check everything in the main app finishes
+	tws.close()
+	WG.Wait()
+}
+
+func TestClient_RoomCanHaveStricterReadLimit(t *testing.T) {
+	// Just for this test, lower the reconnection timeout so that a
+	// Leaver message is triggered reasonably quickly.
+	useSuperhub(t, 250*time.Millisecond)
+
+	serv := newTestServer(bounceHandler)
+	defer serv.Close()
+
+	msg := []byte(`"` + strings.Repeat("a", 2*1024) + `"`)
+
+	// A room with the default limit should take our message
+
+	ws, _, err := dial(serv, "/cl.maxmsg.default", "MAXDEF", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws := newTConn(ws, "MAXDEF")
+	defer tws.close()
+	if err := tws.swallow("Welcome"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ws.WriteMessage(websocket.TextMessage, msg); err != nil {
+		t.Fatal(err)
+	}
+	env, err := tws.readEnvelope(500, "Expecting receipt in default room")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !env.Receipt || string(env.Body) != string(msg) {
+		t.Errorf("Got unexpected envelope in default room: %s", niceEnv(env))
+	}
+	tws.close()
+
+	// A room created with a 1KB limit shouldn't take it, even if a
+	// later client asks for more
+
+	room := "/cl.maxmsg.strict"
+	params := url.Values{"maxmsg": {"1024"}}
+	ws1, _, err := dialWith(serv, room, "MAXS1", -1, params, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws1 := newTConn(ws1, "MAXS1")
+	defer tws1.close()
+	if err := tws1.swallow("Welcome"); err != nil {
+		t.Fatal(err)
+	}
+
+	params = url.Values{"maxmsg": {"100000"}}
+	ws2, _, err := dialWith(serv, room, "MAXS2", -1, params, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws2 := newTConn(ws2, "MAXS2")
+	defer tws2.close()
+	env, err = tws2.readEnvelope(500, "Expecting Welcome in strict room")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Limits == nil || env.Limits.MaxMessageBytes != 1024 ||
+		env.Limits.MaxChunkedBytes != 1024 {
+		t.Errorf("Got unexpected limits in strict room: %#v", env.Limits)
+	}
+
+	// Sending it in chunks should be no better
+
+	for i := 0; i < 2; i++ {
+		chunk := chunkMsg(t, "big", i, 2, string(msg[i*600:(i+1)*600]))
+		if err := ws2.WriteMessage(websocket.TextMessage, chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	env, err = tws2.readEnvelope(500, "Expecting Error in strict room")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Intent != "Error" || env.Reason != "Chunked message too large" {
+		t.Errorf("Got unexpected envelope in strict room: %#v", env)
+	}
+
+	// Sending it in one go should close the connection, after saying
+	// why
+
+	if err := ws2.WriteMessage(websocket.TextMessage, msg); err != nil {
+		t.Fatal(err)
+	}
+	env, err = tws2.readEnvelope(500, "Expecting too big Error in strict room")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Intent != "Error" || env.Reason != "Message too big" ||
+		env.Limits == nil || env.Limits.MaxMessageBytes != 1024 {
+		t.Errorf("Got unexpected too big envelope in strict room: %#v", env)
+	}
+	if err := tws2.expectClose(websocket.CloseMessageTooBig, 500); err != nil {
+		t.Error(err)
+	}
+
+	// Tidy up, and check everything in the main app finishes
+	tws1.close()
+	tws2.close()
+	WG.Wait()
+}
+
+func TestClient_NoSubprotocolOfferedGetsNone(t *testing.T) {
+	// Just for this test, lower the reconnection timeout so that a
+	// Leaver message is triggered reasonably quickly.
+	useSuperhub(t, 250*time.Millisecond)
+
+	serv := newTestServer(bounceHandler)
+	defer serv.Close()
+
+	ws, _, err := dial(serv, "/cl.subprotocol.none", "SPNONE", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws := newTConn(ws, "SPNONE")
+	defer tws.close()
+
+	if p := ws.Subprotocol(); p != "" {
+		t.Errorf("Expected no subprotocol but got '%s'", p)
+	}
+	if err := tws.swallow("Welcome"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Tidy up, and check everything in the main app finishes
+	tws.close()
+	WG.Wait()
+}
+
+func TestClient_SupportedSubprotocolIsSelected(t *testing.T) {
+	// Just for this test, lower the reconnection timeout so that a
+	// Leaver message is triggered reasonably quickly.
+	useSuperhub(t, 250*time.Millisecond)
+
+	serv := newTestServer(bounceHandler)
+	defer serv.Close()
+
+	header := http.Header{"Sec-Websocket-Protocol": {"bgf.json"}}
+	ws, _, err := dialWith(
+		serv, "/cl.subprotocol.supported", "SPSUP", -1, nil, header,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws := newTConn(ws, "SPSUP")
+	defer tws.close()
+
+	if p := ws.Subprotocol(); p != "bgf.json" {
+		t.Errorf("Expected subprotocol bgf.json but got '%s'", p)
+	}
+	if err := tws.swallow("Welcome"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Tidy up, and check everything in the main app finishes
+	tws.close()
+	WG.Wait()
+}
+
+func TestClient_MixedSubprotocolsSelectsSupportedOne(t *testing.T) {
+	// Just for this test, lower the reconnection timeout so that a
+	// Leaver message is triggered reasonably quickly.
+	useSuperhub(t, 250*time.Millisecond)
+
+	serv := newTestServer(bounceHandler)
+	defer serv.Close()
+
+	header := http.Header{"Sec-Websocket-Protocol": {"foo, bgf.json, bar"}}
+	ws, _, err := dialWith(
+		serv, "/cl.subprotocol.mixed", "SPMIX", -1, nil, header,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws := newTConn(ws, "SPMIX")
+	defer tws.close()
+
+	if p := ws.Subprotocol(); p != "bgf.json" {
+		t.Errorf("Expected subprotocol bgf.json but got '%s'", p)
+	}
+	if err := tws.swallow("Welcome"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Tidy up, and check everything in the main app finishes
+	tws.close()
+	WG.Wait()
+}
+
+func TestClient_UnsupportedSubprotocolsAreRejected(t *testing.T) {
+	serv := newTestServer(bounceHandler)
+	defer serv.Close()
+
+	header := http.Header{"Sec-Websocket-Protocol": {"foo, bar"}}
+	ws, resp, err := dialWith(
+		serv, "/cl.subprotocol.unsupported", "SPUNSUP", -1, nil, header,
+	)
+	if err == nil {
+		ws.Close()
+		t.Fatal("Expected error dialling, but didn't get one")
+	}
+	if resp == nil {
+		t.Fatal("Expected a response, but didn't get one")
+	}
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status %d but got %d",
+			http.StatusBadRequest, resp.StatusCode)
+	}
+
+	// The response should tell us what's supported
+	bs, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := struct {
+		Error     string
+		Supported []string
+	}{}
+	if err := json.Unmarshal(bs, &body); err != nil {
+		t.Fatalf("Couldn't unmarshal body '%s': %s", string(bs), err)
+	}
+	if !sameElements(body.Supported, subprotocols) {
+		t.Errorf("Expected supported %v but got %v",
+			subprotocols, body.Supported)
+	}
+
+	// The room shouldn't have been created
+	WG.Wait()
+	if count := Shub.Count(); count != 0 {
+		t.Errorf("Expected no hubs in superhub, got %d", count)
+	}
+}
+
+func TestClient_BadLastnumIsRejected(t *testing.T) {
+	serv := newTestServer(bounceHandler)
+	defer serv.Close()
+
+	for _, ln := range []string{"x", "-5", "99999999999999999999999"} {
+		params := url.Values{"lastnum": {ln}}
+		ws, resp, err := dialWith(
+			serv, "/cl.lastnum.bad", "LNBAD", -1, params, nil,
+		)
+		if err == nil {
+			ws.Close()
+			t.Fatalf("Lastnum %s: Expected error dialling, but didn't get one",
+				ln)
+		}
+		if resp == nil {
+			t.Fatalf("Lastnum %s: Expected a response, but didn't get one", ln)
+		}
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("Lastnum %s: Expected status %d but got %d",
+				ln, http.StatusBadRequest, resp.StatusCode)
+		}
+	}
+
+	// The room shouldn't have been created
+	WG.Wait()
+	if count := Shub.Count(); count != 0 {
+		t.Errorf("Expected no hubs in superhub, got %d", count)
+	}
+}
+
+func TestClient_WelcomeGivesVersionWhenNoneRequested(t *testing.T) {
+	// Just for this test, lower the reconnection timeout so that a
+	// Leaver message is triggered reasonably quickly.
+	useSuperhub(t, 250*time.Millisecond)
+
+	serv := newTestServer(bounceHandler)
+	defer serv.Close()
+
+	ws, _, err := dial(serv, "/cl.version.absent", "VERABS", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws := newTConn(ws, "VERABS")
+	defer tws.close()
+
+	env, err := tws.readEnvelope(500, "Expecting Welcome")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Intent != "Welcome" {
+		t.Errorf("Expected Welcome but got %s", env.Intent)
+	}
+	if env.Version != ProtocolVersion {
+		t.Errorf("Expected version %d but got %d", ProtocolVersion, env.Version)
+	}
+
+	// Tidy up, and check everything in the main app finishes
+	tws.close()
+	WG.Wait()
+}
+
+func TestClient_SupportedVersionIsWelcomed(t *testing.T) {
+	// Just for this test, lower the reconnection timeout so that a
+	// Leaver message is triggered reasonably quickly.
+	useSuperhub(t, 250*time.Millisecond)
+
+	serv := newTestServer(bounceHandler)
+	defer serv.Close()
+
+	params := url.Values{"version": {strconv.Itoa(ProtocolVersion)}}
+	ws, _, err := dialWith(serv, "/cl.version.ok", "VEROK", -1, params, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws := newTConn(ws, "VEROK")
+	defer tws.close()
+
+	env, err := tws.readEnvelope(500, "Expecting Welcome")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Intent != "Welcome" {
+		t.Errorf("Expected Welcome but got %s", env.Intent)
+	}
+	if env.Version != ProtocolVersion {
+		t.Errorf("Expected version %d but got %d", ProtocolVersion, env.Version)
+	}
+
+	// Tidy up, and check everything in the main app finishes
+	tws.close()
+	WG.Wait()
+}
+
+func TestClient_UnsupportedVersionGetsClosedWebsocket(t *testing.T) {
+	// Just for this test, lower the reconnection timeout so that a
+	// Leaver message is triggered reasonably quickly.
+	useSuperhub(t, 250*time.Millisecond)
+
+	serv := newTestServer(bounceHandler)
+	defer serv.Close()
+
+	room := "/cl.version.bad"
+
+	// One client is already in the room
+	ws1, _, err := dial(serv, room, "VERBAD1", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws1 := newTConn(ws1, "VERBAD1")
+	defer tws1.close()
+	if err := tws1.swallow("Welcome"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Try both a version we don't know and something that's not a version
+	for _, ver := range []string{strconv.Itoa(ProtocolVersion + 1), "x"} {
+		params := url.Values{"version": {ver}}
+		ws2, _, err := dialWith(serv, room, "VERBAD2", -1, params, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tws2 := newTConn(ws2, "VERBAD2")
+		if err := tws2.expectClose(CloseBadVersion, 500); err != nil {
+			t.Errorf("Version %s: %s", ver, err)
+		}
+		tws2.close()
+	}
+
+	// The client already there shouldn't have heard about it
+	if err := tws1.expectNoMessage(500); err != nil {
+		t.Error(err)
+	}
+
+	// Tidy up, and check everything in the main app finishes
+	tws1.close()
+	WG.Wait()
+}
+
+func TestClient_RoomPasswordMustMatch(t *testing.T) {
+	// Just for this test, lower the reconnection timeout so that a
+	// Leaver message is triggered reasonably quickly.
+	useSuperhub(t, 250*time.Millisecond)
+
+	serv := newTestServer(bounceHandler)
+	defer serv.Close()
+
+	// Create one room with a password and one without. The password
+	// shouldn't be sent back.
+
+	ws1, _, err := dialWith(serv, "/cl.pass", "PW1", -1,
+		url.Values{"pass": {"sesame"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws1 := newTConn(ws1, "PW1")
+	defer tws1.close()
+	rr, timedOut := tws1.readMessage(500)
+	if timedOut || rr.err != nil {
+		t.Fatalf("PW1 couldn't read Welcome: timed out %v, error %v",
+			timedOut, rr.err)
+	}
+	if strings.Contains(string(rr.msg), "sesame") {
+		t.Errorf("PW1 Welcome gave away the password: %s", string(rr.msg))
+	}
+
+	ws2, _, err := dial(serv, "/cl.nopass", "NP1", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws2 := newTConn(ws2, "NP1")
+	defer tws2.close()
+	if err := tws2.swallow("Welcome"); err != nil {
+		t.Fatalf("Welcome error for NP1: %s", err)
+	}
+
+	// Anyone joining must give the same password, or none if the
+	// room has none. That includes reconnecting.
+
+	data := []struct {
+		room string
+		id   string
+		num  int
+		pass string // Empty if none given
+		ok   bool
+	}{
+		{"/cl.pass", "PW2", -1, "", false},
+		{"/cl.pass", "PW3", -1, "wrong", false},
+		{"/cl.pass", "PW1", 0, "", false},
+		{"/cl.pass", "PW4", -1, "sesame", true},
+		{"/cl.nopass", "NP2", -1, "sesame", false},
+		{"/cl.nopass", "NP3", -1, "", true},
+	}
+
+	for _, d := range data {
+		var params url.Values
+		if d.pass != "" {
+			params = url.Values{"pass": {d.pass}}
+		}
+		ws, resp, err := dialWith(serv, d.room, d.id, d.num, params, nil)
+		if d.ok {
+			if err != nil {
+				t.Errorf("%s with pass '%s' got error %s", d.id, d.pass, err)
+				continue
+			}
+			ws.Close()
+			continue
+		}
+		if err == nil {
+			ws.Close()
+			t.Errorf("%s with pass '%s' should have been rejected",
+				d.id, d.pass)
+			continue
+		}
+		if resp == nil || resp.StatusCode != http.StatusForbidden {
+			t.Errorf("%s with pass '%s' expected 403 but got %v",
+				d.id, d.pass, resp)
+		}
+	}
+
+	// Tidy up, and check everything in the main app finishes
+	tws1.close()
+	tws2.close()
+	WG.Wait()
+}
+
+func TestClient_ParseControlRecognisesControlMessages(t *testing.T) {
+	data := []struct {
+		msg    string
+		intent string // Empty if we expect no control message
+		token  string
+		body   string
+	}{
+		{`{"intent":"Goodbye"}`, "Goodbye", "", ""},
+		{` {"intent": "Goodbye", "extra": [1, 2]} `, "Goodbye", "", ""},
+		{`{"intent":"Time"}`, "Time", "", ""},
+		{`{"intent":"Time","token":"t1"}`, "Time", "t1", ""},
+		{`{"intent":"Time","body":[1]}`, "Time", "", ""},
+		{`{"intent":"Stats","token":"s1"}`, "Stats", "s1", ""},
+		{`{"intent":"Roster","token":"r1"}`, "Roster", "r1", ""},
+		{`{"intent":"Echo","body":{"ping":3}}`, "Echo", "", `{"ping":3}`},
+		{`{"intent":"Echo"}`, "Echo", "", ""},
+		{`{"intent":"Chunk","token":"m1","index":0,"count":2,"body":"{\"a"}`,
+			"Chunk", "m1", `{"a`},
+		{`{"intent":"Replay","num":3,"token":"r1"}`, "Replay", "r1", ""},
+		{`{"intent":"Reassign","id":"b","as":"a","token":"x"}`,
+			"Reassign", "x", ""},
+		{`{"intent":"Kick","id":"b"}`, "Kick", "", ""},
+		{`{"intent":"CreateSpectatorLink","token":"s"}`,
+			"CreateSpectatorLink", "s", ""},
+		{`{"intent":"Reseed","token":"r"}`, "Reseed", "r", ""},
+		{`{"intent":"Roll","sides":6,"count":2}`, "Roll", "", ""},
+		{`{"intent":"SetTurn","id":"b"}`, "SetTurn", "", ""},
+		{`{"intent":"SetTurn","id":""}`, "SetTurn", "", ""},
+		{`{"intent":"PassTurn","token":"p"}`, "PassTurn", "p", ""},
+		{`{"intent":"Pause"}`, "Pause", "", ""},
+		{`{"intent":"Resume"}`, "Resume", "", ""},
+		{`{"intent":"SetState","key":"k","value":{"a":1}}`,
+			"SetState", "", `{"a":1}`},
+		{`{"intent":"SetState","key":"k","value":null,"token":"d"}`,
+			"SetState", "d", "null"},
+		{`{"intent":"Rename","name":" Bob\n","token":"n1"}`, "Rename", "n1", ""},
+		{`{"intent":"Rename","name":""}`, "Rename", "", ""},
+		{`{"move":"e4"}`, "", "", ""},
+		{`{"receipt":false,"body":{"intent":"Peer"}}`, "", "", ""},
+		{`{"intent":`, "", "", ""},
+		{`"Time"`, "", "", ""},
+		{`Hello`, "", "", ""},
+	}
+
+	for _, d := range data {
+		ctrl, err := parseControl([]byte(d.msg))
+		if err != nil {
+			t.Errorf("Message %s gave error %s", d.msg, err)
+			continue
+		}
+		if d.intent == "" {
+			if ctrl != nil {
+				t.Errorf("Message %s gave control %#v", d.msg, ctrl)
+			}
+			continue
+		}
+		if ctrl == nil {
+			t.Errorf("Message %s gave no control", d.msg)
+			continue
+		}
+		if ctrl.Intent != d.intent || ctrl.Token != d.token ||
+			string(ctrl.Body) != d.body {
+			t.Errorf("Message %s gave control %#v", d.msg, ctrl)
+		}
+	}
+}
+
+func TestClient_ParseControlRejectsBadStructuredMessages(t *testing.T) {
+	data := []struct {
+		msg   string
+		token string
+		err   string
+	}{
+		{`{"intent":"Peer","token":"t1"}`, "t1", "Unknown intent"},
+		{`{"intent":"goodbye"}`, "", "Unknown intent"},
+		{`{"intent":null}`, "", "Unknown intent"},
+		{`{"intent":1,"token":"t2"}`, "t2", "Bad intent"},
+		{`{"intent":"Time","token":17}`, "", "Bad token"},
+		{`{"intent":"Chunk","token":"m1","count":1,"body":"a"}`, "m1", "Bad chunk"},
+		{`{"intent":"Chunk","token":"m1","index":0,"count":1,"body":1}`,
+			"m1", "Bad chunk"},
+		{`{"intent":"Replay"}`, "", "Bad replay"},
+		{`{"intent":"Replay","num":-1}`, "", "Bad replay"},
+		{`{"intent":"Replay","num":"3","token":"r2"}`, "r2", "Bad replay"},
+		{`{"intent":"Reassign","id":"b"}`, "", "Bad reassign"},
+		{`{"intent":"Reassign","id":"","as":"a"}`, "", "Bad reassign"},
+		{`{"intent":"Reassign","id":"b","as":7,"token":"x"}`,
+			"x", "Bad reassign"},
+		{`{"intent":"Kick","token":"k1"}`, "k1", "Bad kick"},
+		{`{"intent":"Kick","id":""}`, "", "Bad kick"},
+		{`{"intent":"SetState","key":"k","token":"s1"}`, "s1", "Bad state"},
+		{`{"intent":"SetState","key":"","value":1}`, "", "Bad state"},
+		{`{"intent":"SetState","key":3,"value":1}`, "", "Bad state"},
+		{`{"intent":"Roll","sides":6,"token":"d1"}`, "d1", "Bad roll"},
+		{`{"intent":"Roll","sides":1,"count":2}`, "", "Bad roll"},
+		{`{"intent":"Roll","sides":6,"count":0}`, "", "Bad roll"},
+		{`{"intent":"Roll","sides":1001,"count":1}`, "", "Bad roll"},
+		{`{"intent":"Roll","sides":6,"count":101}`, "", "Bad roll"},
+		{`{"intent":"Roll","sides":"6","count":1}`, "", "Bad roll"},
+		{`{"intent":"SetTurn","token":"t1"}`, "t1", "Bad turn"},
+		{`{"intent":"SetTurn","id":4}`, "", "Bad turn"},
+		{`{"intent":"Rename","token":"n1"}`, "n1", "Bad name"},
+		{`{"intent":"Rename","name":7}`, "", "Bad name"},
+		{`{"intent":"Rename","name":"` + strings.Repeat("x", maxNameLength+1) +
+			`"}`, "", "Bad name"},
+	}
+
+	for _, d := range data {
+		ctrl, err := parseControl([]byte(d.msg))
+		if err == nil {
+			t.Errorf("Message %s gave no error but control %#v", d.msg, ctrl)
+			continue
+		}
+		if err.Error() != d.err || ctrl.Token != d.token {
+			t.Errorf("Message %s gave error '%s' and control %#v",
+				d.msg, err, ctrl)
+		}
+	}
+}
+
+func FuzzParseControl(f *testing.F) {
+	f.Add([]byte(`{"intent":"Goodbye"}`))
+	f.Add([]byte(` {"intent": "Goodbye", "extra": [1, 2]} `))
+	f.Add([]byte(`{"intent":"Time","token":"abc"}`))
+	f.Add([]byte(`{"intent":"Echo","body":[1,2]}`))
+	f.Add([]byte(`{"intent":"Chunk","token":"m","index":0,"count":2,"body":"ab"}`))
+	f.Add([]byte(`{"intent":"Peer"}`))
+	f.Add([]byte(`{"intent":`))
+	f.Add([]byte("Hello"))
+	f.Add([]byte{0xff, 0x00})
+
+	f.Fuzz(func(t *testing.T, msg []byte) {
+		ctrl, err := parseControl(msg)
+
+		// It should only ever recognise what we know, the same way
+		// every time
+		if err == nil && ctrl != nil && !controlIntents[ctrl.Intent] {
+			t.Errorf("Message %q gave intent %q", msg, ctrl.Intent)
+		}
+		ctrl2, err2 := parseControl(msg)
+		if (err == nil) != (err2 == nil) ||
+			(err != nil && err.Error() != err2.Error()) {
+			t.Errorf("Message %q gave errors %v then %v", msg, err, err2)
+		}
+		if (ctrl == nil) != (ctrl2 == nil) ||
+			(ctrl != nil && !reflect.DeepEqual(ctrl, ctrl2)) {
+			t.Errorf("Message %q gave control %#v then %#v", msg, ctrl, ctrl2)
+		}
+
+		// Only a JSON object can be a structured message, and any error
+		// still gives a control for the token
+		if (ctrl != nil || err != nil) && !json.Valid(msg) {
+			t.Errorf("Invalid JSON %q gave control %#v, error %v",
+				msg, ctrl, err)
+		}
+		if err != nil && ctrl == nil {
+			t.Errorf("Message %q gave error %v but no control", msg, err)
+		}
+		if err == nil && ctrl != nil && ctrl.Intent == "Echo" &&
+			ctrl.Body != nil && !json.Valid(ctrl.Body) {
+			t.Errorf("Message %q gave invalid body %q", msg, ctrl.Body)
+		}
+	})
+}
+
+func TestClient_LargeCompressedMessageArrivesIntact(t *testing.T) {
+	// Just for this test, lower the reconnection timeout so that a
+	// Leaver message is triggered reasonably quickly.
+	useSuperhub(t, 250*time.Millisecond)
+
+	serv := newTestServer(bounceHandler)
+	defer serv.Close()
+
+	room := "/cl.compress.large"
+
+	// Connect two clients, both compressing
+
+	ws1, resp, err := dialCompressed(serv, room, "CMP1", -1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ext := resp.Header.Get("Sec-Websocket-Extensions"); !strings.Contains(
+		ext, "permessage-deflate") {
+		t.Errorf("Compression not agreed, extensions are '%s'", ext)
+	}
+	tws1 := newTConn(ws1, "CMP1")
+	defer tws1.close()
+	if err := tws1.swallow("Welcome"); err != nil {
+		t.Fatal(err)
+	}
+
+	ws2, _, err := dialCompressed(serv, room, "CMP2", -1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws2 := newTConn(ws2, "CMP2")
+	defer tws2.close()
+	if err = swallowMany(
+		intentExp{"CMP2 joining, ws2", tws2, "Welcome"},
+		intentExp{"CMP2 joining, ws1", tws1, "Joiner"},
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	// Send a large, repetitive message just within the read limit
+
+	square := `{"piece":"pawn","square":"e4"},`
+	msg := strings.Repeat(square, readLimit/len(square))
+	if err := ws1.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+
+	env, err := tws2.readEnvelope(500, "ws2 expecting Peer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Intent != "Peer" {
+		t.Errorf("Expected Peer but got %s", env.Intent)
+	}
+	if string(env.Body) != msg {
+		t.Errorf("Body of length %d didn't match what was sent, length %d",
+			len(env.Body), len(msg))
+	}
+
+	// Tidy up, and check everything in the main app finishes
+	tws1.close()
+	tws2.close()
+	WG.Wait()
+}
+
+func TestClient_NoCompressionIfClientOptsOut(t *testing.T) {
+	// Just for this test, lower the reconnection timeout so that a
+	// Leaver message is triggered reasonably quickly.
+	useSuperhub(t, 250*time.Millisecond)
+
+	serv := newTestServer(bounceHandler)
+	defer serv.Close()
+
+	params := url.Values{"compress": {"0"}}
+	ws, resp, err := dialCompressed(
+		serv, "/cl.compress.optout", "CMPOUT", -1, params,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ext := resp.Header.Get("Sec-Websocket-Extensions"); ext != "" {
+		t.Errorf("Expected no extensions, but got '%s'", ext)
+	}
+	tws := newTConn(ws, "CMPOUT")
+	defer tws.close()
+	if err := tws.swallow("Welcome"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Tidy up, and check everything in the main app finishes
+	tws.close()
+	WG.Wait()
+}
+
+func TestClient_ReadLimitAppliesAfterDecompression(t *testing.T) {
+	// Just for this test, lower the reconnection timeout so that a
+	// Leaver message is triggered reasonably quickly.
+	useSuperhub(t, 250*time.Millisecond)
+
+	serv := newTestServer(bounceHandler)
+	defer serv.Close()
+
+	room := "/cl.compress.limit"
+
+	// Connect two clients, the first compressing
+
+	ws1, _, err := dialCompressed(serv, room, "LIM1", -1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws1 := newTConn(ws1, "LIM1")
+	defer tws1.close()
+	if err := tws1.swallow("Welcome"); err != nil {
+		t.Fatal(err)
+	}
+
+	ws2, _, err := dial(serv, room, "LIM2", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws2 := newTConn(ws2, "LIM2")
+	defer tws2.close()
+	if err = swallowMany(
+		intentExp{"LIM2 joining, ws2", tws2, "Welcome"},
+		intentExp{"LIM2 joining, ws1", tws1, "Joiner"},
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	// Send a message that's small when compressed, but too big when not.
+	// The sender should be told, then closed, and the other client should
+	// only see it leave.
+
+	msg := strings.Repeat("a", 4*readLimit)
+	if err := ws1.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tws1.swallow("Error"); err != nil {
+		t.Error(err)
+	}
+	if err := tws1.expectClose(websocket.CloseMessageTooBig, 500); err != nil {
+		t.Error(err)
+	}
+	if err := tws2.swallow("Away"); err != nil {
+		t.Error(err)
+	}
+	if err := tws2.swallow("Leaver"); err != nil {
+		t.Error(err)
+	}
+
+	// Tidy up, and check everything in the main app finishes
+	tws1.close()
+	tws2.close()
+	WG.Wait()
+}
+
+func TestClient_UnwrapsOnlyReceiptWrappers(t *testing.T) {
+	data := []struct {
+		msg     string
+		body    string
+		receipt bool
+		tag     string
+		ttl     int64
+		ok      bool
+	}{
+		{`{"receipt": false, "body": {"move": "e4"}}`, `{"move": "e4"}`, false, "", 0, true},
+		{` {"body":[1,2],"receipt":true} `, `[1,2]`, true, "", 0, true},
+		{`{"receipt":false,"body":"Hello"}`, `"Hello"`, false, "", 0, true},
+		{`{"tag":"m1","body":"Hello"}`, `"Hello"`, true, "m1", 0, true},
+		{`{"tag":"m2","receipt":false,"body":3}`, `3`, false, "m2", 0, true},
+		{`{"ttl":500,"body":3}`, `3`, true, "", 500, true},
+		{`{"ttl":0,"body":3}`, "", false, "", 0, false},
+		{`{"ttl":"500","body":3}`, "", false, "", 0, false},
+		{`{"receipt":false}`, "", false, "", 0, false},
+		{`{"tag":"m3"}`, "", false, "", 0, false},
+		{`{"body":"Hello"}`, "", false, "", 0, false},
+		{`{"receipt":false,"body":1,"other":2}`, "", false, "", 0, false},
+		{`{"tag":"m4","body":1,"other":2}`, "", false, "", 0, false},
+		{`{"receipt":"no","body":1}`, "", false, "", 0, false},
+		{`{"receipt":null,"body":1}`, "", false, "", 0, false},
+		{`{"tag":5,"body":1}`, "", false, "", 0, false},
+		{`{"tag":null,"body":1}`, "", false, "", 0, false},
+		{`{"receipt":false,"body":`, "", false, "", 0, false},
+		{`[{"receipt":false,"body":1}]`, "", false, "", 0, false},
+		{`Hello`, "", false, "", 0, false},
+		{``, "", false, "", 0, false},
+	}
+
+	for _, d := range data {
+		w := unwrap([]byte(d.msg))
+		if (w != nil) != d.ok {
+			t.Errorf("Message '%s' gave wrapped %#v", d.msg, w)
+			continue
+		}
+		if w == nil {
+			continue
+		}
+		if string(w.Body) != d.body || w.Receipt != d.receipt ||
+			w.Tag != d.tag || w.TTL != d.ttl {
+			t.Errorf("Message '%s' gave body '%s', receipt %v, tag '%s' and ttl %d",
+				d.msg, string(w.Body), w.Receipt, w.Tag, w.TTL)
+		}
+	}
+}
+
+func TestClient_TooManyMessagesAreDroppedThenClosed(t *testing.T) {
+	// Just for this test, lower the reconnection timeout so that a
+	// Leaver message is triggered reasonably quickly, and only allow
+	// a few messages
+	useSuperhub(t, 250*time.Millisecond)
+	oldMsgRate := msgRate
+	oldMsgBurst := msgBurst
+	oldMsgAbuseLimit := msgAbuseLimit
+	msgRate = 0.1
+	msgBurst = 3
+	msgAbuseLimit = 3
+	defer func() {
+		msgRate = oldMsgRate
+		msgBurst = oldMsgBurst
+		msgAbuseLimit = oldMsgAbuseLimit
+	}()
+
+	serv := newTestServer(bounceHandler)
+	defer serv.Close()
+
+	room := "/cl.rate.limit"
+
+	// Connect two clients
+
+	ws1, _, err := dial(serv, room, "RATE1", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws1 := newTConn(ws1, "RATE1")
+	defer tws1.close()
+	if err := tws1.swallow("Welcome"); err != nil {
+		t.Fatal(err)
+	}
+
+	ws2, _, err := dial(serv, room, "RATE2", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws2 := newTConn(ws2, "RATE2")
+	defer tws2.close()
+	if err = swallowMany(
+		intentExp{"RATE2 joining, ws2", tws2, "Welcome"},
+		intentExp{"RATE2 joining, ws1", tws1, "Joiner"},
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first client sends one message more than it's allowed. The
+	// others get through, but the last one just gets an error.
+
+	for i := 0; i < 4; i++ {
+		msg := []byte("RATE-MSG-" + strconv.Itoa(i))
+		if err := ws1.WriteMessage(websocket.BinaryMessage, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		if err = swallowMany(
+			intentExp{"Peer msg, ws1", tws1, "Peer"},
+			intentExp{"Peer msg, ws2", tws2, "Peer"},
+		); err != nil {
+			t.Fatal(err)
+		}
+	}
+	env, err := tws1.readEnvelope(500, "RATE1 expecting Error")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Intent != "Error" || env.Reason != "Too many messages" {
+		t.Errorf("RATE1 got unexpected envelope: %#v", env)
+	}
+	if err := tws2.expectNoMessage(200); err != nil {
+		t.Error(err)
+	}
+
+	// If it carries on it gets closed, and the other client sees it leave
+
+	for i := 0; i < 3; i++ {
+		if err := ws1.WriteMessage(websocket.BinaryMessage, []byte("More")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tws1.expectClose(websocket.ClosePolicyViolation, 500); err != nil {
+		t.Error(err)
+	}
+	if err := tws2.swallow("Away"); err != nil {
+		t.Error(err)
+	}
+	if err := tws2.swallow("Leaver"); err != nil {
+		t.Error(err)
+	}
+
+	// Tidy up, and check everything in the main app finishes
+	tws1.close()
+	tws2.close()
+	WG.Wait()
+}
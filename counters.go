@@ -0,0 +1,70 @@
+// Copyright 2020 Nik Silver
+//
+// Licensed under the GPL v3.0. See file LICENCE.txt for details.
+
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Global counts of what the server's doing, since it started
+var Counters = NewServerCounters()
+
+// ServerCounters counts connections, messages and rooms across the
+// whole server. Everything's atomic, so any goroutine can add to them
+// without waiting.
+type ServerCounters struct {
+	upgradesAccepted   int64
+	peersRelayed       int64
+	envelopesDelivered int64
+	bytesRelayed       int64
+	activeRooms        int64
+	activeClients      int64
+	upgradesRejected   sync.Map // Reason to *int64
+}
+
+// CounterSnapshot is what the server counters were at some moment.
+type CounterSnapshot struct {
+	UpgradesAccepted   int64            // Clients given a websocket
+	UpgradesRejected   map[string]int64 // Clients refused, by reason
+	PeersRelayed       int64            // Peer messages from clients or services
+	EnvelopesDelivered int64            // Envelopes written to clients
+	BytesRelayed       int64            // Bytes in the Peer message bodies
+	ActiveRooms        int64            // Hubs running now
+	ActiveClients      int64            // Clients connected now
+}
+
+// NewServerCounters creates counters with nothing counted.
+func NewServerCounters() *ServerCounters {
+	return &ServerCounters{}
+}
+
+// rejected counts one client refused a connection for the given reason.
+func (sc *ServerCounters) rejected(reason string) {
+	n, ok := sc.upgradesRejected.Load(reason)
+	if !ok {
+		n, _ = sc.upgradesRejected.LoadOrStore(reason, new(int64))
+	}
+	atomic.AddInt64(n.(*int64), 1)
+}
+
+// Snapshot gives what the counters are now. Each count is read
+// separately, so they may be very slightly out of step.
+func (sc *ServerCounters) Snapshot() *CounterSnapshot {
+	snap := &CounterSnapshot{
+		UpgradesAccepted:   atomic.LoadInt64(&sc.upgradesAccepted),
+		UpgradesRejected:   make(map[string]int64),
+		PeersRelayed:       atomic.LoadInt64(&sc.peersRelayed),
+		EnvelopesDelivered: atomic.LoadInt64(&sc.envelopesDelivered),
+		BytesRelayed:       atomic.LoadInt64(&sc.bytesRelayed),
+		ActiveRooms:        atomic.LoadInt64(&sc.activeRooms),
+		ActiveClients:      atomic.LoadInt64(&sc.activeClients),
+	}
+	sc.upgradesRejected.Range(func(reason, n interface{}) bool {
+		snap.UpgradesRejected[reason.(string)] = atomic.LoadInt64(n.(*int64))
+		return true
+	})
+	return snap
+}
@@ -0,0 +1,105 @@
+// Copyright 2020 Nik Silver
+//
+// Licensed under the GPL v3.0. See file LICENCE.txt for details.
+
+package main
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestCounters_CountConnectionsMessagesAndRooms(t *testing.T) {
+	// Just for this test, lower the reconnection timeout so that the
+	// room closes reasonably quickly
+	useSuperhub(t, 250*time.Millisecond)
+
+	serv := newTestServer(bounceHandler)
+	defer serv.Close()
+	before := Counters.Snapshot()
+
+	// One client is rejected, and two join a room
+
+	params := url.Values{"lastnum": {"x"}}
+	ws, _, err := dialWith(serv, "/cnt.room", "CNT0", -1, params, nil)
+	if err == nil {
+		ws.Close()
+		t.Fatal("Expected error dialling with bad lastnum")
+	}
+	ws1, _, err := dial(serv, "/cnt.room", "CNT1", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws1 := newTConn(ws1, "CNT1")
+	defer tws1.close()
+	if err := tws1.swallow("Welcome"); err != nil {
+		t.Fatal(err)
+	}
+	ws2, _, err := dial(serv, "/cnt.room", "CNT2", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws2 := newTConn(ws2, "CNT2")
+	defer tws2.close()
+	if err = swallowMany(
+		intentExp{"CNT2 joining, ws2", tws2, "Welcome"},
+		intentExp{"CNT2 joining, ws1", tws1, "Joiner"},
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	during := Counters.Snapshot()
+	if n := during.UpgradesAccepted - before.UpgradesAccepted; n != 2 {
+		t.Errorf("Expected 2 more upgrades accepted, got %d", n)
+	}
+	if n := during.UpgradesRejected[REJECTBADPARAMS] -
+		before.UpgradesRejected[REJECTBADPARAMS]; n != 1 {
+		t.Errorf("Expected 1 more bad params rejection, got %d", n)
+	}
+	if n := during.ActiveRooms - before.ActiveRooms; n != 1 {
+		t.Errorf("Expected 1 more active room, got %d", n)
+	}
+	if n := during.ActiveClients - before.ActiveClients; n != 2 {
+		t.Errorf("Expected 2 more active clients, got %d", n)
+	}
+
+	// One client sends a message to the other
+
+	body := []byte(`"hello"`)
+	if err := ws1.WriteMessage(websocket.TextMessage, body); err != nil {
+		t.Fatal(err)
+	}
+	if err = swallowMany(
+		intentExp{"CNT1 sending, ws1", tws1, "Peer"},
+		intentExp{"CNT1 sending, ws2", tws2, "Peer"},
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	// Tidy up, and once everything in the main app finishes the
+	// messages are counted and nothing's active
+
+	tws1.close()
+	tws2.close()
+	WG.Wait()
+
+	after := Counters.Snapshot()
+	if n := after.PeersRelayed - before.PeersRelayed; n != 1 {
+		t.Errorf("Expected 1 more peer message relayed, got %d", n)
+	}
+	if n := after.BytesRelayed - before.BytesRelayed; n != int64(len(body)) {
+		t.Errorf("Expected %d more bytes relayed, got %d", len(body), n)
+	}
+	if n := after.EnvelopesDelivered - before.EnvelopesDelivered; n < 5 {
+		t.Errorf("Expected at least 5 more envelopes delivered, got %d", n)
+	}
+	if after.ActiveRooms != before.ActiveRooms ||
+		after.ActiveClients != before.ActiveClients {
+		t.Errorf("Expected %d rooms and %d clients active, got %d and %d",
+			before.ActiveRooms, before.ActiveClients,
+			after.ActiveRooms, after.ActiveClients)
+	}
+}
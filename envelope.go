@@ -0,0 +1,265 @@
+// Copyright 2020 Nik Silver
+//
+// Licensed under the GPL v3.0. See file LICENCE.txt for details.
+
+package main
+
+import (
+	"encoding/json"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack"
+)
+
+// Envelope is the structure for messages sent to clients. Other than
+// the bare minimum,
+// all fields will be filled in by the hub. The fields have to be exported
+// to be processed by json marshalling.
+type Envelope struct {
+	From    []string // Client id this is from
+	To      []string // Ids of all clients this is going to
+	Num     int      // Sequence number for its recipient, or -1 if none
+	Time    int64    // Server time when sent, in seconds since the epoch
+	Intent  string   // What the message is intended to convey
+	Receipt bool     // If this is a peer message from the receiving client
+	Body    []byte   // Original raw message from the sending client
+	// Why a client left, for a Leaver message: "timeout" if its
+	// connection dropped, "closed" if it closed the connection itself,
+	// "replaced" if a new client took its ID, "kicked" if the leader
+	// threw it out, or "idle" if it sent no peer messages for too long
+	// after an Inactive warning. Or what went wrong, for an Error
+	// message. Or why the room is closing, for a Closing message:
+	// "lifetime" if it's been open as long as it can be, "idle" if it's
+	// been idle too long after an Idle warning, or "shutdown" if the
+	// server is shutting down.
+	Reason string `json:",omitempty" msgpack:",omitempty"`
+	// Protocol version the server speaks, for a Welcome message
+	Version int `json:",omitempty" msgpack:",omitempty"`
+	// How the Body appears in JSON. If the Body is a JSON document
+	// it appears as it is and this is empty. Otherwise it's "text" if
+	// the Body is a plain string, or "base64" if it's base64-encoded.
+	// MessagePack always carries the Body as binary, so it's left out.
+	Encoding string `json:",omitempty" msgpack:"-"`
+	// Nums of the first and last envelopes a reconnecting client has
+	// missed, for a Missed message
+	Missed []int `json:",omitempty" msgpack:",omitempty"`
+	// Whatever the client sent to be echoed back, such as for a Time
+	// message
+	Token string `json:",omitempty" msgpack:",omitempty"`
+	// Num the recipient should expect next, for a Welcome message.
+	// It's the Welcome's own Num plus one. A client reconnecting should
+	// give as its lastnum the Num of the last envelope it received,
+	// which is NextNum - 1 if that was the Welcome. For a Reassigned
+	// message it's the Num of the first envelope it's about to be resent.
+	NextNum int `json:",omitempty" msgpack:",omitempty"`
+	// What the server will put up with, for a Welcome message, or an
+	// Error message because a message was too big
+	Limits *Limits `json:",omitempty" msgpack:",omitempty"`
+	// What the client put on its message, for a receipt only
+	Tag string `json:",omitempty" msgpack:",omitempty"`
+	// How many milliseconds after its Time the envelope is worthless,
+	// so it shouldn't be resent, or 0 if it's always worth sending
+	TTL int64 `json:",omitempty" msgpack:",omitempty"`
+	// ID of the client that leads, for a Welcome or Leader message
+	Leader string `json:",omitempty" msgpack:",omitempty"`
+	// ID a client no longer goes by, for a Reassigned or Reconnected
+	// message
+	Retired string `json:",omitempty" msgpack:",omitempty"`
+	// Display name a client no longer goes by, for a Renamed message.
+	// Its new name, if it has one, is in the Names.
+	OldName string `json:",omitempty" msgpack:",omitempty"`
+	// Path and query string a spectator can join the room with, for a
+	// SpectatorLink message
+	Link string `json:",omitempty" msgpack:",omitempty"`
+	// Key of the room's state that's been set, for a State message. The
+	// Body is its new value, or null if it's been deleted.
+	Key string `json:",omitempty" msgpack:",omitempty"`
+	// All the room's state, for a Welcome message
+	State map[string]json.RawMessage `json:",omitempty" msgpack:",omitempty"`
+	// Random seed all the room's clients share, for a Welcome or Seed
+	// message. It's a string in JSON, as it may be too big for a
+	// JavaScript number.
+	Seed uint64 `json:",omitempty,string" msgpack:",omitempty"`
+	// What dice were rolled and how they came out, for a Rolled message
+	Roll *Roll `json:",omitempty" msgpack:",omitempty"`
+	// ID of the client whose turn it is, for a Welcome or Turn message.
+	// Empty if the leader hasn't said, or has stopped saying.
+	Turn string `json:",omitempty" msgpack:",omitempty"`
+	// How the room's doing, for a Stats message
+	Stats *Stats `json:",omitempty" msgpack:",omitempty"`
+	// Display names of the players this is from and to, by ID, for
+	// those that have one, for a Welcome, Joiner, Leaver or Renamed
+	// message
+	Names map[string]string `json:",omitempty" msgpack:",omitempty"`
+	// Metadata of the players this is from and to, by ID, for those
+	// that have some, for a Welcome or Joiner message
+	Metas map[string]json.RawMessage `json:",omitempty" msgpack:",omitempty"`
+	// Players in the room, longest joined first, for a Roster message
+	Members []Member `json:",omitempty" msgpack:",omitempty"`
+	// How many milliseconds to wait before trying to connect again,
+	// for a Closing message because the server is shutting down
+	RetryMs int64 `json:",omitempty" msgpack:",omitempty"`
+	// ID of the recipient, for a Welcome message, so it knows what it's
+	// called, even if it didn't say
+	You string `json:",omitempty" msgpack:",omitempty"`
+}
+
+// Limits are the server settings a client needs to respect, so it
+// isn't surprised by them.
+type Limits struct {
+	MaxMessageBytes int   // Largest message a client may send in one go
+	MaxChunkedBytes int   // Largest message a client may send in chunks
+	MaxClients      int   // Most clients allowed in a room
+	PingFreqMs      int64 // How often the server pings the client
+	PongTimeoutMs   int64 // How long the server waits for a pong
+	ReconnectionMs  int64 // How long a client has to reconnect
+	// How long a player may go without sending a peer message before
+	// it's warned with an Inactive message, or 0 if it may idle forever
+	ClientIdleMs int64
+}
+
+// Roll is what a client asked to be rolled, and the results.
+type Roll struct {
+	Sides   int   // How many sides each die has
+	Count   int   // How many dice
+	Results []int // What each die came up, from 1 to Sides
+}
+
+// Member is a player in a room, as listed in a roster.
+type Member struct {
+	ID     string // Client ID
+	State  string // "connected", or "reconnecting" if it's lost its connection
+	Leader bool   // If it leads the room
+}
+
+// Stats say how a room's doing.
+type Stats struct {
+	Messages int   // How many peer messages the room has relayed
+	Bytes    int   // How many bytes were in those messages
+	Members  int   // How many players are in the room now
+	AgeMs    int64 // How long the room has been open, in milliseconds
+	Num      int   // Num of the last envelope sent to the recipient
+	// For an operator only: how many clients are connected, how many
+	// may still reconnect, and when someone in the room was last
+	// active, in milliseconds past the epoch. Num is then the highest
+	// sent to any client, or -1 if none.
+	Connected    int
+	Reconnecting int
+	LastActive   int64
+	// Most envelopes any client has queued to send, and the age of
+	// the oldest envelope any client has queued, in milliseconds
+	MaxQueued      int
+	OldestQueuedMs int64
+	// How many envelopes the room is keeping in case they need to be
+	// resent, the bytes of their bodies, and the age of the oldest, in
+	// milliseconds
+	Buffered         int
+	BufferedBytes    int
+	OldestBufferedMs int64
+	// Lowest num the recipient could continue from if it reconnected
+	OldestNum int
+}
+
+// expired says if the envelope's time to live has run out by the given
+// time, in milliseconds since the epoch. It compares the envelope's age
+// rather than its expiry time, so that a huge TTL can't overflow.
+func (e *Envelope) expired(nowMs int64) bool {
+	return e.TTL > 0 && nowMs-e.Time > e.TTL
+}
+
+// Subprotocols for each way of encoding envelopes.
+const (
+	JSONProtocol    = "bgf.json"
+	MsgpackProtocol = "bgf.msgpack"
+)
+
+// encodeEnvelope gives an envelope as it should be sent to a client
+// that's agreed the given subprotocol, together with the type of
+// websocket message to send it in. Envelopes are only encoded like
+// this as they're sent, so the same envelope can go to clients
+// speaking different subprotocols.
+func encodeEnvelope(e *Envelope, subprotocol string) (int, []byte, error) {
+	if subprotocol == MsgpackProtocol {
+		bs, err := msgpack.Marshal(e)
+		return websocket.BinaryMessage, bs, err
+	}
+	bs, err := json.Marshal(e)
+	return websocket.TextMessage, bs, err
+}
+
+// envelopeJSON is an envelope without its JSON methods, so it can
+// be marshalled and unmarshalled in the default way.
+type envelopeJSON Envelope
+
+// encoding gives the Encoding of a body sent in a websocket message
+// of the given type. A JSON document can be sent as it is, and
+// only valid UTF-8 text can be sent as text; anything else has
+// to be base64-encoded.
+func encoding(mType int, body []byte) string {
+	switch {
+	case json.Valid(body):
+		return ""
+	case mType == websocket.TextMessage && utf8.Valid(body):
+		return "text"
+	}
+	return "base64"
+}
+
+// MarshalJSON gives the JSON for an envelope, with the Body as it is,
+// as text, or base64-encoded according to the Encoding. If the Body
+// can't appear as the Encoding says then it's base64-encoded.
+func (e Envelope) MarshalJSON() ([]byte, error) {
+	var body interface{}
+	switch {
+	case e.Body == nil:
+		body = nil
+		e.Encoding = ""
+	case e.Encoding == "" && json.Valid(e.Body):
+		body = json.RawMessage(e.Body)
+	case e.Encoding == "text" && utf8.Valid(e.Body):
+		body = string(e.Body)
+	default:
+		body = e.Body
+		e.Encoding = "base64"
+	}
+	return json.Marshal(struct {
+		envelopeJSON
+		Body interface{}
+	}{
+		envelopeJSON: envelopeJSON(e),
+		Body:         body,
+	})
+}
+
+// UnmarshalJSON reads an envelope from JSON, decoding the Body
+// according to the Encoding.
+func (e *Envelope) UnmarshalJSON(data []byte) error {
+	in := struct {
+		*envelopeJSON
+		Body json.RawMessage
+	}{
+		envelopeJSON: (*envelopeJSON)(e),
+	}
+	if err := json.Unmarshal(data, &in); err != nil {
+		return err
+	}
+
+	e.Body = nil
+	if len(in.Body) == 0 || string(in.Body) == "null" {
+		return nil
+	}
+	switch e.Encoding {
+	case "text":
+		var text string
+		if err := json.Unmarshal(in.Body, &text); err != nil {
+			return err
+		}
+		e.Body = []byte(text)
+		return nil
+	case "base64":
+		return json.Unmarshal(in.Body, &e.Body)
+	}
+	e.Body = []byte(in.Body)
+	return nil
+}
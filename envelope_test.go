@@ -0,0 +1,313 @@
+// Copyright 2020 Nik Silver
+//
+// Licensed under the GPL v3.0. See file LICENCE.txt for details.
+
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack"
+)
+
+func TestEnvelope_EncodingOnlyTextForValidUTF8TextMessages(t *testing.T) {
+	if enc := encoding(websocket.TextMessage, []byte("Hello ✓")); enc != "text" {
+		t.Errorf("Valid text message got encoding '%s'", enc)
+	}
+	if enc := encoding(websocket.TextMessage, []byte{0xff, 0xfe}); enc != "base64" {
+		t.Errorf("Invalid UTF-8 text message got encoding '%s'", enc)
+	}
+	if enc := encoding(websocket.BinaryMessage, []byte("Hello")); enc != "base64" {
+		t.Errorf("Binary message got encoding '%s'", enc)
+	}
+}
+
+func TestEnvelope_EncodingIsEmptyForJSON(t *testing.T) {
+	for _, body := range []string{`{"a":1}`, `[1, 2]`, `"str"`, `12`, `null`} {
+		for _, mType := range []int{websocket.TextMessage, websocket.BinaryMessage} {
+			if enc := encoding(mType, []byte(body)); enc != "" {
+				t.Errorf("JSON %s got encoding '%s'", body, enc)
+			}
+		}
+	}
+	for _, body := range []string{`{"a":1`, `{a:1}`, `''`, ``} {
+		if enc := encoding(websocket.TextMessage, []byte(body)); enc != "text" {
+			t.Errorf("Invalid JSON %s got encoding '%s'", body, enc)
+		}
+	}
+}
+
+func TestEnvelope_JSONBodyAppearsAsItIs(t *testing.T) {
+	env := &Envelope{
+		Intent: "Peer",
+		Body:   []byte(`{"move":"e4","check":false}`),
+	}
+	bs, err := json.Marshal(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Look at the raw JSON
+	raw := struct {
+		Body     map[string]interface{}
+		Encoding *string
+	}{}
+	if err := json.Unmarshal(bs, &raw); err != nil {
+		t.Fatal(err)
+	}
+	if raw.Body["move"] != "e4" || raw.Body["check"] != false {
+		t.Errorf("Raw JSON Body was %#v", raw.Body)
+	}
+	if raw.Encoding != nil {
+		t.Errorf("Raw JSON had Encoding %#v", *raw.Encoding)
+	}
+
+	// Check it reads back in again
+	env2 := Envelope{}
+	if err := json.Unmarshal(bs, &env2); err != nil {
+		t.Fatal(err)
+	}
+	if string(env2.Body) != string(env.Body) {
+		t.Errorf("Body read back as '%s'", string(env2.Body))
+	}
+}
+
+func TestEnvelope_InvalidJSONBodyIsBase64(t *testing.T) {
+	// An envelope that claims a JSON body, but doesn't have one
+	env := &Envelope{
+		Intent: "Peer",
+		Body:   []byte(`{"move":`),
+	}
+	bs, err := json.Marshal(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Look at the raw JSON
+	raw := make(map[string]interface{})
+	if err := json.Unmarshal(bs, &raw); err != nil {
+		t.Fatal(err)
+	}
+	if raw["Encoding"] != "base64" {
+		t.Errorf("Raw JSON Encoding was %#v", raw["Encoding"])
+	}
+
+	// Check it reads back in again
+	env2 := Envelope{}
+	if err := json.Unmarshal(bs, &env2); err != nil {
+		t.Fatal(err)
+	}
+	if string(env2.Body) != string(env.Body) {
+		t.Errorf("Body read back as '%s'", string(env2.Body))
+	}
+}
+
+func TestEnvelope_EmptyBodyIsNotNull(t *testing.T) {
+	for _, enc := range []string{"text", "base64"} {
+		env := &Envelope{
+			Intent:   "Peer",
+			Body:     []byte{},
+			Encoding: enc,
+		}
+		bs, err := json.Marshal(env)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Look at the raw JSON
+		raw := make(map[string]interface{})
+		if err := json.Unmarshal(bs, &raw); err != nil {
+			t.Fatal(err)
+		}
+		if raw["Body"] != "" || raw["Encoding"] != enc {
+			t.Errorf("%s: Raw JSON Body was %#v with Encoding %#v",
+				enc, raw["Body"], raw["Encoding"])
+		}
+
+		// Check it reads back in again
+		env2 := Envelope{}
+		if err := json.Unmarshal(bs, &env2); err != nil {
+			t.Fatal(err)
+		}
+		if env2.Body == nil || len(env2.Body) != 0 {
+			t.Errorf("%s: Body read back as %#v", enc, env2.Body)
+		}
+	}
+}
+
+func TestEnvelope_TextBodyIsPlainStringInJSON(t *testing.T) {
+	env := &Envelope{
+		Intent:   "Peer",
+		Body:     []byte("Hello ✓"),
+		Encoding: "text",
+	}
+	bs, err := json.Marshal(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Look at the raw JSON
+	raw := make(map[string]interface{})
+	if err := json.Unmarshal(bs, &raw); err != nil {
+		t.Fatal(err)
+	}
+	if raw["Body"] != "Hello ✓" {
+		t.Errorf("Raw JSON Body was %#v", raw["Body"])
+	}
+	if raw["Encoding"] != "text" {
+		t.Errorf("Raw JSON Encoding was %#v", raw["Encoding"])
+	}
+
+	// Check it reads back in again
+	env2 := Envelope{}
+	if err := json.Unmarshal(bs, &env2); err != nil {
+		t.Fatal(err)
+	}
+	if string(env2.Body) != "Hello ✓" {
+		t.Errorf("Body read back as '%s'", string(env2.Body))
+	}
+	if env2.Intent != "Peer" {
+		t.Errorf("Intent read back as '%s'", env2.Intent)
+	}
+}
+
+func TestEnvelope_BinaryBodyIsBase64InJSON(t *testing.T) {
+	env := &Envelope{
+		Intent:   "Peer",
+		Body:     []byte{0, 1, 2, 0xff},
+		Encoding: "base64",
+	}
+	bs, err := json.Marshal(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Look at the raw JSON
+	raw := make(map[string]interface{})
+	if err := json.Unmarshal(bs, &raw); err != nil {
+		t.Fatal(err)
+	}
+	if raw["Body"] != "AAEC/w==" {
+		t.Errorf("Raw JSON Body was %#v", raw["Body"])
+	}
+	if raw["Encoding"] != "base64" {
+		t.Errorf("Raw JSON Encoding was %#v", raw["Encoding"])
+	}
+
+	// Check it reads back in again
+	env2 := Envelope{}
+	if err := json.Unmarshal(bs, &env2); err != nil {
+		t.Fatal(err)
+	}
+	if string(env2.Body) != string(env.Body) {
+		t.Errorf("Body read back as %v", env2.Body)
+	}
+}
+
+func TestEnvelope_NoBodyIsNullInJSON(t *testing.T) {
+	env := &Envelope{
+		Intent: "Joiner",
+	}
+	bs, err := json.Marshal(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Look at the raw JSON
+	raw := make(map[string]interface{})
+	if err := json.Unmarshal(bs, &raw); err != nil {
+		t.Fatal(err)
+	}
+	if body, ok := raw["Body"]; !ok || body != nil {
+		t.Errorf("Raw JSON Body was %#v", body)
+	}
+	if _, ok := raw["Encoding"]; ok {
+		t.Errorf("Raw JSON had Encoding %#v", raw["Encoding"])
+	}
+
+	// Check it reads back in again
+	env2 := Envelope{}
+	if err := json.Unmarshal(bs, &env2); err != nil {
+		t.Fatal(err)
+	}
+	if env2.Body != nil {
+		t.Errorf("Body read back as %v", env2.Body)
+	}
+}
+
+func TestEnvelope_MsgpackRoundTrip(t *testing.T) {
+	envs := []*Envelope{
+		{
+			From:     []string{"A"},
+			To:       []string{"B", "C"},
+			Num:      12,
+			Time:     1600000000123,
+			Intent:   "Peer",
+			Receipt:  true,
+			Body:     []byte{0, 1, 2, 0xff},
+			Encoding: "base64",
+		},
+		{
+			From:   []string{"A"},
+			To:     []string{},
+			Num:    3,
+			Intent: "Leaver",
+			Reason: "timeout",
+		},
+		{
+			To:      []string{"A"},
+			Intent:  "Welcome",
+			Version: ProtocolVersion,
+		},
+	}
+
+	for i, env := range envs {
+		mType, bs, err := encodeEnvelope(env, MsgpackProtocol)
+		if err != nil {
+			t.Fatalf("%d: %s", i, err)
+		}
+		if mType != websocket.BinaryMessage {
+			t.Errorf("%d: Message type was %d", i, mType)
+		}
+
+		env2 := Envelope{}
+		if err := msgpack.Unmarshal(bs, &env2); err != nil {
+			t.Fatalf("%d: %s", i, err)
+		}
+
+		// The Encoding is only for JSON
+		want := *env
+		want.Encoding = ""
+		if !reflect.DeepEqual(env2, want) {
+			t.Errorf("%d: Expected %#v but got %#v", i, want, env2)
+		}
+	}
+}
+
+func TestEnvelope_DefaultEncodingIsJSON(t *testing.T) {
+	env := &Envelope{
+		Intent:   "Peer",
+		Body:     []byte("Hello"),
+		Encoding: "text",
+	}
+	for _, p := range []string{"", JSONProtocol} {
+		mType, bs, err := encodeEnvelope(env, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mType != websocket.TextMessage {
+			t.Errorf("'%s': Message type was %d", p, mType)
+		}
+
+		env2 := Envelope{}
+		if err := json.Unmarshal(bs, &env2); err != nil {
+			t.Fatalf("'%s': %s", p, err)
+		}
+		if !reflect.DeepEqual(&env2, env) {
+			t.Errorf("'%s': Expected %#v but got %#v", p, env, env2)
+		}
+	}
+}
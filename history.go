@@ -0,0 +1,54 @@
+// Copyright 2020 Nik Silver
+//
+// Licensed under the GPL v3.0. See file LICENCE.txt for details.
+
+package main
+
+// Most peer messages, and most bytes of them, a room keeps if it keeps
+// its full history
+var fullHistoryCount = 10000
+var fullHistoryBytes = 4 * 1024 * 1024
+
+// History keeps the last few peer messages sent in a room, so that a
+// new joiner can see what's been happening. It's separate from the
+// Buffer, which keeps each client's own envelopes in case they need
+// to be resent.
+type History struct {
+	bs       []*Broadcast // Messages kept, oldest first
+	size     int          // Bytes in the bodies of the messages kept
+	maxCount int          // Most messages to keep
+	maxBytes int          // Most bytes to keep, or 0 if any number
+}
+
+// NewHistory creates a history of the last maxCount messages, and no
+// more than maxBytes of their bodies, unless that's 0. If maxCount
+// is 0 nothing is kept.
+func NewHistory(maxCount int, maxBytes int) *History {
+	return &History{
+		bs:       make([]*Broadcast, 0),
+		maxCount: maxCount,
+		maxBytes: maxBytes,
+	}
+}
+
+// Add keeps a message, dropping the oldest ones if the history is full.
+func (hs *History) Add(b *Broadcast) {
+	if hs.maxCount == 0 {
+		return
+	}
+	hs.bs = append(hs.bs, b)
+	hs.size += len(b.Body)
+	for len(hs.bs) > hs.maxCount ||
+		(hs.maxBytes > 0 && hs.size > hs.maxBytes) {
+		hs.size -= len(hs.bs[0].Body)
+		hs.bs[0] = nil
+		hs.bs = hs.bs[1:]
+	}
+}
+
+// All gives the messages kept, oldest first.
+func (hs *History) All() []*Broadcast {
+	bs := make([]*Broadcast, len(hs.bs))
+	copy(bs, hs.bs)
+	return bs
+}
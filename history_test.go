@@ -0,0 +1,51 @@
+// Copyright 2020 Nik Silver
+//
+// Licensed under the GPL v3.0. See file LICENCE.txt for details.
+
+package main
+
+import (
+	"testing"
+)
+
+func TestHistory_KeepsOnlyTheLastFewInOrder(t *testing.T) {
+	bodies := func(hs *History) string {
+		s := ""
+		for _, b := range hs.All() {
+			s += string(b.Body)
+		}
+		return s
+	}
+
+	hs := NewHistory(3, 0)
+	if got := bodies(hs); got != "" {
+		t.Errorf("Empty history gave %q", got)
+	}
+	for i, exp := range []string{"a", "ab", "abc", "bcd", "cde", "def"} {
+		hs.Add(&Broadcast{Body: []byte{"abcdef"[i]}})
+		if got := bodies(hs); got != exp {
+			t.Errorf("After adding %d expected %q but got %q", i+1, exp, got)
+		}
+	}
+
+	// A history with no room keeps nothing
+	hs = NewHistory(0, 0)
+	hs.Add(&Broadcast{Body: []byte("a")})
+	if got := bodies(hs); got != "" {
+		t.Errorf("History of size 0 gave %q", got)
+	}
+}
+
+func TestHistory_KeepsNoMoreThanMaxBytes(t *testing.T) {
+	hs := NewHistory(10, 5)
+	for _, body := range []string{"ab", "cd", "e", "fgh"} {
+		hs.Add(&Broadcast{Body: []byte(body)})
+	}
+	got := ""
+	for _, b := range hs.All() {
+		got += string(b.Body) + ","
+	}
+	if got != "e,fgh," {
+		t.Errorf("Expected e,fgh, but got %q", got)
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright 2020 Nik Silver
+//
+// Licensed under the GPL v3.0. See file LICENCE.txt for details.
+
+package main
+
+import (
+	"sync"
+)
+
+// How many hook calls can wait to be made before we start dropping them
+var hookQueueSize = 100
+
+// Hooks is told about rooms and clients coming and going, such as for
+// a lobby or analytics service. Its methods are called one at a time,
+// in the order things happened, but never by anything that would wait
+// for them, so they may be slow.
+type Hooks interface {
+	// A new hub has been started for a room
+	OnRoomCreated(room string)
+	// A room's hub has finished with all its clients
+	OnRoomClosed(room string)
+	// A client has joined a room
+	OnClientJoined(room string, id string)
+	// A client has left a room, for the reason given in its Leaver
+	OnClientLeft(room string, id string, reason string)
+}
+
+// NoHooks are hooks that do nothing.
+type NoHooks struct{}
+
+func (NoHooks) OnRoomCreated(room string)                          {}
+func (NoHooks) OnRoomClosed(room string)                           {}
+func (NoHooks) OnClientJoined(room string, id string)              {}
+func (NoHooks) OnClientLeft(room string, id string, reason string) {}
+
+// hookCaller makes calls to some hooks from its own goroutine, so
+// no-one making them ever waits. If too many are waiting, calls are
+// dropped.
+type hookCaller struct {
+	hooks Hooks
+	calls chan func()
+	once  sync.Once
+	mux   sync.Mutex
+}
+
+// newHookCaller creates a caller for hooks that do nothing. It only
+// starts calling when it's first given something to call.
+func newHookCaller() *hookCaller {
+	return &hookCaller{
+		hooks: NoHooks{},
+		calls: make(chan func(), hookQueueSize),
+	}
+}
+
+// set the hooks to call from now on.
+func (hc *hookCaller) set(hooks Hooks) {
+	hc.mux.Lock()
+	defer hc.mux.Unlock()
+
+	if hooks == nil {
+		hooks = NoHooks{}
+	}
+	hc.hooks = hooks
+}
+
+// call queues a call to whatever the hooks are now, unless they do
+// nothing. It's safe to call on a nil caller, which does nothing.
+func (hc *hookCaller) call(what string, room string, fn func(Hooks)) {
+	if hc == nil {
+		return
+	}
+	hc.mux.Lock()
+	hooks := hc.hooks
+	hc.mux.Unlock()
+	if _, ok := hooks.(NoHooks); ok {
+		return
+	}
+	hc.once.Do(func() {
+		go hc.callAll()
+	})
+
+	select {
+	case hc.calls <- func() { fn(hooks) }:
+	default:
+		aLog.Warn("Hook queue full, dropping call", "room", room,
+			"hook", what)
+	}
+}
+
+// callAll makes queued calls forever.
+func (hc *hookCaller) callAll() {
+	for fn := range hc.calls {
+		fn()
+	}
+}
+
+// roomCreated says a new hub has been started for a room.
+func (hc *hookCaller) roomCreated(room string) {
+	hc.call("OnRoomCreated", room, func(hooks Hooks) {
+		hooks.OnRoomCreated(room)
+	})
+}
+
+// roomClosed says a room's hub has finished with all its clients.
+func (hc *hookCaller) roomClosed(room string) {
+	hc.call("OnRoomClosed", room, func(hooks Hooks) {
+		hooks.OnRoomClosed(room)
+	})
+}
+
+// clientJoined says a client has joined a room.
+func (hc *hookCaller) clientJoined(room string, id string) {
+	hc.call("OnClientJoined", room, func(hooks Hooks) {
+		hooks.OnClientJoined(room, id)
+	})
+}
+
+// clientLeft says a client has left a room, and why.
+func (hc *hookCaller) clientLeft(room string, id string, reason string) {
+	hc.call("OnClientLeft", room, func(hooks Hooks) {
+		hooks.OnClientLeft(room, id, reason)
+	})
+}
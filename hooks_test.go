@@ -0,0 +1,160 @@
+// Copyright 2020 Nik Silver
+//
+// Licensed under the GPL v3.0. See file LICENCE.txt for details.
+
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingHooks records every call made to it.
+type recordingHooks struct {
+	calls []string
+	mux   sync.Mutex
+}
+
+func (rh *recordingHooks) OnRoomCreated(room string) {
+	rh.add("created " + room)
+}
+
+func (rh *recordingHooks) OnRoomClosed(room string) {
+	rh.add("closed " + room)
+}
+
+func (rh *recordingHooks) OnClientJoined(room string, id string) {
+	rh.add("joined " + room + " " + id)
+}
+
+func (rh *recordingHooks) OnClientLeft(room string, id string, reason string) {
+	rh.add("left " + room + " " + id + " " + reason)
+}
+
+func (rh *recordingHooks) add(call string) {
+	rh.mux.Lock()
+	defer rh.mux.Unlock()
+	rh.calls = append(rh.calls, call)
+}
+
+// waitFor waits a while for there to be some number of calls, and
+// gives what they are.
+func (rh *recordingHooks) waitFor(n int) []string {
+	for i := 0; i < 100; i++ {
+		rh.mux.Lock()
+		calls := append([]string{}, rh.calls...)
+		rh.mux.Unlock()
+		if len(calls) >= n || i == 99 {
+			return calls
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return nil
+}
+
+// blockingHooks don't return from any call until they're let go.
+type blockingHooks struct {
+	NoHooks
+	release chan struct{}
+}
+
+func (bh blockingHooks) OnRoomCreated(room string) {
+	<-bh.release
+}
+
+func TestHooks_SayWhatHappensToRoomsAndClients(t *testing.T) {
+	// Just for this test, lower the reconnection timeout so that a
+	// Leaver message is triggered reasonably quickly.
+	sh := useSuperhub(t, 250*time.Millisecond)
+	rh := &recordingHooks{}
+	sh.SetHooks(rh)
+
+	serv := newTestServer(bounceHandler)
+	defer serv.Close()
+
+	// Two clients join, then one leaves, then the other
+
+	room := "/hooks.room"
+	ws1, _, err := dial(serv, room, "HKS1", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws1 := newTConn(ws1, "HKS1")
+	defer tws1.close()
+	if err := tws1.swallow("Welcome"); err != nil {
+		t.Fatal(err)
+	}
+	ws2, _, err := dial(serv, room, "HKS2", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws2 := newTConn(ws2, "HKS2")
+	defer tws2.close()
+	if err = swallowMany(
+		intentExp{"HKS2 joining, ws2", tws2, "Welcome"},
+		intentExp{"HKS2 joining, ws1", tws1, "Joiner"},
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	tws2.close()
+	if err = swallowMany(
+		intentExp{"HKS2 leaving, ws1", tws1, "Away"},
+		intentExp{"HKS2 leaving, ws1", tws1, "Leaver"},
+	); err != nil {
+		t.Fatal(err)
+	}
+	tws1.close()
+	WG.Wait()
+
+	// The hooks hear about it all, in order
+
+	expected := []string{
+		"created /hooks.room",
+		"joined /hooks.room HKS1",
+		"joined /hooks.room HKS2",
+		"left /hooks.room HKS2 timeout",
+		"left /hooks.room HKS1 timeout",
+		"closed /hooks.room",
+	}
+	calls := rh.waitFor(len(expected))
+	if len(calls) != len(expected) {
+		t.Fatalf("Expected calls %q but got %q", expected, calls)
+	}
+	for i := range expected {
+		if calls[i] != expected[i] {
+			t.Errorf("Expected calls %q but got %q", expected, calls)
+			break
+		}
+	}
+}
+
+func TestHooks_SlowHooksDontHoldUpTheSuperhub(t *testing.T) {
+	// Hooks that never return can't stop hubs being given out, even
+	// once calls to them start being dropped
+
+	sh := NewSuperhub()
+	bh := blockingHooks{release: make(chan struct{})}
+	sh.SetHooks(bh)
+	defer close(bh.release)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < hookQueueSize*2; i++ {
+			h, err := sh.Hub("/hooks.slow", &ConnectionParams{})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			sh.Release(h, &Client{gone: true})
+			WG.Wait()
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Superhub held up by hooks")
+	}
+}
@@ -5,6 +5,16 @@
 package main
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -14,15 +24,147 @@ type Hub struct {
 	room string
 	// All clients that have been seen, and the superhub is tracking
 	clients map[*Client]status
-	// Num for the next envelope num
-	num int
 	// Messages from clients that need to be bounced out.
 	Pending chan *Message
 	// Message from the superhub saying timed out waiting for a reconnection
 	// to replace a client
 	Timeout chan *Client
+	// Closed when the hub stops processing messages
+	done chan struct{}
+	// The superhub that gave out the hub, if any. Clients release the
+	// hub to it, and it says when it has no more clients for the hub.
+	shub *Superhub
+	// To tell about clients joining and leaving, and the room closing,
+	// if anyone's to be told
+	hooks *hookCaller
 	// Buffer of recent envelopes, in case they need to be resent
-	buffer *Buffer
+	buffer BufferStore
+	// Recent peer messages, to show new joiners
+	history *History
+	// Settings given when the room was created
+	settings RoomSettings
+	// ID of the client that arbitrates for the others. It's an ID
+	// rather than a client so it survives a client being replaced.
+	leader string
+	// IDs of joined clients, longest joined first, so we know who
+	// should lead next
+	joinOrder []string
+	// IDs the leader has thrown out, which can't join again
+	kicked map[string]bool
+	// Display names of joined players, by ID, for those that have one
+	names map[string]string
+	// Metadata of joined players, by ID, for those that have some
+	metas map[string]json.RawMessage
+	// State the clients have stored in the room, as JSON values, and
+	// its size, counting keys and values
+	state     map[string]json.RawMessage
+	stateSize int
+	// Random seed all the clients share, so they can shuffle the same way
+	seed uint64
+	// ID of the client whose turn it is, if the leader has said. Only
+	// it and the leader can send peer messages.
+	turn string
+	// If the leader has paused the room, and if so the num of the
+	// first envelope held back for each client ID
+	paused bool
+	held   map[string]int
+	// If the room is closing, so no-one else can join
+	closing bool
+	// When a player last sent a peer message, joined or left, and if
+	// we've warned everyone the room is idle since then
+	lastActive time.Time
+	idleWarned bool
+	// For limiting how fast peer messages go through the room, how
+	// many have been over the limit, and when we last said so
+	peerBucket bucket
+	peerOver   int
+	peerLogged time.Time
+	// When the hub was created, and how many peer messages it's
+	// relayed and how many bytes were in them
+	created  time.Time
+	relayed  int
+	relayedB int
+	// Random ID for spectator links, so they only work for this hub,
+	// and how many times each link has been used. The superhub
+	// counts the uses, under the lock for the room.
+	linkID   string
+	linkUses map[string]int
+	// If an operator closed the room just before this hub started, so
+	// clients carrying on from the old hub should start again
+	restarted bool
+	// IDs of the players still joined, connected or not, so the
+	// superhub can count them against the room's limit
+	players  map[string]bool
+	countMux sync.Mutex
+}
+
+// RoomSettings are what the client creating a room can choose about it.
+// Anyone joining later can't change them.
+type RoomSettings struct {
+	// Largest message a client in the room may send in one go
+	ReadLimit int
+	// Largest message a client in the room may send in chunks
+	ChunkedLimit int
+	// Most clients allowed in the room
+	MaxClients int
+	// If the leader may give one client another's ID
+	Reassign bool
+	// If anyone can see the room listed
+	Public bool
+	// If a client can only take over a joined client's ID with a lastnum
+	StrictID bool
+	// How long a client has to reconnect before it's taken to have left
+	Reconnection time.Duration
+	// How long a player may go without sending a peer message before
+	// it's warned, and then closed, or 0 if it may idle forever
+	ClientIdle time.Duration
+	// How many recent peer messages to show new joiners, or if they
+	// should see all of them
+	History     int
+	FullHistory bool
+	// Hash of the room's password, or nil if it doesn't have one. We
+	// never keep the password itself.
+	PassHash []byte
+}
+
+// newRoomSettings gets the settings for a new room from the
+// connection params of the client creating it. Clients have the given
+// time to reconnect, unless the params say otherwise.
+func newRoomSettings(p *ConnectionParams, reconnection time.Duration) RoomSettings {
+	rs := RoomSettings{
+		ReadLimit:    readLimit,
+		ChunkedLimit: chunkedLimit,
+		MaxClients:   MaxClients,
+		Reassign:     p.Reassign,
+		Public:       p.Public,
+		StrictID:     p.StrictID,
+		History:      p.History,
+		FullHistory:  p.FullHistory,
+		Reconnection: reconnection,
+		ClientIdle:   p.ClientIdle,
+	}
+	if p.Reconnect >= 0 {
+		rs.Reconnection = p.Reconnect
+	}
+	if p.MaxClients > 0 {
+		rs.MaxClients = p.MaxClients
+	}
+	if p.Pass != "" {
+		hash := sha256.Sum256([]byte(p.Pass))
+		rs.PassHash = hash[:]
+	}
+	if p.MaxMsg > 0 {
+		// This is the largest message, however it's sent
+		rs.ReadLimit = p.MaxMsg
+		rs.ChunkedLimit = p.MaxMsg
+	}
+	return rs
+}
+
+// admits says if a client joining with the given settings has the
+// same password as the room, or neither has one.
+func (rs RoomSettings) admits(joining RoomSettings) bool {
+	return subtle.ConstantTimeCompare(rs.PassHash, joining.PassHash) == 1
 }
 
 // The status of any client seen, and that the superhub is tracking
@@ -38,36 +180,125 @@ const (
 	TRACKEDONLY status = 3
 )
 
-// Message is what is received from a Client.
+// String gives the name of the status, for an operator.
+func (s status) String() string {
+	switch s {
+	case CONNECTED:
+		return "CONNECTED"
+	case MAYRECONNECT:
+		return "MAYRECONNECT"
+	case TRACKEDONLY:
+		return "TRACKEDONLY"
+	}
+	return "UNKNOWN"
+}
+
+// Message is what is received from a Client, or from elsewhere for an
+// Announcement or Send, in which case there's no From.
 type Message struct {
-	From   *Client
+	From *Client
+	// ID the message is from, if it's a Send, which has no From
+	FromID string
 	Intent string
 	Body   []byte
+	Type   int // Websocket message type of the body, text or binary
+	// If the sender doesn't want a receipt for just this message
+	NoReceipt bool
+	// Anything the sender wants echoed back, such as for a Time request
+	Token string
+	// What went wrong, for an Error to be sent back to the client
+	Reason string
+	// Num to send envelopes from again, for a Replay request
+	Num int
+	// Client to give another ID, and the ID it should have, for a
+	// Reassign request. Or the client to throw out, for a Kick. Or
+	// whose turn it is, for a SetTurn.
+	ID string
+	As string
+	// Key of the room's state to set, for a SetState request, whose
+	// Body is the value
+	Key string
+	// How many sides each die has and how many dice, for a Roll request
+	Sides int
+	Count int
+	// New display name, for a Rename request
+	Name string
+	// What the sender wants on its receipt, to identify it
+	Tag string
+	// Where to send the room's stats, for a RoomStats request from
+	// the superhub
+	Reply chan *Stats
+	// Where to send how the room's clients are doing, for a
+	// ClientStats request from the superhub
+	ClientsReply chan []*ClientStats
+	// Milliseconds until the message isn't worth resending, or 0
+	TTL int64
 }
 
-// Envelope is the structure for messages sent to clients. Other than
-// the bare minimum,
-// all fields will be filled in by the hub. The fields have to be exported
-// to be processed by json marshalling.
-type Envelope struct {
-	From    []string // Client id this is from
-	To      []string // Ids of all clients this is going to
-	Num     int      // A number reference for this envelope
-	Time    int64    // Server time when sent, in seconds since the epoch
-	Intent  string   // What the message is intended to convey
-	Receipt bool     // If this is a peer message from the receiving client
-	Body    []byte   // Original raw message from the sending client
-}
+// Most state a room can store, counting keys and values
+var maxStateSize = 64 * 1024
+
+// Longest a room can stay open, however busy it is
+var roomLifetime = 4 * time.Hour
+
+// How long a room can go with no peer messages, joiners or leavers
+// before everyone's warned it's idle, how long after that it closes
+// if it's still idle, and how often we check
+var idleTimeout = time.Hour
+var idleGrace = time.Minute
+var idleCheck = 10 * time.Second
+
+// How many peer messages a room can take in a second, on average, and
+// in a burst, whoever sends them. And what to do with any more.
+var roomMsgRate = 200.0
+var roomMsgBurst = 400.0
+var roomMsgStrategy = DROPMSGS
+
+// Least time between warnings that a room is over its message rate
+var roomMsgLogFreq = 10 * time.Second
+
+// What to do with peer messages over a room's limit
+type strategy int
+
+// Various strategies for too many peer messages
+const (
+	// Drop the message, and send the sender an Error
+	DROPMSGS strategy = 1
+	// Wait until the message is allowed, not reading any others
+	DELAYREADS strategy = 2
+)
 
 // NewHub creates a new, empty Hub with a given room name.
-func NewHub(room string) *Hub {
+func NewHub(room string, settings RoomSettings) *Hub {
 	return &Hub{
-		room:    room,
-		clients: make(map[*Client]status),
-		num:     0,
-		Pending: make(chan *Message),
-		Timeout: make(chan *Client),
-		buffer:  NewBuffer(),
+		room:       room,
+		clients:    make(map[*Client]status),
+		Pending:    make(chan *Message),
+		Timeout:    make(chan *Client),
+		done:       make(chan struct{}),
+		buffer:     newBufferStore(room, settings.Reconnection),
+		history:    newRoomHistory(settings),
+		settings:   settings,
+		kicked:     make(map[string]bool),
+		names:      make(map[string]string),
+		metas:      make(map[string]json.RawMessage),
+		held:       make(map[string]int),
+		state:      make(map[string]json.RawMessage),
+		seed:       randomSeed(),
+		lastActive: time.Now(),
+		created:    time.Now(),
+		linkID:     randomToken(),
+		linkUses:   make(map[string]int),
+	}
+}
+
+// stopped says if the hub has stopped processing messages.
+func (h *Hub) stopped() bool {
+	select {
+	case <-h.done:
+		return true
+	default:
+		return false
 	}
 }
 
@@ -85,13 +316,41 @@ func (h *Hub) receiveInt() {
 
 	defer fLog.Debug("Goroutine done")
 	defer WG.Done()
+	defer close(h.done)
+	defer h.hooks.roomClosed(h.room)
+	defer h.buffer.Close()
 	fLog.Debug("Entering")
 
+	atomic.AddInt64(&Counters.activeRooms, 1)
+	defer atomic.AddInt64(&Counters.activeRooms, -1)
+
+	lifetime := time.NewTimer(roomLifetime)
+	defer lifetime.Stop()
+	idle := time.NewTicker(idleCheck)
+	defer idle.Stop()
+
+	// A client whose Joiner we've just had, to tell the superhub about
+	var arriving *Client
+
 readingLoop:
 	for {
 		fLog.Debug("Selecting")
 
 		select {
+		case <-lifetime.C:
+			// The room has been open long enough
+			fLog.Debug("Room lifetime over")
+			h.close("lifetime")
+
+		case <-idle.C:
+			// Check if the room, or anyone in it, has been idle too long
+			h.checkIdle()
+			h.checkIdleClients()
+			if !h.paused {
+				// A quiet room may still need trimming for the budget
+				h.buffer.Clean()
+			}
+
 		case c := <-h.Timeout:
 			// The superhub's client reconnection timer has fired
 			caseLog := fLog.New("cid", c.ID, "cref", c.Ref)
@@ -99,24 +358,121 @@ readingLoop:
 
 			if h.stillJoined(c) {
 				// We have a leaver
+				reason := "timeout"
+				if c.closed {
+					reason = "closed"
+				}
 				h.remove(c)
-				h.leaver(c)
-				h.num++
+				h.leaver(c, reason)
+				h.left(c)
 				caseLog.Debug("Sent leaver messages")
 			} else {
 				caseLog.Debug("No messages to send")
 				h.remove(c)
 			}
 
-			if len(h.clients) == 0 {
+			if len(h.clients) == 0 && h.shub.finished(h) {
 				caseLog.Debug("That was the last client; exiting")
 				break readingLoop
 			}
 
 		case msg := <-h.Pending:
 			fLog.Debug("Received pending message")
+			if msg.Intent == "Joiner" {
+				arriving = msg.From
+				h.restart(msg.From)
+			}
 
 			switch {
+			case msg.Intent == "Announcement":
+				// The operator has something to say to everyone
+				fLog.Debug("Got announcement")
+				b := h.newBroadcast("Announcement", []string{}, h.allPlayerIDs())
+				b.Body = msg.Body
+				env := b.Envelope(false)
+				for _, c := range h.allJoined() {
+					h.send(c, env)
+				}
+
+			case msg.Intent == "RoomStats":
+				// An operator wants to know how the room's doing
+				fLog.Debug("Got room stats request")
+				msg.Reply <- h.stats(nil)
+
+			case msg.Intent == "ClientStats":
+				// An operator wants to know who's in the room
+				fLog.Debug("Got client stats request")
+				msg.ClientsReply <- h.clientStats()
+
+			case msg.Intent == "Shutdown":
+				// The server is shutting down
+				fLog.Debug("Got shutdown")
+				h.shutdown()
+
+			case msg.Intent == "ForceClose":
+				// An operator wants the room to end
+				fLog.Debug("Got force close")
+				h.forceClose()
+
+			case msg.Intent == "Send":
+				// A service is sending a message into the room as if
+				// it were a client
+				fLog.Debug("Got sent msg", "fromid", msg.FromID)
+				b := h.newSystemBroadcast(
+					"Peer", msg.FromID, h.allPlayerIDs(),
+				)
+				b.Body = msg.Body
+				b.Encoding = encoding(msg.Type, msg.Body)
+				h.history.Add(b)
+				h.active()
+				h.relay(msg)
+				env := b.Envelope(false)
+				for _, c := range h.allJoined() {
+					h.send(c, env)
+				}
+
+			case msg.Intent == "Joiner" && h.closing:
+				// Someone trying to join just as the room closes;
+				// tell it and then just track it quietly
+				c := msg.From
+				caseLog := fLog.New("cid", c.ID, "cref", c.Ref)
+				caseLog.Debug("Client trying to join closing room")
+
+				h.connect(c, NewQueue())
+				c.Pending <- &Envelope{Intent: "Closed"}
+				h.justTrack(c)
+
+			case msg.Intent == "Joiner" && h.kicked[msg.From.ID]:
+				// A client the leader has thrown out; tell it and then
+				// just track it quietly
+				c := msg.From
+				caseLog := fLog.New("cid", c.ID, "cref", c.Ref)
+				caseLog.Debug("Kicked client trying to join")
+
+				h.connect(c, NewQueue())
+				c.Pending <- &Envelope{Intent: "Kicked"}
+				h.justTrack(c)
+
+			case msg.Intent == "Joiner" &&
+				msg.From.BestEffort &&
+				h.otherJoined(msg.From) != nil &&
+				h.missed(msg.From.ID, msg.From.Num):
+				// New client taking over from old client, but some
+				// envelopes it wants have gone; it's happy to carry on
+				// from what we have
+				c := msg.From
+				caseLog := fLog.New("cid", c.ID, "cref", c.Ref)
+				cOld := h.otherJoined(msg.From)
+				caseLog.Debug("New client taking over, missing some",
+					"oldcref", cOld.Ref, "num", c.Num)
+
+				// Tell it what it's missed first, then start it off
+				// from the oldest envelope we have
+				oldest := h.buffer.Oldest(c.ID)
+				q := h.queueFrom(c.ID, oldest)
+				q.PriorityAdd(h.missedEnvelope(c, oldest))
+				h.replace(c, q, cOld)
+
 			case msg.Intent == "Joiner" &&
 				!h.canFulfill(msg.From.ID, msg.From.Num):
 				// New client but bad lastnum; tell the client and then
@@ -127,7 +483,7 @@ readingLoop:
 
 				// Tell the client there's an error
 				h.connect(c, NewQueue())
-				c.Pending <- &Envelope{Intent: "BadLastnum"}
+				c.Pending <- &Envelope{Intent: "BadLastnum", You: c.ID}
 				h.justTrack(c)
 
 			case msg.Intent == "Joiner" &&
@@ -141,7 +497,22 @@ readingLoop:
 				caseLog.Debug("New client taking over", "oldcref", cOld.Ref)
 
 				// Let the new client replace the old client and start it off
-				h.replace(c, h.buffer.Queue(c.ID, c.Num), cOld)
+				h.replace(c, h.queueFrom(c.ID, c.Num), cOld)
+
+			case msg.Intent == "Joiner" &&
+				h.settings.StrictID &&
+				h.otherJoined(msg.From) != nil &&
+				msg.From.Num < 0:
+				// New client for old ID, but didn't ask to take over,
+				// and the room won't let it replace the old client;
+				// tell it and then just track it quietly
+				c := msg.From
+				caseLog := fLog.New("cid", c.ID, "cref", c.Ref)
+				caseLog.Debug("New client for taken ID in strict room")
+
+				h.connect(c, NewQueue())
+				c.Pending <- &Envelope{Intent: "IDTaken"}
+				h.justTrack(c)
 
 			case msg.Intent == "Joiner" &&
 				h.otherJoined(msg.From) != nil &&
@@ -158,17 +529,23 @@ readingLoop:
 				h.justTrack(cOld)
 
 				// Next, send leaver messages to all the clients
-				h.leaver(cOld)
-				h.num++
+				h.leaver(cOld, "replaced")
+				h.left(cOld)
 
 				// Then add the new client and start it going with an
 				// empty queue
 				h.connect(c, NewQueue())
+				newLeader := h.joined(c)
 
-				// Finally send joiner/welcome messages
-				h.joiner(c)
+				// Finally send joiner/welcome messages, and say who
+				// leads if that's new
+				envJ := h.joiner(c)
 				h.welcome(c)
-				h.num++
+				h.selfJoiner(c, envJ)
+				h.replayHistory(c)
+				if newLeader {
+					h.announceLeader(c)
+				}
 
 			case msg.Intent == "Joiner" && h.otherJoined(msg.From) == nil:
 				// New joiner
@@ -176,19 +553,192 @@ readingLoop:
 				caseLog := fLog.New("cid", c.ID, "cref", c.Ref)
 				caseLog.Debug("New joiner")
 
-				// Connect the new client
-				h.connect(c, NewQueue())
+				// Connect the new client. The first one leads. If the
+				// room's been restored after a restart the client may
+				// be carrying on, so it gets what it's missed first.
+				q := NewQueue()
+				if c.Num >= 0 {
+					q = h.queueFrom(c.ID, c.Num)
+				}
+				h.connect(c, q)
+				newLeader := h.joined(c)
 
-				// Send joiner and welcome messages
-				h.joiner(c)
+				// Send joiner and welcome messages, and say who leads
+				// if that's new
+				envJ := h.joiner(c)
 				h.welcome(c)
-				h.num++
+				h.selfJoiner(c, envJ)
+				h.replayHistory(c)
+				if newLeader {
+					h.announceLeader(c)
+				}
 
 			case msg.Intent == "LostConnection":
 				// A client receiver has lost the connection
 				c := msg.From
 				fLog.Debug("Got lost connection", "cid", c.ID, "cref", c.Ref)
-				h.disconnect(c)
+				if h.connected(c) {
+					h.disconnect(c)
+					h.away(c)
+				}
+
+			case msg.Intent == "TooBig":
+				// A client sent a message over the read limit. Tell
+				// it what the limit is, then close its connection.
+				c := msg.From
+				fLog.Debug("Got too big message", "cid", c.ID, "cref", c.Ref)
+				if h.connected(c) {
+					b := h.newBroadcast("Error", []string{}, []string{c.ID})
+					b.Reason = "Message too big"
+					b.Limits = h.limits(c)
+					h.sendOnly(c, b.Envelope(false))
+					c.Pending <- &Envelope{Intent: "TooBig"}
+					h.disconnect(c)
+					h.away(c)
+				}
+
+			case msg.Intent == "Goodbye":
+				// A client is leaving deliberately, so it won't reconnect
+				c := msg.From
+				caseLog := fLog.New("cid", c.ID, "cref", c.Ref)
+				caseLog.Debug("Got goodbye")
+
+				if !h.stillJoined(c) {
+					caseLog.Debug("Client already gone; no messages to send")
+					break
+				}
+
+				// Only track it quietly, and tell the others it's left
+				if h.connected(c) {
+					c.gone = true
+				}
+				h.justTrack(c)
+				h.leaver(c, "closed")
+				h.left(c)
+
+			case msg.Intent == "Time":
+				// A client wants to know the server time; just tell it
+				c := msg.From
+				fLog.Debug("Got time request", "cid", c.ID, "cref", c.Ref)
+				b := h.newBroadcast("Time", []string{}, []string{c.ID})
+				b.Token = msg.Token
+				h.sendOnly(c, b.Envelope(false))
+
+			case msg.Intent == "Roster":
+				// A client wants to know who's in the room
+				c := msg.From
+				fLog.Debug("Got roster request", "cid", c.ID, "cref", c.Ref)
+				b := h.newBroadcast("Roster", []string{}, []string{c.ID})
+				b.Token = msg.Token
+				b.Members = h.members()
+				h.sendOnly(c, b.Envelope(false))
+
+			case msg.Intent == "Stats":
+				// A client wants to know how the room's doing
+				c := msg.From
+				fLog.Debug("Got stats request", "cid", c.ID, "cref", c.Ref)
+				b := h.newBroadcast("Stats", []string{}, []string{c.ID})
+				b.Token = msg.Token
+				b.Stats = h.stats(c)
+				h.sendOnly(c, b.Envelope(false))
+
+			case msg.Intent == "Echo":
+				// A client wants its message straight back
+				c := msg.From
+				fLog.Debug("Got echo request", "cid", c.ID, "cref", c.Ref)
+				b := h.newBroadcast("Echo", []string{}, []string{c.ID})
+				b.Body = msg.Body
+				h.sendOnly(c, b.Envelope(false))
+
+			case msg.Intent == "Replay":
+				// A client wants some envelopes again
+				c := msg.From
+				fLog.Debug("Got replay request", "cid", c.ID, "cref", c.Ref,
+					"num", msg.Num)
+				h.replay(c, msg.Num, msg.Token)
+
+			case msg.Intent == "Reassign":
+				// The leader wants a client to have another's ID
+				c := msg.From
+				fLog.Debug("Got reassign request", "cid", c.ID, "cref", c.Ref,
+					"id", msg.ID, "as", msg.As)
+				h.reassign(c, msg.ID, msg.As, msg.Token)
+
+			case msg.Intent == "CreateSpectatorLink":
+				// The leader wants a link for spectators
+				c := msg.From
+				fLog.Debug("Got spectator link request", "cid", c.ID,
+					"cref", c.Ref)
+				h.createLink(c, msg.Token)
+
+			case msg.Intent == "Reseed":
+				// The leader wants a new seed
+				c := msg.From
+				fLog.Debug("Got reseed request", "cid", c.ID, "cref", c.Ref)
+				h.reseed(c, msg.Token)
+
+			case msg.Intent == "Pause":
+				// The leader wants to stop messages going out
+				c := msg.From
+				fLog.Debug("Got pause request", "cid", c.ID, "cref", c.Ref)
+				h.pause(c, msg.Token)
+
+			case msg.Intent == "Resume":
+				// The leader wants messages to go out again
+				c := msg.From
+				fLog.Debug("Got resume request", "cid", c.ID, "cref", c.Ref)
+				h.resume(c, msg.Token)
+
+			case msg.Intent == "SetTurn":
+				// The leader says whose turn it is
+				c := msg.From
+				fLog.Debug("Got set turn request", "cid", c.ID, "cref", c.Ref,
+					"id", msg.ID)
+				h.setTurn(c, msg.ID, msg.Token)
+
+			case msg.Intent == "PassTurn":
+				// A client says its turn is over
+				c := msg.From
+				fLog.Debug("Got pass turn request", "cid", c.ID, "cref", c.Ref)
+				h.passTurn(c, msg.Token)
+
+			case msg.Intent == "Rename":
+				// A client wants to go by another name
+				c := msg.From
+				fLog.Debug("Got rename request", "cid", c.ID, "cref", c.Ref)
+				h.rename(c, msg.Name, msg.Token)
+
+			case msg.Intent == "Roll":
+				// A client wants some dice rolled
+				c := msg.From
+				fLog.Debug("Got roll request", "cid", c.ID, "cref", c.Ref,
+					"sides", msg.Sides, "count", msg.Count)
+				h.roll(c, msg.Sides, msg.Count, msg.Token)
+
+			case msg.Intent == "SetState":
+				// A client wants to store some state
+				c := msg.From
+				caseLog := fLog.New("cid", c.ID, "cref", c.Ref)
+				caseLog.Debug("Got SetState", "key", msg.Key)
+
+				h.setState(c, msg.Key, msg.Body, msg.Token)
+
+			case msg.Intent == "Kick":
+				// The leader wants to throw a client out
+				c := msg.From
+				fLog.Debug("Got kick request", "cid", c.ID, "cref", c.Ref,
+					"id", msg.ID)
+				h.kick(c, msg.ID, msg.Token)
+
+			case msg.Intent == "Error":
+				// Something the client sent went wrong; tell it
+				c := msg.From
+				fLog.Debug("Got error", "cid", c.ID, "cref", c.Ref,
+					"reason", msg.Reason)
+				b := h.newBroadcast("Error", []string{}, []string{c.ID})
+				b.Token = msg.Token
+				b.Reason = msg.Reason
+				h.sendOnly(c, b.Envelope(false))
 
 			case msg.Intent == "Peer":
 				// We have a peer message
@@ -196,46 +746,101 @@ readingLoop:
 				caseLog := fLog.New("cid", c.ID, "cref", c.Ref)
 				caseLog.Debug("Got peer msg", "content", string(msg.Body))
 
-				toCls := h.joinedExcluding(c)
-				envP := &Envelope{
-					From:    []string{c.ID},
-					To:      ids(toCls),
-					Num:     h.num,
-					Time:    nowMs(),
-					Intent:  "Peer",
-					Receipt: false,
-					Body:    msg.Body,
+				if c.Role == OBSERVER {
+					caseLog.Debug("Observer can't send peer msg")
+					b := h.newBroadcast("Error", []string{}, []string{c.ID})
+					b.Reason = "Observers can't send messages"
+					h.sendOnly(c, b.Envelope(false))
+					break
+				}
+
+				if h.turn != "" && c.ID != h.turn && c.ID != h.leader {
+					caseLog.Debug("Not client's turn")
+					b := h.newBroadcast("Error", []string{}, []string{c.ID})
+					b.Reason = "Not your turn"
+					env := b.Envelope(false)
+					env.Tag = msg.Tag
+					h.sendOnly(c, env)
+					break
 				}
 
+				if !h.allowPeer(c, msg) {
+					caseLog.Debug("Dropping peer msg over room limit")
+					break
+				}
+
+				h.active()
+				h.relay(msg)
+				toCls := h.joinedExcluding(c)
+				b := h.newBroadcast(
+					"Peer", []string{c.ID}, h.playerIDsExcluding(c),
+				)
+				b.Body = msg.Body
+				b.Encoding = encoding(msg.Type, msg.Body)
+				b.TTL = msg.TTL
+
+				h.history.Add(b)
 				caseLog.Debug("Sending peer messages")
+				envP := b.Envelope(false)
 				for _, cl := range toCls {
 					caseLog.Debug("Sending peer msg", "tocref", cl.Ref)
 					h.send(cl, envP)
 				}
 
-				caseLog.Debug("Sending receipt")
-				envR := &Envelope{
-					From:    envP.From,
-					To:      envP.To,
-					Num:     envP.Num,
-					Time:    envP.Time,
-					Intent:  "Peer",
-					Receipt: true,
-					Body:    envP.Body,
+				if c.Receipts && !msg.NoReceipt {
+					caseLog.Debug("Sending receipt")
+					envR := b.Envelope(true)
+					envR.Tag = msg.Tag
+					h.send(c, envR)
 				}
-				h.send(c, envR)
-
-				// Set the next message num
-				h.num++
 
 			default:
 				// Should never get here
 				fLog.Error("Cannot handle message", "msg", msg)
 			}
-			h.buffer.Clean()
+			if !h.paused {
+				// Nothing can be cleaned away until it's been sent
+				h.buffer.Clean()
+			}
+		}
+
+		h.countPlayers()
+		if arriving != nil {
+			// Now the client's counted as a player, if it's joined,
+			// the superhub needn't count it as one still to come
+			h.shub.arrived(h, arriving)
+			arriving = nil
 		}
+	}
+}
 
+// countPlayers updates which players are still joined, by ID.
+func (h *Hub) countPlayers() {
+	ids := make(map[string]bool)
+	for c := range h.clients {
+		if c.Role == PLAYER && h.stillJoined(c) {
+			ids[c.ID] = true
+		}
 	}
+	h.countMux.Lock()
+	defer h.countMux.Unlock()
+	h.players = ids
+}
+
+// Players says how many players are still joined, connected or not,
+// counting each ID once. It's safe to call from outside the hub.
+func (h *Hub) Players() int {
+	h.countMux.Lock()
+	defer h.countMux.Unlock()
+	return len(h.players)
+}
+
+// HasPlayer says if a player with the given ID is still joined,
+// connected or not. It's safe to call from outside the hub.
+func (h *Hub) HasPlayer(id string) bool {
+	h.countMux.Lock()
+	defer h.countMux.Unlock()
+	return h.players[id]
 }
 
 // now in milliseconds past the epock
@@ -243,9 +848,16 @@ func nowMs() int64 {
 	return time.Now().UnixNano() / 1000000
 }
 
-// canFulfill says if we can send the next num the client is expecting
+// canFulfill says if we can send the next num the client is expecting.
+// Each client ID has its own sequence of nums.
 func (h *Hub) canFulfill(id string, num int) bool {
-	return num < 0 || num == h.num || h.buffer.Available(id, num)
+	return num < 0 || num == h.buffer.Next(id) || h.buffer.Available(id, num)
+}
+
+// missed says if a client expecting the given num has missed some
+// envelopes, because they've been cleaned from the buffer.
+func (h *Hub) missed(id string, num int) bool {
+	return num >= 0 && num < h.buffer.Oldest(id)
 }
 
 // Is a client known and connected?
@@ -269,11 +881,17 @@ func (h *Hub) tracked(c *Client) bool {
 }
 
 // remove a client from the list of tracked clients. This like replace,
-// but there's no new client, so the buffer is lost.
+// but there's no new client, so the buffer is lost. But if another
+// client with the same ID is still tracked then the buffer is still theirs.
 func (h *Hub) remove(c *Client) {
 	aLog.Debug("Removing client", "fn", "hub.remove",
 		"cid", c.ID, "cref", c.Ref)
 	delete(h.clients, c)
+	for c2 := range h.clients {
+		if c2.ID == c.ID {
+			return
+		}
+	}
 	h.buffer.Remove(c.ID)
 }
 
@@ -310,7 +928,9 @@ func (h *Hub) justTrack(c *Client) {
 }
 
 // replace has a new (connected) client replacing an old joined one.
-// The old one is shut down if it's still connected and we just track it.
+// The old one is shut down if it's still connected, with a close frame
+// saying it's been superseded. There's no reconnection to wait for, so
+// the superhub stops timing it out and we forget it straight away.
 // The new client is started off with the given queue.
 func (h *Hub) replace(cNew *Client, qNew *Queue, cOld *Client) {
 	fLog := aLog.New("fn", "hub.replace", "cnewref", cNew.Ref,
@@ -320,70 +940,1171 @@ func (h *Hub) replace(cNew *Client, qNew *Queue, cOld *Client) {
 		fLog.Error("Old client not known")
 		return
 	}
+	wasAway := h.mayReconnect(cOld)
 	if h.connected(cOld) {
-		fLog.Debug("Closing old channel")
+		fLog.Debug("Closing old connection and channel")
+		cOld.Pending <- &Envelope{Intent: "Superseded"}
 		close(cOld.Pending)
 	}
-	h.clients[cOld] = TRACKEDONLY
 	h.clients[cNew] = CONNECTED
+	h.remove(cOld)
+	h.shub.Superseded(h, cOld)
+	if cNew.Role == PLAYER {
+		h.setName(cNew)
+		h.setMeta(cNew)
+	}
 	cNew.InitialQueue <- qNew
+	if wasAway {
+		h.back(cNew)
+	}
+}
+
+// close shuts the room down, for the given reason. Everyone is told
+// and their connections are closed, without waiting for them to
+// reconnect, and the superhub forgets the room so anyone else trying to
+// join gets a new one. We carry on until the superhub has timed out all
+// the clients, as usual.
+func (h *Hub) close(reason string) {
+	h.closeFor(reason, 0, "Closed")
+}
+
+// shutdown closes the room because the server is shutting down. As
+// well as being told, everyone is told when to try reconnecting, and
+// their connections are closed as going away.
+func (h *Hub) shutdown() {
+	if h.closing {
+		return
+	}
+	// Clients should be able to carry on from here after a restart
+	h.buffer.Keep()
+	h.closeFor("shutdown", shutdownRetry.Milliseconds(), "GoingAway")
+}
+
+// forceClose closes the room because an operator has said to, such as
+// if it's got into a bad state. Nothing is kept for anyone to carry on
+// from.
+func (h *Hub) forceClose() {
+	if !h.closing {
+		h.closeFor("operator", 0, "ForceClosed")
+	}
+	for c := range h.clients {
+		h.buffer.Remove(c.ID)
+	}
+}
+
+// restart has a client that's carrying on from before an operator
+// closed the room start again, as nothing was kept for it. Only a
+// client whose lastnum this hub can't fulfill is affected.
+func (h *Hub) restart(c *Client) {
+	if h.restarted && !h.canFulfill(c.ID, c.Num) {
+		c.Num = -1
+	}
+}
+
+// closeIdle closes the room because it's been idle too long.
+func (h *Hub) closeIdle() {
+	h.closeFor("idle", 0, "IdleClosed")
+}
+
+// closeFor closes the room for the given reason, saying how many
+// milliseconds to wait before trying to reconnect, if it's worth it,
+// and telling each client to close with the given internal intent.
+func (h *Hub) closeFor(reason string, retryMs int64, intent string) {
+	aLog.Info("Closing room", "fn", "hub.close", "room", h.room,
+		"reason", reason)
+	h.closing = true
+	b := h.newBroadcast("Closing", []string{}, h.allPlayerIDs())
+	b.Reason = reason
+	b.RetryMs = retryMs
+	for _, c := range h.allJoined() {
+		if h.connected(c) {
+			h.sendOnly(c, b.Envelope(false))
+			c.gone = true
+			c.Pending <- &Envelope{Intent: intent}
+		}
+		h.justTrack(c)
+	}
+
+	WG.Add(1)
+	go func() {
+		defer WG.Done()
+		h.shub.forget(h)
+	}()
+}
+
+// allowPeer says if a peer message can go through the room without
+// going over its limit. If not, and the strategy is to delay, we wait
+// until it can, otherwise we tell the sender it's dropped.
+func (h *Hub) allowPeer(c *Client, msg *Message) bool {
+	if h.peerBucket.take(roomMsgRate, roomMsgBurst) {
+		return true
+	}
+
+	h.peerOver++
+	if time.Since(h.peerLogged) >= roomMsgLogFreq {
+		aLog.Warn("Room over message rate", "fn", "hub.allowPeer",
+			"room", h.room, "over", h.peerOver, "strategy", roomMsgStrategy)
+		h.peerLogged = time.Now()
+		h.peerOver = 0
+	}
+
+	if roomMsgStrategy == DELAYREADS {
+		time.Sleep(h.peerBucket.wait(roomMsgRate))
+		h.peerBucket.take(roomMsgRate, roomMsgBurst)
+		return true
+	}
+
+	b := h.newBroadcast("Error", []string{}, []string{c.ID})
+	b.Reason = "Room too busy"
+	env := b.Envelope(false)
+	env.Tag = msg.Tag
+	h.sendOnly(c, env)
+	return false
+}
+
+// setState stores a value under a key in the room's state, or deletes
+// the key if the value is null, and tells everyone. Whoever sets it
+// last wins.
+func (h *Hub) setState(c *Client, key string, value json.RawMessage, token string) {
+	reason := ""
+	size := h.stateSize
+	if old, ok := h.state[key]; ok {
+		size -= len(key) + len(old)
+	}
+	if string(value) != "null" {
+		size += len(key) + len(value)
+	}
+	switch {
+	case c.Role == OBSERVER:
+		reason = "Observers can't set state"
+	case size > maxStateSize:
+		reason = "State too large"
+	}
+	if reason != "" {
+		b := h.newBroadcast("Error", []string{}, []string{c.ID})
+		b.Token = token
+		b.Reason = reason
+		h.sendOnly(c, b.Envelope(false))
+		return
+	}
+
+	if string(value) == "null" {
+		delete(h.state, key)
+	} else {
+		h.state[key] = value
+	}
+	h.stateSize = size
+
+	b := h.newBroadcast("State", []string{c.ID}, h.allPlayerIDs())
+	b.Key = key
+	b.Body = value
+	b.Token = token
+	env := b.Envelope(false)
+	for _, cl := range h.allJoined() {
+		h.send(cl, env)
+	}
+}
+
+// currentState is a copy of all the room's state, or nil if there's
+// none.
+func (h *Hub) currentState() map[string]json.RawMessage {
+	if len(h.state) == 0 {
+		return nil
+	}
+	state := make(map[string]json.RawMessage, len(h.state))
+	for k, v := range h.state {
+		state[k] = v
+	}
+	return state
+}
+
+// active notes there's been some activity in the room, so it's not idle.
+func (h *Hub) active() {
+	h.lastActive = time.Now()
+	h.idleWarned = false
+}
+
+// checkIdle warns everyone if the room has been idle too long, and
+// closes it if it's still idle some time after that.
+func (h *Hub) checkIdle() {
+	if h.closing {
+		return
+	}
+	idle := time.Since(h.lastActive)
+	switch {
+	case idle >= idleTimeout+idleGrace && h.idleWarned:
+		h.closeIdle()
+	case idle >= idleTimeout && !h.idleWarned:
+		aLog.Debug("Warning room is idle", "fn", "hub.checkIdle",
+			"room", h.room)
+		h.idleWarned = true
+		b := h.newBroadcast("Idle", []string{}, h.allPlayerIDs())
+		for _, c := range h.allJoined() {
+			if h.connected(c) {
+				h.sendOnly(c, b.Envelope(false))
+			}
+		}
+	}
+}
+
+// checkIdleClients warns any player that hasn't sent a peer message
+// for as long as the room allows, and closes its connection if it still
+// hasn't some time after that. Observers can't send peer messages, so
+// they're left alone.
+func (h *Hub) checkIdleClients() {
+	if h.settings.ClientIdle == 0 || h.closing {
+		return
+	}
+	now := nowMs()
+	for _, c := range h.allJoined() {
+		if !h.connected(c) || c.Role == OBSERVER {
+			continue
+		}
+		idle := time.Duration(now-atomic.LoadInt64(&c.lastPeer)) * time.Millisecond
+		switch {
+		case idle < h.settings.ClientIdle:
+			c.idleWarned = false
+		case idle >= h.settings.ClientIdle+clientIdleGrace && c.idleWarned:
+			h.closeIdleClient(c)
+		case !c.idleWarned:
+			aLog.Debug("Warning client is idle", "fn", "hub.checkIdleClients",
+				"cid", c.ID, "cref", c.Ref)
+			c.idleWarned = true
+			b := h.newBroadcast("Inactive", []string{}, []string{c.ID})
+			h.sendOnly(c, b.Envelope(false))
+		}
+	}
+}
+
+// closeIdleClient closes the connection of a player that's been idle
+// too long, without waiting for it to reconnect, and tells the others
+// it's left.
+func (h *Hub) closeIdleClient(c *Client) {
+	aLog.Info("Closing idle client", "room", h.room, "id", c.ID)
+	c.gone = true
+	c.Pending <- &Envelope{Intent: "ClientIdle"}
+	h.justTrack(c)
+	h.leaver(c, "idle")
+	h.left(c)
+}
+
+// joined records that client c has joined, after all the others. If
+// no-one leads then c does, and it returns true. Observers never lead.
+func (h *Hub) joined(c *Client) bool {
+	if c.Role == OBSERVER {
+		return false
+	}
+	h.setName(c)
+	h.setMeta(c)
+	h.joinOrder = append(h.joinOrder, c.ID)
+	if h.leader != "" {
+		return false
+	}
+	h.leader = c.ID
+	return true
+}
+
+// left records that client c is no longer joined. If it led, the
+// longest joined of the others takes over, and they're all told.
+func (h *Hub) left(c *Client) {
+	delete(h.names, c.ID)
+	delete(h.metas, c.ID)
+	nextTurn := h.nextTurn(c.ID)
+	for i, id := range h.joinOrder {
+		if id == c.ID {
+			h.joinOrder = append(h.joinOrder[:i], h.joinOrder[i+1:]...)
+			break
+		}
+	}
+	if h.leader == c.ID {
+		h.leader = ""
+		if len(h.joinOrder) > 0 {
+			h.leader = h.joinOrder[0]
+			h.announceLeader(nil)
+		}
+	}
+	if h.turn == c.ID {
+		if nextTurn == c.ID {
+			nextTurn = ""
+		}
+		h.turn = nextTurn
+		h.announceTurn(nil)
+	}
+}
+
+// setName records the display name of joined client c, replacing
+// any name its ID had before.
+func (h *Hub) setName(c *Client) {
+	if c.Name == "" {
+		delete(h.names, c.ID)
+		return
+	}
+	h.names[c.ID] = c.Name
+}
+
+// rename gives client c a new display name, or none if it's empty,
+// and tells everyone, including c. Only players have names others
+// see, so an observer gets an Error, with its token.
+func (h *Hub) rename(c *Client, name string, token string) {
+	if c.Role == OBSERVER {
+		b := h.newBroadcast("Error", []string{}, []string{c.ID})
+		b.Token = token
+		b.Reason = "Not a player"
+		h.sendOnly(c, b.Envelope(false))
+		return
+	}
+	old := h.names[c.ID]
+	c.Name = name
+	h.setName(c)
+
+	b := h.newBroadcast("Renamed", []string{c.ID}, h.allPlayerIDs())
+	b.OldName = old
+	b.Names = h.namesOf(b.From)
+	env := b.Envelope(false)
+	for _, cl := range h.allJoined() {
+		h.send(cl, env)
+	}
+}
+
+// namesOf gives the display names of the players with the given IDs,
+// for those that have one, or nil if none do.
+func (h *Hub) namesOf(idLists ...[]string) map[string]string {
+	var names map[string]string
+	for _, ids := range idLists {
+		for _, id := range ids {
+			name, ok := h.names[id]
+			if !ok {
+				continue
+			}
+			if names == nil {
+				names = make(map[string]string)
+			}
+			names[id] = name
+		}
+	}
+	return names
+}
+
+// setMeta records the metadata of joined client c, replacing any
+// metadata its ID had before.
+func (h *Hub) setMeta(c *Client) {
+	if c.Meta == nil {
+		delete(h.metas, c.ID)
+		return
+	}
+	h.metas[c.ID] = c.Meta
+}
+
+// metasOf gives the metadata of the players with the given IDs, for
+// those that have some, or nil if none do.
+func (h *Hub) metasOf(idLists ...[]string) map[string]json.RawMessage {
+	var metas map[string]json.RawMessage
+	for _, ids := range idLists {
+		for _, id := range ids {
+			meta, ok := h.metas[id]
+			if !ok {
+				continue
+			}
+			if metas == nil {
+				metas = make(map[string]json.RawMessage)
+			}
+			metas[id] = meta
+		}
+	}
+	return metas
+}
+
+// nextTurn gives the ID of the client whose turn it is after the
+// client with the given ID, which is the next to have joined, or the
+// first if none joined after it.
+func (h *Hub) nextTurn(id string) string {
+	for i, id2 := range h.joinOrder {
+		if id2 == id {
+			return h.joinOrder[(i+1)%len(h.joinOrder)]
+		}
+	}
+	if len(h.joinOrder) > 0 {
+		return h.joinOrder[0]
+	}
+	return ""
+}
+
+// setTurn is for when the leader, client c, says whose turn it is.
+// After that only the client with that ID, and the leader, can send
+// peer messages, until the leader sets the turn to no-one with an
+// empty ID. Everyone is told. If the sender isn't the leader, or
+// there's no such client, it gets an Error, with its token.
+func (h *Hub) setTurn(c *Client, id string, token string) {
+	reason := ""
+	switch {
+	case c.ID != h.leader:
+		reason = "Not leader"
+	case id != "" && !h.isJoinedPlayer(id):
+		reason = "Cannot set turn"
+	}
+	if reason != "" {
+		b := h.newBroadcast("Error", []string{}, []string{c.ID})
+		b.Token = token
+		b.Reason = reason
+		h.sendOnly(c, b.Envelope(false))
+		return
+	}
+	h.turn = id
+	h.announceTurn(c)
+}
+
+// passTurn is for when client c says its turn is over, so it's the
+// turn of the next client to have joined. Everyone is told. If it
+// wasn't client c's turn it gets an Error, with its token.
+func (h *Hub) passTurn(c *Client, token string) {
+	if h.turn == "" || c.ID != h.turn {
+		b := h.newBroadcast("Error", []string{}, []string{c.ID})
+		b.Token = token
+		b.Reason = "Not your turn"
+		h.sendOnly(c, b.Envelope(false))
+		return
+	}
+	h.turn = h.nextTurn(c.ID)
+	h.announceTurn(c)
+}
+
+// announceTurn tells everyone whose turn it is. It's from client c,
+// unless that's nil.
+func (h *Hub) announceTurn(c *Client) {
+	aLog.Debug("Sending turn messages", "fn", "hub.announceTurn",
+		"turn", h.turn)
+	from := []string{}
+	if c != nil {
+		from = []string{c.ID}
+	}
+	b := h.newBroadcast("Turn", from, h.allPlayerIDs())
+	b.Turn = h.turn
+	env := b.Envelope(false)
+	for _, cl := range h.allJoined() {
+		h.send(cl, env)
+	}
+}
+
+// isJoinedPlayer says if the given ID is of a player that's still
+// joined.
+func (h *Hub) isJoinedPlayer(id string) bool {
+	for _, id2 := range h.joinOrder {
+		if id2 == id {
+			return true
+		}
+	}
+	return false
 }
 
 // welcome sends a Welcome message to just this client.
 func (h *Hub) welcome(c *Client) {
 	aLog.Debug("Sending welcome", "fn", "hub.welcome",
 		"cid", c.ID, "cref", c.Ref)
-	env := &Envelope{
-		To:     []string{c.ID},
-		From:   h.joinedIDsExcluding(c),
-		Num:    h.num,
-		Time:   nowMs(),
-		Intent: "Welcome",
+	b := h.newBroadcast("Welcome", h.playerIDsExcluding(c), []string{c.ID})
+	b.Version = ProtocolVersion
+	b.Limits = h.limits(c)
+	b.Leader = h.leader
+	b.State = h.currentState()
+	b.Seed = h.seed
+	b.Turn = h.turn
+	b.You = c.ID
+	b.Names = h.namesOf(b.From, b.To)
+	b.Metas = h.metasOf(b.From, b.To)
+	env := b.Envelope(false)
+	env.NextNum = h.buffer.Next(c.ID) + 1
+	h.deliver(c, h.buffer.Add(c.ID, env))
+}
+
+// newRoomHistory creates the history of peer messages a room with the
+// given settings keeps, which is all of them if it keeps its full
+// history, within limits.
+func newRoomHistory(rs RoomSettings) *History {
+	if rs.FullHistory {
+		return NewHistory(fullHistoryCount, fullHistoryBytes)
 	}
-	h.buffer.Add(c.ID, env)
-	c.Pending <- env
+	return NewHistory(rs.History, 0)
+}
+
+// replayHistory sends a new joiner the recent peer messages, as Replay
+// messages from their original senders and at their original times,
+// in order and before any live ones. They're numbered for the joiner
+// like any other envelope, and buffered as if just sent, so they
+// aren't sent again if it reconnects. Any that have expired are left
+// out.
+func (h *Hub) replayHistory(c *Client) {
+	now := nowMs()
+	q := NewQueue()
+	for _, b := range h.history.All() {
+		env := b.Envelope(false)
+		if env.expired(now) {
+			continue
+		}
+		env.Intent = "Replay"
+		env.To = []string{c.ID}
+		q.Add(h.buffer.AddAt(c.ID, env, now))
+	}
+	if !h.connected(c) {
+		return
+	}
+	for !q.Empty() {
+		env, _ := q.Get()
+		h.deliver(c, env)
+	}
+}
+
+// limits gives the limits client c needs to respect in this hub.
+func (h *Hub) limits(c *Client) *Limits {
+	freq, timeout := c.pingTimes()
+	return &Limits{
+		MaxMessageBytes: h.settings.ReadLimit,
+		MaxChunkedBytes: h.settings.ChunkedLimit,
+		MaxClients:      h.settings.MaxClients,
+		PingFreqMs:      freq.Milliseconds(),
+		PongTimeoutMs:   timeout.Milliseconds(),
+		ReconnectionMs:  h.settings.Reconnection.Milliseconds(),
+		ClientIdleMs:    h.settings.ClientIdle.Milliseconds(),
+	}
+}
+
+// missedEnvelope creates a Missed message for client c, which expects
+// its envelopes to continue from c.Num but we can only continue from
+// the given num. It isn't buffered, but its num is that of the last
+// envelope missed, so the client's next num follows on from it.
+func (h *Hub) missedEnvelope(c *Client, from int) *Envelope {
+	b := h.newBroadcast("Missed", []string{}, []string{c.ID})
+	b.Missed = []int{c.Num, from - 1}
+	env := b.Envelope(false)
+	env.Num = from - 1
+	return env
 }
 
 // joiner sends a Joiner message to all clients (except c), about joiner c.
-func (h *Hub) joiner(c *Client) {
+// No-one is told about an observer. It returns the Joiner, or nil if
+// there wasn't one. If c wants it too, it's included in who it's to.
+func (h *Hub) joiner(c *Client) *Envelope {
+	if c.Role == OBSERVER {
+		return nil
+	}
 	aLog.Debug("Sending joiner messages", "fn", "hub.joiner",
 		"cid", c.ID, "cref", c.Ref)
-	env := &Envelope{
-		From:   []string{c.ID},
-		To:     h.joinedIDsExcluding(c),
-		Num:    h.num,
-		Time:   nowMs(),
-		Intent: "Joiner",
+	h.active()
+	to := h.playerIDsExcluding(c)
+	if c.SelfJoin {
+		to = h.allPlayerIDs()
 	}
+	b := h.newBroadcast("Joiner", []string{c.ID}, to)
+	b.Names = h.namesOf(b.From, b.To)
+	b.Metas = h.metasOf(b.From, b.To)
+	env := b.Envelope(false)
 
 	for _, cl := range h.allJoined() {
 		if cl != c {
 			h.send(cl, env)
 		}
 	}
+	h.notify(c, "Joiner")
+	h.hooks.clientJoined(h.room, c.ID)
+	return env
 }
 
-// leaver message sent to all joined clients about leaver c.
-func (h *Hub) leaver(c *Client) {
-	aLog.Debug("Sending leaver messages", "fn", "hub.leaver",
-		"cid", c.ID, "cref", c.Ref)
-	env := &Envelope{
-		From:   []string{c.ID},
-		To:     h.allJoinedIDs(),
-		Num:    h.num,
-		Time:   nowMs(),
-		Intent: "Leaver",
+// selfJoiner sends joiner c its own Joiner message, if it wants it.
+// It must come after its Welcome.
+func (h *Hub) selfJoiner(c *Client, env *Envelope) {
+	if env == nil || !c.SelfJoin {
+		return
+	}
+	h.send(c, env)
+}
+
+// announceLeader sends a Leader message to all joined clients (except c),
+// saying which client leads. Client c, if any, will have been told in
+// its Welcome.
+func (h *Hub) announceLeader(c *Client) {
+	aLog.Debug("Sending leader messages", "fn", "hub.announceLeader",
+		"leader", h.leader)
+	b := h.newBroadcast("Leader", []string{}, h.playerIDsExcluding(c))
+	b.Leader = h.leader
+	env := b.Envelope(false)
+	for _, cl := range h.allJoined() {
+		if cl != c {
+			h.send(cl, env)
+		}
+	}
+}
+
+// away sends an Away message to all joined clients (except c), saying
+// c has lost its connection and may reconnect. No-one is told about an
+// observer.
+func (h *Hub) away(c *Client) {
+	h.presence(c, "Away")
+}
+
+// back sends a Back message to all joined clients (except c), saying
+// c has reconnected after being away. No-one is told about an observer.
+func (h *Hub) back(c *Client) {
+	h.presence(c, "Back")
+}
+
+// presence sends a message with the given intent to all joined
+// clients (except c), about c, unless it's an observer.
+func (h *Hub) presence(c *Client, intent string) {
+	if c.Role == OBSERVER {
+		return
+	}
+	aLog.Debug("Sending presence messages", "fn", "hub.presence",
+		"cid", c.ID, "cref", c.Ref, "intent", intent)
+	env := h.newBroadcast(
+		intent, []string{c.ID}, h.playerIDsExcluding(c),
+	).Envelope(false)
+	for _, cl := range h.joinedExcluding(c) {
+		h.send(cl, env)
 	}
+}
+
+// leaver message sent to all joined clients about leaver c,
+// saying why it left. No-one is told about an observer.
+func (h *Hub) leaver(c *Client, reason string) {
+	if c.Role == OBSERVER {
+		return
+	}
+	aLog.Debug("Sending leaver messages", "fn", "hub.leaver",
+		"cid", c.ID, "cref", c.Ref, "reason", reason)
+	h.active()
+	b := h.newBroadcast("Leaver", []string{c.ID}, h.allPlayerIDs())
+	b.Reason = reason
+	b.Names = h.namesOf(b.From, b.To)
+	env := b.Envelope(false)
 	for _, cl := range h.allJoined() {
 		h.send(cl, env)
 	}
+	h.notify(c, "Leaver")
+	h.hooks.clientLeft(h.room, c.ID, reason)
+}
+
+// notify tells the webhook, if there is one, that client c has joined
+// or left, and how many players there are now.
+func (h *Hub) notify(c *Client, event string) {
+	Webhooks.Notify(&HookEvent{
+		Room:    h.room,
+		ID:      c.ID,
+		Event:   event,
+		Members: len(h.allPlayerIDs()),
+	})
 }
 
 // send an envelope to a client (if it's connected) and buffer it (either way).
+// The client gets its own copy, with the next num in its sequence.
 func (h *Hub) send(c *Client, env *Envelope) {
-	h.buffer.Add(c.ID, env)
+	env = h.buffer.Add(c.ID, env)
+	if h.paused {
+		if _, ok := h.held[c.ID]; !ok {
+			h.held[c.ID] = env.Num
+		}
+		return
+	}
 	if h.connected(c) {
-		c.Pending <- env
+		h.deliver(c, env)
+	}
+}
+
+// deliver gives an envelope to a connected client to send. If the
+// client has fallen too far behind its connection is closed as a slow
+// consumer and it gets nothing more. Losing the connection is then
+// handled like any other.
+func (h *Hub) deliver(c *Client, env *Envelope) {
+	if c.slow {
+		return
+	}
+	size := int64(len(env.Body))
+	total := atomic.AddInt64(&c.queuedBytes, size)
+	if total > int64(maxQueuedBytes) && total > size {
+		atomic.AddInt64(&c.queuedBytes, -size)
+		h.slowConsumer(c)
+		return
+	}
+	select {
+	case c.Pending <- env:
+		return
+	default:
+	}
+	timer := time.NewTimer(slowConsumerWait)
+	defer timer.Stop()
+	select {
+	case c.Pending <- env:
+	case <-timer.C:
+		atomic.AddInt64(&c.queuedBytes, -size)
+		h.slowConsumer(c)
+	}
+}
+
+// slowConsumer closes the connection of a client that's fallen too far
+// behind reading what we send it.
+func (h *Hub) slowConsumer(c *Client) {
+	aLog.Warn("Closing slow consumer", "fn", "hub.slowConsumer",
+		"room", h.room, "cid", c.ID, "cref", c.Ref)
+	c.slow = true
+	WG.Add(1)
+	go c.closeSlow()
+}
+
+// members lists the players in the room, longest joined first, saying
+// if each is connected or may reconnect, and which leads.
+func (h *Hub) members() []Member {
+	out := make([]Member, 0, len(h.joinOrder))
+	for _, id := range h.joinOrder {
+		for c, st := range h.clients {
+			if c.ID != id || !h.stillJoined(c) {
+				continue
+			}
+			state := "connected"
+			if st == MAYRECONNECT {
+				state = "reconnecting"
+			}
+			out = append(out, Member{
+				ID:     id,
+				State:  state,
+				Leader: id == h.leader,
+			})
+			break
+		}
+	}
+	return out
+}
+
+// relay counts a peer message being relayed, for the room's stats.
+func (h *Hub) relay(msg *Message) {
+	h.relayed++
+	h.relayedB += len(msg.Body)
+	atomic.AddInt64(&Counters.peersRelayed, 1)
+	atomic.AddInt64(&Counters.bytesRelayed, int64(len(msg.Body)))
+}
+
+// stats says how the room's doing, for client c, or for an operator if
+// c is nil. An operator gets the highest num sent to anyone, rather
+// than one client's nums, and also how many clients are connected or
+// may reconnect and when the room was last active.
+func (h *Hub) stats(c *Client) *Stats {
+	st := &Stats{
+		Messages: h.relayed,
+		Bytes:    h.relayedB,
+		Members:  len(h.allPlayerIDs()),
+		AgeMs:    time.Since(h.created).Milliseconds(),
+	}
+	if c != nil {
+		st.Num = h.buffer.Next(c.ID) - 1
+		st.OldestNum = h.buffer.Oldest(c.ID)
+	} else {
+		st.Num = -1
+		for cl := range h.clients {
+			if num := h.buffer.Next(cl.ID) - 1; num > st.Num {
+				st.Num = num
+			}
+			if h.connected(cl) {
+				st.Connected++
+			} else if h.mayReconnect(cl) {
+				st.Reconnecting++
+			}
+		}
+		st.LastActive = h.lastActive.UnixNano() / 1000000
+	}
+	now := nowMs()
+	bst := h.buffer.Stats()
+	st.Buffered = bst.Envelopes
+	st.BufferedBytes = bst.Bytes
+	if bst.OldestAt > 0 && now > bst.OldestAt {
+		st.OldestBufferedMs = now - bst.OldestAt
+	}
+	for cl := range h.clients {
+		if !h.connected(cl) {
+			continue
+		}
+		if depth := int(atomic.LoadInt64(&cl.queueDepth)); depth > st.MaxQueued {
+			st.MaxQueued = depth
+		}
+		oldest := atomic.LoadInt64(&cl.queueOldest)
+		if oldest > 0 && now-oldest > st.OldestQueuedMs {
+			st.OldestQueuedMs = now - oldest
+		}
+	}
+	return st
+}
+
+// ClientStats says how one client the room's tracking is doing, for
+// an operator.
+type ClientStats struct {
+	ID       string
+	Status   string // CONNECTED, MAYRECONNECT or TRACKEDONLY
+	Ref      string
+	Num      int   // Num of the last envelope sent to the client's ID
+	Buffered int   // How many envelopes are kept for its ID to resend
+	AgeMs    int64 // How long since it connected, in milliseconds
+}
+
+// clientStats says how every client the room's tracking is doing, in
+// order of ID and then ref.
+func (h *Hub) clientStats() []*ClientStats {
+	out := make([]*ClientStats, 0, len(h.clients))
+	for c, st := range h.clients {
+		next := h.buffer.Next(c.ID)
+		out = append(out, &ClientStats{
+			ID:       c.ID,
+			Status:   st.String(),
+			Ref:      c.Ref,
+			Num:      next - 1,
+			Buffered: next - h.buffer.Oldest(c.ID),
+			AgeMs:    time.Since(c.created).Milliseconds(),
+		})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].ID != out[j].ID {
+			return out[i].ID < out[j].ID
+		}
+		return out[i].Ref < out[j].Ref
+	})
+	return out
+}
+
+// post sends the hub a message that's not from a client, unless the
+// hub has finished, and says if it did.
+func (h *Hub) post(msg *Message) bool {
+	select {
+	case h.Pending <- msg:
+		return true
+	case <-h.done:
+		return false
+	}
+}
+
+// queueFrom gives the envelopes for some client ID from the given num
+// onwards, leaving out any that are being held back while the room is
+// paused.
+func (h *Hub) queueFrom(id string, num int) *Queue {
+	q := h.buffer.Queue(id, num)
+	held, ok := h.held[id]
+	if !ok {
+		return q
+	}
+	qOut := NewQueue()
+	for !q.Empty() {
+		env, _ := q.Get()
+		if env.Num < held {
+			qOut.Add(env)
+		}
+	}
+	return qOut
+}
+
+// pause is for when the leader, client c, wants to stop messages going
+// out. Everyone is told, and after that envelopes are numbered and
+// buffered as usual, but held back until the room is resumed. If the
+// sender isn't the leader, or the room's already paused, it gets an
+// Error, with its token.
+func (h *Hub) pause(c *Client, token string) {
+	reason := ""
+	switch {
+	case c.ID != h.leader:
+		reason = "Not leader"
+	case h.paused:
+		reason = "Already paused"
+	}
+	if reason != "" {
+		b := h.newBroadcast("Error", []string{}, []string{c.ID})
+		b.Token = token
+		b.Reason = reason
+		h.sendOnly(c, b.Envelope(false))
+		return
+	}
+
+	b := h.newBroadcast("Paused", []string{c.ID}, h.allPlayerIDs())
+	b.Token = token
+	env := b.Envelope(false)
+	for _, cl := range h.allJoined() {
+		h.send(cl, env)
+	}
+	h.paused = true
+}
+
+// resume is for when the leader, client c, wants messages to go out
+// again. Everything held back goes out in order, as if it had just been
+// sent, and then everyone is told. If the sender isn't the leader, or
+// the room isn't paused, it gets an Error, with its token.
+func (h *Hub) resume(c *Client, token string) {
+	reason := ""
+	switch {
+	case c.ID != h.leader:
+		reason = "Not leader"
+	case !h.paused:
+		reason = "Not paused"
+	}
+	if reason != "" {
+		b := h.newBroadcast("Error", []string{}, []string{c.ID})
+		b.Token = token
+		b.Reason = reason
+		h.sendOnly(c, b.Envelope(false))
+		return
+	}
+
+	now := nowMs()
+	for id, num := range h.held {
+		h.buffer.Resent(id, num, now)
+	}
+	for _, cl := range h.allJoined() {
+		num, ok := h.held[cl.ID]
+		if !ok || !h.connected(cl) {
+			continue
+		}
+		q := h.buffer.Queue(cl.ID, num)
+		for !q.Empty() {
+			env, _ := q.Get()
+			h.deliver(cl, env)
+		}
+	}
+	h.paused = false
+	h.held = make(map[string]int)
+
+	b := h.newBroadcast("Resumed", []string{c.ID}, h.allPlayerIDs())
+	b.Token = token
+	env := b.Envelope(false)
+	for _, cl := range h.allJoined() {
+		h.send(cl, env)
+	}
+}
+
+// replay sends a connected client its envelopes again, from the given
+// num onwards, before any live ones. The client is told first, so it can
+// drop any of them it's still waiting to send. If we don't have the
+// envelopes the client gets an Error, with its token.
+func (h *Hub) replay(c *Client, num int, token string) {
+	if !h.connected(c) {
+		return
+	}
+	if !h.buffer.Available(c.ID, num) {
+		b := h.newBroadcast("Error", []string{}, []string{c.ID})
+		b.Token = token
+		b.Reason = "Replay not available"
+		h.sendOnly(c, b.Envelope(false))
+		return
+	}
+	c.Pending <- &Envelope{Intent: "Resend", Num: num}
+	q := h.queueFrom(c.ID, num)
+	for !q.Empty() {
+		env, _ := q.Get()
+		h.deliver(c, env)
+	}
+}
+
+// reassign is for when the leader, client cl, says the connected client
+// with the given id is really the joined client with ID as, which has
+// lost its connection. It's for a player whose browser has forgotten its
+// ID, and is only allowed if the room was created with reassign=on.
+// The client takes over the old ID as if it had reconnected with it,
+// keeping the old ID's place in the room and its buffer. The client is
+// told its new ID and sent the envelopes we have for it, and the others
+// are told the old ID has reconnected and the temporary ID is retired,
+// with no Leaver. If anything's wrong the leader gets an Error, with its
+// token.
+func (h *Hub) reassign(cl *Client, id string, as string, token string) {
+	var c, cOld *Client
+	for c2, st := range h.clients {
+		if c2.ID == id && st == CONNECTED {
+			c = c2
+		}
+		if c2.ID == as && st == MAYRECONNECT {
+			cOld = c2
+		}
+	}
+
+	reason := ""
+	switch {
+	case !h.settings.Reassign:
+		reason = "Reassign not allowed"
+	case cl.ID != h.leader:
+		reason = "Not leader"
+	case c == nil || cOld == nil || id == h.leader:
+		reason = "Cannot reassign"
+	}
+	if reason != "" {
+		b := h.newBroadcast("Error", []string{}, []string{cl.ID})
+		b.Token = token
+		b.Reason = reason
+		h.sendOnly(cl, b.Envelope(false))
+		return
+	}
+
+	// Retire the temporary ID, and have the client take the old ID's
+	// place. The old client's channel is already closed.
+	h.clients[cOld] = TRACKEDONLY
+	for i, id2 := range h.joinOrder {
+		if id2 == id {
+			h.joinOrder = append(h.joinOrder[:i], h.joinOrder[i+1:]...)
+			break
+		}
+	}
+	h.buffer.Remove(id)
+	delete(h.names, id)
+	delete(h.metas, id)
+	c.setID(as)
+	h.setName(c)
+	h.setMeta(c)
+	if h.turn == id {
+		h.turn = as
+	}
+
+	// Drop anything the client still has queued for its temporary ID,
+	// tell it its new ID, and send it what we have for that
+	oldest := h.buffer.Oldest(as)
+	c.Pending <- &Envelope{Intent: "Resend", Num: 0}
+	b := h.newBroadcast("Reassigned", []string{}, []string{as})
+	b.Retired = id
+	env := b.Envelope(false)
+	env.NextNum = oldest
+	h.sendOnly(c, env)
+	q := h.queueFrom(as, oldest)
+	for !q.Empty() {
+		env, _ := q.Get()
+		h.deliver(c, env)
+	}
+
+	// Tell the others
+	b = h.newBroadcast(
+		"Reconnected", []string{as}, h.playerIDsExcluding(c),
+	)
+	b.Retired = id
+	env = b.Envelope(false)
+	for _, cl2 := range h.joinedExcluding(c) {
+		h.send(cl2, env)
+	}
+}
+
+// createLink is for when the leader, client c, wants a link that lets
+// others join the room as observers. It gets the link in a SpectatorLink
+// message, or an Error if it's not the leader, either with its token.
+func (h *Hub) createLink(c *Client, token string) {
+	if c.ID != h.leader {
+		b := h.newBroadcast("Error", []string{}, []string{c.ID})
+		b.Token = token
+		b.Reason = "Not leader"
+		h.sendOnly(c, b.Envelope(false))
+		return
+	}
+	b := h.newBroadcast("SpectatorLink", []string{}, []string{c.ID})
+	b.Token = token
+	b.Link = linkPath(h.room, mintLink(h.room, h.linkID))
+	h.sendOnly(c, b.Envelope(false))
+}
+
+// reseed is for when the leader, client c, wants a new random seed.
+// Everyone is sent it. If the sender isn't the leader it gets an Error,
+// with its token.
+func (h *Hub) reseed(c *Client, token string) {
+	if c.ID != h.leader {
+		b := h.newBroadcast("Error", []string{}, []string{c.ID})
+		b.Token = token
+		b.Reason = "Not leader"
+		h.sendOnly(c, b.Envelope(false))
+		return
+	}
+	h.seed = randomSeed()
+	b := h.newBroadcast("Seed", []string{c.ID}, h.allPlayerIDs())
+	b.Token = token
+	b.Seed = h.seed
+	env := b.Envelope(false)
+	for _, cl := range h.allJoined() {
+		h.send(cl, env)
+	}
+}
+
+// roll is for when client c wants some dice rolled. Everyone is sent
+// the results, so no-one has to trust anyone else's. An observer can't
+// roll, and gets an Error, with its token.
+func (h *Hub) roll(c *Client, sides int, count int, token string) {
+	if c.Role == OBSERVER {
+		b := h.newBroadcast("Error", []string{}, []string{c.ID})
+		b.Token = token
+		b.Reason = "Observers can't roll"
+		h.sendOnly(c, b.Envelope(false))
+		return
+	}
+	b := h.newBroadcast("Rolled", []string{c.ID}, h.allPlayerIDs())
+	b.Token = token
+	b.Roll = &Roll{
+		Sides:   sides,
+		Count:   count,
+		Results: rollDice(sides, count),
+	}
+	env := b.Envelope(false)
+	for _, cl := range h.allJoined() {
+		h.send(cl, env)
+	}
+}
+
+// rollDice gives the results of rolling count dice, each with the
+// given number of sides, numbered from 1.
+func rollDice(sides int, count int) []int {
+	results := make([]int, count)
+	for i := range results {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(sides)))
+		if err != nil {
+			panic(fmt.Sprintf("Couldn't roll a die: %s", err))
+		}
+		results[i] = int(n.Int64()) + 1
+	}
+	return results
+}
+
+// randomSeed is a new seed for the clients to share, which none of
+// them could have guessed.
+func randomSeed() uint64 {
+	return binary.BigEndian.Uint64(randomBytes(8))
+}
+
+// kick is for when the leader, client cl, wants to throw out the joined
+// client with the given id. That client's connection is closed, the
+// others are told it's left, and its ID can't join this room again. If
+// the sender isn't the leader, or there's no such client, it gets an
+// Error, with its token.
+func (h *Hub) kick(cl *Client, id string, token string) {
+	var c *Client
+	for c2 := range h.clients {
+		if c2.ID == id && h.stillJoined(c2) {
+			c = c2
+		}
+	}
+
+	reason := ""
+	switch {
+	case cl.ID != h.leader:
+		reason = "Not leader"
+	case c == nil || id == h.leader:
+		reason = "Cannot kick"
+	}
+	if reason != "" {
+		b := h.newBroadcast("Error", []string{}, []string{cl.ID})
+		b.Token = token
+		b.Reason = reason
+		h.sendOnly(cl, b.Envelope(false))
+		return
+	}
+
+	// Close its connection, if it has one, without waiting for it to
+	// reconnect
+	h.kicked[id] = true
+	if h.connected(c) {
+		c.gone = true
+		c.Pending <- &Envelope{Intent: "Kicked"}
+	}
+	h.justTrack(c)
+	h.leaver(c, "kicked")
+	h.left(c)
+}
+
+// sendOnly sends an envelope to a client if it's connected, without
+// buffering or numbering it. It's for envelopes that only matter at
+// the time, so the client won't get them again if it reconnects.
+func (h *Hub) sendOnly(c *Client, env *Envelope) {
+	env.Num = -1
+	if h.connected(c) {
+		h.deliver(c, env)
 	}
 }
 
@@ -410,38 +2131,31 @@ func (h *Hub) joinedExcluding(cx *Client) []*Client {
 	return cOut
 }
 
-// joinedIDsExcluding finds the IDs of all joined clients which aren't
-// the given client.
-func (h *Hub) joinedIDsExcluding(cx *Client) []string {
+// playerIDsExcluding finds the IDs of all joined players which aren't
+// the given client. These are what clients are told about, so observers
+// are left out.
+func (h *Hub) playerIDsExcluding(cx *Client) []string {
 	cOut := make([]string, 0)
 	for c, _ := range h.clients {
-		if c != cx && h.stillJoined(c) {
+		if c != cx && h.stillJoined(c) && c.Role == PLAYER {
 			cOut = append(cOut, c.ID)
 		}
 	}
 	return cOut
 }
 
-// allJoinedIDs returns all the IDs known to the hub
-func (h *Hub) allJoinedIDs() []string {
+// allPlayerIDs returns the IDs of all joined players, leaving out
+// observers
+func (h *Hub) allPlayerIDs() []string {
 	out := make([]string, 0)
 	for c, _ := range h.clients {
-		if h.stillJoined(c) {
+		if h.stillJoined(c) && c.Role == PLAYER {
 			out = append(out, c.ID)
 		}
 	}
 	return out
 }
 
-// ids returns just the IDs of the given clients
-func ids(cs []*Client) []string {
-	out := make([]string, len(cs))
-	for i, c := range cs {
-		out[i] = c.ID
-	}
-	return out
-}
-
 // otherJoined returns the other joined client with the same ID, or nil
 func (h *Hub) otherJoined(c *Client) *Client {
 	var cOther *Client
@@ -6,7 +6,12 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
 	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -17,14 +22,10 @@ import (
 // Tests for basic messages and message structure
 
 func TestHubMsgs_SendsWelcome(t *testing.T) {
-	// Just for this test, lower the reconnectionTimeout so that a
+	// Just for this test, lower the reconnection timeout so that a
 	// Leaver message is triggered reasonably quickly.
 
-	oldReconnectionTimeout := reconnectionTimeout
-	reconnectionTimeout = 250 * time.Millisecond
-	defer func() {
-		reconnectionTimeout = oldReconnectionTimeout
-	}()
+	useSuperhub(t, 250*time.Millisecond)
 
 	// Start a server
 	serv := newTestServer(bounceHandler)
@@ -58,15 +59,57 @@ func TestHubMsgs_SendsWelcome(t *testing.T) {
 	WG.Wait()
 }
 
+func TestHubMsgs_WelcomeGivesLimits(t *testing.T) {
+	// Just for this test, lower the reconnection timeout so that a
+	// Leaver message is triggered reasonably quickly. The Welcome
+	// should tell us about this lower value.
+
+	useSuperhub(t, 250*time.Millisecond)
+
+	// Start a server
+	serv := newTestServer(bounceHandler)
+	defer serv.Close()
+
+	// Connect to the server
+	ws, _, err := dial(serv, "/hub.welcome.limits", "WLIM", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws := newTConn(ws, "WLIM")
+	defer tws.close()
+
+	env, err := tws.readEnvelope(500, "Waiting for welcome")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Intent != "Welcome" {
+		t.Fatalf("Message intent was '%s' but expected 'Welcome'", env.Intent)
+	}
+	if env.Limits == nil {
+		t.Fatal("Welcome gave no limits")
+	}
+	exp := Limits{
+		MaxMessageBytes: readLimit,
+		MaxChunkedBytes: chunkedLimit,
+		MaxClients:      MaxClients,
+		PingFreqMs:      int64(pingFreq / time.Millisecond),
+		PongTimeoutMs:   int64(pongTimeout / time.Millisecond),
+		ReconnectionMs:  250,
+	}
+	if *env.Limits != exp {
+		t.Errorf("Welcome gave limits %#v but expected %#v", *env.Limits, exp)
+	}
+
+	// Tidy up, and check everything in the main app finishes
+	tws.close()
+	WG.Wait()
+}
+
 func TestHubMsgs_WelcomeIsFromExistingClients(t *testing.T) {
-	// Just for this test, lower the reconnectionTimeout so that a
+	// Just for this test, lower the reconnection timeout so that a
 	// Leaver message is triggered reasonably quickly.
 
-	oldReconnectionTimeout := reconnectionTimeout
-	reconnectionTimeout = 250 * time.Millisecond
-	defer func() {
-		reconnectionTimeout = oldReconnectionTimeout
-	}()
+	useSuperhub(t, 250*time.Millisecond)
 
 	// Start a server
 	serv := newTestServer(bounceHandler)
@@ -135,14 +178,10 @@ func TestHubMsgs_WelcomeIsFromExistingClients(t *testing.T) {
 }
 
 func TestHubMsgs_BasicMessageEnvelopeIsCorrect(t *testing.T) {
-	// Just for this test, lower the reconnectionTimeout so that a
+	// Just for this test, lower the reconnection timeout so that a
 	// Leaver message is triggered reasonably quickly.
 
-	oldReconnectionTimeout := reconnectionTimeout
-	reconnectionTimeout = 250 * time.Millisecond
-	defer func() {
-		reconnectionTimeout = oldReconnectionTimeout
-	}()
+	useSuperhub(t, 250*time.Millisecond)
 
 	// Start a server
 	serv := newTestServer(bounceHandler)
@@ -261,14 +300,10 @@ func TestHubMsgs_BasicMessageEnvelopeIsCorrect(t *testing.T) {
 }
 
 func TestHubMsgs_JoinerMessagesHappen(t *testing.T) {
-	// Just for this test, lower the reconnectionTimeout so that a
+	// Just for this test, lower the reconnection timeout so that a
 	// Leaver message is triggered reasonably quickly.
 
-	oldReconnectionTimeout := reconnectionTimeout
-	reconnectionTimeout = 250 * time.Millisecond
-	defer func() {
-		reconnectionTimeout = oldReconnectionTimeout
-	}()
+	useSuperhub(t, 250*time.Millisecond)
 
 	// Start a server
 	serv := newTestServer(bounceHandler)
@@ -420,14 +455,10 @@ func TestHubMsgs_LeaverMessagesHappen(t *testing.T) {
 	serv := newTestServer(bounceHandler)
 	defer serv.Close()
 
-	// Just for this test, lower the reconnectionTimeout so that a
+	// Just for this test, lower the reconnection timeout so that a
 	// Leaver message is triggered reasonably quickly.
 
-	oldReconnectionTimeout := reconnectionTimeout
-	reconnectionTimeout = 250 * time.Millisecond
-	defer func() {
-		reconnectionTimeout = oldReconnectionTimeout
-	}()
+	useSuperhub(t, 250*time.Millisecond)
 
 	// Connect 3 clients in turn. When one leaves the remaining
 	// ones should get leaver messages.
@@ -474,9 +505,15 @@ func TestHubMsgs_LeaverMessagesHappen(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	// Now ws1 will leave, and the others should get leaver messages
-	// once the reconnectionTimeout has expired
+	// Now ws1 will leave, and the others should hear it's away, then
+	// get leaver messages once the reconnection timeout has expired
 	tws1.close()
+	if err := swallowMany(
+		intentExp{"LV1 leaving, ws2", tws2, "Away"},
+		intentExp{"LV1 leaving, ws3", tws3, "Away"},
+	); err != nil {
+		t.Fatal(err)
+	}
 
 	// Let's check the ws2 first
 	rr, timedOut := tws2.readMessage(500)
@@ -542,14 +579,10 @@ func TestHubMsgs_LeaverMessagesHappen(t *testing.T) {
 }
 
 func TestHubMsgs_SendsErrorOverMaximumClients(t *testing.T) {
-	// Just for this test, lower the reconnectionTimeout so that a
+	// Just for this test, lower the reconnection timeout so that a
 	// Leaver message is triggered reasonably quickly.
 
-	oldReconnectionTimeout := reconnectionTimeout
-	reconnectionTimeout = 250 * time.Millisecond
-	defer func() {
-		reconnectionTimeout = oldReconnectionTimeout
-	}()
+	useSuperhub(t, 250*time.Millisecond)
 
 	// Our expected clients, allowing some connections to fail
 	maxTries := 2 * MaxClients
@@ -612,12 +645,15 @@ func TestHubMsgs_SendsErrorOverMaximumClients(t *testing.T) {
 	// Trying to connect should get a response, but an error response
 	// from the upgraded websocket connection.
 
-	ws, resp, err := dial(serv, "/hub.max", "MAXOVER", -1)
-	if err == nil {
-		t.Fatalf("Expected error for MAXOVER, but didn't get one")
+	ws, _, err := dial(serv, "/hub.max", "MAXOVER", -1)
+	if err != nil {
+		t.Fatalf("Couldn't dial for MAXOVER: %s", err)
 	}
-	if err := responseContains(resp, "Maximum number of clients"); err != nil {
+	twsOver := newTConn(ws, "MAXOVER")
+	if err := twsOver.expectClose(CloseRoomFull, 500); err != nil {
+		t.Error(err)
 	}
+	twsOver.close()
 
 	// Close connections and wait for test goroutines
 	for _, tws := range twss {
@@ -625,24 +661,90 @@ func TestHubMsgs_SendsErrorOverMaximumClients(t *testing.T) {
 			tws.close()
 		}
 	}
-	if ws != nil {
-		ws.Close()
-	}
 	w.Wait()
 
 	// Check everything in the main app finishes
 	WG.Wait()
 }
 
+func TestHubMsgs_RoomCanHaveFewerClients(t *testing.T) {
+	// For this test, make the reconnection timeout long enough that
+	// a client we're only tracking is still known to the superhub
+	useSuperhub(t, 1000*time.Millisecond)
+
+	serv := newTestServer(bounceHandler)
+	defer serv.Close()
+
+	// Create a room for two. A later client can't change that.
+
+	room := "/hub.fewer.clients"
+	ws1, _, err := dialWith(serv, room, "MC1", -1,
+		url.Values{"maxclients": {"2"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws1 := newTConn(ws1, "MC1")
+	defer tws1.close()
+	env, err := tws1.readEnvelope(500, "MC1 expecting Welcome")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Limits == nil || env.Limits.MaxClients != 2 {
+		t.Errorf("MC1 got unexpected limits: %#v", env.Limits)
+	}
+
+	// A client with a bad lastnum is only tracked, so it shouldn't
+	// take up a place
+
+	ws2, _, err := dial(serv, room, "MC2", 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws2 := newTConn(ws2, "MC2")
+	defer tws2.close()
+	if err := tws2.expectClose(CloseBadLastnum, 500); err != nil {
+		t.Fatal(err)
+	}
+
+	ws3, _, err := dialWith(serv, room, "MC3", -1,
+		url.Values{"maxclients": {"10"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws3 := newTConn(ws3, "MC3")
+	defer tws3.close()
+	env, err = tws3.readEnvelope(500, "MC3 expecting Welcome")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Limits == nil || env.Limits.MaxClients != 2 {
+		t.Errorf("MC3 got unexpected limits: %#v", env.Limits)
+	}
+
+	// Now the room is full
+
+	ws4, _, err := dial(serv, room, "MC4", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws4 := newTConn(ws4, "MC4")
+	defer tws4.close()
+	if err := tws4.expectClose(CloseRoomFull, 500); err != nil {
+		t.Error(err)
+	}
+
+	// Tidy up, and check everything in the main app finishes
+	tws1.close()
+	tws2.close()
+	tws3.close()
+	WG.Wait()
+}
+
 func TestHubMsgs_TimeIsInMilliseconds(t *testing.T) {
-	// Just for this test, lower the reconnectionTimeout so that a
+	// Just for this test, lower the reconnection timeout so that a
 	// Leaver message is triggered reasonably quickly.
 
-	oldReconnectionTimeout := reconnectionTimeout
-	reconnectionTimeout = 250 * time.Millisecond
-	defer func() {
-		reconnectionTimeout = oldReconnectionTimeout
-	}()
+	useSuperhub(t, 250*time.Millisecond)
 
 	// Start a web server
 	serv := newTestServer(bounceHandler)
@@ -701,3 +803,3535 @@ func TestHubMsgs_TimeIsInMilliseconds(t *testing.T) {
 	tLog.Debug("TestHubMsgs_TimeIsInMilliseconds, waiting on group")
 	WG.Wait()
 }
+
+func TestHubMsgs_GoodbyeSendsLeaverWithoutWaiting(t *testing.T) {
+	// For this test, make the reconnection timeout long enough that we
+	// can tell a Leaver message comes from the goodbye and not the timeout.
+
+	useSuperhub(t, 1000*time.Millisecond)
+
+	// Start a server
+	serv := newTestServer(bounceHandler)
+	defer serv.Close()
+
+	room := "/hub.goodbye"
+
+	// Connect two clients
+
+	ws1, _, err := dial(serv, room, "GB1", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws1 := newTConn(ws1, "GB1")
+	defer tws1.close()
+	if err := tws1.swallow("Welcome"); err != nil {
+		t.Fatalf("Welcome error for ws1: %s", err)
+	}
+
+	ws2, _, err := dial(serv, room, "GB2", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws2 := newTConn(ws2, "GB2")
+	defer tws2.close()
+	if err = swallowMany(
+		intentExp{"GB2 joining, ws2", tws2, "Welcome"},
+		intentExp{"GB2 joining, ws1", tws1, "Joiner"},
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first client says goodbye, and the second should get a leaver
+	// message well before the reconnection timeout
+
+	err = ws1.WriteMessage(
+		websocket.TextMessage, []byte(`{"intent":"Goodbye"}`),
+	)
+	if err != nil {
+		t.Fatalf("Error writing goodbye: %s", err.Error())
+	}
+
+	env, err := tws2.readEnvelope(500, "ws2 expecting Leaver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Intent != "Leaver" {
+		t.Errorf("ws2 expected Leaver, got %s", env.Intent)
+	}
+	if !sameElements(env.From, []string{"GB1"}) {
+		t.Errorf("ws2 expected Leaver From [GB1], got %v", env.From)
+	}
+	if !sameElements(env.To, []string{"GB2"}) {
+		t.Errorf("ws2 expected Leaver To [GB2], got %v", env.To)
+	}
+	if env.Reason != "closed" {
+		t.Errorf("ws2 expected Leaver Reason closed, got '%s'", env.Reason)
+	}
+
+	// The leader has gone, so the second client should take over
+	env, err = tws2.readEnvelope(500, "ws2 expecting Leader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Intent != "Leader" || env.Leader != "GB2" {
+		t.Errorf("ws2 expected Leader GB2, got %#v", env)
+	}
+
+	// The first client should have its connection closed
+	rr, timedOut := tws1.readMessage(500)
+	if timedOut {
+		t.Fatal("ws1 timed out listening for close")
+	}
+	if rr.err == nil {
+		t.Errorf("ws1 should have got a closed connection, but got '%s'",
+			string(rr.msg))
+	}
+
+	// There should be no second leaver message when the reconnection
+	// timeout would have expired
+	if err := tws2.expectNoMessage(1500); err != nil {
+		t.Error(err)
+	}
+
+	// Tidy up, and check everything in the main app finishes
+	tws1.close()
+	tws2.close()
+	WG.Wait()
+}
+
+func TestHubMsgs_GoodbyeCloseCodeSendsLeaverWithoutWaiting(t *testing.T) {
+	// For this test, make the reconnection timeout long enough that we
+	// can tell a Leaver message comes from the goodbye and not the timeout.
+
+	useSuperhub(t, 1000*time.Millisecond)
+
+	// Start a server
+	serv := newTestServer(bounceHandler)
+	defer serv.Close()
+
+	room := "/hub.goodbye.close"
+
+	// Connect two clients
+
+	ws1, _, err := dial(serv, room, "GBC1", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws1 := newTConn(ws1, "GBC1")
+	defer tws1.close()
+	if err := tws1.swallow("Welcome"); err != nil {
+		t.Fatalf("Welcome error for ws1: %s", err)
+	}
+
+	ws2, _, err := dial(serv, room, "GBC2", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws2 := newTConn(ws2, "GBC2")
+	defer tws2.close()
+	if err = swallowMany(
+		intentExp{"GBC2 joining, ws2", tws2, "Welcome"},
+		intentExp{"GBC2 joining, ws1", tws1, "Joiner"},
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first client closes with the goodbye code, and the second
+	// should get a leaver message well before the reconnection timeout
+
+	err = ws1.WriteControl(
+		websocket.CloseMessage,
+		websocket.FormatCloseMessage(CloseGoodbye, "Goodbye"),
+		time.Now().Add(time.Second),
+	)
+	if err != nil {
+		t.Fatalf("Error writing close: %s", err.Error())
+	}
+
+	env, err := tws2.readEnvelope(500, "ws2 expecting Leaver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Intent != "Leaver" {
+		t.Errorf("ws2 expected Leaver, got %s", env.Intent)
+	}
+	if !sameElements(env.From, []string{"GBC1"}) {
+		t.Errorf("ws2 expected Leaver From [GBC1], got %v", env.From)
+	}
+	if env.Reason != "closed" {
+		t.Errorf("ws2 expected Leaver Reason closed, got '%s'", env.Reason)
+	}
+
+	// The leader has gone, so the second client should take over
+	env, err = tws2.readEnvelope(500, "ws2 expecting Leader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Intent != "Leader" || env.Leader != "GBC2" {
+		t.Errorf("ws2 expected Leader GBC2, got %#v", env)
+	}
+
+	// There should be no second leaver message when the reconnection
+	// timeout would have expired
+	if err := tws2.expectNoMessage(1500); err != nil {
+		t.Error(err)
+	}
+
+	// Tidy up, and check everything in the main app finishes
+	tws1.close()
+	tws2.close()
+	WG.Wait()
+}
+
+func TestHubMsgs_LeaverReasonIsTimeoutWhenConnectionDrops(t *testing.T) {
+	// Just for this test, lower the reconnection timeout so that a
+	// Leaver message is triggered reasonably quickly.
+
+	useSuperhub(t, 250*time.Millisecond)
+
+	// Start a server
+	serv := newTestServer(bounceHandler)
+	defer serv.Close()
+
+	room := "/hub.leaver.reason.timeout"
+
+	// Connect two clients
+
+	ws1, _, err := dial(serv, room, "LRT1", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws1 := newTConn(ws1, "LRT1")
+	defer tws1.close()
+	if err := tws1.swallow("Welcome"); err != nil {
+		t.Fatalf("Welcome error for ws1: %s", err)
+	}
+
+	ws2, _, err := dial(serv, room, "LRT2", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws2 := newTConn(ws2, "LRT2")
+	defer tws2.close()
+	if err = swallowMany(
+		intentExp{"LRT2 joining, ws2", tws2, "Welcome"},
+		intentExp{"LRT2 joining, ws1", tws1, "Joiner"},
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first client's connection drops without a close message,
+	// so the second should hear it's away, then get a leaver message
+	// after the timeout
+
+	tws1.close()
+	if err := tws2.swallow("Away"); err != nil {
+		t.Fatal(err)
+	}
+
+	env, err := tws2.readEnvelope(500, "ws2 expecting Leaver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Intent != "Leaver" {
+		t.Errorf("ws2 expected Leaver, got %s", env.Intent)
+	}
+	if env.Reason != "timeout" {
+		t.Errorf("ws2 expected Leaver Reason timeout, got '%s'", env.Reason)
+	}
+
+	// Tidy up, and check everything in the main app finishes
+	tws2.close()
+	WG.Wait()
+}
+
+func TestHubMsgs_LeaverReasonIsClosedWhenConnectionClosed(t *testing.T) {
+	// Just for this test, lower the reconnection timeout so that a
+	// Leaver message is triggered reasonably quickly.
+
+	useSuperhub(t, 250*time.Millisecond)
+
+	// Start a server
+	serv := newTestServer(bounceHandler)
+	defer serv.Close()
+
+	room := "/hub.leaver.reason.closed"
+
+	// Connect two clients
+
+	ws1, _, err := dial(serv, room, "LRC1", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws1 := newTConn(ws1, "LRC1")
+	defer tws1.close()
+	if err := tws1.swallow("Welcome"); err != nil {
+		t.Fatalf("Welcome error for ws1: %s", err)
+	}
+
+	ws2, _, err := dial(serv, room, "LRC2", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws2 := newTConn(ws2, "LRC2")
+	defer tws2.close()
+	if err = swallowMany(
+		intentExp{"LRC2 joining, ws2", tws2, "Welcome"},
+		intentExp{"LRC2 joining, ws1", tws1, "Joiner"},
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first client closes its connection properly (as a browser
+	// does when a tab is closed), so the second should get a leaver
+	// message after the timeout
+
+	err = ws1.WriteControl(
+		websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseGoingAway, ""),
+		time.Now().Add(time.Second),
+	)
+	if err != nil {
+		t.Fatalf("Error writing close: %s", err.Error())
+	}
+	if err := tws2.swallow("Away"); err != nil {
+		t.Fatal(err)
+	}
+
+	env, err := tws2.readEnvelope(500, "ws2 expecting Leaver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Intent != "Leaver" {
+		t.Errorf("ws2 expected Leaver, got %s", env.Intent)
+	}
+	if env.Reason != "closed" {
+		t.Errorf("ws2 expected Leaver Reason closed, got '%s'", env.Reason)
+	}
+
+	// Tidy up, and check everything in the main app finishes
+	tws1.close()
+	tws2.close()
+	WG.Wait()
+}
+
+func TestHubMsgs_TextMessagesArriveAsText(t *testing.T) {
+	// Just for this test, lower the reconnection timeout so that a
+	// Leaver message is triggered reasonably quickly.
+
+	useSuperhub(t, 250*time.Millisecond)
+
+	// Start a server
+	serv := newTestServer(bounceHandler)
+	defer serv.Close()
+
+	room := "/hub.text.messages"
+
+	// Connect two clients
+
+	ws1, _, err := dial(serv, room, "TXT1", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws1 := newTConn(ws1, "TXT1")
+	defer tws1.close()
+	if err := tws1.swallow("Welcome"); err != nil {
+		t.Fatalf("Welcome error for ws1: %s", err)
+	}
+
+	ws2, _, err := dial(serv, room, "TXT2", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws2 := newTConn(ws2, "TXT2")
+	defer tws2.close()
+	if err = swallowMany(
+		intentExp{"TXT2 joining, ws2", tws2, "Welcome"},
+		intentExp{"TXT2 joining, ws1", tws1, "Joiner"},
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	// Send text messages, which should arrive as plain strings
+	msgs := []string{"Hello", `{"move": "e4"`, "Ünïcödé ✓", ""}
+	for _, msg := range msgs {
+		if err := ws1.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+			t.Fatalf("Error writing message '%s': %s", msg, err.Error())
+		}
+	}
+
+	for _, msg := range msgs {
+		for _, tws := range []*tConn{tws1, tws2} {
+			rr, timedOut := tws.readMessage(500)
+			if timedOut {
+				t.Fatalf("%s timed out expecting '%s'", tws.id, msg)
+			}
+			if rr.err != nil {
+				t.Fatalf("%s got error expecting '%s': %s",
+					tws.id, msg, rr.err.Error())
+			}
+
+			// The raw JSON should have the text as it was sent
+			raw := struct {
+				Body     string
+				Encoding string
+			}{}
+			if err := json.Unmarshal(rr.msg, &raw); err != nil {
+				t.Fatal(err)
+			}
+			if raw.Body != msg || raw.Encoding != "text" {
+				t.Errorf("%s expected Body '%s' as text, but got '%s' as '%s'",
+					tws.id, msg, raw.Body, raw.Encoding)
+			}
+
+			// And it should unmarshal as a normal envelope
+			var env Envelope
+			if err := json.Unmarshal(rr.msg, &env); err != nil {
+				t.Fatal(err)
+			}
+			if string(env.Body) != msg {
+				t.Errorf("%s expected envelope Body '%s' but got '%s'",
+					tws.id, msg, string(env.Body))
+			}
+		}
+	}
+
+	// Tidy up, and check everything in the main app finishes
+	tws1.close()
+	tws2.close()
+	WG.Wait()
+}
+
+func TestHubMsgs_ReplayedBodiesKeepTheirEncodings(t *testing.T) {
+	// Just for this test, lower the reconnection timeout so that a
+	// Leaver message is triggered reasonably quickly.
+
+	useSuperhub(t, 250*time.Millisecond)
+
+	// Start a server
+	serv := newTestServer(bounceHandler)
+	defer serv.Close()
+
+	room := "/hub.replayed.encodings"
+
+	// Connect two clients
+
+	ws1a, _, err := dial(serv, room, "ENC1", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws1a := newTConn(ws1a, "ENC1")
+	defer tws1a.close()
+	if err := tws1a.swallow("Welcome"); err != nil {
+		t.Fatalf("Welcome error for ws1a: %s", err)
+	}
+
+	ws2, _, err := dial(serv, room, "ENC2", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws2 := newTConn(ws2, "ENC2")
+	defer tws2.close()
+	if err := tws2.swallow("Welcome"); err != nil {
+		t.Fatalf("Welcome error for ws2: %s", err)
+	}
+	env, err := tws1a.readEnvelope(500, "ws1a expecting Joiner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lastnum := env.Num
+
+	// Disconnect the first client, and while it's away the second
+	// client sends JSON, text, binary and empty messages
+
+	tws1a.close()
+	if err := tws2.swallow("Away"); err != nil {
+		t.Fatal(err)
+	}
+
+	type sent struct {
+		mType    int
+		body     string
+		rawBody  interface{}
+		encoding string
+	}
+	msgs := []sent{
+		{websocket.TextMessage, `{"move":"e4"}`,
+			map[string]interface{}{"move": "e4"}, ""},
+		{websocket.BinaryMessage, `[1,2]`, []interface{}{1.0, 2.0}, ""},
+		{websocket.TextMessage, "Hello", "Hello", "text"},
+		{websocket.BinaryMessage, "\x00\xff", "AP8=", "base64"},
+		{websocket.TextMessage, "", "", "text"},
+		{websocket.BinaryMessage, "", "", "base64"},
+	}
+	for _, msg := range msgs {
+		if err := ws2.WriteMessage(msg.mType, []byte(msg.body)); err != nil {
+			t.Fatalf("Error writing message '%s': %s", msg.body, err.Error())
+		}
+		if err := tws2.swallow("Peer"); err != nil {
+			t.Fatalf("Receipt error for ws2: %s", err)
+		}
+	}
+
+	// Reconnect the first client, which should get everything replayed
+	// just as it would have been sent originally
+
+	ws1b, _, err := dial(serv, room, "ENC1", lastnum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws1b := newTConn(ws1b, "ENC1")
+	defer tws1b.close()
+
+	for _, msg := range msgs {
+		rr, timedOut := tws1b.readMessage(500)
+		if timedOut {
+			t.Fatalf("Timed out expecting '%s'", msg.body)
+		}
+		if rr.err != nil {
+			t.Fatalf("Got error expecting '%s': %s", msg.body, rr.err.Error())
+		}
+
+		raw := struct {
+			Body     interface{}
+			Encoding string
+		}{}
+		if err := json.Unmarshal(rr.msg, &raw); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(raw.Body, msg.rawBody) ||
+			raw.Encoding != msg.encoding {
+			t.Errorf("Expected Body %#v as '%s', but got %#v as '%s'",
+				msg.rawBody, msg.encoding, raw.Body, raw.Encoding)
+		}
+
+		var env Envelope
+		if err := json.Unmarshal(rr.msg, &env); err != nil {
+			t.Fatal(err)
+		}
+		if string(env.Body) != msg.body {
+			t.Errorf("Expected envelope Body '%s' but got '%s'",
+				msg.body, string(env.Body))
+		}
+	}
+
+	// Tidy up, and check everything in the main app finishes
+	tws1b.close()
+	tws2.close()
+	WG.Wait()
+}
+
+func TestHubMsgs_JSONAndMsgpackClientsSeeTheSameEnvelopes(t *testing.T) {
+	// Just for this test, lower the reconnection timeout so that a
+	// Leaver message is triggered reasonably quickly.
+
+	useSuperhub(t, 250*time.Millisecond)
+
+	// Start a server
+	serv := newTestServer(bounceHandler)
+	defer serv.Close()
+
+	room := "/hub.json.and.msgpack"
+	jsonHeader := http.Header{"Sec-Websocket-Protocol": {JSONProtocol}}
+	msgpackHeader := http.Header{"Sec-Websocket-Protocol": {MsgpackProtocol}}
+
+	// Connect a JSON client and a msgpack client
+
+	ws1, _, err := dialWith(serv, room, "MP1", -1, nil, jsonHeader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws1 := newTConn(ws1, "MP1")
+	defer tws1.close()
+	if err := tws1.swallow("Welcome"); err != nil {
+		t.Fatalf("Welcome error for ws1: %s", err)
+	}
+
+	ws2, _, err := dialWith(serv, room, "MP2", -1, nil, msgpackHeader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := ws2.Subprotocol(); p != MsgpackProtocol {
+		t.Fatalf("Expected subprotocol %s but got '%s'", MsgpackProtocol, p)
+	}
+	tws2 := newTConn(ws2, "MP2")
+	defer tws2.close()
+	if err = swallowMany(
+		intentExp{"MP2 joining, ws2", tws2, "Welcome"},
+		intentExp{"MP2 joining, ws1", tws1, "Joiner"},
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	// Connect a third client, which sends messages of all kinds to
+	// the other two
+
+	ws3, _, err := dial(serv, room, "MP3", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws3 := newTConn(ws3, "MP3")
+	defer tws3.close()
+	if err = swallowMany(
+		intentExp{"MP3 joining, ws3", tws3, "Welcome"},
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	type sent struct {
+		mType int
+		body  []byte
+	}
+	msgs := []sent{
+		{websocket.TextMessage, []byte(`{"move":"e4"}`)},
+		{websocket.TextMessage, []byte("Hello")},
+		{websocket.BinaryMessage, []byte{0, 1, 0xff}},
+	}
+	for _, msg := range msgs {
+		if err := ws3.WriteMessage(msg.mType, msg.body); err != nil {
+			t.Fatalf("Error writing message '%s': %s", msg.body, err.Error())
+		}
+		if err := tws3.swallow("Peer"); err != nil {
+			t.Fatalf("Receipt error for ws3: %s", err)
+		}
+	}
+
+	// Both should see the same Joiner and Peer envelopes, though
+	// one arrives as text and the other as binary
+
+	lastnum := -1
+	for i := 0; i < 1+len(msgs); i++ {
+		rr1, timedOut := tws1.readMessage(500)
+		if timedOut || rr1.err != nil {
+			t.Fatalf("%d: ws1 timed out or got error %v", i, rr1.err)
+		}
+		rr2, timedOut := tws2.readMessage(500)
+		if timedOut || rr2.err != nil {
+			t.Fatalf("%d: ws2 timed out or got error %v", i, rr2.err)
+		}
+		if rr1.mType != websocket.TextMessage {
+			t.Errorf("%d: ws1 got message type %d", i, rr1.mType)
+		}
+		if rr2.mType != websocket.BinaryMessage {
+			t.Errorf("%d: ws2 got message type %d", i, rr2.mType)
+		}
+
+		var env1, env2 Envelope
+		if err := decodeEnvelope(rr1.mType, rr1.msg, &env1); err != nil {
+			t.Fatalf("%d: ws1 error decoding: %s", i, err)
+		}
+		if err := decodeEnvelope(rr2.mType, rr2.msg, &env2); err != nil {
+			t.Fatalf("%d: ws2 error decoding: %s", i, err)
+		}
+
+		// Nums are per recipient, and the Encoding is only for JSON
+		lastnum = env1.Num
+		env1.Num, env2.Num = 0, 0
+		env1.Encoding = ""
+		if !reflect.DeepEqual(env1, env2) {
+			t.Errorf("%d: ws1 got %#v but ws2 got %#v", i, env1, env2)
+		}
+		if i > 0 && string(env2.Body) != string(msgs[i-1].body) {
+			t.Errorf("%d: Expected body %v but got %v",
+				i, msgs[i-1].body, env2.Body)
+		}
+	}
+
+	// The JSON client should be able to reconnect speaking msgpack
+	// and get what it missed
+
+	tws1.close()
+	if err := ws3.WriteMessage(websocket.TextMessage, []byte("Missed")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tws3.swallow("Peer"); err != nil {
+		t.Fatalf("Receipt error for ws3: %s", err)
+	}
+
+	ws1b, _, err := dialWith(serv, room, "MP1", lastnum, nil, msgpackHeader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws1b := newTConn(ws1b, "MP1")
+	defer tws1b.close()
+	env, err := tws1b.readEnvelope(500, "ws1b expecting missed Peer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Intent != "Peer" || string(env.Body) != "Missed" {
+		t.Errorf("ws1b got %#v", env)
+	}
+
+	// Tidy up, and check everything in the main app finishes
+	tws1b.close()
+	tws2.close()
+	tws3.close()
+	WG.Wait()
+}
+
+func TestHubMsgs_WrappedMessageCanSkipReceipt(t *testing.T) {
+	// Just for this test, lower the reconnection timeout so that a
+	// Leaver message is triggered reasonably quickly.
+
+	useSuperhub(t, 250*time.Millisecond)
+
+	// Start a server
+	serv := newTestServer(bounceHandler)
+	defer serv.Close()
+
+	room := "/hub.skip.receipt"
+
+	// Connect two clients
+
+	ws1, _, err := dial(serv, room, "SKIP1", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws1 := newTConn(ws1, "SKIP1")
+	defer tws1.close()
+	if err := tws1.swallow("Welcome"); err != nil {
+		t.Fatalf("Welcome error for ws1: %s", err)
+	}
+
+	ws2, _, err := dial(serv, room, "SKIP2", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws2 := newTConn(ws2, "SKIP2")
+	defer tws2.close()
+	env, err := tws2.readEnvelope(500, "ws2 expecting Welcome")
+	if err != nil {
+		t.Fatal(err)
+	}
+	num := env.Num
+	if err := tws1.swallow("Joiner"); err != nil {
+		t.Fatalf("Joiner error for ws1: %s", err)
+	}
+
+	// The first client sends a message without wanting a receipt,
+	// then a message as usual
+
+	msgs := []struct {
+		sent string
+		body string
+	}{
+		{`{"receipt": false, "body": {"move":"e4"}}`, `{"move":"e4"}`},
+		{`{"move":"e5"}`, `{"move":"e5"}`},
+	}
+	for _, msg := range msgs {
+		if err := ws1.WriteMessage(websocket.TextMessage, []byte(msg.sent)); err != nil {
+			t.Fatalf("Error writing message '%s': %s", msg.sent, err.Error())
+		}
+	}
+
+	// The second client should get both, with contiguous nums, and
+	// the first client should only get a receipt for the second
+
+	for i, msg := range msgs {
+		env, err := tws2.readEnvelope(500, "ws2 expecting Peer %d", i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if env.Intent != "Peer" || env.Num != num+1+i ||
+			string(env.Body) != msg.body {
+			t.Errorf("ws2 got unexpected envelope %#v", env)
+		}
+	}
+
+	env, err = tws1.readEnvelope(500, "ws1 expecting Receipt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Intent != "Peer" || !env.Receipt || env.Num != num+2 ||
+		string(env.Body) != msgs[1].body {
+		t.Errorf("ws1 got unexpected envelope %#v", env)
+	}
+	if err := tws1.expectNoMessage(100); err != nil {
+		t.Error(err)
+	}
+
+	// Tidy up, and check everything in the main app finishes
+	tws1.close()
+	tws2.close()
+	WG.Wait()
+}
+
+func TestHubMsgs_TimeRequestGetsServerTime(t *testing.T) {
+	// Just for this test, lower the reconnection timeout so that a
+	// Leaver message is triggered reasonably quickly.
+
+	useSuperhub(t, 250*time.Millisecond)
+
+	// Start a server
+	serv := newTestServer(bounceHandler)
+	defer serv.Close()
+
+	room := "/hub.time.request"
+
+	// Connect two clients, remembering the last num each has had
+
+	ws1, _, err := dial(serv, room, "TREQ1", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws1 := newTConn(ws1, "TREQ1")
+	defer tws1.close()
+	if err := tws1.swallow("Welcome"); err != nil {
+		t.Fatalf("Welcome error for ws1: %s", err)
+	}
+
+	ws2, _, err := dial(serv, room, "TREQ2", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws2 := newTConn(ws2, "TREQ2")
+	defer tws2.close()
+	env, err := tws2.readEnvelope(500, "ws2 expecting Welcome")
+	if err != nil {
+		t.Fatal(err)
+	}
+	num2 := env.Num
+	env, err = tws1.readEnvelope(500, "ws1 expecting Joiner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	num1 := env.Num
+
+	// The first client asks for the time, and should get it back,
+	// unnumbered, with its token
+
+	before := time.Now().UnixNano() / 1000000
+	msg := []byte(`{"intent":"Time","token":"t42"}`)
+	if err := ws1.WriteMessage(websocket.TextMessage, msg); err != nil {
+		t.Fatalf("Error writing time request: %s", err.Error())
+	}
+	env, err = tws1.readEnvelope(500, "ws1 expecting Time")
+	if err != nil {
+		t.Fatal(err)
+	}
+	after := time.Now().UnixNano() / 1000000
+	if env.Intent != "Time" || env.Token != "t42" || env.Num != -1 ||
+		env.Receipt || len(env.Body) != 0 {
+		t.Errorf("ws1 got unexpected envelope %#v", env)
+	}
+	if env.Time < before || env.Time > after {
+		t.Errorf("Expected time between %d and %d, but got %d",
+			before, after, env.Time)
+	}
+
+	// The second client shouldn't hear anything about it
+	if err := tws2.expectNoMessage(500); err != nil {
+		t.Error(err)
+	}
+
+	// A peer message should carry on both clients' nums as if
+	// nothing had happened
+
+	msg = []byte(`{"move":"e4"}`)
+	if err := ws1.WriteMessage(websocket.TextMessage, msg); err != nil {
+		t.Fatalf("Error writing peer message: %s", err.Error())
+	}
+	env, err = tws1.readEnvelope(500, "ws1 expecting Receipt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Intent != "Peer" || !env.Receipt || env.Num != num1+1 {
+		t.Errorf("ws1 got unexpected envelope %#v", env)
+	}
+	env, err = tws2.readEnvelope(500, "ws2 expecting Peer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Intent != "Peer" || env.Num != num2+1 {
+		t.Errorf("ws2 got unexpected envelope %#v", env)
+	}
+
+	// Tidy up, and check everything in the main app finishes
+	tws1.close()
+	tws2.close()
+	WG.Wait()
+}
+
+func TestHubMsgs_EchoComesBackOnlyToSender(t *testing.T) {
+	// Just for this test, lower the reconnection timeout so that a
+	// Leaver message is triggered reasonably quickly.
+
+	useSuperhub(t, 250*time.Millisecond)
+
+	// Start a server
+	serv := newTestServer(bounceHandler)
+	defer serv.Close()
+
+	room := "/hub.echo"
+
+	// Connect two clients, remembering the last num each has had
+
+	ws1, _, err := dial(serv, room, "ECHO1", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws1 := newTConn(ws1, "ECHO1")
+	defer tws1.close()
+	if err := tws1.swallow("Welcome"); err != nil {
+		t.Fatalf("Welcome error for ws1: %s", err)
+	}
+
+	ws2, _, err := dial(serv, room, "ECHO2", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws2 := newTConn(ws2, "ECHO2")
+	defer tws2.close()
+	env, err := tws2.readEnvelope(500, "ws2 expecting Welcome")
+	if err != nil {
+		t.Fatal(err)
+	}
+	num2 := env.Num
+	env, err = tws1.readEnvelope(500, "ws1 expecting Joiner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	num1 := env.Num
+
+	// The first client asks for an echo, and should get its payload
+	// back, unnumbered
+
+	msg := []byte(`{"intent":"Echo","body":{"sent":12345}}`)
+	if err := ws1.WriteMessage(websocket.TextMessage, msg); err != nil {
+		t.Fatalf("Error writing echo request: %s", err.Error())
+	}
+	env, err = tws1.readEnvelope(500, "ws1 expecting Echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Intent != "Echo" || env.Num != -1 || env.Receipt ||
+		string(env.Body) != `{"sent":12345}` {
+		t.Errorf("ws1 got unexpected envelope %#v", env)
+	}
+
+	// The second client shouldn't hear anything about it
+	if err := tws2.expectNoMessage(500); err != nil {
+		t.Error(err)
+	}
+
+	// A peer message should carry on both clients' nums as if
+	// nothing had happened
+
+	msg = []byte(`{"move":"e4"}`)
+	if err := ws1.WriteMessage(websocket.TextMessage, msg); err != nil {
+		t.Fatalf("Error writing peer message: %s", err.Error())
+	}
+	env, err = tws1.readEnvelope(500, "ws1 expecting Receipt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Intent != "Peer" || !env.Receipt || env.Num != num1+1 {
+		t.Errorf("ws1 got unexpected envelope %#v", env)
+	}
+	env, err = tws2.readEnvelope(500, "ws2 expecting Peer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Intent != "Peer" || env.Num != num2+1 {
+		t.Errorf("ws2 got unexpected envelope %#v", env)
+	}
+
+	// Tidy up, and check everything in the main app finishes
+	tws1.close()
+	tws2.close()
+	WG.Wait()
+}
+
+func TestHubMsgs_ExcessEchoesAreDropped(t *testing.T) {
+	// Just for this test, lower the reconnection timeout so that a
+	// Leaver message is triggered reasonably quickly.
+
+	useSuperhub(t, 250*time.Millisecond)
+
+	// Start a server
+	serv := newTestServer(bounceHandler)
+	defer serv.Close()
+
+	room := "/hub.echo.limit"
+
+	ws, _, err := dial(serv, room, "ECHOLIM", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws := newTConn(ws, "ECHOLIM")
+	defer tws.close()
+	if err := tws.swallow("Welcome"); err != nil {
+		t.Fatalf("Welcome error: %s", err)
+	}
+
+	// Ask for more echoes than allowed all at once, and we should
+	// only get the first ones back
+
+	for i := 0; i < echoLimit+3; i++ {
+		msg := []byte(fmt.Sprintf(`{"intent":"Echo","body":%d}`, i))
+		if err := ws.WriteMessage(websocket.TextMessage, msg); err != nil {
+			t.Fatalf("Error writing echo request %d: %s", i, err.Error())
+		}
+	}
+	for i := 0; i < echoLimit; i++ {
+		env, err := tws.readEnvelope(500, "expecting Echo %d", i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if env.Intent != "Echo" || string(env.Body) != strconv.Itoa(i) {
+			t.Errorf("Echo %d: Got unexpected envelope %#v", i, env)
+		}
+	}
+	if err := tws.expectNoMessage(500); err != nil {
+		t.Error(err)
+	}
+
+	// After a second we should be allowed more
+
+	time.Sleep(time.Second)
+	msg := []byte(`{"intent":"Echo","body":"again"}`)
+	if err := ws.WriteMessage(websocket.TextMessage, msg); err != nil {
+		t.Fatalf("Error writing final echo request: %s", err.Error())
+	}
+	env, err := tws.readEnvelope(500, "expecting final Echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Intent != "Echo" || string(env.Body) != `"again"` {
+		t.Errorf("Got unexpected final envelope %#v", env)
+	}
+
+	// Tidy up, and check everything in the main app finishes
+	tws.close()
+	WG.Wait()
+}
+
+func TestHubMsgs_UnknownIntentGivesErrorToSenderOnly(t *testing.T) {
+	// Just for this test, lower the reconnection timeout so that a
+	// Leaver message is triggered reasonably quickly.
+
+	useSuperhub(t, 250*time.Millisecond)
+
+	// Start a server
+	serv := newTestServer(bounceHandler)
+	defer serv.Close()
+
+	room := "/hub.unknown.intent"
+
+	// Connect two clients
+
+	ws1, _, err := dial(serv, room, "UNK1", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws1 := newTConn(ws1, "UNK1")
+	defer tws1.close()
+	if err := tws1.swallow("Welcome"); err != nil {
+		t.Fatalf("Welcome error for ws1: %s", err)
+	}
+
+	ws2, _, err := dial(serv, room, "UNK2", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws2 := newTConn(ws2, "UNK2")
+	defer tws2.close()
+	if err := tws2.swallow("Welcome"); err != nil {
+		t.Fatalf("Welcome error for ws2: %s", err)
+	}
+	if err := tws1.swallow("Joiner"); err != nil {
+		t.Fatalf("Joiner error for ws1: %s", err)
+	}
+
+	// A structured message the server doesn't understand should come
+	// back to the sender as an error, and go nowhere else
+
+	msg := []byte(`{"intent":"Shout","token":"s1"}`)
+	if err := ws1.WriteMessage(websocket.TextMessage, msg); err != nil {
+		t.Fatalf("Error writing message: %s", err.Error())
+	}
+	env, err := tws1.readEnvelope(500, "ws1 expecting Error")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Intent != "Error" || env.Num != -1 || env.Token != "s1" ||
+		env.Reason != "Unknown intent" {
+		t.Errorf("ws1 got unexpected envelope %#v", env)
+	}
+	if err := tws2.expectNoMessage(500); err != nil {
+		t.Error(err)
+	}
+
+	// Unstructured messages should still be bounced as before
+
+	for _, msg := range []string{`{"move":"e4"}`, `Just text`} {
+		err := ws1.WriteMessage(websocket.TextMessage, []byte(msg))
+		if err != nil {
+			t.Fatalf("Error writing message '%s': %s", msg, err.Error())
+		}
+		env, err := tws2.readEnvelope(500, "ws2 expecting Peer")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if env.Intent != "Peer" || string(env.Body) != msg {
+			t.Errorf("ws2 got unexpected envelope %#v", env)
+		}
+		if err := tws1.swallow("Peer"); err != nil {
+			t.Fatalf("Receipt error for ws1: %s", err)
+		}
+	}
+
+	// Tidy up, and check everything in the main app finishes
+	tws1.close()
+	tws2.close()
+	WG.Wait()
+}
+
+func TestHubMsgs_TagsAppearOnlyOnReceipts(t *testing.T) {
+	// Just for this test, lower the reconnection timeout so that a
+	// Leaver message is triggered reasonably quickly.
+
+	useSuperhub(t, 250*time.Millisecond)
+
+	// Start a server
+	serv := newTestServer(bounceHandler)
+	defer serv.Close()
+
+	room := "/hub.receipt.tags"
+
+	// Connect two clients
+
+	ws1, _, err := dial(serv, room, "TAG1", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws1 := newTConn(ws1, "TAG1")
+	defer tws1.close()
+	if err := tws1.swallow("Welcome"); err != nil {
+		t.Fatalf("Welcome error for ws1: %s", err)
+	}
+
+	ws2, _, err := dial(serv, room, "TAG2", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws2 := newTConn(ws2, "TAG2")
+	defer tws2.close()
+	if err := tws2.swallow("Welcome"); err != nil {
+		t.Fatalf("Welcome error for ws2: %s", err)
+	}
+	if err := tws1.swallow("Joiner"); err != nil {
+		t.Fatalf("Joiner error for ws1: %s", err)
+	}
+
+	// The first client sends three tagged messages quickly, the last
+	// with a tag that's too long
+
+	longTag := strings.Repeat("x", maxTagLength+1)
+	msgs := []struct {
+		tag     string
+		expTag  string
+		body    string
+		wrapped string
+	}{
+		{"m1", "m1", `"a"`, `{"tag":"m1","body":"a"}`},
+		{"m2", "m2", `"b"`, `{"tag":"m2","body":"b"}`},
+		{longTag, "", `"c"`, `{"tag":"` + longTag + `","body":"c"}`},
+	}
+	for _, msg := range msgs {
+		err := ws1.WriteMessage(websocket.TextMessage, []byte(msg.wrapped))
+		if err != nil {
+			t.Fatalf("Error writing message '%s': %s", msg.wrapped, err.Error())
+		}
+	}
+
+	// The receipts should carry the right tags in order, and the
+	// other client's envelopes shouldn't carry them at all
+
+	for i, msg := range msgs {
+		env, err := tws1.readEnvelope(500, "ws1 expecting Receipt %d", i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !env.Receipt || env.Tag != msg.expTag || string(env.Body) != msg.body {
+			t.Errorf("ws1 got unexpected receipt %d: %#v", i, env)
+		}
+		env, err = tws2.readEnvelope(500, "ws2 expecting Peer %d", i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if env.Receipt || env.Tag != "" || string(env.Body) != msg.body {
+			t.Errorf("ws2 got unexpected envelope %d: %#v", i, env)
+		}
+	}
+
+	// Tidy up, and check everything in the main app finishes
+	tws1.close()
+	tws2.close()
+	WG.Wait()
+}
+
+func TestHubMsgs_FirstJoinerLeads(t *testing.T) {
+	// Just for this test, lower the reconnection timeout so that a
+	// Leaver message is triggered reasonably quickly.
+
+	useSuperhub(t, 250*time.Millisecond)
+
+	// Start a server
+	serv := newTestServer(bounceHandler)
+	defer serv.Close()
+
+	room := "/hub.first.leads"
+
+	// The first client creates the room, and its Welcome should say it
+	// leads. It needs no other announcement.
+
+	ws1, _, err := dial(serv, room, "FL1", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws1 := newTConn(ws1, "FL1")
+	defer tws1.close()
+	env, err := tws1.readEnvelope(500, "ws1 expecting Welcome")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Intent != "Welcome" || env.Leader != "FL1" {
+		t.Errorf("ws1 got unexpected Welcome: %#v", env)
+	}
+	if err := tws1.expectNoMessage(200); err != nil {
+		t.Error(err)
+	}
+
+	// A later joiner's Welcome should name the existing leader, and
+	// leadership shouldn't be announced again
+
+	ws2, _, err := dial(serv, room, "FL2", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws2 := newTConn(ws2, "FL2")
+	defer tws2.close()
+	env, err = tws2.readEnvelope(500, "ws2 expecting Welcome")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Intent != "Welcome" || env.Leader != "FL1" {
+		t.Errorf("ws2 got unexpected Welcome: %#v", env)
+	}
+	if err := tws1.swallow("Joiner"); err != nil {
+		t.Fatalf("Joiner error for ws1: %s", err)
+	}
+	if err := tws1.expectNoMessage(200); err != nil {
+		t.Error(err)
+	}
+	if err := tws2.expectNoMessage(200); err != nil {
+		t.Error(err)
+	}
+
+	// Tidy up, and check everything in the main app finishes
+	tws1.close()
+	tws2.close()
+	WG.Wait()
+}
+
+func TestHubMsgs_LongestJoinedTakesOverWhenLeaderLeaves(t *testing.T) {
+	// Just for this test, lower the reconnection timeout so that a
+	// Leaver message is triggered reasonably quickly.
+
+	useSuperhub(t, 250*time.Millisecond)
+
+	// Start a server
+	serv := newTestServer(bounceHandler)
+	defer serv.Close()
+
+	room := "/hub.leader.handover"
+
+	// Connect four clients, one after the other
+
+	ids := []string{"HO1", "HO2", "HO3", "HO4"}
+	twss := make([]*tConn, len(ids))
+	for i, id := range ids {
+		ws, _, err := dial(serv, room, id, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		twss[i] = newTConn(ws, id)
+		defer twss[i].close()
+		if err := twss[i].swallow("Welcome"); err != nil {
+			t.Fatalf("Welcome error for %s: %s", id, err)
+		}
+		for j := 0; j < i; j++ {
+			if err := twss[j].swallow("Joiner"); err != nil {
+				t.Fatalf("Joiner error for %s: %s", ids[j], err)
+			}
+		}
+	}
+
+	// The leader says goodbye, so the others should hear it's left, and
+	// then that the longest joined of them leads. Then a client that
+	// doesn't lead says goodbye, and the leader shouldn't change.
+
+	leaves := []struct {
+		i         int
+		expLeader string
+	}{
+		{0, "HO2"},
+		{2, ""},
+	}
+	gone := map[int]bool{}
+	for _, l := range leaves {
+		err := twss[l.i].ws.WriteMessage(
+			websocket.TextMessage, []byte(`{"intent":"Goodbye"}`),
+		)
+		if err != nil {
+			t.Fatalf("Error writing goodbye for %s: %s", ids[l.i], err)
+		}
+		gone[l.i] = true
+
+		for i, tws := range twss {
+			if gone[i] {
+				continue
+			}
+			if err := tws.swallow("Leaver"); err != nil {
+				t.Fatalf("Leaver error for %s: %s", ids[i], err)
+			}
+			if l.expLeader == "" {
+				continue
+			}
+			env, err := tws.readEnvelope(500, "%s expecting Leader", ids[i])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if env.Intent != "Leader" || env.Leader != l.expLeader {
+				t.Errorf("%s expected Leader %s, got %#v",
+					ids[i], l.expLeader, env)
+			}
+		}
+	}
+	for i, tws := range twss {
+		if gone[i] {
+			continue
+		}
+		if err := tws.expectNoMessage(200); err != nil {
+			t.Errorf("%s: %s", ids[i], err)
+		}
+	}
+
+	// Tidy up, and check everything in the main app finishes
+	for _, tws := range twss {
+		tws.close()
+	}
+	WG.Wait()
+}
+
+func TestHubMsgs_ReassignErrorsGoToSenderOnly(t *testing.T) {
+	// Just for this test, lower the reconnection timeout so that a
+	// Leaver message is triggered reasonably quickly.
+
+	useSuperhub(t, 250*time.Millisecond)
+
+	// Start a server
+	serv := newTestServer(bounceHandler)
+	defer serv.Close()
+
+	data := []struct {
+		room   string
+		params url.Values
+		sender int // Which client sends the Reassign
+		msg    string
+		reason string
+	}{
+		{"/hub.reassign.off", nil, 0,
+			`{"intent":"Reassign","id":"RE2","as":"RE1","token":"t1"}`,
+			"Reassign not allowed"},
+		{"/hub.reassign.nonleader", url.Values{"reassign": {"on"}}, 1,
+			`{"intent":"Reassign","id":"RE2","as":"RE1","token":"t1"}`,
+			"Not leader"},
+		{"/hub.reassign.joined", url.Values{"reassign": {"on"}}, 0,
+			`{"intent":"Reassign","id":"RE2","as":"RE1","token":"t1"}`,
+			"Cannot reassign"},
+		{"/hub.reassign.unknown", url.Values{"reassign": {"on"}}, 0,
+			`{"intent":"Reassign","id":"RE2","as":"RE9","token":"t1"}`,
+			"Cannot reassign"},
+	}
+
+	for _, d := range data {
+		ws1, _, err := dialWith(serv, d.room, "RE1", -1, d.params, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tws1 := newTConn(ws1, "RE1")
+		defer tws1.close()
+		if err := tws1.swallow("Welcome"); err != nil {
+			t.Fatalf("%s: Welcome error for ws1: %s", d.room, err)
+		}
+		ws2, _, err := dial(serv, d.room, "RE2", -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tws2 := newTConn(ws2, "RE2")
+		defer tws2.close()
+		if err = swallowMany(
+			intentExp{d.room + ", ws2", tws2, "Welcome"},
+			intentExp{d.room + ", ws1", tws1, "Joiner"},
+		); err != nil {
+			t.Fatal(err)
+		}
+
+		twss := []*tConn{tws1, tws2}
+		sender, other := twss[d.sender], twss[1-d.sender]
+		err = sender.ws.WriteMessage(websocket.TextMessage, []byte(d.msg))
+		if err != nil {
+			t.Fatal(err)
+		}
+		env, err := sender.readEnvelope(500, "%s: expecting Error", d.room)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if env.Intent != "Error" || env.Reason != d.reason ||
+			env.Token != "t1" {
+			t.Errorf("%s: Got unexpected envelope: %#v", d.room, env)
+		}
+		if err := other.expectNoMessage(100); err != nil {
+			t.Errorf("%s: %s", d.room, err)
+		}
+
+		tws1.close()
+		tws2.close()
+	}
+	WG.Wait()
+}
+
+func TestHubMsgs_LeaderCanKickClientOut(t *testing.T) {
+	// Just for this test, lower the reconnection timeout so that a
+	// Leaver message is triggered reasonably quickly.
+
+	useSuperhub(t, 250*time.Millisecond)
+
+	// Start a server
+	serv := newTestServer(bounceHandler)
+	defer serv.Close()
+
+	room := "/hub.kick"
+
+	// Connect three clients, the first of which leads
+
+	ids := []string{"KK1", "KK2", "KK3"}
+	twss := make([]*tConn, len(ids))
+	for i, id := range ids {
+		ws, _, err := dial(serv, room, id, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		twss[i] = newTConn(ws, id)
+		defer twss[i].close()
+		if err := twss[i].swallow("Welcome"); err != nil {
+			t.Fatalf("Welcome error for %s: %s", id, err)
+		}
+		for j := 0; j < i; j++ {
+			if err := twss[j].swallow("Joiner"); err != nil {
+				t.Fatalf("Joiner error for %s: %s", ids[j], err)
+			}
+		}
+	}
+	tws1, tws2, tws3 := twss[0], twss[1], twss[2]
+
+	// A client that doesn't lead can't kick anyone
+
+	err := tws2.ws.WriteMessage(websocket.TextMessage,
+		[]byte(`{"intent":"Kick","id":"KK3","token":"k1"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	env, err := tws2.readEnvelope(500, "ws2 expecting Error")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Intent != "Error" || env.Reason != "Not leader" || env.Token != "k1" {
+		t.Errorf("ws2 got unexpected envelope: %#v", env)
+	}
+
+	// The leader kicks the second client out. It should get a close,
+	// and the others should hear it's left straight away.
+
+	err = tws1.ws.WriteMessage(websocket.TextMessage,
+		[]byte(`{"intent":"Kick","id":"KK2"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tws2.expectClose(CloseKicked, 500); err != nil {
+		t.Error(err)
+	}
+	for _, tws := range []*tConn{tws1, tws3} {
+		env, err := tws.readEnvelope(100, "%s expecting Leaver", tws.id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if env.Intent != "Leaver" || env.Reason != "kicked" ||
+			!sameElements(env.From, []string{"KK2"}) {
+			t.Errorf("%s got unexpected envelope: %#v", tws.id, env)
+		}
+	}
+
+	// The kicked client can't come back, and the others shouldn't
+	// hear about it trying
+
+	ws2b, _, err := dial(serv, room, "KK2", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws2b := newTConn(ws2b, "KK2")
+	defer tws2b.close()
+	if err := tws2b.expectClose(CloseKicked, 500); err != nil {
+		t.Error(err)
+	}
+	for _, tws := range []*tConn{tws1, tws3} {
+		if err := tws.expectNoMessage(500); err != nil {
+			t.Errorf("%s: %s", tws.id, err)
+		}
+	}
+
+	// Tidy up, and check everything in the main app finishes
+	tws1.close()
+	tws3.close()
+	WG.Wait()
+}
+
+func TestHubMsgs_ObserversWatchWithoutBeingAnnounced(t *testing.T) {
+	// Just for this test, lower the reconnection timeout so that a
+	// Leaver message is triggered reasonably quickly.
+
+	useSuperhub(t, 250*time.Millisecond)
+
+	serv := newTestServer(bounceHandler)
+	defer serv.Close()
+
+	// Create a room for two players, and have an observer join it
+
+	room := "/hub.observers"
+	ws1, _, err := dialWith(serv, room, "OB1", -1,
+		url.Values{"maxclients": {"2"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws1 := newTConn(ws1, "OB1")
+	defer tws1.close()
+	if err := tws1.swallow("Welcome"); err != nil {
+		t.Fatalf("Welcome error for OB1: %s", err)
+	}
+
+	wsO, _, err := dialWith(serv, room, "OBS", -1,
+		url.Values{"role": {"observer"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	twsO := newTConn(wsO, "OBS")
+	defer twsO.close()
+	env, err := twsO.readEnvelope(500, "OBS expecting Welcome")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Intent != "Welcome" || !sameElements(env.From, []string{"OB1"}) {
+		t.Errorf("OBS got unexpected Welcome: %#v", env)
+	}
+	if err := tws1.expectNoMessage(200); err != nil {
+		t.Errorf("OB1 heard about the observer: %s", err)
+	}
+
+	// The observer shouldn't take a player's place, or be in the
+	// players' lists, but it should hear about them
+
+	ws2, _, err := dial(serv, room, "OB2", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws2 := newTConn(ws2, "OB2")
+	defer tws2.close()
+	env, err = tws2.readEnvelope(500, "OB2 expecting Welcome")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Intent != "Welcome" || !sameElements(env.From, []string{"OB1"}) {
+		t.Errorf("OB2 got unexpected Welcome: %#v", env)
+	}
+	for _, tws := range []*tConn{tws1, twsO} {
+		env, err := tws.readEnvelope(500, "%s expecting Joiner", tws.id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if env.Intent != "Joiner" || !sameElements(env.To, []string{"OB1"}) {
+			t.Errorf("%s got unexpected Joiner: %#v", tws.id, env)
+		}
+	}
+
+	// The observer should see the players' messages, but not be able
+	// to send any of its own
+
+	if err := ws1.WriteMessage(websocket.TextMessage, []byte("Hi")); err != nil {
+		t.Fatal(err)
+	}
+	for _, tws := range []*tConn{tws2, twsO} {
+		env, err := tws.readEnvelope(500, "%s expecting Peer", tws.id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if env.Intent != "Peer" || !sameElements(env.To, []string{"OB2"}) {
+			t.Errorf("%s got unexpected Peer: %#v", tws.id, env)
+		}
+	}
+	if err := tws1.swallow("Peer"); err != nil {
+		t.Fatalf("Receipt error for OB1: %s", err)
+	}
+
+	if err := wsO.WriteMessage(websocket.TextMessage, []byte("Me")); err != nil {
+		t.Fatal(err)
+	}
+	env, err = twsO.readEnvelope(500, "OBS expecting Error")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Intent != "Error" || env.Reason != "Observers can't send messages" {
+		t.Errorf("OBS got unexpected envelope: %#v", env)
+	}
+
+	// A player leaving should be heard by the observer, but not
+	// counting it. The observer leaving shouldn't be heard at all.
+
+	err = ws2.WriteMessage(websocket.TextMessage, []byte(`{"intent":"Goodbye"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tws := range []*tConn{tws1, twsO} {
+		env, err := tws.readEnvelope(500, "%s expecting Leaver", tws.id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if env.Intent != "Leaver" || !sameElements(env.To, []string{"OB1"}) {
+			t.Errorf("%s got unexpected Leaver: %#v", tws.id, env)
+		}
+	}
+
+	err = wsO.WriteMessage(websocket.TextMessage, []byte(`{"intent":"Goodbye"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tws1.expectNoMessage(500); err != nil {
+		t.Errorf("OB1 heard about the observer: %s", err)
+	}
+
+	// Tidy up, and check everything in the main app finishes
+	tws1.close()
+	tws2.close()
+	twsO.close()
+	WG.Wait()
+}
+
+func TestHubMsgs_RoomClosesAtEndOfLifetime(t *testing.T) {
+	// Just for this test, lower the reconnection timeout so that a
+	// Leaver message is triggered reasonably quickly, and make rooms
+	// short-lived
+
+	useSuperhub(t, 250*time.Millisecond)
+	oldRoomLifetime := roomLifetime
+	roomLifetime = 400 * time.Millisecond
+	defer func() {
+		roomLifetime = oldRoomLifetime
+	}()
+
+	// Start a server
+	serv := newTestServer(bounceHandler)
+	defer serv.Close()
+
+	room := "/hub.lifetime"
+
+	// Connect two clients
+
+	ws1, _, err := dial(serv, room, "LIFE1", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws1 := newTConn(ws1, "LIFE1")
+	defer tws1.close()
+	if err := tws1.swallow("Welcome"); err != nil {
+		t.Fatal(err)
+	}
+
+	ws2, _, err := dial(serv, room, "LIFE2", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws2 := newTConn(ws2, "LIFE2")
+	defer tws2.close()
+	if err = swallowMany(
+		intentExp{"LIFE2 joining, ws2", tws2, "Welcome"},
+		intentExp{"LIFE2 joining, ws1", tws1, "Joiner"},
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	// When the room's lifetime is up both should be told, and then
+	// have their connections closed
+
+	for _, tws := range []*tConn{tws1, tws2} {
+		env, err := tws.readEnvelope(1000, "%s expecting Closing", tws.id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if env.Intent != "Closing" || env.Reason != "lifetime" ||
+			!sameElements(env.To, []string{"LIFE1", "LIFE2"}) {
+			t.Errorf("%s got unexpected envelope: %#v", tws.id, env)
+		}
+		if err := tws.expectClose(CloseRoomClosed, 500); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// Someone joining the room afterwards gets a new one
+
+	ws3, _, err := dial(serv, room, "LIFE3", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws3 := newTConn(ws3, "LIFE3")
+	defer tws3.close()
+	env, err := tws3.readEnvelope(500, "LIFE3 expecting Welcome")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Intent != "Welcome" || len(env.From) != 0 {
+		t.Errorf("LIFE3 got unexpected envelope: %#v", env)
+	}
+
+	// Tidy up, and check everything in the main app finishes
+	tws3.close()
+	WG.Wait()
+}
+
+func TestHubMsgs_IdleRoomIsWarnedThenCloses(t *testing.T) {
+	// Just for this test, lower the reconnection timeout so that a
+	// Leaver message is triggered reasonably quickly, and make rooms
+	// go idle quickly
+
+	useSuperhub(t, 250*time.Millisecond)
+	oldIdleTimeout := idleTimeout
+	oldIdleGrace := idleGrace
+	oldIdleCheck := idleCheck
+	idleTimeout = 300 * time.Millisecond
+	idleGrace = 300 * time.Millisecond
+	idleCheck = 50 * time.Millisecond
+	defer func() {
+		idleTimeout = oldIdleTimeout
+		idleGrace = oldIdleGrace
+		idleCheck = oldIdleCheck
+	}()
+
+	// Start a server
+	serv := newTestServer(bounceHandler)
+	defer serv.Close()
+
+	room := "/hub.idle"
+
+	// Connect two clients
+
+	ws1, _, err := dial(serv, room, "IDLE1", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws1 := newTConn(ws1, "IDLE1")
+	defer tws1.close()
+	if err := tws1.swallow("Welcome"); err != nil {
+		t.Fatal(err)
+	}
+
+	ws2, _, err := dial(serv, room, "IDLE2", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws2 := newTConn(ws2, "IDLE2")
+	defer tws2.close()
+	if err = swallowMany(
+		intentExp{"IDLE2 joining, ws2", tws2, "Welcome"},
+		intentExp{"IDLE2 joining, ws1", tws1, "Joiner"},
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	// Both should be warned when the room's idle
+
+	expectIdle := func() {
+		for _, tws := range []*tConn{tws1, tws2} {
+			env, err := tws.readEnvelope(1000, "%s expecting Idle", tws.id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if env.Intent != "Idle" ||
+				!sameElements(env.To, []string{"IDLE1", "IDLE2"}) {
+				t.Fatalf("%s got unexpected envelope: %#v", tws.id, env)
+			}
+		}
+	}
+	expectIdle()
+
+	// A peer message keeps the room open, until it's idle again
+
+	err = ws1.WriteMessage(websocket.BinaryMessage, []byte("Still here"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = swallowMany(
+		intentExp{"Peer msg, ws1", tws1, "Peer"},
+		intentExp{"Peer msg, ws2", tws2, "Peer"},
+	); err != nil {
+		t.Fatal(err)
+	}
+	expectIdle()
+
+	// If it stays idle both should be told it's closing, and then
+	// have their connections closed
+
+	for _, tws := range []*tConn{tws1, tws2} {
+		env, err := tws.readEnvelope(1000, "%s expecting Closing", tws.id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if env.Intent != "Closing" || env.Reason != "idle" {
+			t.Errorf("%s got unexpected envelope: %#v", tws.id, env)
+		}
+		if err := tws.expectClose(CloseIdle, 500); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// Check everything in the main app finishes
+	WG.Wait()
+}
+
+func TestHubMsgs_IdleClientIsWarnedThenCloses(t *testing.T) {
+	// Just for this test, lower the reconnection timeout so that a
+	// Leaver message is triggered reasonably quickly, and close idle
+	// clients soon after they're warned
+
+	useSuperhub(t, 250*time.Millisecond)
+	oldClientIdleGrace := clientIdleGrace
+	oldIdleCheck := idleCheck
+	clientIdleGrace = 300 * time.Millisecond
+	idleCheck = 50 * time.Millisecond
+	defer func() {
+		clientIdleGrace = oldClientIdleGrace
+		idleCheck = oldIdleCheck
+	}()
+
+	// Start a server
+	serv := newTestServer(bounceHandler)
+	defer serv.Close()
+
+	room := "/hub.idle.client"
+
+	// Connect two clients to a room where players may only idle for a
+	// second. The second is pinged often, so it'll be sending pongs.
+
+	ws1, _, err := dialWith(serv, room, "IDLC1", -1,
+		url.Values{"clientidle": {"1"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws1 := newTConn(ws1, "IDLC1")
+	defer tws1.close()
+	env, err := tws1.readEnvelope(500, "IDLC1 expecting Welcome")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Intent != "Welcome" || env.Limits == nil ||
+		env.Limits.ClientIdleMs != 1000 {
+		t.Errorf("IDLC1 got unexpected envelope: %#v", env)
+	}
+
+	ws2, _, err := dialWith(serv, room, "IDLC2", -1,
+		url.Values{"ping": {"1"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws2 := newTConn(ws2, "IDLC2")
+	defer tws2.close()
+	if err = swallowMany(
+		intentExp{"IDLC2 joining, ws2", tws2, "Welcome"},
+		intentExp{"IDLC2 joining, ws1", tws1, "Joiner"},
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first client keeps itself active, so only the second is
+	// warned
+
+	time.Sleep(600 * time.Millisecond)
+	err = ws1.WriteMessage(websocket.BinaryMessage, []byte("Still here"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = swallowMany(
+		intentExp{"Peer msg, ws1", tws1, "Peer"},
+		intentExp{"Peer msg, ws2", tws2, "Peer"},
+	); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(300 * time.Millisecond)
+	env, err = tws2.readEnvelope(500, "IDLC2 expecting Inactive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Intent != "Inactive" || env.Num != -1 ||
+		!reflect.DeepEqual(env.To, []string{"IDLC2"}) {
+		t.Fatalf("IDLC2 got unexpected envelope: %#v", env)
+	}
+
+	// If it stays idle it's closed, and has left
+
+	if err := tws2.expectClose(CloseClientIdle, 500); err != nil {
+		t.Error(err)
+	}
+	env, err = tws1.readEnvelope(500, "IDLC1 expecting Leaver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Intent != "Leaver" || env.Reason != "idle" ||
+		!reflect.DeepEqual(env.From, []string{"IDLC2"}) {
+		t.Errorf("IDLC1 got unexpected envelope: %#v", env)
+	}
+
+	// The first client is warned in its turn
+
+	env, err = tws1.readEnvelope(500, "IDLC1 expecting Inactive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Intent != "Inactive" {
+		t.Errorf("IDLC1 got unexpected envelope: %#v", env)
+	}
+
+	// Tidy up, and check everything in the main app finishes
+	tws1.close()
+	tws2.close()
+	WG.Wait()
+}
+
+func TestHubMsgs_RoomLimitsPeerMessages(t *testing.T) {
+	// Just for this test, lower the reconnection timeout so that a
+	// Leaver message is triggered reasonably quickly, and only let a
+	// few messages through a room
+	useSuperhub(t, 250*time.Millisecond)
+	oldRoomMsgRate := roomMsgRate
+	oldRoomMsgBurst := roomMsgBurst
+	oldRoomMsgStrategy := roomMsgStrategy
+	roomMsgRate = 0.1
+	roomMsgBurst = 3
+	roomMsgStrategy = DROPMSGS
+	defer func() {
+		roomMsgRate = oldRoomMsgRate
+		roomMsgBurst = oldRoomMsgBurst
+		roomMsgStrategy = oldRoomMsgStrategy
+	}()
+
+	serv := newTestServer(bounceHandler)
+	defer serv.Close()
+
+	// Connect two clients
+
+	join := func(room string, id1 string, id2 string) (*tConn, *tConn) {
+		ws1, _, err := dial(serv, room, id1, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tws1 := newTConn(ws1, id1)
+		if err := tws1.swallow("Welcome"); err != nil {
+			t.Fatal(err)
+		}
+		ws2, _, err := dial(serv, room, id2, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tws2 := newTConn(ws2, id2)
+		if err = swallowMany(
+			intentExp{id2 + " joining, ws2", tws2, "Welcome"},
+			intentExp{id2 + " joining, ws1", tws1, "Joiner"},
+		); err != nil {
+			t.Fatal(err)
+		}
+		return tws1, tws2
+	}
+	tws1, tws2 := join("/hub.room.limit.drop", "RLD1", "RLD2")
+	defer tws1.close()
+	defer tws2.close()
+
+	// Between them they send one more message than the room allows.
+	// The last one is dropped, and its sender told.
+
+	send := func(tws *tConn, msg string) {
+		if err := tws.ws.WriteMessage(
+			websocket.TextMessage, []byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	send(tws1, `"One"`)
+	send(tws2, `"Two"`)
+	send(tws1, `"Three"`)
+	if err := swallowMany(
+		intentExp{"One, ws1", tws1, "Peer"},
+		intentExp{"One, ws2", tws2, "Peer"},
+		intentExp{"Two, ws1", tws1, "Peer"},
+		intentExp{"Two, ws2", tws2, "Peer"},
+		intentExp{"Three, ws1", tws1, "Peer"},
+		intentExp{"Three, ws2", tws2, "Peer"},
+	); err != nil {
+		t.Fatal(err)
+	}
+	send(tws2, `{"receipt":true,"tag":"t4","body":"Four"}`)
+	env, err := tws2.readEnvelope(500, "RLD2 expecting Error")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Intent != "Error" || env.Reason != "Room too busy" ||
+		env.Tag != "t4" {
+		t.Errorf("RLD2 got unexpected envelope: %#v", env)
+	}
+	if err := tws1.expectNoMessage(200); err != nil {
+		t.Error(err)
+	}
+
+	// If the room delays messages instead, they all get through, but
+	// no faster than the room allows
+
+	roomMsgRate = 10
+	roomMsgBurst = 1
+	roomMsgStrategy = DELAYREADS
+	tws3, tws4 := join("/hub.room.limit.delay", "RLY1", "RLY2")
+	defer tws3.close()
+	defer tws4.close()
+
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		send(tws3, `"Delayed"`)
+	}
+	for i := 0; i < 4; i++ {
+		if err := swallowMany(
+			intentExp{"Delayed, ws3", tws3, "Peer"},
+			intentExp{"Delayed, ws4", tws4, "Peer"},
+		); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 250*time.Millisecond {
+		t.Errorf("Messages took only %s", elapsed)
+	}
+
+	// Tidy up, and check everything in the main app finishes
+	tws1.close()
+	tws2.close()
+	tws3.close()
+	tws4.close()
+	WG.Wait()
+}
+
+func TestHubMsgs_RoomKeepsStateForLateJoiners(t *testing.T) {
+	// Just for this test, lower the reconnection timeout so that a
+	// Leaver message is triggered reasonably quickly, and make the
+	// room's state small
+	useSuperhub(t, 250*time.Millisecond)
+	oldMaxStateSize := maxStateSize
+	maxStateSize = 50
+	defer func() {
+		maxStateSize = oldMaxStateSize
+	}()
+
+	serv := newTestServer(bounceHandler)
+	defer serv.Close()
+
+	room := "/hub.state"
+
+	// Connect two clients
+
+	ws1, _, err := dial(serv, room, "ST1", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws1 := newTConn(ws1, "ST1")
+	defer tws1.close()
+	env, err := tws1.readEnvelope(500, "ST1 expecting Welcome")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Intent != "Welcome" || env.State != nil {
+		t.Errorf("ST1 got unexpected envelope: %#v", env)
+	}
+
+	ws2, _, err := dial(serv, room, "ST2", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws2 := newTConn(ws2, "ST2")
+	defer tws2.close()
+	if err = swallowMany(
+		intentExp{"ST2 joining, ws2", tws2, "Welcome"},
+		intentExp{"ST2 joining, ws1", tws1, "Joiner"},
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	// Setting some state tells everyone, and the last write wins
+
+	setState := func(tws *tConn, key string, value string) {
+		msg := `{"intent":"SetState","key":"` + key + `","value":` + value + `}`
+		if err := tws.ws.WriteMessage(
+			websocket.TextMessage, []byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, exp := range []struct {
+		from  *tConn
+		key   string
+		value string
+	}{
+		{tws1, "score", `{"a":1}`},
+		{tws2, "score", `{"a":2}`},
+		{tws2, "turn", `"ST1"`},
+	} {
+		setState(exp.from, exp.key, exp.value)
+		for _, tws := range []*tConn{tws1, tws2} {
+			env, err := tws.readEnvelope(500, "%s expecting State", tws.id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if env.Intent != "State" || env.Key != exp.key ||
+				string(env.Body) != exp.value ||
+				!sameElements(env.From, []string{exp.from.id}) {
+				t.Errorf("%s got unexpected envelope: %#v", tws.id, env)
+			}
+		}
+	}
+
+	// Too much state is refused, and only its sender is told
+
+	setState(tws2, "big", `"`+strings.Repeat("x", 40)+`"`)
+	env, err = tws2.readEnvelope(500, "ST2 expecting Error")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Intent != "Error" || env.Reason != "State too large" {
+		t.Errorf("ST2 got unexpected envelope: %#v", env)
+	}
+	if err := tws1.expectNoMessage(200); err != nil {
+		t.Error(err)
+	}
+
+	// A late joiner gets all the state in its Welcome
+
+	ws3, _, err := dial(serv, room, "ST3", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws3 := newTConn(ws3, "ST3")
+	defer tws3.close()
+	env, err = tws3.readEnvelope(500, "ST3 expecting Welcome")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Intent != "Welcome" || len(env.State) != 2 ||
+		string(env.State["score"]) != `{"a":2}` ||
+		string(env.State["turn"]) != `"ST1"` {
+		t.Errorf("ST3 got unexpected envelope: %#v", env)
+	}
+
+	// Once everyone's gone the state goes with the room
+
+	tws1.close()
+	tws2.close()
+	tws3.close()
+	WG.Wait()
+
+	ws4, _, err := dial(serv, room, "ST4", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws4 := newTConn(ws4, "ST4")
+	defer tws4.close()
+	env, err = tws4.readEnvelope(500, "ST4 expecting Welcome")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Intent != "Welcome" || env.State != nil {
+		t.Errorf("ST4 got unexpected envelope: %#v", env)
+	}
+
+	// Tidy up, and check everything in the main app finishes
+	tws4.close()
+	WG.Wait()
+}
+
+func TestHubMsgs_ClientsShareARandomSeed(t *testing.T) {
+	// Just for this test, lower the reconnection timeout so that a
+	// Leaver message is triggered reasonably quickly.
+	useSuperhub(t, 250*time.Millisecond)
+
+	serv := newTestServer(bounceHandler)
+	defer serv.Close()
+
+	room := "/hub.seed"
+
+	// Two clients joining get the same seed
+
+	ws1, _, err := dial(serv, room, "SEED1", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws1 := newTConn(ws1, "SEED1")
+	defer tws1.close()
+	env1, err := tws1.readEnvelope(500, "SEED1 expecting Welcome")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ws2, _, err := dial(serv, room, "SEED2", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws2 := newTConn(ws2, "SEED2")
+	defer tws2.close()
+	env2, err := tws2.readEnvelope(500, "SEED2 expecting Welcome")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tws1.swallow("Joiner"); err != nil {
+		t.Fatal(err)
+	}
+	if env1.Seed == 0 || env1.Seed != env2.Seed {
+		t.Errorf("Welcomes had seeds %d and %d", env1.Seed, env2.Seed)
+	}
+
+	// Only the leader can ask for a new seed
+
+	req := []byte(`{"intent":"Reseed","token":"r1"}`)
+	if err := ws2.WriteMessage(websocket.TextMessage, req); err != nil {
+		t.Fatal(err)
+	}
+	env, err := tws2.readEnvelope(500, "SEED2 expecting Error")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Intent != "Error" || env.Reason != "Not leader" || env.Token != "r1" {
+		t.Errorf("SEED2 got unexpected envelope: %#v", env)
+	}
+
+	// When it does, everyone gets it, numbered so it can be resent
+
+	if err := ws1.WriteMessage(websocket.TextMessage, req); err != nil {
+		t.Fatal(err)
+	}
+	seeds := make([]uint64, 0)
+	for _, tws := range []*tConn{tws1, tws2} {
+		env, err := tws.readEnvelope(500, "%s expecting Seed", tws.id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if env.Intent != "Seed" || env.Num < 0 ||
+			!sameElements(env.From, []string{"SEED1"}) {
+			t.Errorf("%s got unexpected envelope: %#v", tws.id, env)
+		}
+		seeds = append(seeds, env.Seed)
+	}
+	if seeds[0] == env1.Seed || seeds[0] != seeds[1] {
+		t.Errorf("Old seed was %d, but new ones are %v", env1.Seed, seeds)
+	}
+
+	// Tidy up, and check everything in the main app finishes
+	tws1.close()
+	tws2.close()
+	WG.Wait()
+}
+
+func TestHubMsgs_ServerRollsDiceForEveryone(t *testing.T) {
+	// Just for this test, lower the reconnection timeout so that a
+	// Leaver message is triggered reasonably quickly.
+	useSuperhub(t, 250*time.Millisecond)
+
+	serv := newTestServer(bounceHandler)
+	defer serv.Close()
+
+	room := "/hub.roll"
+
+	// Connect two clients
+
+	ws1, _, err := dial(serv, room, "ROLL1", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws1 := newTConn(ws1, "ROLL1")
+	defer tws1.close()
+	if err := tws1.swallow("Welcome"); err != nil {
+		t.Fatal(err)
+	}
+
+	ws2, _, err := dial(serv, room, "ROLL2", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws2 := newTConn(ws2, "ROLL2")
+	defer tws2.close()
+	if err = swallowMany(
+		intentExp{"ROLL2 joining, ws2", tws2, "Welcome"},
+		intentExp{"ROLL2 joining, ws1", tws1, "Joiner"},
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	// A bad roll only gets an error back
+
+	bad := []byte(`{"intent":"Roll","sides":0,"count":2,"token":"d1"}`)
+	if err := ws2.WriteMessage(websocket.TextMessage, bad); err != nil {
+		t.Fatal(err)
+	}
+	env, err := tws2.readEnvelope(500, "ROLL2 expecting Error")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Intent != "Error" || env.Reason != "Bad roll" || env.Token != "d1" {
+		t.Errorf("ROLL2 got unexpected envelope: %#v", env)
+	}
+	if err := tws1.expectNoMessage(200); err != nil {
+		t.Error(err)
+	}
+
+	// A good roll gives everyone the same results, numbered so they
+	// can be resent
+
+	req := []byte(`{"intent":"Roll","sides":6,"count":20,"token":"d2"}`)
+	if err := ws2.WriteMessage(websocket.TextMessage, req); err != nil {
+		t.Fatal(err)
+	}
+	results := make([][]int, 0)
+	for _, tws := range []*tConn{tws1, tws2} {
+		env, err := tws.readEnvelope(500, "%s expecting Rolled", tws.id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if env.Intent != "Rolled" || env.Num < 0 || env.Roll == nil ||
+			env.Roll.Sides != 6 || env.Roll.Count != 20 ||
+			len(env.Roll.Results) != 20 ||
+			!sameElements(env.From, []string{"ROLL2"}) {
+			t.Fatalf("%s got unexpected envelope: %#v", tws.id, env)
+		}
+		for _, r := range env.Roll.Results {
+			if r < 1 || r > 6 {
+				t.Errorf("%s got result %d", tws.id, r)
+			}
+		}
+		results = append(results, env.Roll.Results)
+	}
+	if !reflect.DeepEqual(results[0], results[1]) {
+		t.Errorf("Clients got different results: %v", results)
+	}
+
+	// Tidy up, and check everything in the main app finishes
+	tws1.close()
+	tws2.close()
+	WG.Wait()
+}
+
+func TestHubMsgs_OnlyTurnHolderAndLeaderCanSend(t *testing.T) {
+	// Just for this test, lower the reconnection timeout so that a
+	// Leaver message is triggered reasonably quickly.
+	useSuperhub(t, 250*time.Millisecond)
+
+	serv := newTestServer(bounceHandler)
+	defer serv.Close()
+
+	room := "/hub.turn"
+
+	// Connect three clients, the first of which leads
+
+	ids := []string{"TURN1", "TURN2", "TURN3"}
+	twss := make([]*tConn, len(ids))
+	for i, id := range ids {
+		ws, _, err := dial(serv, room, id, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		twss[i] = newTConn(ws, id)
+		defer twss[i].close()
+		if err := twss[i].swallow("Welcome"); err != nil {
+			t.Fatalf("Welcome error for %s: %s", id, err)
+		}
+		for j := 0; j < i; j++ {
+			if err := twss[j].swallow("Joiner"); err != nil {
+				t.Fatalf("Joiner error for %s: %s", ids[j], err)
+			}
+		}
+	}
+	tws1, tws2, tws3 := twss[0], twss[1], twss[2]
+
+	send := func(tws *tConn, msg string) {
+		if err := tws.ws.WriteMessage(
+			websocket.TextMessage, []byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectError := func(tws *tConn, reason string) {
+		env, err := tws.readEnvelope(500, "%s expecting Error", tws.id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if env.Intent != "Error" || env.Reason != reason {
+			t.Errorf("%s got unexpected envelope: %#v", tws.id, env)
+		}
+		for _, tws2 := range twss {
+			if err := tws2.expectNoMessage(100); err != nil {
+				t.Errorf("%s: %s", tws2.id, err)
+			}
+		}
+	}
+	expectTurn := func(twss []*tConn, turn string) {
+		for _, tws := range twss {
+			env, err := tws.readEnvelope(500, "%s expecting Turn", tws.id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if env.Intent != "Turn" || env.Turn != turn || env.Num < 0 {
+				t.Errorf("%s got unexpected envelope: %#v", tws.id, env)
+			}
+		}
+	}
+	expectPeers := func() {
+		for _, tws := range twss {
+			if err := tws.swallow("Peer"); err != nil {
+				t.Fatalf("%s: %s", tws.id, err)
+			}
+		}
+	}
+
+	// Only the leader can say whose turn it is
+
+	send(tws2, `{"intent":"SetTurn","id":"TURN2"}`)
+	expectError(tws2, "Not leader")
+	send(tws1, `{"intent":"SetTurn","id":"TURN9"}`)
+	expectError(tws1, "Cannot set turn")
+	send(tws1, `{"intent":"SetTurn","id":"TURN2"}`)
+	expectTurn(twss, "TURN2")
+
+	// Then only the turn holder and the leader can send messages
+
+	send(tws3, `"Me next"`)
+	expectError(tws3, "Not your turn")
+	send(tws2, `"My move"`)
+	expectPeers()
+	send(tws1, `"Leader's move"`)
+	expectPeers()
+
+	// Only the turn holder can pass the turn on, which goes to whoever
+	// joined next
+
+	send(tws3, `{"intent":"PassTurn"}`)
+	expectError(tws3, "Not your turn")
+	send(tws2, `{"intent":"PassTurn"}`)
+	expectTurn(twss, "TURN3")
+
+	// A new client is told whose turn it is, and gets its turn after
+	// the others
+
+	ws4, _, err := dial(serv, room, "TURN4", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws4 := newTConn(ws4, "TURN4")
+	defer tws4.close()
+	env, err := tws4.readEnvelope(500, "TURN4 expecting Welcome")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Intent != "Welcome" || env.Turn != "TURN3" {
+		t.Errorf("TURN4 got unexpected envelope: %#v", env)
+	}
+	for _, tws := range twss {
+		if err := tws.swallow("Joiner"); err != nil {
+			t.Fatalf("%s: %s", tws.id, err)
+		}
+	}
+	send(tws3, `{"intent":"PassTurn"}`)
+	expectTurn(append(twss, tws4), "TURN4")
+
+	// Tidy up, and check everything in the main app finishes
+	tws1.close()
+	tws2.close()
+	tws3.close()
+	tws4.close()
+	WG.Wait()
+}
+
+func TestHubMsgs_NewJoinerSeesRecentHistory(t *testing.T) {
+	// Just for this test, lower the reconnection timeout so that a
+	// Leaver message is triggered reasonably quickly.
+	useSuperhub(t, 250*time.Millisecond)
+
+	serv := newTestServer(bounceHandler)
+	defer serv.Close()
+
+	room := "/hub.history"
+
+	// Create a room which keeps two messages, and send three
+
+	ws1, _, err := dialWith(serv, room, "HIST1", -1,
+		url.Values{"history": {"2"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws1 := newTConn(ws1, "HIST1")
+	defer tws1.close()
+	if err := tws1.swallow("Welcome"); err != nil {
+		t.Fatal(err)
+	}
+	times := make([]int64, 0)
+	for _, msg := range []string{`"One"`, `"Two"`, `"Three"`} {
+		if err := ws1.WriteMessage(
+			websocket.TextMessage, []byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		env, err := tws1.readEnvelope(500, "HIST1 expecting receipt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		times = append(times, env.Time)
+	}
+
+	// A new joiner gets the last two, numbered after its Welcome
+
+	ws2, _, err := dial(serv, room, "HIST2", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws2 := newTConn(ws2, "HIST2")
+	defer tws2.close()
+	env, err := tws2.readEnvelope(500, "HIST2 expecting Welcome")
+	if err != nil {
+		t.Fatal(err)
+	}
+	num := env.Num
+	for i, exp := range []string{`"Two"`, `"Three"`} {
+		env, err := tws2.readEnvelope(500, "HIST2 expecting Replay %d", i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		num++
+		if env.Intent != "Replay" || string(env.Body) != exp ||
+			env.Time != times[i+1] || env.Num != num ||
+			!sameElements(env.From, []string{"HIST1"}) {
+			t.Errorf("HIST2 got unexpected envelope: %#v", env)
+		}
+	}
+	if err := tws1.swallow("Joiner"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reconnecting doesn't get them again
+
+	ws2b, _, err := dial(serv, room, "HIST2", num)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws2b := newTConn(ws2b, "HIST2")
+	defer tws2b.close()
+	tws2.close()
+	if err := tws2b.expectNoMessage(300); err != nil {
+		t.Error(err)
+	}
+
+	// Tidy up, and check everything in the main app finishes
+	tws1.close()
+	tws2b.close()
+	WG.Wait()
+}
+
+func TestHubMsgs_FullHistoryRoomShowsEverythingOnce(t *testing.T) {
+	// Just for this test, lower the reconnection timeout so that a
+	// Leaver message is triggered reasonably quickly, and messages
+	// get old quickly
+	sh := useSuperhub(t, 250*time.Millisecond)
+
+	serv := newTestServer(bounceHandler)
+	defer serv.Close()
+
+	room := "/hub.history.full"
+
+	// Create a room which keeps all its messages, and send some
+
+	ws1, _, err := dialWith(serv, room, "FULL1", -1,
+		url.Values{"history": {"all"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws1 := newTConn(ws1, "FULL1")
+	defer tws1.close()
+	if err := tws1.swallow("Welcome"); err != nil {
+		t.Fatal(err)
+	}
+	msgs := make([]string, 0)
+	for i := 0; i < 30; i++ {
+		msg := `"Move ` + strconv.Itoa(i) + `"`
+		if err := ws1.WriteMessage(
+			websocket.TextMessage, []byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		if err := tws1.swallow("Peer"); err != nil {
+			t.Fatal(err)
+		}
+		msgs = append(msgs, msg)
+	}
+
+	// Wait until they'd be too old to reconnect for, then a new joiner
+	// gets them all, in order
+
+	time.Sleep(sh.config.Reconnection * 3 / 2)
+	expectReplays := func(tws *tConn) int {
+		env, err := tws.readEnvelope(500, "FULL2 expecting Welcome")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if env.Intent != "Welcome" {
+			t.Fatalf("FULL2 got unexpected envelope: %#v", env)
+		}
+		num := env.Num
+		for _, msg := range msgs {
+			env, err := tws.readEnvelope(500, "FULL2 expecting Replay")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if env.Intent != "Replay" || string(env.Body) != msg ||
+				env.Num != num+1 {
+				t.Fatalf("FULL2 got unexpected envelope: %#v", env)
+			}
+			num = env.Num
+		}
+		return num
+	}
+	ws2, _, err := dial(serv, room, "FULL2", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws2 := newTConn(ws2, "FULL2")
+	defer tws2.close()
+	num := expectReplays(tws2)
+	if err := tws1.swallow("Joiner"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another message goes to both, and reconnecting from there doesn't
+	// get the backlog again
+
+	if err := ws1.WriteMessage(
+		websocket.TextMessage, []byte(`"Live"`)); err != nil {
+		t.Fatal(err)
+	}
+	if err = swallowMany(
+		intentExp{"Live, ws1", tws1, "Peer"},
+		intentExp{"Live, ws2", tws2, "Peer"},
+	); err != nil {
+		t.Fatal(err)
+	}
+	ws2b, _, err := dial(serv, room, "FULL2", num+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws2b := newTConn(ws2b, "FULL2")
+	defer tws2b.close()
+	tws2.close()
+	if err := tws2b.expectNoMessage(300); err != nil {
+		t.Error(err)
+	}
+
+	// Tidy up, and check everything in the main app finishes
+	tws1.close()
+	tws2b.close()
+	WG.Wait()
+}
+
+func TestHubMsgs_LeaderCanPauseAndResumeRoom(t *testing.T) {
+	// Just for this test, lower the reconnection timeout so that a
+	// Leaver message is triggered reasonably quickly.
+	useSuperhub(t, 250*time.Millisecond)
+
+	serv := newTestServer(bounceHandler)
+	defer serv.Close()
+
+	room := "/hub.pause"
+
+	// Connect two clients, the first of which leads
+
+	ws1, _, err := dial(serv, room, "PAU1", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws1 := newTConn(ws1, "PAU1")
+	defer tws1.close()
+	if err := tws1.swallow("Welcome"); err != nil {
+		t.Fatal(err)
+	}
+
+	ws2, _, err := dial(serv, room, "PAU2", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws2 := newTConn(ws2, "PAU2")
+	defer tws2.close()
+	if err = swallowMany(
+		intentExp{"PAU2 joining, ws2", tws2, "Welcome"},
+		intentExp{"PAU2 joining, ws1", tws1, "Joiner"},
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	send := func(tws *tConn, msg string) {
+		if err := tws.ws.WriteMessage(
+			websocket.TextMessage, []byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Only the leader can pause the room
+
+	send(tws2, `{"intent":"Pause","token":"p1"}`)
+	env, err := tws2.readEnvelope(500, "PAU2 expecting Error")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Intent != "Error" || env.Reason != "Not leader" || env.Token != "p1" {
+		t.Errorf("PAU2 got unexpected envelope: %#v", env)
+	}
+
+	send(tws1, `{"intent":"Pause"}`)
+	nums := make(map[string]int)
+	for _, tws := range []*tConn{tws1, tws2} {
+		env, err := tws.readEnvelope(500, "%s expecting Paused", tws.id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if env.Intent != "Paused" ||
+			!sameElements(env.From, []string{"PAU1"}) {
+			t.Errorf("%s got unexpected envelope: %#v", tws.id, env)
+		}
+		nums[tws.id] = env.Num
+	}
+
+	// Messages sent now don't go out, even to a client that reconnects
+
+	send(tws2, `"Held 1"`)
+	for _, tws := range []*tConn{tws1, tws2} {
+		if err := tws.expectNoMessage(200); err != nil {
+			t.Errorf("%s: %s", tws.id, err)
+		}
+	}
+	ws2b, _, err := dial(serv, room, "PAU2", nums["PAU2"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws2b := newTConn(ws2b, "PAU2")
+	defer tws2b.close()
+	tws2.close()
+	send(tws1, `"Held 2"`)
+	for _, tws := range []*tConn{tws1, tws2b} {
+		if err := tws.expectNoMessage(300); err != nil {
+			t.Errorf("%s: %s", tws.id, err)
+		}
+	}
+
+	// When the leader resumes, everything goes out in order
+
+	send(tws1, `{"intent":"Resume"}`)
+	for _, tws := range []*tConn{tws1, tws2b} {
+		for _, exp := range []string{`"Held 1"`, `"Held 2"`, ""} {
+			env, err := tws.readEnvelope(500, "%s expecting envelope", tws.id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			nums[tws.id]++
+			if env.Num != nums[tws.id] ||
+				(exp != "" && (env.Intent != "Peer" || string(env.Body) != exp)) ||
+				(exp == "" && env.Intent != "Resumed") {
+				t.Errorf("%s got unexpected envelope: %#v", tws.id, env)
+			}
+		}
+	}
+
+	// Tidy up, and check everything in the main app finishes
+	tws1.close()
+	tws2b.close()
+	WG.Wait()
+}
+
+func TestHubMsgs_StatsGoOnlyToRequester(t *testing.T) {
+	// Just for this test, lower the reconnection timeout so that a
+	// Leaver message is triggered reasonably quickly.
+	useSuperhub(t, 250*time.Millisecond)
+
+	serv := newTestServer(bounceHandler)
+	defer serv.Close()
+
+	room := "/hub.stats"
+
+	// Connect two clients, remembering the last num each has had
+
+	ws1, _, err := dial(serv, room, "STA1", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws1 := newTConn(ws1, "STA1")
+	defer tws1.close()
+	if err := tws1.swallow("Welcome"); err != nil {
+		t.Fatal(err)
+	}
+
+	ws2, _, err := dial(serv, room, "STA2", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws2 := newTConn(ws2, "STA2")
+	defer tws2.close()
+	if err := tws2.swallow("Welcome"); err != nil {
+		t.Fatal(err)
+	}
+	env, err := tws1.readEnvelope(500, "STA1 expecting Joiner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	num1 := env.Num
+
+	// Relay two peer messages
+
+	for _, msg := range []string{`{"move":"e4"}`, `"Hello"`} {
+		if err := ws2.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		if env, err = tws1.readEnvelope(500, "STA1 expecting Peer"); err != nil {
+			t.Fatal(err)
+		}
+		num1 = env.Num
+		if err := tws2.swallow("Peer"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The first client asks for stats, and gets them unnumbered,
+	// and the second client hears nothing
+
+	req := []byte(`{"intent":"Stats","token":"s1"}`)
+	if err := ws1.WriteMessage(websocket.TextMessage, req); err != nil {
+		t.Fatal(err)
+	}
+	env, err = tws1.readEnvelope(500, "STA1 expecting Stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Intent != "Stats" || env.Token != "s1" || env.Num != -1 ||
+		env.Stats == nil {
+		t.Fatalf("STA1 got unexpected envelope %#v", env)
+	}
+	exp := Stats{
+		Messages:         2,
+		Bytes:            len(`{"move":"e4"}`) + len(`"Hello"`),
+		Members:          2,
+		AgeMs:            env.Stats.AgeMs,
+		Num:              num1,
+		Buffered:         env.Stats.Buffered,
+		BufferedBytes:    env.Stats.BufferedBytes,
+		OldestBufferedMs: env.Stats.OldestBufferedMs,
+		OldestNum:        0,
+	}
+	if *env.Stats != exp || env.Stats.AgeMs < 0 ||
+		env.Stats.Buffered < num1+1 ||
+		env.Stats.BufferedBytes < exp.Bytes ||
+		env.Stats.OldestBufferedMs < 0 {
+		t.Errorf("Expected stats like %#v but got %#v", exp, *env.Stats)
+	}
+	if err := tws2.expectNoMessage(200); err != nil {
+		t.Error(err)
+	}
+
+	// Asking too often gets an error
+
+	for i := 1; i < statsLimit; i++ {
+		if err := ws1.WriteMessage(websocket.TextMessage, req); err != nil {
+			t.Fatal(err)
+		}
+		if err := tws1.swallow("Stats"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ws1.WriteMessage(websocket.TextMessage, req); err != nil {
+		t.Fatal(err)
+	}
+	env, err = tws1.readEnvelope(500, "STA1 expecting Error")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Intent != "Error" || env.Token != "s1" ||
+		env.Reason != "Too many stats requests" {
+		t.Errorf("STA1 got unexpected envelope %#v", env)
+	}
+
+	// Peer messages carry on the first client's nums as if nothing
+	// had happened
+
+	if err := ws2.WriteMessage(websocket.TextMessage, []byte(`"Again"`)); err != nil {
+		t.Fatal(err)
+	}
+	env, err = tws1.readEnvelope(500, "STA1 expecting Peer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Intent != "Peer" || env.Num != num1+1 {
+		t.Errorf("STA1 got unexpected envelope %#v", env)
+	}
+
+	// Tidy up, and check everything in the main app finishes
+	tws1.close()
+	tws2.close()
+	WG.Wait()
+}
+
+func TestHubMsgs_SelfJoinerGetsItsOwnJoinerAfterWelcome(t *testing.T) {
+	// Just for this test, lower the reconnection timeout so that a
+	// Leaver message is triggered reasonably quickly.
+	useSuperhub(t, 250*time.Millisecond)
+
+	serv := newTestServer(bounceHandler)
+	defer serv.Close()
+
+	room := "/hub.self.joiner"
+
+	// The first client joins as usual
+
+	ws1, _, err := dial(serv, room, "SELF1", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws1 := newTConn(ws1, "SELF1")
+	defer tws1.close()
+	if err := tws1.swallow("Welcome"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The second client wants its own Joiner, which should come
+	// straight after its Welcome, and be to both clients
+
+	selfJoin := url.Values{"selfjoin": {"1"}}
+	ws2a, _, err := dialWith(serv, room, "SELF2", -1, selfJoin, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws2a := newTConn(ws2a, "SELF2")
+	defer tws2a.close()
+	env, err := tws2a.readEnvelope(500, "SELF2 expecting Welcome")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Intent != "Welcome" {
+		t.Fatalf("SELF2 expected Welcome but got %#v", env)
+	}
+	welcomeNum := env.Num
+
+	both := []string{"SELF1", "SELF2"}
+	for _, tws := range []*tConn{tws2a, tws1} {
+		env, err := tws.readEnvelope(500, "%s expecting Joiner", tws.id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if env.Intent != "Joiner" ||
+			!sameElements(env.From, []string{"SELF2"}) ||
+			!sameElements(env.To, both) {
+			t.Errorf("%s got unexpected envelope %#v", tws.id, env)
+		}
+		if tws == tws2a && env.Num != welcomeNum+1 {
+			t.Errorf("SELF2 expected Joiner num %d but got %d",
+				welcomeNum+1, env.Num)
+		}
+	}
+
+	// If the second client reconnects having missed its Joiner it
+	// gets it again. The first hears it's away and back, and nothing
+	// more.
+
+	tws2a.close()
+	if err := tws1.swallow("Away"); err != nil {
+		t.Fatal(err)
+	}
+	ws2b, _, err := dialWith(serv, room, "SELF2", welcomeNum, selfJoin, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws2b := newTConn(ws2b, "SELF2")
+	defer tws2b.close()
+	env, err = tws2b.readEnvelope(500, "SELF2 expecting Joiner again")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Intent != "Joiner" || env.Num != welcomeNum+1 ||
+		!sameElements(env.From, []string{"SELF2"}) {
+		t.Errorf("SELF2 got unexpected envelope %#v", env)
+	}
+	if err := tws1.swallow("Back"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tws1.expectNoMessage(200); err != nil {
+		t.Error(err)
+	}
+
+	// Tidy up, and check everything in the main app finishes
+	tws1.close()
+	tws2b.close()
+	WG.Wait()
+}
+
+func TestHubMsgs_OthersHearWhenClientIsAwayAndBack(t *testing.T) {
+	// Just for this test, lower the reconnection timeout so that a
+	// Leaver message is triggered reasonably quickly.
+	useSuperhub(t, 250*time.Millisecond)
+
+	serv := newTestServer(bounceHandler)
+	defer serv.Close()
+
+	room := "/hub.away.back"
+
+	// Connect two clients
+
+	ws1a, _, err := dial(serv, room, "AWAY1", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws1a := newTConn(ws1a, "AWAY1")
+	defer tws1a.close()
+	if err := tws1a.swallow("Welcome"); err != nil {
+		t.Fatal(err)
+	}
+
+	ws2, _, err := dial(serv, room, "AWAY2", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws2 := newTConn(ws2, "AWAY2")
+	defer tws2.close()
+	env, err := tws2.readEnvelope(500, "AWAY2 expecting Welcome")
+	if err != nil {
+		t.Fatal(err)
+	}
+	num2 := env.Num
+	env, err = tws1a.readEnvelope(500, "AWAY1 expecting Joiner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	num1 := env.Num
+
+	// expect checks the second client gets an envelope about the first,
+	// numbered next
+	expect := func(intent string) {
+		env, err := tws2.readEnvelope(500, "AWAY2 expecting %s", intent)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if env.Intent != intent || env.Num != num2+1 ||
+			!sameElements(env.From, []string{"AWAY1"}) ||
+			!sameElements(env.To, []string{"AWAY2"}) {
+			t.Errorf("AWAY2 got unexpected envelope %#v", env)
+		}
+		num2 = env.Num
+	}
+
+	// The first client drops out, and the second hears it's away. When
+	// it comes back the second hears that, and there's no Leaver.
+
+	tws1a.close()
+	expect("Away")
+
+	ws1b, _, err := dial(serv, room, "AWAY1", num1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws1b := newTConn(ws1b, "AWAY1")
+	defer tws1b.close()
+	expect("Back")
+	if err := tws2.expectNoMessage(500); err != nil {
+		t.Error(err)
+	}
+	if err := tws1b.expectNoMessage(100); err != nil {
+		t.Error(err)
+	}
+
+	// If it drops out again and doesn't come back, the second client
+	// hears it's away, and then that it's left
+
+	tws1b.close()
+	expect("Away")
+	expect("Leaver")
+
+	// Tidy up, and check everything in the main app finishes
+	tws2.close()
+	WG.Wait()
+}
+
+func TestHubMsgs_RosterSaysWhoIsReconnecting(t *testing.T) {
+	// Just for this test, lower the reconnection timeout so that a
+	// Leaver message is triggered reasonably quickly.
+	useSuperhub(t, 500*time.Millisecond)
+
+	serv := newTestServer(bounceHandler)
+	defer serv.Close()
+
+	room := "/hub.roster"
+
+	// Connect three clients, and an observer
+
+	twss := make([]*tConn, 0)
+	for i, id := range []string{"ROS1", "ROS2", "ROS3"} {
+		ws, _, err := dial(serv, room, id, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tws := newTConn(ws, id)
+		defer tws.close()
+		if err := tws.swallow("Welcome"); err != nil {
+			t.Fatal(err)
+		}
+		for _, tws2 := range twss[:i] {
+			if err := tws2.swallow("Joiner"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		twss = append(twss, tws)
+	}
+	wsO, _, err := dialWith(serv, room, "ROSO", -1,
+		url.Values{"role": {"observer"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	twsO := newTConn(wsO, "ROSO")
+	defer twsO.close()
+	if err := twsO.swallow("Welcome"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The second client drops out, and within the reconnection window
+	// the third asks who's in the room. It alone gets the answer.
+
+	twss[1].close()
+	for _, tws := range []*tConn{twss[0], twss[2]} {
+		if err := tws.swallow("Away"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	req := []byte(`{"intent":"Roster","token":"r1"}`)
+	if err := twss[2].ws.WriteMessage(websocket.TextMessage, req); err != nil {
+		t.Fatal(err)
+	}
+	env, err := twss[2].readEnvelope(500, "ROS3 expecting Roster")
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := []Member{
+		{ID: "ROS1", State: "connected", Leader: true},
+		{ID: "ROS2", State: "reconnecting"},
+		{ID: "ROS3", State: "connected"},
+	}
+	if env.Intent != "Roster" || env.Token != "r1" || env.Num != -1 ||
+		!reflect.DeepEqual(env.Members, exp) {
+		t.Errorf("ROS3 got unexpected envelope %#v", env)
+	}
+	if err := twss[0].expectNoMessage(100); err != nil {
+		t.Error(err)
+	}
+
+	// Once the second client has left it's not in the roster
+
+	if err := twss[2].swallow("Leaver"); err != nil {
+		t.Fatal(err)
+	}
+	if err := twss[2].ws.WriteMessage(websocket.TextMessage, req); err != nil {
+		t.Fatal(err)
+	}
+	env, err = twss[2].readEnvelope(500, "ROS3 expecting second Roster")
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp = []Member{exp[0], exp[2]}
+	if env.Intent != "Roster" || !reflect.DeepEqual(env.Members, exp) {
+		t.Errorf("ROS3 got unexpected envelope %#v", env)
+	}
+
+	// Tidy up, and check everything in the main app finishes
+	for _, tws := range twss {
+		tws.close()
+	}
+	twsO.close()
+	WG.Wait()
+}
+
+func TestHubMsgs_NamesGoWithJoinersWelcomesAndLeavers(t *testing.T) {
+	// Just for this test, lower the reconnection timeout so that a
+	// Leaver message is triggered reasonably quickly.
+	useSuperhub(t, 250*time.Millisecond)
+
+	serv := newTestServer(bounceHandler)
+	defer serv.Close()
+
+	room := "/hub.names"
+
+	// The first client has a name, and the second doesn't
+
+	ws1a, _, err := dialWith(serv, room, "NAM1", -1,
+		url.Values{"name": {"Alice"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws1a := newTConn(ws1a, "NAM1")
+	defer tws1a.close()
+	env, err := tws1a.readEnvelope(500, "NAM1 expecting Welcome")
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice := map[string]string{"NAM1": "Alice"}
+	if env.Intent != "Welcome" || !reflect.DeepEqual(env.Names, alice) {
+		t.Errorf("NAM1 got unexpected envelope %#v", env)
+	}
+
+	ws2, _, err := dial(serv, room, "NAM2", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws2 := newTConn(ws2, "NAM2")
+	defer tws2.close()
+	env, err = tws2.readEnvelope(500, "NAM2 expecting Welcome")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Intent != "Welcome" || !reflect.DeepEqual(env.Names, alice) {
+		t.Errorf("NAM2 got unexpected envelope %#v", env)
+	}
+	env, err = tws1a.readEnvelope(500, "NAM1 expecting Joiner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Intent != "Joiner" || !reflect.DeepEqual(env.Names, alice) {
+		t.Errorf("NAM1 got unexpected envelope %#v", env)
+	}
+
+	// The first client's ID is taken over, and the new connection's
+	// name is what the third client sees
+
+	ws1b, _, err := dialWith(serv, room, "NAM1", env.Num,
+		url.Values{"name": {"Alicia"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws1b := newTConn(ws1b, "NAM1")
+	defer tws1b.close()
+	tws1a.close()
+
+	ws3, _, err := dialWith(serv, room, "NAM3", -1,
+		url.Values{"name": {"Carol"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws3 := newTConn(ws3, "NAM3")
+	defer tws3.close()
+	env, err = tws3.readEnvelope(500, "NAM3 expecting Welcome")
+	if err != nil {
+		t.Fatal(err)
+	}
+	all := map[string]string{"NAM1": "Alicia", "NAM3": "Carol"}
+	if env.Intent != "Welcome" || !reflect.DeepEqual(env.Names, all) {
+		t.Errorf("NAM3 got unexpected envelope %#v", env)
+	}
+	if err := swallowMany(
+		intentExp{"NAM3 joining, ws1b", tws1b, "Joiner"},
+		intentExp{"NAM3 joining, ws2", tws2, "Joiner"},
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	// When the third client leaves the others still see its name
+
+	if err := ws3.WriteControl(
+		websocket.CloseMessage,
+		websocket.FormatCloseMessage(CloseGoodbye, "Goodbye"),
+		time.Now().Add(time.Second),
+	); err != nil {
+		t.Fatal(err)
+	}
+	env, err = tws2.readEnvelope(500, "NAM2 expecting Leaver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Intent != "Leaver" || !reflect.DeepEqual(env.Names, all) {
+		t.Errorf("NAM2 got unexpected envelope %#v", env)
+	}
+
+	// Tidy up, and check everything in the main app finishes
+	tws1b.close()
+	tws2.close()
+	tws3.close()
+	WG.Wait()
+}
+
+func TestHubMsgs_PlayersCanRename(t *testing.T) {
+	// Just for this test, lower the reconnection timeout so that a
+	// Leaver message is triggered reasonably quickly, and only allow
+	// a couple of renames
+	useSuperhub(t, 250*time.Millisecond)
+	oldRenameLimit := renameLimit
+	renameLimit = 2
+	defer func() {
+		renameLimit = oldRenameLimit
+	}()
+
+	serv := newTestServer(bounceHandler)
+	defer serv.Close()
+
+	room := "/hub.rename"
+
+	// Two clients, of which the first has a name
+
+	ws1, _, err := dialWith(serv, room, "REN1", -1,
+		url.Values{"name": {"Alice"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws1 := newTConn(ws1, "REN1")
+	defer tws1.close()
+	if err := tws1.swallow("Welcome"); err != nil {
+		t.Fatal(err)
+	}
+	ws2, _, err := dial(serv, room, "REN2", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws2 := newTConn(ws2, "REN2")
+	defer tws2.close()
+	if err = swallowMany(
+		intentExp{"REN2 joining, ws2", tws2, "Welcome"},
+		intentExp{"REN2 joining, ws1", tws1, "Joiner"},
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each renames, and both hear about it, numbered
+
+	rename := func(ws *websocket.Conn, name string) {
+		req := `{"intent":"Rename","name":"` + name + `","token":"r1"}`
+		if err := ws.WriteMessage(
+			websocket.TextMessage, []byte(req)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectRenamed := func(from string, old string, names map[string]string) {
+		for _, tws := range []*tConn{tws1, tws2} {
+			env, err := tws.readEnvelope(500, "%s expecting Renamed", tws.id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if env.Intent != "Renamed" || env.Num < 1 ||
+				!reflect.DeepEqual(env.From, []string{from}) ||
+				env.OldName != old || !reflect.DeepEqual(env.Names, names) {
+				t.Errorf("%s got unexpected envelope %#v", tws.id, env)
+			}
+		}
+	}
+	rename(ws1, " Alicia ")
+	expectRenamed("REN1", "Alice", map[string]string{"REN1": "Alicia"})
+	rename(ws2, "Bob")
+	expectRenamed("REN2", "", map[string]string{"REN2": "Bob"})
+	rename(ws2, "")
+	expectRenamed("REN2", "Bob", nil)
+
+	// Renaming too often gets an error
+
+	rename(ws2, "Robert")
+	env, err := tws2.readEnvelope(500, "REN2 expecting Error")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Intent != "Error" || env.Reason != "Too many renames" ||
+		env.Token != "r1" {
+		t.Errorf("REN2 got unexpected envelope %#v", env)
+	}
+	if err := tws1.expectNoMessage(200); err != nil {
+		t.Error(err)
+	}
+
+	// Someone joining later sees the new names
+
+	ws3, _, err := dial(serv, room, "REN3", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws3 := newTConn(ws3, "REN3")
+	defer tws3.close()
+	env, err = tws3.readEnvelope(500, "REN3 expecting Welcome")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Intent != "Welcome" ||
+		!reflect.DeepEqual(env.Names, map[string]string{"REN1": "Alicia"}) {
+		t.Errorf("REN3 got unexpected envelope %#v", env)
+	}
+
+	// Tidy up, and check everything in the main app finishes
+	tws1.close()
+	tws2.close()
+	tws3.close()
+	WG.Wait()
+}
+
+func TestHubMsgs_MetasGoWithJoinersAndWelcomes(t *testing.T) {
+	serv := newTestServer(bounceHandler)
+	defer serv.Close()
+
+	room := "/hub.metas"
+
+	// Bad metadata is refused before the client gets in
+
+	ws, resp, err := dialWith(serv, room, "META0", -1,
+		url.Values{"meta": {"{colour"}}, nil)
+	if err == nil {
+		ws.Close()
+		t.Fatal("Expected error for bad meta, but didn't get one")
+	}
+	if resp == nil || resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400 for bad meta, but got %v", resp)
+	}
+
+	// The first client has metadata, and the second doesn't
+
+	ws1, _, err := dialWith(serv, room, "META1", -1,
+		url.Values{"meta": {`{"colour":"red"}`}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws1 := newTConn(ws1, "META1")
+	defer tws1.close()
+	env, err := tws1.readEnvelope(500, "META1 expecting Welcome")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Intent != "Welcome" || string(env.Metas["META1"]) != `{"colour":"red"}` {
+		t.Errorf("META1 got unexpected envelope %#v", env)
+	}
+
+	ws2, _, err := dial(serv, room, "META2", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws2 := newTConn(ws2, "META2")
+	defer tws2.close()
+	env, err = tws2.readEnvelope(500, "META2 expecting Welcome")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Intent != "Welcome" || len(env.Metas) != 1 ||
+		string(env.Metas["META1"]) != `{"colour":"red"}` {
+		t.Errorf("META2 got unexpected envelope %#v", env)
+	}
+	if err := tws1.swallow("Joiner"); err != nil {
+		t.Fatalf("Joiner error for META1: %s", err)
+	}
+
+	// A third client's metadata goes to the others with its Joiner
+
+	ws3, _, err := dialWith(serv, room, "META3", -1,
+		url.Values{"meta": {`["blue",3]`}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws3 := newTConn(ws3, "META3")
+	defer tws3.close()
+	env, err = tws3.readEnvelope(500, "META3 expecting Welcome")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Intent != "Welcome" || len(env.Metas) != 2 ||
+		string(env.Metas["META3"]) != `["blue",3]` {
+		t.Errorf("META3 got unexpected envelope %#v", env)
+	}
+	for _, tws := range []*tConn{tws1, tws2} {
+		env, err = tws.readEnvelope(500, "%s expecting Joiner", tws.id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if env.Intent != "Joiner" ||
+			string(env.Metas["META3"]) != `["blue",3]` {
+			t.Errorf("%s got unexpected envelope %#v", tws.id, env)
+		}
+	}
+
+	// Tidy up, and check everything in the main app finishes
+	tws1.close()
+	tws2.close()
+	tws3.close()
+	WG.Wait()
+}
+
+func TestHubMsgs_RoomCanSetItsReconnectionTime(t *testing.T) {
+	serv := newTestServer(bounceHandler)
+	defer serv.Close()
+
+	// The room's creator says how long to allow for a reconnection,
+	// and a later client can't change it
+
+	room := "/hub.reconnect.time"
+	ws1, _, err := dialWith(serv, room, "RCT1", -1,
+		url.Values{"reconnect": {"100"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws1 := newTConn(ws1, "RCT1")
+	defer tws1.close()
+	env, err := tws1.readEnvelope(500, "RCT1 expecting Welcome")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Intent != "Welcome" || env.Limits == nil ||
+		env.Limits.ReconnectionMs != 100 {
+		t.Errorf("RCT1 got unexpected envelope %#v", env)
+	}
+
+	ws2, _, err := dialWith(serv, room, "RCT2", -1,
+		url.Values{"reconnect": {"60000"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws2 := newTConn(ws2, "RCT2")
+	defer tws2.close()
+	env, err = tws2.readEnvelope(500, "RCT2 expecting Welcome")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Intent != "Welcome" || env.Limits == nil ||
+		env.Limits.ReconnectionMs != 100 {
+		t.Errorf("RCT2 got unexpected envelope %#v", env)
+	}
+	if err := tws1.swallow("Joiner"); err != nil {
+		t.Fatal(err)
+	}
+
+	// When the second client drops out it should be taken to have
+	// left well before the usual reconnection time
+
+	tws2.close()
+	if err := tws1.swallow("Away"); err != nil {
+		t.Fatal(err)
+	}
+	env, err = tws1.readEnvelope(1000, "RCT1 expecting Leaver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Intent != "Leaver" || !sameElements(env.From, []string{"RCT2"}) {
+		t.Errorf("RCT1 got unexpected envelope %#v", env)
+	}
+
+	// Tidy up, and check everything in the main app finishes
+	tws1.close()
+	WG.Wait()
+}
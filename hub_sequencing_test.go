@@ -8,6 +8,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"math/rand"
+	"net/url"
 	"reflect"
 	"strconv"
 	"sync"
@@ -20,14 +21,10 @@ import (
 // Tests around sequencing
 
 func TestHubSeq_BouncesToOtherClients(t *testing.T) {
-	// Just for this test, lower the reconnectionTimeout so that a
+	// Just for this test, lower the reconnection timeout so that a
 	// Leaver message is triggered reasonably quickly.
 
-	oldReconnectionTimeout := reconnectionTimeout
-	reconnectionTimeout = 250 * time.Millisecond
-	defer func() {
-		reconnectionTimeout = oldReconnectionTimeout
-	}()
+	useSuperhub(t, 250*time.Millisecond)
 
 	// Start a server
 	serv := newTestServer(bounceHandler)
@@ -155,14 +152,10 @@ func TestHubSeq_BouncesToOtherClients(t *testing.T) {
 // A test for general connecting, disconnecting and message sending...
 // This just needs to run and not deadlock.
 func TestHubSeq_GeneralChaos(t *testing.T) {
-	// Just for this test, lower the reconnectionTimeout so that a
+	// Just for this test, lower the reconnection timeout so that a
 	// Leaver message is triggered reasonably quickly.
 
-	oldReconnectionTimeout := reconnectionTimeout
-	reconnectionTimeout = 250 * time.Millisecond
-	defer func() {
-		reconnectionTimeout = oldReconnectionTimeout
-	}()
+	useSuperhub(t, 250*time.Millisecond)
 
 	// Tracking our connections and clients
 	cMap := make(map[string]*websocket.Conn)
@@ -259,13 +252,17 @@ func TestHubSeq_NonReadingClientsDontBlock(t *testing.T) {
 	max := 10
 	twss := make([]*tConn, max)
 
-	// Just for this test, lower the reconnectionTimeout so that a
-	// Leaver message is triggered reasonably quickly.
+	// Just for this test, lower the reconnection timeout so that a
+	// Leaver message is triggered reasonably quickly, and let the
+	// clients send as fast as they like.
 
-	oldReconnectionTimeout := reconnectionTimeout
-	reconnectionTimeout = 250 * time.Millisecond
+	useSuperhub(t, 250*time.Millisecond)
+	oldMsgBurst := msgBurst
+	msgBurst = 10000
 	defer func() {
-		reconnectionTimeout = oldReconnectionTimeout
+		// The hub may still be reading these if we stopped early
+		WG.Wait()
+		msgBurst = oldMsgBurst
 	}()
 
 	// Start a web server
@@ -351,18 +348,226 @@ func TestHubSeq_NonReadingClientsDontBlock(t *testing.T) {
 	WG.Wait()
 }
 
+func TestHubSeq_SlowConsumersAreClosed(t *testing.T) {
+	// Just for this test, let very little wait for a client, lower the
+	// reconnection timeout so that a Leaver message is triggered
+	// reasonably quickly, and let the clients send as fast as they like.
+
+	oldMaxQueued := maxQueued
+	oldSlowConsumerWait := slowConsumerWait
+	useSuperhub(t, 250*time.Millisecond)
+	oldMsgBurst := msgBurst
+	oldRoomMsgBurst := roomMsgBurst
+	maxQueued = 2
+	slowConsumerWait = 100 * time.Millisecond
+	msgBurst = 10000
+	roomMsgBurst = 10000
+	defer func() {
+		// The hub may still be reading these if we stopped early
+		WG.Wait()
+		maxQueued = oldMaxQueued
+		slowConsumerWait = oldSlowConsumerWait
+		msgBurst = oldMsgBurst
+		roomMsgBurst = oldRoomMsgBurst
+	}()
+
+	serv := newTestServer(bounceHandler)
+	defer serv.Close()
+
+	// Three clients, of which the middle one doesn't read anything
+
+	room := "/hub.slow.consumer"
+	twss := make([]*tConn, 3)
+	for i := range twss {
+		id := "SC" + strconv.Itoa(i+1)
+		ws, _, err := dial(serv, room, id, -1)
+		if err != nil {
+			t.Fatalf("Couldn't dial %s: %s", id, err)
+		}
+		twss[i] = newTConn(ws, id)
+		defer twss[i].close()
+	}
+
+	// The polite clients should get every message, and then hear that
+	// the slow one has left
+
+	count := 400
+	w := sync.WaitGroup{}
+	consume := func(tws *tConn) {
+		defer w.Done()
+		got := 0
+		left := false
+		deadline := time.Now().Add(20 * time.Second)
+		for (got < count || !left) && time.Now().Before(deadline) {
+			rr, timedOut := tws.readMessage(500)
+			if timedOut {
+				continue
+			}
+			if rr.err != nil {
+				t.Errorf("%s: Read error: %s", tws.id, rr.err)
+				return
+			}
+			env := Envelope{}
+			if err := decodeEnvelope(rr.mType, rr.msg, &env); err != nil {
+				t.Errorf("%s: Decoding error: %s", tws.id, err)
+				return
+			}
+			switch {
+			case env.Intent == "Receipt" || env.Intent == "Peer":
+				got++
+			case env.Intent == "Leaver" &&
+				reflect.DeepEqual(env.From, []string{"SC2"}):
+				left = true
+			}
+		}
+		if got != count || !left {
+			t.Errorf("%s: Got %d of %d messages, and heard SC2 leave: %t",
+				tws.id, got, count, left)
+		}
+	}
+	w.Add(2)
+	go consume(twss[0])
+	go consume(twss[2])
+
+	// Send enough that the slow client can't take any more
+
+	msg := []byte(fmt.Sprintf(`"%050000d"`, 0))
+	for i := 0; i < count; i++ {
+		if err := twss[0].ws.WriteMessage(
+			websocket.TextMessage, msg); err != nil {
+			t.Fatalf("Write error for message %d: %s", i, err)
+		}
+	}
+	w.Wait()
+
+	// Tidy up, and check everything in the main app finishes
+	for _, tws := range twss {
+		tws.close()
+	}
+	WG.Wait()
+}
+
+func TestHubSeq_StatsShowClientsFallingBehind(t *testing.T) {
+	// Just for this test, say a client's falling behind soon, lower the
+	// reconnection timeout so that the test finishes reasonably quickly,
+	// let the clients send as fast as they like, and keep everything
+	// they send for reconnections
+	oldLaggingQueued := laggingQueued
+	useSuperhub(t, time.Second)
+	oldMsgBurst := msgBurst
+	oldRoomMsgBurst := roomMsgBurst
+	oldMaxBufferedBytes := maxBufferedBytes
+	laggingQueued = 10
+	msgBurst = 10000
+	roomMsgBurst = 10000
+	maxBufferedBytes = 64 * 1024 * 1024
+	defer func() {
+		// The hub may still be reading these if we stopped early
+		WG.Wait()
+		laggingQueued = oldLaggingQueued
+		msgBurst = oldMsgBurst
+		roomMsgBurst = oldRoomMsgBurst
+		maxBufferedBytes = oldMaxBufferedBytes
+	}()
+
+	serv := newTestServer(bounceHandler)
+	defer serv.Close()
+
+	// Connect two clients. The first doesn't want receipts.
+
+	room := "/hub.falling.behind"
+	ws1, _, err := dialWith(serv, room, "LAG1", -1,
+		url.Values{"receipts": {"off"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws1 := newTConn(ws1, "LAG1")
+	defer tws1.close()
+	ws2a, _, err := dial(serv, room, "LAG2", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws2a := newTConn(ws2a, "LAG2")
+	defer tws2a.close()
+	if err := tws1.swallow("Welcome"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tws1.swallow("Joiner"); err != nil {
+		t.Fatal(err)
+	}
+	env, err := tws2a.readEnvelope(500, "LAG2 expecting Welcome")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lastnum := env.Num
+
+	// Nobody's behind yet
+
+	req := []byte(`{"intent":"Stats","token":"s1"}`)
+	if err := ws1.WriteMessage(websocket.TextMessage, req); err != nil {
+		t.Fatal(err)
+	}
+	env, err = tws1.readEnvelope(500, "LAG1 expecting first Stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Stats == nil || env.Stats.MaxQueued != 0 ||
+		env.Stats.OldestQueuedMs != 0 {
+		t.Errorf("LAG1 got unexpected first stats %#v", env.Stats)
+	}
+
+	// The second client goes away, misses lots of big messages, and
+	// comes back without reading them
+
+	tws2a.close()
+	if err := tws1.swallow("Away"); err != nil {
+		t.Fatal(err)
+	}
+	msg := []byte(fmt.Sprintf(`"%050000d"`, 0))
+	for i := 0; i < 400; i++ {
+		if err := ws1.WriteMessage(websocket.TextMessage, msg); err != nil {
+			t.Fatalf("Write error for message %d: %s", i, err)
+		}
+	}
+	ws2b, _, err := dial(serv, room, "LAG2", lastnum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws2b := newTConn(ws2b, "LAG2")
+	defer tws2b.close()
+	if err := tws1.swallow("Back"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(500 * time.Millisecond)
+
+	// Now the stats show it's behind
+
+	if err := ws1.WriteMessage(websocket.TextMessage, req); err != nil {
+		t.Fatal(err)
+	}
+	env, err = tws1.readEnvelope(500, "LAG1 expecting second Stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Stats == nil || env.Stats.MaxQueued < laggingQueued ||
+		env.Stats.OldestQueuedMs <= 0 {
+		t.Errorf("LAG1 got unexpected second stats %#v", env.Stats)
+	}
+
+	// Tidy up, and check everything in the main app finishes
+	tws1.close()
+	tws2b.close()
+	WG.Wait()
+}
+
 func TestHubSeq_ReconnectingClientsDontMissMessages(t *testing.T) {
 	// Logging for just this function
 	fLog := tLog.New("fn", "TestHubSeq_ReconnectingClientsDontMissMessages")
 	fLog.Debug("Entering")
 
-	// Just for this test, lower the reconnectionTimeout so that a
+	// Just for this test, lower the reconnection timeout so that a
 	// Leaver message is triggered reasonably quickly.
-	oldReconnectionTimeout := reconnectionTimeout
-	reconnectionTimeout = 250 * time.Millisecond
-	defer func() {
-		reconnectionTimeout = oldReconnectionTimeout
-	}()
+	useSuperhub(t, 250*time.Millisecond)
 
 	// Start a server
 	serv := newTestServer(bounceHandler)
@@ -446,6 +651,9 @@ func TestHubSeq_ReconnectingClientsDontMissMessages(t *testing.T) {
 				case gotFirstEnv && env.Intent == "Leaver" &&
 					env.From[0] == "WS2":
 					fLog.Debug("Listener got WS2 Leaver message")
+				case gotFirstEnv && env.Intent == "Away" &&
+					env.From[0] == "WS2":
+					fLog.Debug("Listener got WS2 Away message")
 				default:
 					t.Fatalf("Unexpected later env: from=%v, to=%v, intent=%s, body=%s",
 						env.From, env.To, env.Intent, string(env.Body))
@@ -529,13 +737,9 @@ func TestHubSeq_ReconnectingClientsDontMissMessages(t *testing.T) {
 // client, but it's expecting a message num that's not there, then
 // it should be get a closed connection with a suitable message.
 func TestHubSeq_ReconnectionWithBadLastnumShouldGetClosed(t *testing.T) {
-	// Just for this test, lower the reconnectionTimeout so that a
+	// Just for this test, lower the reconnection timeout so that a
 	// Leaver message is triggered reasonably quickly.
-	oldReconnectionTimeout := reconnectionTimeout
-	reconnectionTimeout = 250 * time.Millisecond
-	defer func() {
-		reconnectionTimeout = oldReconnectionTimeout
-	}()
+	useSuperhub(t, 250*time.Millisecond)
 
 	// Start a server
 	serv := newTestServer(bounceHandler)
@@ -581,8 +785,14 @@ func TestHubSeq_ReconnectionWithBadLastnumShouldGetClosed(t *testing.T) {
 	}
 	tws1b := newTConn(ws1b, "REC1")
 	defer tws1b.close()
-	if err := tws1b.expectClose(CloseBadLastnum, 500); err != nil {
-		t.Error(err)
+	rr, timedOut := tws1b.readMessage(500)
+	if timedOut {
+		t.Fatal("ws1b timed out expecting close")
+	}
+	if !websocket.IsCloseError(rr.err, CloseBadLastnum) {
+		t.Errorf("Expected close error %d but got %v", CloseBadLastnum, rr.err)
+	} else if text := rr.err.(*websocket.CloseError).Text; text != "Bad lastnum for ID REC1" {
+		t.Errorf("Got close reason %q", text)
 	}
 
 	// Close the connections
@@ -602,13 +812,9 @@ func TestHubSeq_ReconnectionWithBadLastnumShouldGetClosed(t *testing.T) {
 // second client times out;
 // third client tries to connect.
 func TestHubSeq_ConnectionWithBadLastnumShouldAllowLaterGoodConn(t *testing.T) {
-	// Just for this test, lower the reconnectionTimeout so that a
+	// Just for this test, lower the reconnection timeout so that a
 	// Leaver message is triggered reasonably quickly.
-	oldReconnectionTimeout := reconnectionTimeout
-	reconnectionTimeout = 250 * time.Millisecond
-	defer func() {
-		reconnectionTimeout = oldReconnectionTimeout
-	}()
+	sh := useSuperhub(t, 250*time.Millisecond)
 
 	// Start a server
 	serv := newTestServer(bounceHandler)
@@ -625,7 +831,7 @@ func TestHubSeq_ConnectionWithBadLastnumShouldAllowLaterGoodConn(t *testing.T) {
 
 	// Sleep for a short time to allow the first client to time out
 	// before the second
-	time.Sleep(reconnectionTimeout / 2)
+	time.Sleep(sh.config.Reconnection / 2)
 
 	// Connect the second client with a bad lastnum
 	ws2, _, err := dial(serv, room, "BADGOOD", 3056)
@@ -637,7 +843,7 @@ func TestHubSeq_ConnectionWithBadLastnumShouldAllowLaterGoodConn(t *testing.T) {
 
 	// Sleep for a short time to allow the second client to time out
 	// before continuing
-	time.Sleep(reconnectionTimeout * 3 / 2)
+	time.Sleep(sh.config.Reconnection * 3 / 2)
 
 	// Connect the third client
 	ws3, _, err := dial(serv, room, "BADGOOD", -1)
@@ -666,13 +872,9 @@ func TestHubSeq_ConnectionWithBadLastnumShouldAllowLaterGoodConn(t *testing.T) {
 // A timeout from a connection with a bad lastnum should not send a leaver
 // message to clients.
 func TestHubSeq_ConnectionWithBadLastnumShouldNotBeALeaver(t *testing.T) {
-	// Just for this test, lower the reconnectionTimeout so that a
+	// Just for this test, lower the reconnection timeout so that a
 	// Leaver message is triggered reasonably quickly.
-	oldReconnectionTimeout := reconnectionTimeout
-	reconnectionTimeout = 250 * time.Millisecond
-	defer func() {
-		reconnectionTimeout = oldReconnectionTimeout
-	}()
+	useSuperhub(t, 250*time.Millisecond)
 
 	// Start a server
 	serv := newTestServer(bounceHandler)
@@ -731,13 +933,9 @@ func TestHubSeq_ConnectionWithBadLastnumShouldNotBeALeaver(t *testing.T) {
 // client, and it's expecting a sensible last num but it was too slow,
 // then it should be get a closed connection with a suitable message.
 func TestHubSeq_ReconnWithGoodLastnumTooLateShouldGetClosed(t *testing.T) {
-	// Just for this test, lower the reconnectionTimeout so that a
+	// Just for this test, lower the reconnection timeout so that a
 	// Leaver message is triggered reasonably quickly.
-	oldReconnectionTimeout := reconnectionTimeout
-	reconnectionTimeout = 200 * time.Millisecond
-	defer func() {
-		reconnectionTimeout = oldReconnectionTimeout
-	}()
+	useSuperhub(t, 200*time.Millisecond)
 
 	// Start a server
 	serv := newTestServer(bounceHandler)
@@ -782,13 +980,9 @@ func TestHubSeq_ReconnWithGoodLastnumTooLateShouldGetClosed(t *testing.T) {
 }
 
 func TestHubSeq_ReconnWithNoLastNumShouldSignalLeaverAndJoiner(t *testing.T) {
-	// Just for this test, lower the reconnectionTimeout so that a
+	// Just for this test, lower the reconnection timeout so that a
 	// Leaver message is triggered reasonably quickly.
-	oldReconnectionTimeout := reconnectionTimeout
-	reconnectionTimeout = 250 * time.Millisecond
-	defer func() {
-		reconnectionTimeout = oldReconnectionTimeout
-	}()
+	useSuperhub(t, 250*time.Millisecond)
 
 	// Start a server
 	serv := newTestServer(bounceHandler)
@@ -864,6 +1058,16 @@ func TestHubSeq_ReconnWithNoLastNumShouldSignalLeaverAndJoiner(t *testing.T) {
 		if !sameElements(env.To, []string{"NOLAST2"}) {
 			t.Errorf("ws2 expected Leaver From [NOLAST2], got %v", env.To)
 		}
+		if env.Reason != "replaced" {
+			t.Errorf("ws2 expected Leaver Reason replaced, got '%s'",
+				env.Reason)
+		}
+	}
+	env, err = tws2.readEnvelope(500, "ws2 expecting Leader")
+	if err != nil {
+		t.Fatal(err)
+	} else if env.Intent != "Leader" || env.Leader != "NOLAST2" {
+		t.Errorf("ws2 expected Leader NOLAST2, got %#v", env)
 	}
 	env, err = tws2.readEnvelope(500, "ws2 expecting Joiner")
 	if err != nil {
@@ -898,101 +1102,1356 @@ func TestHubSeq_ReconnWithNoLastNumShouldSignalLeaverAndJoiner(t *testing.T) {
 	WG.Wait()
 }
 
-// If a client takes over an old client, and the old client signals
-// a disconnection, then the leaver list should always have clients
-// with unique IDs.
-func TestHubSeq_ExpectUniqueClientIDsEvenWithTakeOversAndDisconnections(t *testing.T) {
-	tLog.Debug("Entering TestHubSeq_ExpectUniqueClientIDsEvenWithTakeOversAndDisconnections")
-
-	// Just for this test, lower the reconnectionTimeout so that a
+func TestHubSeq_StrictIDNeedsLastnumToTakeOver(t *testing.T) {
+	// Just for this test, lower the reconnection timeout so that a
 	// Leaver message is triggered reasonably quickly.
-	oldReconnectionTimeout := reconnectionTimeout
-	reconnectionTimeout = 250 * time.Millisecond
-	defer func() {
-		reconnectionTimeout = oldReconnectionTimeout
-	}()
+	useSuperhub(t, 250*time.Millisecond)
 
 	// Start a server
 	serv := newTestServer(bounceHandler)
 	defer serv.Close()
 
-	// Initial values
-	room := "/hub.takeovers"
-	w := sync.WaitGroup{}
+	data := []struct {
+		desc    string
+		strict  bool
+		lastnum bool
+	}{
+		{"Not strict, no lastnum", false, false},
+		{"Strict, no lastnum", true, false},
+		{"Strict, lastnum", true, true},
+	}
 
-	// For some ID, we'll have one client join, a second take over,
-	// the first disconnect anyway, and the second leave after a bit.
+	for i, d := range data {
+		// Connect two clients, the first creating the room
 
-	joinAndTakeOver := func(id string) {
-		defer w.Done()
+		room := "/hub.strict.id." + strconv.Itoa(i)
+		params := url.Values{}
+		if d.strict {
+			params.Set("strictid", "on")
+		}
+		ws1a, _, err := dialWith(serv, room, "STRICT1", -1, params, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tws1a := newTConn(ws1a, "STRICT1")
+		defer tws1a.close()
+		if err := tws1a.swallow("Welcome"); err != nil {
+			t.Fatalf("%s: %s", d.desc, err)
+		}
 
-		ws1, _, err := dial(serv, room, id, -1)
+		ws2, _, err := dial(serv, room, "STRICT2", -1)
 		if err != nil {
 			t.Fatal(err)
 		}
-		tws1 := newTConn(ws1, id)
-		defer tws1.close()
-		env, err := tws1.readEnvelope(500, "Assumed Welcome")
+		tws2 := newTConn(ws2, "STRICT2")
+		defer tws2.close()
+		if err := tws2.swallow("Welcome"); err != nil {
+			t.Fatalf("%s: %s", d.desc, err)
+		}
+		env, err := tws1a.readEnvelope(500, "%s: ws1a expecting Joiner", d.desc)
 		if err != nil {
-			t.Fatalf("Didn't get Welcome; id=%s, err=%s", id, err.Error())
+			t.Fatal(err)
 		}
-		lastnum := env.Num
 
-		// Have the second take over
+		// Connect another client with the first one's ID
 
-		ws2, _, err := dial(serv, room, id, lastnum)
+		num := -1
+		if d.lastnum {
+			num = env.Num
+		}
+		ws1b, _, err := dial(serv, room, "STRICT1", num)
 		if err != nil {
-			t.Fatalf("Error taking over id=%s, err=%s", id, err.Error())
+			t.Fatalf("%s: Error dialling for ws1b: %s", d.desc, err)
 		}
-		defer ws2.Close()
+		tws1b := newTConn(ws1b, "STRICT1")
+		defer tws1b.close()
 
-		// Close the first, pause, then close the second
-		tws1.close()
-		time.Sleep(100 * time.Millisecond)
-		ws2.Close()
-	}
+		switch {
+		case !d.strict:
+			// The new client replaces the old one, and the other
+			// client hears about it
+			if err := swallowMany(
+				intentExp{d.desc + ", ws1b", tws1b, "Welcome"},
+				intentExp{d.desc + ", ws2", tws2, "Leaver"},
+				intentExp{d.desc + ", ws2", tws2, "Leader"},
+				intentExp{d.desc + ", ws2", tws2, "Joiner"},
+			); err != nil {
+				t.Fatal(err)
+			}
+			rr, timedOut := tws1a.readMessage(250)
+			if timedOut || rr.err == nil {
+				t.Errorf("%s: ws1a should have been closed", d.desc)
+			}
 
-	// Check all IDs in a list are unique
-	checkIDs := func(ids []string, intent string, field string) {
-		u := make(map[string]bool)
-		for _, id := range ids {
-			if u[id] {
-				t.Errorf("Found duplicate ID %s in %s (%s): %v",
-					id, intent, field, ids)
+		case !d.lastnum:
+			// The new client is refused, and the old one carries on
+			// without anyone hearing anything
+			if err := tws1b.expectClose(CloseIDTaken, 500); err != nil {
+				t.Errorf("%s: %s", d.desc, err)
+			}
+			if err := tws2.expectNoMessage(200); err != nil {
+				t.Errorf("%s: %s", d.desc, err)
+			}
+			msg := []byte(`"Still here"`)
+			if err := ws1a.WriteMessage(websocket.TextMessage, msg); err != nil {
+				t.Fatal(err)
+			}
+			if err := swallowMany(
+				intentExp{d.desc + ", ws1a", tws1a, "Peer"},
+				intentExp{d.desc + ", ws2", tws2, "Peer"},
+			); err != nil {
+				t.Fatal(err)
+			}
+
+		default:
+			// The new client takes over quietly, and carries on
+			tws1a.close()
+			msg := []byte(`"Took over"`)
+			if err := ws1b.WriteMessage(websocket.TextMessage, msg); err != nil {
+				t.Fatal(err)
+			}
+			env, err := tws2.readEnvelope(500, "%s: ws2 expecting Peer", d.desc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if env.Intent != "Peer" || string(env.Body) != `"Took over"` {
+				t.Errorf("%s: ws2 got unexpected envelope %#v", d.desc, env)
 			}
-			u[id] = true
 		}
+
+		// Close the connections
+		tws1a.close()
+		tws1b.close()
+		tws2.close()
 	}
 
-	// Create a client that will listen and check envelopes
-	ws0, _, err := dial(serv, room, "JTOLISTENER", -1)
+	// Wait for all processes to finish
+	WG.Wait()
+}
+
+// If a client takes over an old client then the other clients shouldn't
+// hear anything about it, not even when the old client times out.
+func TestHubSeq_TakeoverShouldNotSignalLeaver(t *testing.T) {
+	// Just for this test, lower the reconnection timeout so that a
+	// Leaver message is triggered reasonably quickly.
+	useSuperhub(t, 250*time.Millisecond)
+
+	// Start a server
+	serv := newTestServer(bounceHandler)
+	defer serv.Close()
+
+	// Connect the first client
+	room := "/hub.takeover.no.leaver"
+	ws1a, _, err := dial(serv, room, "TNL1", -1)
 	if err != nil {
 		t.Fatal(err)
 	}
-	tws0 := newTConn(ws0, "JTOLISTENER")
-	defer tws0.close()
+	tws1a := newTConn(ws1a, "TNL1")
+	defer tws1a.close()
+	if err := tws1a.swallow("Welcome"); err != nil {
+		t.Fatalf("Welcome error for ws1a: %s", err)
+	}
 
-	// Set off 24 joiners-and-take-overers
-	// (There's a limit of 50 clients, and each of these is two)
-	for i := 0; i < 24; i++ {
-		w.Add(1)
-		go joinAndTakeOver("JTO" + strconv.Itoa(i))
-		time.Sleep(10 * time.Millisecond)
+	// Connect the second client
+	ws2, _, err := dial(serv, room, "TNL2", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws2 := newTConn(ws2, "TNL2")
+	defer tws2.close()
+	if err := tws2.swallow("Welcome"); err != nil {
+		t.Fatalf("Welcome error for ws2: %s", err)
 	}
 
-	// Listen and check for 40 messages (though there will be more)
-	for i := 0; i < 40; i++ {
-		env, err := tws0.readEnvelope(500, "Assumed Welcome")
-		if err != nil {
-			t.Fatal(err)
-		}
-		checkIDs(env.From, env.Intent, "From")
-		checkIDs(env.To, env.Intent, "To")
+	// The first client should get a joiner message. Record the envelope num
+	env, err := tws1a.readEnvelope(500, "ws1a expecting Joiner")
+	if err != nil {
+		t.Fatal(err)
 	}
+	num := env.Num
 
-	// Shut down
-	tLog.Debug("Waiting for goroutines")
-	tws0.close()
-	w.Wait()
+	// Take over the first client, and close the old connection
+	ws1b, _, err := dial(serv, room, "TNL1", num)
+	if err != nil {
+		t.Fatalf("Error dialling for ws1b: %s", err)
+	}
+	tws1b := newTConn(ws1b, "TNL1")
+	defer tws1b.close()
+	tws1a.close()
+
+	// The second client should hear nothing, even after the old client's
+	// reconnection timeout
+	if err := tws2.expectNoMessage(750); err != nil {
+		t.Error(err)
+	}
+
+	// Close the other connections
+	tws1b.close()
+	tws2.close()
+
+	// Wait for all processes to finish
+	WG.Wait()
+}
+
+func TestHubSeq_TakeoverClosesOldConnectionAsSuperseded(t *testing.T) {
+	// Just for this test, lower the reconnection timeout so that a
+	// Leaver message is triggered reasonably quickly.
+	useSuperhub(t, 250*time.Millisecond)
+
+	serv := newTestServer(bounceHandler)
+	defer serv.Close()
+
+	room := "/hub.takeover.superseded"
+	ws1a, _, err := dial(serv, room, "SUP1", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws1a := newTConn(ws1a, "SUP1")
+	defer tws1a.close()
+	env, err := tws1a.readEnvelope(500, "ws1a expecting Welcome")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Take over the client. The old connection should be told why it's
+	// closed, and the new one should carry on.
+
+	ws1b, _, err := dial(serv, room, "SUP1", env.Num)
+	if err != nil {
+		t.Fatalf("Error dialling for ws1b: %s", err)
+	}
+	tws1b := newTConn(ws1b, "SUP1")
+	defer tws1b.close()
+
+	rr, timedOut := tws1a.readMessage(500)
+	if timedOut {
+		t.Fatal("ws1a timed out expecting close")
+	}
+	if !websocket.IsCloseError(rr.err, CloseSuperseded) {
+		t.Errorf("Expected close error %d but got %v", CloseSuperseded, rr.err)
+	} else if text := rr.err.(*websocket.CloseError).Text; text != "Superseded by reconnection" {
+		t.Errorf("Got close reason %q", text)
+	}
+
+	if err := ws1b.WriteMessage(websocket.TextMessage, []byte(`"Hi"`)); err != nil {
+		t.Fatal(err)
+	}
+	env, err = tws1b.readEnvelope(500, "ws1b expecting receipt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Intent != "Peer" || !env.Receipt {
+		t.Errorf("ws1b got unexpected envelope %#v", env)
+	}
+
+	// Tidy up, and check everything in the main app finishes
+	tws1a.close()
+	tws1b.close()
+	WG.Wait()
+}
+
+func TestHubSeq_TakeoverKeepsLeadership(t *testing.T) {
+	// Just for this test, lower the reconnection timeout so that a
+	// Leaver message is triggered reasonably quickly.
+	useSuperhub(t, 250*time.Millisecond)
+
+	// Start a server
+	serv := newTestServer(bounceHandler)
+	defer serv.Close()
+
+	// Connect the first client, which leads
+	room := "/hub.takeover.keeps.leader"
+	ws1a, _, err := dial(serv, room, "TKL1", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws1a := newTConn(ws1a, "TKL1")
+	defer tws1a.close()
+	if err := tws1a.swallow("Welcome"); err != nil {
+		t.Fatalf("Welcome error for ws1a: %s", err)
+	}
+
+	// Connect the second client
+	ws2, _, err := dial(serv, room, "TKL2", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws2 := newTConn(ws2, "TKL2")
+	defer tws2.close()
+	if err := tws2.swallow("Welcome"); err != nil {
+		t.Fatalf("Welcome error for ws2: %s", err)
+	}
+	env, err := tws1a.readEnvelope(500, "ws1a expecting Joiner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	num := env.Num
+
+	// Take over the first client, and close the old connection
+	ws1b, _, err := dial(serv, room, "TKL1", num)
+	if err != nil {
+		t.Fatalf("Error dialling for ws1b: %s", err)
+	}
+	tws1b := newTConn(ws1b, "TKL1")
+	defer tws1b.close()
+	tws1a.close()
+
+	// The second client should hear of no change of leader, even after
+	// the old client's reconnection timeout
+	if err := tws2.expectNoMessage(750); err != nil {
+		t.Error(err)
+	}
+
+	// A new joiner should still be told the first client leads
+	ws3, _, err := dial(serv, room, "TKL3", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws3 := newTConn(ws3, "TKL3")
+	defer tws3.close()
+	env, err = tws3.readEnvelope(500, "ws3 expecting Welcome")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Intent != "Welcome" || env.Leader != "TKL1" {
+		t.Errorf("ws3 got unexpected Welcome: %#v", env)
+	}
+
+	// Close the connections
+	tws1b.close()
+	tws2.close()
+	tws3.close()
+
+	// Wait for all processes to finish
+	WG.Wait()
+}
+
+func TestHubSeq_EachRecipientsNumsRiseByOne(t *testing.T) {
+	// Just for this test, lower the reconnection timeout so that a
+	// Leaver message is triggered reasonably quickly.
+	useSuperhub(t, 250*time.Millisecond)
+
+	// Start a server
+	serv := newTestServer(bounceHandler)
+	defer serv.Close()
+
+	room := "/hub.nums.rise"
+	last := make(map[*tConn]int)
+	join := func(id string) (*websocket.Conn, *tConn) {
+		ws, _, err := dial(serv, room, id, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ws, newTConn(ws, id)
+	}
+
+	// expect checks each client gets an envelope with the given intent,
+	// numbered one after the last envelope it got
+	expect := func(desc string, tss []*tConn, intent string) {
+		for _, tws := range tss {
+			env, err := tws.readEnvelope(500, "%s: %s expecting %s",
+				desc, tws.id, intent)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if env.Intent != intent {
+				t.Fatalf("%s: %s expected %s but got %#v",
+					desc, tws.id, intent, env)
+			}
+			if prev, ok := last[tws]; ok && env.Num != prev+1 {
+				t.Errorf("%s: %s expected num %d but got %d",
+					desc, tws.id, prev+1, env.Num)
+			}
+			last[tws] = env.Num
+		}
+	}
+	send := func(ws *websocket.Conn, body string) {
+		if err := ws.WriteMessage(websocket.TextMessage, []byte(body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A mix of joining, sending and leaving
+
+	ws1, tws1 := join("RISE1")
+	defer tws1.close()
+	expect("RISE1 joining", []*tConn{tws1}, "Welcome")
+
+	ws2, tws2 := join("RISE2")
+	defer tws2.close()
+	expect("RISE2 joining", []*tConn{tws2}, "Welcome")
+	expect("RISE2 joining", []*tConn{tws1}, "Joiner")
+
+	send(ws1, `"one"`)
+	expect("RISE1 sending", []*tConn{tws1, tws2}, "Peer")
+
+	_, tws3 := join("RISE3")
+	defer tws3.close()
+	expect("RISE3 joining", []*tConn{tws3}, "Welcome")
+	expect("RISE3 joining", []*tConn{tws1, tws2}, "Joiner")
+
+	send(ws2, `"two"`)
+	expect("RISE2 sending", []*tConn{tws1, tws2, tws3}, "Peer")
+
+	tws3.close()
+	expect("RISE3 dropping out", []*tConn{tws1, tws2}, "Away")
+	expect("RISE3 leaving", []*tConn{tws1, tws2}, "Leaver")
+
+	send(ws1, `"three"`)
+	expect("RISE1 sending again", []*tConn{tws1, tws2}, "Peer")
+
+	// Close the connections
+	tws1.close()
+	tws2.close()
+
+	// Wait for all processes to finish
+	WG.Wait()
+}
+
+func TestHubSeq_ReceiptOptOutKeepsNumsAndReconnection(t *testing.T) {
+	// Just for this test, lower the reconnection timeout so that a
+	// Leaver message is triggered reasonably quickly.
+	useSuperhub(t, 250*time.Millisecond)
+
+	// Start a server
+	serv := newTestServer(bounceHandler)
+	defer serv.Close()
+
+	// Connect the first client, which doesn't want receipts
+	room := "/hub.receipts.off"
+	noReceipts := url.Values{"receipts": {"off"}}
+	ws1a, _, err := dialWith(serv, room, "RO1", -1, noReceipts, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws1a := newTConn(ws1a, "RO1")
+	defer tws1a.close()
+	if err := tws1a.swallow("Welcome"); err != nil {
+		t.Fatalf("Welcome error for ws1a: %s", err)
+	}
+
+	// Connect the second client, which does want receipts
+	ws2, _, err := dial(serv, room, "RO2", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws2 := newTConn(ws2, "RO2")
+	defer tws2.close()
+	env, err := tws2.readEnvelope(500, "ws2 expecting Welcome")
+	if err != nil {
+		t.Fatal(err)
+	}
+	num2 := env.Num
+	env, err = tws1a.readEnvelope(500, "ws1a expecting Joiner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	num1 := env.Num
+
+	// Each client sends a message, in turn. The second client should
+	// get all the envelopes, and the first client should get only the
+	// second client's messages. Each should get contiguous nums.
+
+	for i, body := range []string{"a1", "b1", "a2", "b2"} {
+		sender, ws := tws1a, ws1a
+		if body[0] == 'b' {
+			sender, ws = tws2, ws2
+		}
+		if err := ws.WriteMessage(websocket.TextMessage, []byte(body)); err != nil {
+			t.Fatalf("%s: Write error: %s", body, err)
+		}
+
+		env, err = tws2.readEnvelope(500, "ws2 expecting %s", body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if env.Num != num2+1+i || string(env.Body) != body ||
+			env.Receipt != (sender == tws2) {
+			t.Errorf("%s: ws2 got unexpected envelope %#v", body, env)
+		}
+
+		if sender == tws1a {
+			continue
+		}
+		env, err = tws1a.readEnvelope(500, "ws1a expecting %s", body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if env.Num != num1+1+i/2 || string(env.Body) != body || env.Receipt {
+			t.Errorf("%s: ws1a got unexpected envelope %#v", body, env)
+		}
+	}
+
+	// The first client reconnects having missed b2, so its lastnum is
+	// for b1. It should get b2 again, and no receipt for a2.
+
+	ws1b, _, err := dialWith(serv, room, "RO1", num1+1, noReceipts, nil)
+	if err != nil {
+		t.Fatalf("Error dialling for ws1b: %s", err)
+	}
+	tws1b := newTConn(ws1b, "RO1")
+	defer tws1b.close()
+	tws1a.close()
+
+	env, err = tws1b.readEnvelope(500, "ws1b expecting b2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Num != num1+2 || string(env.Body) != "b2" || env.Receipt {
+		t.Errorf("ws1b got unexpected envelope %#v", env)
+	}
+	if err := tws1b.expectNoMessage(500); err != nil {
+		t.Error(err)
+	}
+
+	// Close the other connections
+	tws1b.close()
+	tws2.close()
+
+	// Wait for all processes to finish
+	WG.Wait()
+}
+
+func TestHubSeq_EachClientHasItsOwnNums(t *testing.T) {
+	// Just for this test, lower the reconnection timeout so that a
+	// Leaver message is triggered reasonably quickly.
+	useSuperhub(t, 250*time.Millisecond)
+
+	// Start a server
+	serv := newTestServer(bounceHandler)
+	defer serv.Close()
+
+	// Connect two clients
+	room := "/hub.own.nums"
+	ws1, _, err := dial(serv, room, "OWN1", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws1 := newTConn(ws1, "OWN1")
+	defer tws1.close()
+	ws2, _, err := dial(serv, room, "OWN2", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws2 := newTConn(ws2, "OWN2")
+	defer tws2.close()
+
+	// The second client sends some messages. Each client's nums
+	// should start at 0 and run on from there.
+	for i := 0; i < 3; i++ {
+		msg := []byte("Message " + strconv.Itoa(i))
+		if err := ws2.WriteMessage(websocket.TextMessage, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, exp := range []struct {
+		tws    *tConn
+		intent string
+		num    int
+	}{
+		{tws1, "Welcome", 0},
+		{tws1, "Joiner", 1},
+		{tws1, "Peer", 2},
+		{tws1, "Peer", 3},
+		{tws1, "Peer", 4},
+		{tws2, "Welcome", 0},
+		{tws2, "Peer", 1},
+		{tws2, "Peer", 2},
+		{tws2, "Peer", 3},
+	} {
+		env, err := exp.tws.readEnvelope(500, "%s expecting %s",
+			exp.tws.id, exp.intent)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if env.Intent != exp.intent || env.Num != exp.num {
+			t.Errorf("%s expected %s with num %d but got %s with num %d",
+				exp.tws.id, exp.intent, exp.num, env.Intent, env.Num)
+		}
+	}
+
+	// The second client can't reconnect with a lastnum it's not had,
+	// even if the first client has had it
+
+	ws2b, _, err := dial(serv, room, "OWN2", 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws2b := newTConn(ws2b, "OWN2")
+	defer tws2b.close()
+	if err := tws2b.expectClose(CloseBadLastnum, 500); err != nil {
+		t.Error(err)
+	}
+	tws2b.close()
+
+	// But it can reconnect with the last num it did have
+
+	ws2c, _, err := dial(serv, room, "OWN2", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws2c := newTConn(ws2c, "OWN2")
+	defer tws2c.close()
+	tws2.close()
+	if err := tws2c.expectNoMessage(500); err != nil {
+		t.Error(err)
+	}
+	if err := tws1.expectNoMessage(100); err != nil {
+		t.Error(err)
+	}
+
+	// Close the other connections
+	tws1.close()
+	tws2c.close()
+
+	// Wait for all processes to finish
+	WG.Wait()
+}
+
+func TestHubSeq_ReplacedClientTimingOutDoesntLoseNewClientsNums(t *testing.T) {
+	// Just for this test, lower the reconnection timeout so that a
+	// Leaver message is triggered reasonably quickly.
+	useSuperhub(t, 250*time.Millisecond)
+
+	// Start a server
+	serv := newTestServer(bounceHandler)
+	defer serv.Close()
+
+	// Connect two clients
+	room := "/hub.replaced.keeps.nums"
+	ws1a, _, err := dial(serv, room, "RKN1", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws1a := newTConn(ws1a, "RKN1")
+	defer tws1a.close()
+	if err := tws1a.swallow("Welcome"); err != nil {
+		t.Fatal(err)
+	}
+	ws2, _, err := dial(serv, room, "RKN2", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws2 := newTConn(ws2, "RKN2")
+	defer tws2.close()
+	if err = swallowMany(
+		intentExp{"RKN2 joining, ws2", tws2, "Welcome"},
+		intentExp{"RKN2 joining, ws1a", tws1a, "Joiner"},
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	// A new client with the first ID joins without taking over, so
+	// the old one is replaced
+	ws1b, _, err := dial(serv, room, "RKN1", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws1b := newTConn(ws1b, "RKN1")
+	defer tws1b.close()
+	env, err := tws1b.readEnvelope(500, "ws1b expecting Welcome")
+	if err != nil {
+		t.Fatal(err)
+	}
+	num := env.Num
+	tws1a.close()
+	if err = swallowMany(
+		intentExp{"RKN1 replaced, ws2", tws2, "Leaver"},
+		intentExp{"RKN1 replaced, ws2", tws2, "Leader"},
+		intentExp{"RKN1 replaced, ws2", tws2, "Joiner"},
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	// Let the old client time out, then send a message to the new one.
+	// Its nums should carry on.
+	time.Sleep(500 * time.Millisecond)
+	if err := ws2.WriteMessage(websocket.TextMessage, []byte("Hello")); err != nil {
+		t.Fatal(err)
+	}
+	env, err = tws1b.readEnvelope(500, "ws1b expecting Peer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Intent != "Peer" || env.Num != num+1 {
+		t.Errorf("ws1b expected Peer with num %d but got %s with num %d",
+			num+1, env.Intent, env.Num)
+	}
+
+	// And it should be able to reconnect to get the message again
+	ws1c, _, err := dial(serv, room, "RKN1", num)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws1c := newTConn(ws1c, "RKN1")
+	defer tws1c.close()
+	tws1b.close()
+	env, err = tws1c.readEnvelope(500, "ws1c expecting Peer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Intent != "Peer" || env.Num != num+1 {
+		t.Errorf("ws1c expected Peer with num %d but got %s with num %d",
+			num+1, env.Intent, env.Num)
+	}
+
+	// Close the other connections
+	tws1c.close()
+	tws2.close()
+
+	// Wait for all processes to finish
+	WG.Wait()
+}
+
+func TestHubSeq_BestEffortReconnectionGetsMissedAfterGap(t *testing.T) {
+	// Just for this test, lower the reconnection timeout so that
+	// envelopes are cleaned from the buffer reasonably quickly.
+	useSuperhub(t, 250*time.Millisecond)
+
+	// Start a server
+	serv := newTestServer(bounceHandler)
+	defer serv.Close()
+
+	// Connect two clients
+	room := "/hub.best.effort"
+	ws1a, _, err := dial(serv, room, "BEST1", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws1a := newTConn(ws1a, "BEST1")
+	defer tws1a.close()
+	ws2, _, err := dial(serv, room, "BEST2", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws2 := newTConn(ws2, "BEST2")
+	defer tws2.close()
+	if err = swallowMany(
+		intentExp{"BEST1 joining, ws1a", tws1a, "Welcome"},
+		intentExp{"BEST2 joining, ws1a", tws1a, "Joiner"},
+		intentExp{"BEST2 joining, ws2", tws2, "Welcome"},
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	// The second client sends a message, then another after the first
+	// client's early envelopes are too old to keep
+	if err := ws2.WriteMessage(websocket.TextMessage, []byte("Old")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(400 * time.Millisecond)
+	if err := ws2.WriteMessage(websocket.TextMessage, []byte("New")); err != nil {
+		t.Fatal(err)
+	}
+	if err = swallowMany(
+		intentExp{"Old, ws1a", tws1a, "Peer"},
+		intentExp{"New, ws1a", tws1a, "Peer"},
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	// A strict client reconnecting from its Welcome gets closed
+	ws1b, _, err := dial(serv, room, "BEST1", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws1b := newTConn(ws1b, "BEST1")
+	defer tws1b.close()
+	if err := tws1b.expectClose(CloseBadLastnum, 500); err != nil {
+		t.Error(err)
+	}
+	tws1b.close()
+
+	// A best effort client reconnecting from its Welcome hears what
+	// it's missed, and carries on from there
+	params := url.Values{"resume": {"best-effort"}}
+	ws1c, _, err := dialWith(serv, room, "BEST1", 0, params, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws1c := newTConn(ws1c, "BEST1")
+	defer tws1c.close()
+	tws1a.close()
+
+	env, err := tws1c.readEnvelope(500, "ws1c expecting Missed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Intent != "Missed" || env.Num != 2 ||
+		!reflect.DeepEqual(env.Missed, []int{1, 2}) {
+		t.Errorf("ws1c expected Missed 1 to 2, but got %#v", env)
+	}
+	env, err = tws1c.readEnvelope(500, "ws1c expecting Peer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Intent != "Peer" || env.Num != 3 || string(env.Body) != "New" {
+		t.Errorf("ws1c expected Peer New with num 3, but got %#v", env)
+	}
+
+	// The other client shouldn't hear about any of this
+	if err := tws2.swallow("Peer"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tws2.swallow("Peer"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tws2.expectNoMessage(500); err != nil {
+		t.Error(err)
+	}
+
+	// Close the other connections
+	tws1c.close()
+	tws2.close()
+
+	// Wait for all processes to finish
+	WG.Wait()
+}
+
+// If a client takes over an old client, and the old client signals
+// a disconnection, then the leaver list should always have clients
+// with unique IDs.
+func TestHubSeq_WelcomeSaysWhichLastnumToReconnectWith(t *testing.T) {
+	// Just for this test, lower the reconnection timeout so that a
+	// Leaver message is triggered reasonably quickly.
+	useSuperhub(t, 250*time.Millisecond)
+
+	// Start a server
+	serv := newTestServer(bounceHandler)
+	defer serv.Close()
+
+	// Connect the first client. Its Welcome should say which num
+	// comes next.
+	room := "/hub.welcome.nextnum"
+	ws1a, _, err := dial(serv, room, "WNN1", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws1a := newTConn(ws1a, "WNN1")
+	defer tws1a.close()
+	env, err := tws1a.readEnvelope(500, "ws1a expecting Welcome")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Intent != "Welcome" || env.NextNum != env.Num+1 {
+		t.Fatalf("ws1a got unexpected envelope %#v", env)
+	}
+	nextNum := env.NextNum
+
+	// The first client drops out having read only the Welcome, and
+	// while it's gone the second client joins, so it's not told the
+	// first is away
+	tws1a.close()
+	time.Sleep(100 * time.Millisecond)
+	ws2, _, err := dial(serv, room, "WNN2", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws2 := newTConn(ws2, "WNN2")
+	defer tws2.close()
+	if err := tws2.swallow("Welcome"); err != nil {
+		t.Fatalf("Welcome error for ws2: %s", err)
+	}
+
+	// The first client reconnects with lastnum NextNum - 1, the Num of
+	// the Welcome, and should get the Joiner it missed with NextNum
+	ws1b, _, err := dial(serv, room, "WNN1", nextNum-1)
+	if err != nil {
+		t.Fatalf("Error dialling for ws1b: %s", err)
+	}
+	tws1b := newTConn(ws1b, "WNN1")
+	defer tws1b.close()
+	env, err = tws1b.readEnvelope(500, "ws1b expecting Joiner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Intent != "Joiner" || env.Num != nextNum {
+		t.Fatalf("ws1b got unexpected envelope %#v", env)
+	}
+	if err := tws2.swallow("Back"); err != nil {
+		t.Fatal(err)
+	}
+
+	// From then on the lastnum is just the Num of the last envelope
+	// received
+	lastNum := env.Num
+	tws1b.close()
+	if err := tws2.swallow("Away"); err != nil {
+		t.Fatal(err)
+	}
+	msg := []byte(`{"move":"e4"}`)
+	if err := ws2.WriteMessage(websocket.TextMessage, msg); err != nil {
+		t.Fatalf("Error writing peer message: %s", err.Error())
+	}
+	if err := tws2.swallow("Peer"); err != nil {
+		t.Fatalf("Receipt error for ws2: %s", err)
+	}
+	ws1c, _, err := dial(serv, room, "WNN1", lastNum)
+	if err != nil {
+		t.Fatalf("Error dialling for ws1c: %s", err)
+	}
+	tws1c := newTConn(ws1c, "WNN1")
+	defer tws1c.close()
+	env, err = tws1c.readEnvelope(500, "ws1c expecting Peer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Intent != "Peer" || env.Num != lastNum+1 {
+		t.Errorf("ws1c got unexpected envelope %#v", env)
+	}
+
+	// Close the connections
+	tws1c.close()
+	tws2.close()
+
+	// Wait for all processes to finish
+	WG.Wait()
+}
+
+func TestHubSeq_ExpectUniqueClientIDsEvenWithTakeOversAndDisconnections(t *testing.T) {
+	tLog.Debug("Entering TestHubSeq_ExpectUniqueClientIDsEvenWithTakeOversAndDisconnections")
+
+	// Just for this test, lower the reconnection timeout so that a
+	// Leaver message is triggered reasonably quickly.
+	useSuperhub(t, 250*time.Millisecond)
+
+	// Start a server
+	serv := newTestServer(bounceHandler)
+	defer serv.Close()
+
+	// Initial values
+	room := "/hub.takeovers"
+	w := sync.WaitGroup{}
+
+	// For some ID, we'll have one client join, a second take over,
+	// the first disconnect anyway, and the second leave after a bit.
+
+	joinAndTakeOver := func(id string) {
+		defer w.Done()
+
+		ws1, _, err := dial(serv, room, id, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tws1 := newTConn(ws1, id)
+		defer tws1.close()
+		env, err := tws1.readEnvelope(500, "Assumed Welcome")
+		if err != nil {
+			t.Fatalf("Didn't get Welcome; id=%s, err=%s", id, err.Error())
+		}
+		lastnum := env.Num
+
+		// Have the second take over
+
+		ws2, _, err := dial(serv, room, id, lastnum)
+		if err != nil {
+			t.Fatalf("Error taking over id=%s, err=%s", id, err.Error())
+		}
+		defer ws2.Close()
+
+		// Close the first, pause, then close the second
+		tws1.close()
+		time.Sleep(100 * time.Millisecond)
+		ws2.Close()
+	}
+
+	// Check all IDs in a list are unique
+	checkIDs := func(ids []string, intent string, field string) {
+		u := make(map[string]bool)
+		for _, id := range ids {
+			if u[id] {
+				t.Errorf("Found duplicate ID %s in %s (%s): %v",
+					id, intent, field, ids)
+			}
+			u[id] = true
+		}
+	}
+
+	// Create a client that will listen and check envelopes
+	ws0, _, err := dial(serv, room, "JTOLISTENER", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws0 := newTConn(ws0, "JTOLISTENER")
+	defer tws0.close()
+
+	// Set off 24 joiners-and-take-overers
+	// (There's a limit of 50 clients, and each of these is two)
+	for i := 0; i < 24; i++ {
+		w.Add(1)
+		go joinAndTakeOver("JTO" + strconv.Itoa(i))
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Listen and check for 40 messages (though there will be more)
+	for i := 0; i < 40; i++ {
+		env, err := tws0.readEnvelope(500, "Assumed Welcome")
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkIDs(env.From, env.Intent, "From")
+		checkIDs(env.To, env.Intent, "To")
+	}
+
+	// Shut down
+	tLog.Debug("Waiting for goroutines")
+	tws0.close()
+	w.Wait()
+	WG.Wait()
+}
+
+func TestHubSeq_ReplayResendsEnvelopesOnSameConnection(t *testing.T) {
+	// Just for this test, lower the reconnection timeout so that a
+	// Leaver message is triggered reasonably quickly.
+	useSuperhub(t, 250*time.Millisecond)
+
+	// Start a server
+	serv := newTestServer(bounceHandler)
+	defer serv.Close()
+
+	// Connect two clients
+	room := "/hub.replay"
+	ws1, _, err := dial(serv, room, "REP1", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws1 := newTConn(ws1, "REP1")
+	defer tws1.close()
+	if err := tws1.swallow("Welcome"); err != nil {
+		t.Fatalf("Welcome error for ws1: %s", err)
+	}
+
+	ws2, _, err := dial(serv, room, "REP2", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws2 := newTConn(ws2, "REP2")
+	defer tws2.close()
+	if err := tws2.swallow("Welcome"); err != nil {
+		t.Fatalf("Welcome error for ws2: %s", err)
+	}
+	env, err := tws1.readEnvelope(500, "ws1 expecting Joiner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	joinerNum := env.Num
+
+	// The second client sends three messages, which the first client reads
+
+	bodies := []string{`"a"`, `"b"`, `"c"`}
+	for i, body := range bodies {
+		err := ws2.WriteMessage(websocket.TextMessage, []byte(body))
+		if err != nil {
+			t.Fatalf("Error writing message %d: %s", i, err.Error())
+		}
+		env, err := tws1.readEnvelope(500, "ws1 expecting Peer %d", i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if env.Num != joinerNum+1+i || string(env.Body) != body {
+			t.Fatalf("ws1 got unexpected envelope %#v", env)
+		}
+		if err := tws2.swallow("Peer"); err != nil {
+			t.Fatalf("Receipt %d error for ws2: %s", i, err)
+		}
+	}
+
+	// The first client asks for the last two again, and should get
+	// them once each on the same connection
+
+	msg := fmt.Sprintf(`{"intent":"Replay","num":%d}`, joinerNum+2)
+	if err := ws1.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+		t.Fatalf("Error writing replay request: %s", err.Error())
+	}
+	for i := 1; i < len(bodies); i++ {
+		env, err := tws1.readEnvelope(500, "ws1 expecting replayed Peer %d", i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if env.Intent != "Peer" || env.Num != joinerNum+1+i ||
+			string(env.Body) != bodies[i] {
+			t.Errorf("ws1 got unexpected replayed envelope %#v", env)
+		}
+	}
+	if err := tws1.expectNoMessage(100); err != nil {
+		t.Error(err)
+	}
+
+	// Live delivery should carry on as before
+	if err := ws2.WriteMessage(websocket.TextMessage, []byte(`"d"`)); err != nil {
+		t.Fatalf("Error writing final message: %s", err.Error())
+	}
+	env, err = tws1.readEnvelope(500, "ws1 expecting final Peer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Num != joinerNum+4 || string(env.Body) != `"d"` {
+		t.Errorf("ws1 got unexpected final envelope %#v", env)
+	}
+	if err := tws2.swallow("Peer"); err != nil {
+		t.Fatalf("Final receipt error for ws2: %s", err)
+	}
+
+	// A num we've not sent should give an error, not close the
+	// connection
+
+	msg = fmt.Sprintf(`{"intent":"Replay","num":%d,"token":"r9"}`, joinerNum+5)
+	if err := ws1.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+		t.Fatalf("Error writing bad replay request: %s", err.Error())
+	}
+	env, err = tws1.readEnvelope(500, "ws1 expecting Error")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Intent != "Error" || env.Token != "r9" ||
+		env.Reason != "Replay not available" {
+		t.Errorf("ws1 got unexpected envelope %#v", env)
+	}
+
+	// The second client shouldn't have heard any of this
+	if err := tws2.expectNoMessage(100); err != nil {
+		t.Error(err)
+	}
+
+	// Close the connections
+	tws1.close()
+	tws2.close()
+
+	// Wait for all processes to finish
+	WG.Wait()
+}
+
+func TestHubSeq_ExpiredEnvelopesAreSkippedOnReconnection(t *testing.T) {
+	// Just for this test, lower the reconnection timeout so that a
+	// Leaver message is triggered reasonably quickly.
+	useSuperhub(t, 250*time.Millisecond)
+
+	// Start a server
+	serv := newTestServer(bounceHandler)
+	defer serv.Close()
+
+	// Connect two clients
+	room := "/hub.ttl.skipped"
+	ws1a, _, err := dial(serv, room, "TTL1", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws1a := newTConn(ws1a, "TTL1")
+	defer tws1a.close()
+	if err := tws1a.swallow("Welcome"); err != nil {
+		t.Fatalf("Welcome error for ws1a: %s", err)
+	}
+
+	ws2, _, err := dial(serv, room, "TTL2", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws2 := newTConn(ws2, "TTL2")
+	defer tws2.close()
+	if err := tws2.swallow("Welcome"); err != nil {
+		t.Fatalf("Welcome error for ws2: %s", err)
+	}
+	env, err := tws1a.readEnvelope(500, "ws1a expecting Joiner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lastNum := env.Num
+
+	// The first client drops out, and while it's gone the second client
+	// sends a lasting message between two short-lived ones
+
+	tws1a.close()
+	if err := tws2.swallow("Away"); err != nil {
+		t.Fatal(err)
+	}
+	msgs := []string{
+		`{"ttl":50,"body":"cursor1"}`,
+		`"move"`,
+		`{"ttl":50,"body":"cursor2"}`,
+	}
+	for i, msg := range msgs {
+		if err := ws2.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+			t.Fatalf("Error writing message %d: %s", i, err.Error())
+		}
+		if err := tws2.swallow("Peer"); err != nil {
+			t.Fatalf("Receipt %d error for ws2: %s", i, err)
+		}
+	}
+
+	// After the short-lived ones have expired the first client
+	// reconnects, and should only get the lasting one
+
+	time.Sleep(100 * time.Millisecond)
+	ws1b, _, err := dial(serv, room, "TTL1", lastNum)
+	if err != nil {
+		t.Fatalf("Error dialling for ws1b: %s", err)
+	}
+	tws1b := newTConn(ws1b, "TTL1")
+	defer tws1b.close()
+	env, err = tws1b.readEnvelope(500, "ws1b expecting Peer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Intent != "Peer" || env.Num != lastNum+2 || string(env.Body) != `"move"` {
+		t.Errorf("ws1b got unexpected envelope %#v", env)
+	}
+	if err := tws1b.expectNoMessage(100); err != nil {
+		t.Error(err)
+	}
+
+	// Live messages should carry on with nums after the expired ones
+
+	if err := ws2.WriteMessage(websocket.TextMessage, []byte(`"next"`)); err != nil {
+		t.Fatalf("Error writing final message: %s", err.Error())
+	}
+	env, err = tws1b.readEnvelope(500, "ws1b expecting final Peer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Num != lastNum+4 || string(env.Body) != `"next"` {
+		t.Errorf("ws1b got unexpected final envelope %#v", env)
+	}
+
+	// Close the connections
+	tws1b.close()
+	tws2.close()
+
+	// Wait for all processes to finish
+	WG.Wait()
+}
+
+func TestHubSeq_LeaderCanReassignLostID(t *testing.T) {
+	// For this test, make the reconnection timeout long enough to
+	// reassign an ID within it, but short enough to see there's no
+	// Leaver afterwards
+	useSuperhub(t, 500*time.Millisecond)
+
+	// Start a server
+	serv := newTestServer(bounceHandler)
+	defer serv.Close()
+
+	// Connect the leader, creating a room that allows reassigning,
+	// and a second client
+	room := "/hub.reassign"
+	reassign := url.Values{"reassign": {"on"}}
+	ws1, _, err := dialWith(serv, room, "RA1", -1, reassign, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws1 := newTConn(ws1, "RA1")
+	defer tws1.close()
+	if err := tws1.swallow("Welcome"); err != nil {
+		t.Fatalf("Welcome error for ws1: %s", err)
+	}
+
+	ws2, _, err := dial(serv, room, "RA2", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws2 := newTConn(ws2, "RA2")
+	defer tws2.close()
+	if err = swallowMany(
+		intentExp{"RA2 joining, ws2", tws2, "Welcome"},
+		intentExp{"RA2 joining, ws1", tws1, "Joiner"},
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	// The second client loses its connection, and its player comes
+	// back with a new ID
+	tws2.close()
+	if err := tws1.swallow("Away"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ws1.WriteMessage(websocket.TextMessage, []byte("Away")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tws1.swallow("Peer"); err != nil {
+		t.Fatalf("Receipt error for ws1: %s", err)
+	}
+
+	ws3, _, err := dial(serv, room, "RA3", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws3 := newTConn(ws3, "RA3")
+	defer tws3.close()
+	if err = swallowMany(
+		intentExp{"RA3 joining, ws3", tws3, "Welcome"},
+		intentExp{"RA3 joining, ws1", tws1, "Joiner"},
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	// The leader says the new client is really the second one
+	err = ws1.WriteMessage(websocket.TextMessage,
+		[]byte(`{"intent":"Reassign","id":"RA3","as":"RA2"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The new client should be told its ID, and get what was buffered
+	// for that ID from the start
+	env, err := tws3.readEnvelope(500, "ws3 expecting Reassigned")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Intent != "Reassigned" || !sameElements(env.To, []string{"RA2"}) ||
+		env.Retired != "RA3" || env.NextNum != 0 || env.Num != -1 {
+		t.Errorf("ws3 got unexpected Reassigned: %#v", env)
+	}
+	exps := []struct {
+		intent string
+		body   string
+	}{
+		{"Welcome", ""},
+		{"Peer", "Away"},
+		{"Joiner", ""},
+	}
+	for i, exp := range exps {
+		env, err := tws3.readEnvelope(500, "ws3 expecting %s", exp.intent)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if env.Intent != exp.intent || env.Num != i ||
+			string(env.Body) != exp.body {
+			t.Errorf("ws3 expected %s num %d but got %s",
+				exp.intent, i, niceEnv(env))
+		}
+	}
+
+	// The leader should be told the second client is back, and then
+	// hear no more about it, even after the old connection's timeout
+	env, err = tws1.readEnvelope(500, "ws1 expecting Reconnected")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Intent != "Reconnected" || !sameElements(env.From, []string{"RA2"}) ||
+		env.Retired != "RA3" {
+		t.Errorf("ws1 got unexpected Reconnected: %#v", env)
+	}
+	if err := tws1.expectNoMessage(750); err != nil {
+		t.Error(err)
+	}
+
+	// Messages should reach the new connection under its new ID
+	if err := ws1.WriteMessage(websocket.TextMessage, []byte("Back")); err != nil {
+		t.Fatal(err)
+	}
+	env, err = tws3.readEnvelope(500, "ws3 expecting Peer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Intent != "Peer" || env.Num != 3 ||
+		!sameElements(env.To, []string{"RA2"}) {
+		t.Errorf("ws3 got unexpected Peer: %#v", env)
+	}
+
+	// Close the connections
+	tws1.close()
+	tws3.close()
+
+	// Wait for all processes to finish
 	WG.Wait()
 }
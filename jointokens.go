@@ -0,0 +1,71 @@
+// Copyright 2020 Nik Silver
+//
+// Licensed under the GPL v3.0. See file LICENCE.txt for details.
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Secret for checking join tokens. If it's set then every client must
+// give a join token signed with it; if it's empty then no-one need.
+var joinSecret []byte
+
+// Why a join token might not let a client in
+var (
+	errBadJoinToken     = fmt.Errorf("Bad join token")
+	errJoinTokenExpired = fmt.Errorf("Join token expired")
+)
+
+// MintJoinToken creates a token that lets the client with the given ID
+// join the given room until the expiry time, for a server with the
+// given secret. The room is the path of its URL, such as "/g/my-room".
+// It's for a lobby service to give its players.
+func MintJoinToken(secret []byte, room string, id string, exp time.Time) string {
+	expMs := strconv.FormatInt(exp.UnixNano()/1000000, 10)
+	sig := signJoin(secret, room, id, expMs)
+	return expMs + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// checkJoinToken checks a join token lets the client with the given ID
+// join the given room at the given time, in milliseconds since the
+// epoch. It's fine if we don't need join tokens.
+func checkJoinToken(token string, room string, id string, nowMs int64) error {
+	if len(joinSecret) == 0 {
+		return nil
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return errBadJoinToken
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return errBadJoinToken
+	}
+	if !hmac.Equal(sig, signJoin(joinSecret, room, id, parts[0])) {
+		return errBadJoinToken
+	}
+	exp, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return errBadJoinToken
+	}
+	if exp < nowMs {
+		return errJoinTokenExpired
+	}
+	return nil
+}
+
+// signJoin signs the room, client ID and expiry time of a join token
+// with a secret.
+func signJoin(secret []byte, room string, id string, expMs string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(room + "\n" + id + "\n" + expMs))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,139 @@
+// Copyright 2020 Nik Silver
+//
+// Licensed under the GPL v3.0. See file LICENCE.txt for details.
+
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJoinTokens_TokensAreSignedAndExpire(t *testing.T) {
+	oldJoinSecret := joinSecret
+	defer func() {
+		joinSecret = oldJoinSecret
+	}()
+
+	// Without a secret no token is needed
+
+	joinSecret = nil
+	if err := checkJoinToken("", "/room", "ID1", nowMs()); err != nil {
+		t.Errorf("No secret gave error %s", err)
+	}
+
+	// With a secret the token must be for this room and client
+
+	joinSecret = []byte("secret-a")
+	exp := time.Now().Add(time.Minute)
+	token := MintJoinToken(joinSecret, "/room", "ID1", exp)
+	if err := checkJoinToken(token, "/room", "ID1", nowMs()); err != nil {
+		t.Errorf("Fresh token gave error %s", err)
+	}
+
+	parts := strings.Split(token, ".")
+	later := strings.Split(
+		MintJoinToken(joinSecret, "/room", "ID1", exp.Add(time.Hour)), ".")
+	data := []struct {
+		desc  string
+		token string
+		room  string
+		id    string
+	}{
+		{"Empty", "", "/room", "ID1"},
+		{"No signature", parts[0], "/room", "ID1"},
+		{"Bad signature", parts[0] + ".%%%", "/room", "ID1"},
+		{"Tampered signature", parts[0] + "." + parts[1][1:], "/room", "ID1"},
+		{"Tampered expiry", later[0] + "." + parts[1], "/room", "ID1"},
+		{"Other room", token, "/other", "ID1"},
+		{"Other client", token, "/room", "ID2"},
+		{"Other secret",
+			MintJoinToken([]byte("secret-b"), "/room", "ID1", exp),
+			"/room", "ID1"},
+		{"Too many parts", token + "." + parts[1], "/room", "ID1"},
+	}
+	for _, d := range data {
+		err := checkJoinToken(d.token, d.room, d.id, nowMs())
+		if err != errBadJoinToken {
+			t.Errorf("%s: Expected bad token but got %v", d.desc, err)
+		}
+	}
+
+	// A token shouldn't last beyond its expiry
+
+	afterExp := exp.Add(time.Second).UnixNano() / 1000000
+	if err := checkJoinToken(token, "/room", "ID1", afterExp); err != errJoinTokenExpired {
+		t.Errorf("Old token gave error %v", err)
+	}
+	old := MintJoinToken(joinSecret, "/room", "ID1", time.Now().Add(-time.Second))
+	if err := checkJoinToken(old, "/room", "ID1", nowMs()); err != errJoinTokenExpired {
+		t.Errorf("Expired token gave error %v", err)
+	}
+}
+
+func TestJoinTokens_ClientsNeedATokenToJoin(t *testing.T) {
+	// Just for this test, lower the reconnection timeout so that a
+	// Leaver message is triggered reasonably quickly, and have a secret
+	useSuperhub(t, 250*time.Millisecond)
+	oldJoinSecret := joinSecret
+	joinSecret = []byte("sesame")
+	defer func() {
+		joinSecret = oldJoinSecret
+	}()
+
+	serv := newTestServer(bounceHandler)
+	defer serv.Close()
+
+	room := "/jointokens.room"
+	exp := time.Now().Add(time.Minute)
+	good := MintJoinToken(joinSecret, room, "JT1", exp)
+	expired := MintJoinToken(joinSecret, room, "JT1",
+		time.Now().Add(-time.Second))
+
+	// Clients without a good token are refused before the upgrade
+
+	data := []struct {
+		desc   string
+		params url.Values
+		msg    string
+	}{
+		{"No token", nil, "Bad join token"},
+		{"Other client's token",
+			url.Values{"token": {MintJoinToken(joinSecret, room, "JT2", exp)}},
+			"Bad join token"},
+		{"Expired token", url.Values{"token": {expired}}, "Join token expired"},
+	}
+	for _, d := range data {
+		ws, resp, err := dialWith(serv, room, "JT1", -1, d.params, nil)
+		if err == nil {
+			ws.Close()
+			t.Errorf("%s: Expected error, but didn't get one", d.desc)
+			continue
+		}
+		if resp == nil || resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("%s: Expected 401 but got %v", d.desc, resp)
+		} else if err := responseContains(resp, d.msg); err != nil {
+			t.Errorf("%s: %s", d.desc, err)
+		}
+	}
+
+	// A client with a good token is welcomed
+
+	ws, _, err := dialWith(serv, room, "JT1", -1,
+		url.Values{"token": {good}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws := newTConn(ws, "JT1")
+	defer tws.close()
+	if err := tws.swallow("Welcome"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Tidy up, and check everything in the main app finishes
+	tws.close()
+	WG.Wait()
+}
@@ -0,0 +1,138 @@
+// Copyright 2020 Nik Silver
+//
+// Licensed under the GPL v3.0. See file LICENCE.txt for details.
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Keys for signing spectator links. New links are signed with the
+// first, but a link signed with any of them is accepted, so a key can
+// be rotated out gradually. Random unless set at startup.
+var linkKeys = [][]byte{randomBytes(32)}
+
+// How long a spectator link lasts
+var linkLifetime = time.Hour
+
+// How many connections can be made with one spectator link
+var linkUses = 10
+
+// Why a spectator link might not let a client in
+var (
+	errBadLink     = fmt.Errorf("Bad spectator link")
+	errLinkExpired = fmt.Errorf("Spectator link expired")
+	errLinkUsedUp  = fmt.Errorf("Spectator link used up")
+)
+
+// spectatorLink is what a signed spectator link says. Anyone with it
+// can join the room as an observer, without the room's password.
+type spectatorLink struct {
+	Room  string // Room the link is for
+	Hub   string // Link ID of the room's hub, so it dies with the hub
+	Exp   int64  // When the link expires, in milliseconds since the epoch
+	Uses  int    // How many connections can be made with it
+	Nonce string // Identifies the link, so its uses can be counted
+}
+
+// newLinkKeys gets the spectator link signing keys from a comma-separated
+// list, newest first. If there are none we use a random key.
+func newLinkKeys(list string) [][]byte {
+	keys := make([][]byte, 0)
+	for _, k := range strings.Split(list, ",") {
+		if k = strings.TrimSpace(k); k != "" {
+			keys = append(keys, []byte(k))
+		}
+	}
+	if len(keys) == 0 {
+		keys = append(keys, randomBytes(32))
+	}
+	return keys
+}
+
+// mintLink creates a signed spectator link token for the given room and
+// hub link ID, using the current signing key.
+func mintLink(room string, hubID string) string {
+	payload, _ := json.Marshal(&spectatorLink{
+		Room:  room,
+		Hub:   hubID,
+		Exp:   nowMs() + linkLifetime.Milliseconds(),
+		Uses:  linkUses,
+		Nonce: randomToken(),
+	})
+	p64 := base64.RawURLEncoding.EncodeToString(payload)
+	sig := signLink(linkKeys[0], p64)
+	return p64 + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// linkPath is the path and query a spectator can connect with, given
+// a room and a spectator link token.
+func linkPath(room string, token string) string {
+	return room + "?" + url.Values{"link": {token}}.Encode()
+}
+
+// parseLink checks a spectator link token was signed with one of our
+// keys and hasn't expired by the given time, and returns what it says.
+func parseLink(token string, nowMs int64) (*spectatorLink, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return nil, errBadLink
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errBadLink
+	}
+	signed := false
+	for _, key := range linkKeys {
+		if hmac.Equal(sig, signLink(key, parts[0])) {
+			signed = true
+			break
+		}
+	}
+	if !signed {
+		return nil, errBadLink
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errBadLink
+	}
+	link := &spectatorLink{}
+	if err := json.Unmarshal(payload, link); err != nil {
+		return nil, errBadLink
+	}
+	if link.Exp < nowMs {
+		return nil, errLinkExpired
+	}
+	return link, nil
+}
+
+// signLink signs the encoded payload of a spectator link with a key.
+func signLink(key []byte, p64 string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(p64))
+	return mac.Sum(nil)
+}
+
+// randomToken is a random string that's safe to put in a URL.
+func randomToken() string {
+	return base64.RawURLEncoding.EncodeToString(randomBytes(16))
+}
+
+// randomBytes gives n bytes that are hard to guess.
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("Couldn't get random bytes: %s", err))
+	}
+	return b
+}
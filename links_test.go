@@ -0,0 +1,217 @@
+// Copyright 2020 Nik Silver
+//
+// Licensed under the GPL v3.0. See file LICENCE.txt for details.
+
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestLinks_LinksAreSignedAndExpire(t *testing.T) {
+	oldLinkKeys := linkKeys
+	defer func() {
+		linkKeys = oldLinkKeys
+	}()
+	linkKeys = newLinkKeys("key-a")
+
+	token := mintLink("/room", "hub1")
+	link, err := parseLink(token, nowMs())
+	if err != nil {
+		t.Fatalf("Fresh link gave error %s", err)
+	}
+	if link.Room != "/room" || link.Hub != "hub1" || link.Uses != linkUses {
+		t.Errorf("Fresh link gave %#v", link)
+	}
+
+	// Anything tampered with or malformed is bad, and it shouldn't
+	// last forever
+
+	parts := strings.Split(token, ".")
+	other := mintLink("/other", "hub1")
+	for _, bad := range []string{
+		"",
+		parts[0],
+		parts[0] + "." + parts[1] + "." + parts[1],
+		parts[0] + "x." + parts[1],
+		strings.Split(other, ".")[0] + "." + parts[1],
+		parts[0] + ".%%%",
+	} {
+		if _, err := parseLink(bad, nowMs()); err != errBadLink {
+			t.Errorf("Link %q gave error %v", bad, err)
+		}
+	}
+	later := nowMs() + linkLifetime.Milliseconds() + 1000
+	if _, err := parseLink(token, later); err != errLinkExpired {
+		t.Errorf("Old link gave error %v", err)
+	}
+
+	// A new key signs new links, but old links still work until the
+	// old key goes
+
+	linkKeys = newLinkKeys("key-b, key-a")
+	if _, err := parseLink(token, nowMs()); err != nil {
+		t.Errorf("Link signed with previous key gave error %s", err)
+	}
+	newToken := mintLink("/room", "hub1")
+	linkKeys = newLinkKeys("key-b")
+	if _, err := parseLink(token, nowMs()); err != errBadLink {
+		t.Errorf("Link signed with retired key gave error %v", err)
+	}
+	if _, err := parseLink(newToken, nowMs()); err != nil {
+		t.Errorf("Link signed with new key gave error %s", err)
+	}
+}
+
+func TestLinks_SpectatorLinkLetsObserversIn(t *testing.T) {
+	// Just for this test, lower the reconnection timeout so that a
+	// Leaver message is triggered reasonably quickly, allow only two
+	// uses of a link, and make links short-lived
+	useSuperhub(t, 250*time.Millisecond)
+	oldLinkUses := linkUses
+	oldLinkLifetime := linkLifetime
+	linkUses = 2
+	linkLifetime = 500 * time.Millisecond
+	defer func() {
+		linkUses = oldLinkUses
+		linkLifetime = oldLinkLifetime
+	}()
+
+	serv := newTestServer(bounceHandler)
+	defer serv.Close()
+
+	// Create a room with a password, and another client
+
+	room := "/links.room"
+	ws1, _, err := dialWith(serv, room, "LNK1", -1,
+		url.Values{"pass": {"sesame"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws1 := newTConn(ws1, "LNK1")
+	defer tws1.close()
+	if err := tws1.swallow("Welcome"); err != nil {
+		t.Fatalf("Welcome error for LNK1: %s", err)
+	}
+
+	ws2, _, err := dialWith(serv, room, "LNK2", -1,
+		url.Values{"pass": {"sesame"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws2 := newTConn(ws2, "LNK2")
+	defer tws2.close()
+	if err = swallowMany(
+		intentExp{"LNK2 joining, ws2", tws2, "Welcome"},
+		intentExp{"LNK2 joining, ws1", tws1, "Joiner"},
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the leader can create a link
+
+	req := []byte(`{"intent":"CreateSpectatorLink","token":"s1"}`)
+	if err := ws2.WriteMessage(websocket.TextMessage, req); err != nil {
+		t.Fatal(err)
+	}
+	env, err := tws2.readEnvelope(500, "LNK2 expecting Error")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Intent != "Error" || env.Reason != "Not leader" || env.Token != "s1" {
+		t.Errorf("LNK2 got unexpected envelope: %#v", env)
+	}
+
+	if err := ws1.WriteMessage(websocket.TextMessage, req); err != nil {
+		t.Fatal(err)
+	}
+	env, err = tws1.readEnvelope(500, "LNK1 expecting SpectatorLink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Intent != "SpectatorLink" || env.Token != "s1" ||
+		!strings.HasPrefix(env.Link, room+"?") {
+		t.Fatalf("LNK1 got unexpected envelope: %#v", env)
+	}
+	params, err := url.ParseQuery(strings.TrimPrefix(env.Link, room+"?"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The link can be used twice, without the password, and its holders
+	// are observers. The third time it's used up.
+
+	obs := make([]*tConn, 0)
+	for i, id := range []string{"LNKO1", "LNKO2"} {
+		ws, _, err := dialWith(serv, room, id, -1, params, nil)
+		if err != nil {
+			t.Fatalf("Use %d of link gave error %s", i, err)
+		}
+		tws := newTConn(ws, id)
+		defer tws.close()
+		obs = append(obs, tws)
+		if err := tws.swallow("Welcome"); err != nil {
+			t.Fatalf("Welcome error for %s: %s", id, err)
+		}
+	}
+	if err := tws1.expectNoMessage(200); err != nil {
+		t.Errorf("LNK1 heard about an observer: %s", err)
+	}
+
+	data := []struct {
+		desc   string
+		room   string
+		params url.Values
+	}{
+		{"Used up", room, params},
+		{"Other room", "/links.other", params},
+		{"Bad link", room, url.Values{"link": {"abc.def"}}},
+	}
+	for _, d := range data {
+		ws, resp, err := dialWith(serv, d.room, "LNKBAD", -1, d.params, nil)
+		if err == nil {
+			ws.Close()
+			t.Errorf("%s: Expected error, but didn't get one", d.desc)
+			continue
+		}
+		if resp == nil || resp.StatusCode != http.StatusForbidden {
+			t.Errorf("%s: Expected 403 but got %v", d.desc, resp)
+		}
+	}
+
+	// A new link expires
+
+	if err := ws1.WriteMessage(websocket.TextMessage, req); err != nil {
+		t.Fatal(err)
+	}
+	env, err = tws1.readEnvelope(500, "LNK1 expecting second SpectatorLink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	params, err = url.ParseQuery(strings.TrimPrefix(env.Link, room+"?"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(linkLifetime + 100*time.Millisecond)
+	ws, resp, err := dialWith(serv, room, "LNKLATE", -1, params, nil)
+	if err == nil {
+		ws.Close()
+		t.Error("Expected error for expired link, but didn't get one")
+	} else if err := responseContains(resp, "expired"); err != nil {
+		t.Error(err)
+	}
+
+	// Tidy up, and check everything in the main app finishes
+	tws1.close()
+	tws2.close()
+	for _, tws := range obs {
+		tws.close()
+	}
+	WG.Wait()
+}
@@ -6,14 +6,21 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"net/http"
-	"net/url"
 	"os"
+	"os/signal"
 	"strconv"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
+	"github.com/gorilla/websocket"
 	"github.com/inconshreveable/log15"
+	"github.com/redis/go-redis/v9"
 )
 
 // Global superhub that holds all the hubs
@@ -36,20 +43,246 @@ func main() {
 	// Handle proof of running
 	http.HandleFunc("/", helloHandler)
 
+	// Handle requests for how the server's doing
+	http.HandleFunc("/status", statusHandler)
+
+	// Handle requests for rooms anyone can join
+	http.HandleFunc("/rooms/public",
+		withCORS(publicRoomsHandler, http.MethodGet))
+
+	// Make new rooms, with codes that can't be guessed
+	http.HandleFunc("/new", withCORS(newRoomHandler, http.MethodPost))
+
 	// Handle game requests
-	http.HandleFunc("/g/", bounceHandler)
+	http.HandleFunc("/g/", roomHandler)
+
+	// Handle operators' requests, if they've a secret
+	http.HandleFunc("/admin/broadcast", adminBroadcastHandler)
+	http.HandleFunc("/admin/rooms", adminRoomsHandler)
+	http.HandleFunc("/admin/rooms/", adminRoomHandler)
+	adminSecret = os.Getenv("ADMIN_SECRET")
+	if adminSecret == "" {
+		aLog.Info("No admin secret, so admin requests are turned off")
+	}
+	sendSecret = os.Getenv("SEND_SECRET")
+	if from := os.Getenv("SEND_FROM"); from != "" {
+		sendFromID = systemID(from)
+	}
+
+	// Only let in clients from web pages we allow, if we've a list
+	allowedOrigins = newAllowedOrigins(os.Getenv("ALLOWED_ORIGINS"))
+
+	// Only let in clients with JWTs, if we've a key
+	if key := os.Getenv("JWT_KEY"); key != "" {
+		authHook = JWTAuth([]byte(key))
+	}
+
+	// Only let in clients with join tokens, if we've a secret
+	joinSecret = []byte(os.Getenv("JOIN_SECRET"))
+
+	// Tell another service about joiners and leavers, if it wants
+	webhookURL = os.Getenv("WEBHOOK_URL")
+
+	// Spectator links need to be signed with keys that survive a restart
+	if keys := os.Getenv("LINK_KEYS"); keys != "" {
+		linkKeys = newLinkKeys(keys)
+	} else {
+		aLog.Info("Using random key for spectator links")
+	}
+
+	// Operators may want clients pinged more or less often, or to wait
+	// longer for their pongs
+	if freq, ok := durationEnv("PING_FREQ"); ok {
+		pingFreq = freq
+		pongTimeout = (freq * 5) / 4
+	}
+	if timeout, ok := durationEnv("PONG_TIMEOUT"); ok {
+		pongTimeout = timeout
+	}
+	if pongTimeout <= pingFreq {
+		aLog.Warn("Pong timeout not longer than ping frequency",
+			"pingFreq", pingFreq, "pongTimeout", pongTimeout)
+	}
+
+	// Operators may want to give clients more or less time to reconnect,
+	// or limit how many clients the whole server has
+	config := SuperhubConfig{Reconnection: defaultReconnection}
+	if timeout, ok := durationEnv("RECONNECTION_TIMEOUT"); ok {
+		config.Reconnection = timeout
+	}
+	if n, ok := intEnv("MAX_TOTAL_CLIENTS"); ok {
+		config.MaxTotalClients = n
+	}
+	Shub = NewSuperhubWith(config)
+
+	// Operators may want longer or shorter codes for new rooms, or made
+	// from other characters
+	if n, ok := intEnv("ROOM_CODE_LENGTH"); ok {
+		roomCodeLength = n
+	}
+	if alphabet := os.Getenv("ROOM_CODE_ALPHABET"); alphabet != "" {
+		if urlSafe(alphabet) {
+			roomCodeAlphabet = alphabet
+		} else {
+			aLog.Warn("Ignoring room code alphabet that's not URL-safe",
+				"value", alphabet)
+		}
+	}
+
+	// Keep rooms' buffers on disk, if we can, so clients can carry on
+	// after a restart
+	persistDir = os.Getenv("PERSIST_DIR")
+
+	// Keep rooms' buffers in Redis instead, if we're told to, so
+	// clients can reconnect to any server sharing it
+	if str := os.Getenv("REDIS_URL"); str != "" {
+		if opts, err := redis.ParseURL(str); err == nil {
+			redisClient = redis.NewClient(opts)
+		} else {
+			aLog.Crit("Bad Redis URL", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	// Operators may want the buffers to use more or less memory, or
+	// keep fewer envelopes for each client, however recent
+	if mb, ok := intEnv("BUFFER_BUDGET_MB"); ok {
+		maxBufferedTotal = mb * 1024 * 1024
+	}
+	if n, ok := intEnv("BUFFER_MAX_ENVELOPES"); ok {
+		maxBuffered = n
+	}
+
+	// Serve over TLS if we've a certificate, or can get one, and then
+	// plain HTTP only redirects to it
+	ts := tlsSettingsFromEnv()
+	if err := ts.check(); err != nil {
+		aLog.Crit("Bad TLS settings", "error", err)
+		os.Exit(1)
+	}
 
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8080"
+		if ts.enabled() {
+			port = "80"
+		}
 		aLog.Info("Using default port", "port", port)
 	}
+	srv := &http.Server{Addr: ":" + port}
+	var redirect *http.Server
+	if ts.enabled() {
+		tlsPort := os.Getenv("TLS_PORT")
+		if tlsPort == "" {
+			tlsPort = "443"
+			aLog.Info("Using default TLS port", "port", tlsPort)
+		}
+		srv, redirect = ts.servers(":"+tlsPort, ":"+port, http.DefaultServeMux)
+	}
 
-	aLog.Info("Listening", "port", port)
-	if err := http.ListenAndServe(":"+port, nil); err != nil {
+	// Shut down gracefully if we're told to stop
+	stopped := make(chan struct{})
+	go func() {
+		stop := make(chan os.Signal, 1)
+		signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+		<-stop
+		shutdown(srv, redirect)
+		close(stopped)
+	}()
+
+	var err error
+	if redirect != nil {
+		go func() {
+			aLog.Info("Listening to redirect", "port", port)
+			err := redirect.ListenAndServe()
+			if err != http.ErrServerClosed {
+				aLog.Crit("ListenAndServe", "error", err)
+				os.Exit(1)
+			}
+		}()
+		aLog.Info("Listening with TLS", "addr", srv.Addr, "auto", ts.auto())
+		err = ts.listen(srv)
+	} else {
+		aLog.Info("Listening", "port", port)
+		err = srv.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
 		aLog.Crit("ListenAndServe", "error", err)
 		os.Exit(1)
 	}
+	<-stopped
+}
+
+// shutdown stops the server gracefully. No-one else can connect, every
+// room tells its clients it's closing and closes their connections,
+// and we wait for everything to finish, or until the deadline passes.
+// If there's a server only redirecting to the main one, it stops too.
+func shutdown(srv *http.Server, redirect *http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownDeadline)
+	defer cancel()
+
+	aLog.Info("Shutting down", "rooms", Shub.Count())
+	drained := make(chan error, 1)
+	go func() {
+		drained <- Shub.Drain(ctx)
+	}()
+	if redirect != nil {
+		if err := redirect.Shutdown(ctx); err != nil {
+			aLog.Warn("Redirect server didn't shut down cleanly",
+				"error", err)
+		}
+	}
+	if err := srv.Shutdown(ctx); err != nil {
+		aLog.Warn("Server didn't shut down cleanly", "error", err)
+	}
+	if err := <-drained; err != nil {
+		aLog.Warn("Gave up waiting for rooms", "error", err)
+		return
+	}
+
+	// Anything left, such as writing out buffers, should finish soon
+	finished := make(chan struct{})
+	go func() {
+		WG.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+		aLog.Info("Shut down")
+	case <-ctx.Done():
+		aLog.Warn("Gave up waiting to shut down")
+	}
+}
+
+// durationEnv gets a duration such as "90s" from the named environment
+// variable, and true, or false if it's not set or isn't a positive
+// duration.
+func durationEnv(name string) (time.Duration, bool) {
+	str := os.Getenv(name)
+	if str == "" {
+		return 0, false
+	}
+	d, err := time.ParseDuration(str)
+	if err != nil || d <= 0 {
+		aLog.Warn("Ignoring bad duration", "name", name, "value", str)
+		return 0, false
+	}
+	return d, true
+}
+
+// intEnv gets a number from the named environment variable, and true,
+// or false if it's not set or isn't a positive whole number.
+func intEnv(name string) (int, bool) {
+	str := os.Getenv(name)
+	if str == "" {
+		return 0, false
+	}
+	n, err := strconv.Atoi(str)
+	if err != nil || n <= 0 {
+		aLog.Warn("Ignoring bad number", "name", name, "value", str)
+		return 0, false
+	}
+	return n, true
 }
 
 // bounceHandler sets up a websocket to bounce whatever it receives to
@@ -60,65 +293,160 @@ func bounceHandler(w http.ResponseWriter, r *http.Request) {
 	WG.Add(1)
 	defer WG.Done()
 
+	// A request that's not for a websocket only wants to know about
+	// the room, perhaps from a page in the browser
+	if !websocket.IsWebSocketUpgrade(r) {
+		withCORS(roomInfoHandler, http.MethodGet)(w, r)
+		return
+	}
+
+	// Only connect clients from web pages we allow
+	if !originAllowed(r) {
+		aLog.Warn("Origin not allowed", "origin", r.Header.Get("Origin"))
+		reject(w, r, http.StatusForbidden, &rejection{
+			Error:  "Origin not allowed",
+			Reason: REJECTORIGIN,
+		})
+		return
+	}
+
+	// Don't connect a client expecting a subprotocol we can't speak
+	if offered := websocket.Subprotocols(r); !subprotocolsAcceptable(offered) {
+		reject(w, r, http.StatusBadRequest, &rejection{
+			Error:     "Unsupported subprotocols",
+			Reason:    REJECTSUBPROTOCOL,
+			Supported: subprotocols,
+		})
+		return
+	}
+
+	// Make sure we understand what the client's telling us
+	params, err := ParseConnectionParams(r.URL.RawQuery)
+	if err != nil {
+		reject(w, r, http.StatusBadRequest, &rejection{
+			Error:  err.Error(),
+			Reason: REJECTBADPARAMS,
+		})
+		return
+	}
+
+	// Find out who the client is, if we need to know
+	if authHook != nil {
+		id, err := authHook(r)
+		if err == nil && !validID(id) && !reservedID(id) {
+			// It's an ID no client could ask for. Reserved ones are
+			// refused below.
+			err = fmt.Errorf("Bad id")
+		}
+		if err != nil {
+			reject(w, r, http.StatusUnauthorized, &rejection{
+				Error:  err.Error(),
+				Reason: REJECTAUTH,
+			})
+			return
+		}
+		params.ID = id
+	}
+	if reservedID(params.ID) {
+		reject(w, r, http.StatusBadRequest, &rejection{
+			Error:  "Reserved id",
+			Reason: REJECTBADPARAMS,
+		})
+		return
+	}
+
+	// Make sure the client may join, if we need to know
+	err = checkJoinToken(params.JoinToken, r.URL.Path, params.ID, nowMs())
+	if err != nil {
+		reject(w, r, http.StatusUnauthorized, &rejection{
+			Error:  err.Error(),
+			Reason: REJECTJOINTOKEN,
+		})
+		return
+	}
+
 	// Make sure we can get a hub
-	hub, err := Shub.Hub(r.URL.Path)
+	hub, err := Shub.Hub(r.URL.Path, params)
+	switch err {
+	case errWrongPassword:
+		reject(w, r, http.StatusForbidden, &rejection{
+			Error:  err.Error(),
+			Reason: REJECTPASSWORD,
+		})
+		return
+	case errBadLink, errLinkExpired, errLinkUsedUp:
+		reject(w, r, http.StatusForbidden, &rejection{
+			Error:  err.Error(),
+			Reason: REJECTBADLINK,
+		})
+		return
+	case errShuttingDown:
+		reject(w, r, http.StatusServiceUnavailable, &rejection{
+			Error:  err.Error(),
+			Reason: REJECTSHUTDOWN,
+		})
+		return
+	case errServerFull:
+		retry := strconv.Itoa(int(serverFullRetry.Seconds()))
+		w.Header().Set("Retry-After", retry)
+		reject(w, r, http.StatusServiceUnavailable, &rejection{
+			Error:  err.Error(),
+			Reason: REJECTSERVERFULL,
+		})
+		return
+	}
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusServiceUnavailable)
-		aLog.Warn("Superhub rejected client", "path", r.URL.Path, "err", err.Error())
+		rejectUpgraded(w, r, CloseRoomFull, &rejection{
+			Error:  err.Error(),
+			Reason: REJECTROOMFULL,
+		})
 		return
 	}
 
 	// Create the client
-	ClientID := ClientIDOrNew(r.URL.RawQuery)
-	lastNum := lastNum(r.URL.RawQuery)
-	num := lastNum
-	if lastNum >= 0 {
-		num = lastNum + 1
+	num := params.LastNum
+	if num >= 0 {
+		num = params.LastNum + 1
 	}
 	c := &Client{
-		ID:           ClientID,
+		ID:           params.ID,
+		Name:         params.Name,
+		Meta:         params.Meta,
 		Num:          num,
+		Version:      params.Version,
+		Receipts:     params.Receipts,
+		SelfJoin:     params.SelfJoin,
+		BestEffort:   params.BestEffort,
+		PingFreq:     params.PingFreq,
+		PongTimeout:  params.PongTimeout,
+		Role:         params.Role,
 		WS:           nil,
 		Hub:          hub,
 		InitialQueue: make(chan *Queue),
-		Pending:      make(chan *Envelope),
+		Pending:      make(chan *Envelope, maxQueued),
+		created:      time.Now(),
 	}
 	c.Ref = fmt.Sprintf("%p", c)
 
-	// Try to upgrade to a websocket
-	ws, err := upgrader.Upgrade(w, r, make(http.Header))
+	// Try to upgrade to a websocket, not offering compression to
+	// clients that can't handle it
+	up := upgrader
+	up.EnableCompression = params.Compress
+	ws, err := up.Upgrade(w, r, make(http.Header))
 	if err != nil {
 		aLog.Warn("Upgrade error", "error", err)
-		Shub.Release(c.Hub, c)
+		c.Hub.shub.Release(c.Hub, c)
 		return
 	}
+	atomic.AddInt64(&Counters.upgradesAccepted, 1)
 	c.WS = ws
+	c.Subprotocol = ws.Subprotocol()
 
 	// Start the client handler running.
 	aLog.Info("Connected client", "path", r.URL.Path, "id", c.ID, "ref", c.Ref)
 	c.Start()
 }
 
-// lastNum gets the integer given by the lastnum query parameter,
-// or -1 if there is none.
-func lastNum(query string) int {
-	v, err := url.ParseQuery(query)
-	if err != nil {
-		aLog.Warn("Couldn't parse query string", "query", query)
-		return -1
-	}
-	lnStr := v.Get("lastnum")
-	if lnStr == "" {
-		return -1
-	}
-	num, err := strconv.Atoi(lnStr)
-	if err != nil {
-		aLog.Warn("lastnum not an integer", "lastnum", query)
-		return -1
-	}
-	return num
-}
-
 // Just say hello
 func helloHandler(w http.ResponseWriter, r *http.Request) {
 	if r.URL.Path != "/" {
@@ -127,3 +455,42 @@ func helloHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	fmt.Fprint(w, "Hello, there")
 }
+
+// statusHandler gives JSON describing how the server's doing, such as
+// how many clients have been rejected recently, and why.
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Rejections *RejectionCounts
+	}{
+		Rejections: Rejections.Counts(),
+	})
+}
+
+// roomInfoHandler gives JSON describing a room, so a page can show how
+// it is before anyone connects to it. The room is the request's path.
+func roomInfoHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(Shub.RoomInfo(r.URL.Path))
+}
+
+// publicRoomsHandler gives JSON listing the public rooms, so players
+// can find one to join.
+func publicRoomsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Rooms []RoomListing
+	}{
+		Rooms: Shub.PublicRooms(),
+	})
+}
@@ -0,0 +1,107 @@
+// Copyright 2020 Nik Silver
+//
+// Licensed under the GPL v3.0. See file LICENCE.txt for details.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"time"
+)
+
+// Length of the codes we make for new rooms, and the characters they're
+// made from. These are safe in a URL, and leave out some that are easily
+// confused when read out.
+var roomCodeLength = 8
+var roomCodeAlphabet = "abcdefghjkmnpqrstuvwxyz23456789"
+
+// How long a new room's code is kept for its creator to connect
+var roomReserveTTL = 2 * time.Minute
+
+// How many codes we try before giving up on finding one that's free
+var roomCodeTries = 5
+
+// newRoomHandler makes a new room for a POST, with an unguessable code,
+// and reserves it for a short time so it's not given out again before
+// its creator connects. The creator can give maxclients, public and
+// history in the query string, as if it were connecting, and they're
+// used when the first client does. The room and its code are given as
+// JSON.
+func newRoomHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	params, err := ParseConnectionParams(r.URL.RawQuery)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	creation := &ConnectionParams{
+		MaxClients:  params.MaxClients,
+		Public:      params.Public,
+		History:     params.History,
+		FullHistory: params.FullHistory,
+	}
+
+	for i := 0; i < roomCodeTries; i++ {
+		code, err := newRoomCode()
+		if err != nil {
+			aLog.Error("Couldn't make room code", "error", err)
+			break
+		}
+		room := "/g/" + code
+		switch err := Shub.Reserve(room, creation, roomReserveTTL); err {
+		case nil:
+			aLog.Info("Reserved new room", "room", room)
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(struct {
+				Code  string
+				Room  string
+				TTLMs int64
+			}{
+				Code:  code,
+				Room:  room,
+				TTLMs: roomReserveTTL.Milliseconds(),
+			})
+			return
+		case errShuttingDown:
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+	}
+	http.Error(w, "Couldn't make a new room", http.StatusInternalServerError)
+}
+
+// urlSafe says if a string only has characters that needn't be escaped
+// in a URL's path: letters, digits, and . _ - or ~.
+func urlSafe(str string) bool {
+	for _, r := range str {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case r == '.' || r == '_' || r == '-' || r == '~':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// newRoomCode gives a random code for a room, from the alphabet for
+// room codes.
+func newRoomCode() (string, error) {
+	max := big.NewInt(int64(len(roomCodeAlphabet)))
+	code := make([]byte, roomCodeLength)
+	for i := range code {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		code[i] = roomCodeAlphabet[n.Int64()]
+	}
+	return string(code), nil
+}
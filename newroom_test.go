@@ -0,0 +1,129 @@
+// Copyright 2020 Nik Silver
+//
+// Licensed under the GPL v3.0. See file LICENCE.txt for details.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewRoom_ReservesARoomWithItsSettings(t *testing.T) {
+	// Just for this test, lower the reconnection timeout so that a
+	// Leaver message is triggered reasonably quickly.
+	sh := useSuperhub(t, 250*time.Millisecond)
+
+	serv := newTestServer(bounceHandler)
+	defer serv.Close()
+
+	post := func(method string, query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/new?"+query, nil)
+		w := httptest.NewRecorder()
+		newRoomHandler(w, req)
+		return w
+	}
+
+	// Only a POST with good settings makes a room
+
+	if w := post("GET", ""); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET: Expected status 405 but got %d", w.Code)
+	}
+	if w := post("POST", "maxclients=0"); w.Code != http.StatusBadRequest {
+		t.Errorf("Bad maxclients: Expected status 400 but got %d", w.Code)
+	}
+
+	w := post("POST", "maxclients=2&public=1")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200 but got %d", w.Code)
+	}
+	out := struct {
+		Code  string
+		Room  string
+		TTLMs int64
+	}{}
+	if err := json.NewDecoder(w.Body).Decode(&out); err != nil {
+		t.Fatal(err)
+	}
+	if len(out.Code) != roomCodeLength || out.Room != "/g/"+out.Code ||
+		out.TTLMs != roomReserveTTL.Milliseconds() {
+		t.Errorf("Got unexpected new room %#v", out)
+	}
+	for _, r := range out.Code {
+		if !strings.ContainsRune(roomCodeAlphabet, r) {
+			t.Errorf("Code %q has character %q not in alphabet",
+				out.Code, r)
+		}
+	}
+
+	// No-one else can have it, and the first to join gets the room
+	// its creator asked for
+
+	err := sh.Reserve(out.Room, &ConnectionParams{}, time.Minute)
+	if err != errRoomTaken {
+		t.Errorf("Reserving again, expected errRoomTaken but got %v", err)
+	}
+	ws, _, err := dial(serv, out.Room, "NR1", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws := newTConn(ws, "NR1")
+	defer tws.close()
+	env, err := tws.readEnvelope(500, "NR1 expecting Welcome")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Intent != "Welcome" || env.Limits == nil ||
+		env.Limits.MaxClients != 2 {
+		t.Errorf("NR1 expected Welcome for 2 clients, got %#v", env)
+	}
+	rooms := sh.PublicRooms()
+	if len(rooms) != 1 || rooms[0].Room != out.Room {
+		t.Errorf("Expected new room to be public, got %#v", rooms)
+	}
+
+	// Tidy up, and check everything in the main app finishes
+	tws.close()
+	WG.Wait()
+}
+
+func TestNewRoom_ReservationsRunOut(t *testing.T) {
+	sh := NewSuperhub()
+
+	// A room reserved only briefly can be reserved again once it's
+	// run out, and its settings aren't used
+
+	room := "/g/nr.runout"
+	p := &ConnectionParams{MaxClients: 2}
+	if err := sh.Reserve(room, p, time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if err := sh.Reserve(room, p, time.Millisecond); err != nil {
+		t.Errorf("Reserving after running out, got %v", err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	h, err := sh.Hub(room, &ConnectionParams{Reconnect: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.settings.MaxClients != MaxClients {
+		t.Errorf("Expected room for %d clients but got %d",
+			MaxClients, h.settings.MaxClients)
+	}
+
+	// Once the room's in use, it can't be reserved
+
+	if err := sh.Reserve(room, p, time.Minute); err != errRoomTaken {
+		t.Errorf("Reserving room in use, expected errRoomTaken but got %v",
+			err)
+	}
+
+	// Tidy up, and check everything finishes
+	sh.Release(h, &Client{gone: true})
+	WG.Wait()
+}
@@ -0,0 +1,101 @@
+// Copyright 2020 Nik Silver
+//
+// Licensed under the GPL v3.0. See file LICENCE.txt for details.
+
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Origins of web pages allowed to connect, or to call our other
+// endpoints from the browser. Each is a host, such as
+// "games.example.com", or a wildcard for its subdomains, such as
+// "*.example.com". A port must match if one is given. If there are none
+// then any page can connect, which helps with testing locally.
+var allowedOrigins []string
+
+// How long a browser can remember what a preflight request told it
+var corsMaxAge = 10 * time.Minute
+
+// newAllowedOrigins gets the allowed origins from a comma-separated
+// list.
+func newAllowedOrigins(list string) []string {
+	origins := make([]string, 0)
+	for _, o := range strings.Split(list, ",") {
+		if o = strings.ToLower(strings.TrimSpace(o)); o != "" {
+			origins = append(origins, o)
+		}
+	}
+	return origins
+}
+
+// originAllowed says if the request comes from a web page that's
+// allowed to connect. A request without an Origin header isn't from a
+// browser, so it's allowed.
+func originAllowed(r *http.Request) bool {
+	if len(allowedOrigins) == 0 {
+		return true
+	}
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	for _, allowed := range allowedOrigins {
+		if originMatches(allowed, u) {
+			return true
+		}
+	}
+	return false
+}
+
+// originMatches says if an origin URL matches an allowed host or
+// wildcard.
+func originMatches(allowed string, u *url.URL) bool {
+	host := strings.ToLower(u.Hostname())
+	if strings.Contains(allowed, ":") {
+		host = strings.ToLower(u.Host)
+	}
+	if strings.HasPrefix(allowed, "*.") {
+		return strings.HasSuffix(host, allowed[1:])
+	}
+	return host == allowed
+}
+
+// withCORS lets web pages from the allowed origins call a handler from
+// the browser, with the given methods, and answers their preflight
+// requests itself. A page from any other origin isn't told it may, and
+// its preflight is refused.
+func withCORS(h http.HandlerFunc, methods ...string) http.HandlerFunc {
+	allow := strings.Join(append(methods, http.MethodOptions), ", ")
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Origin")
+		origin := r.Header.Get("Origin")
+		okay := origin != "" && originAllowed(r)
+		if okay {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+		}
+
+		if r.Method != http.MethodOptions {
+			h(w, r)
+			return
+		}
+		if !okay {
+			http.Error(w, "Origin not allowed", http.StatusForbidden)
+			return
+		}
+		maxAge := strconv.Itoa(int(corsMaxAge.Seconds()))
+		w.Header().Set("Access-Control-Allow-Methods", allow)
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		w.Header().Set("Access-Control-Max-Age", maxAge)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
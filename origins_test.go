@@ -0,0 +1,156 @@
+// Copyright 2020 Nik Silver
+//
+// Licensed under the GPL v3.0. See file LICENCE.txt for details.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestOrigins_OnlyAllowedOriginsCanConnect(t *testing.T) {
+	// Just for this test, lower the reconnection timeout so that a
+	// Leaver message is triggered reasonably quickly
+	useSuperhub(t, 250*time.Millisecond)
+	oldAllowedOrigins := allowedOrigins
+	defer func() {
+		allowedOrigins = oldAllowedOrigins
+	}()
+
+	serv := newTestServer(bounceHandler)
+	defer serv.Close()
+
+	data := []struct {
+		allowed string
+		origin  string
+		ok      bool
+	}{
+		{"", "https://anywhere.com", true},
+		{"games.example.com", "", true},
+		{"games.example.com", "https://games.example.com", true},
+		{"games.example.com", "https://Games.Example.com:8443", true},
+		{"games.example.com", "https://example.com", false},
+		{"games.example.com", "https://evil.com", false},
+		{"games.example.com", "https://games.example.com.evil.com", false},
+		{"games.example.com", "null", false},
+		{"*.example.com", "https://games.example.com", true},
+		{"*.example.com", "https://a.b.example.com", true},
+		{"*.example.com", "https://example.com", false},
+		{"*.example.com", "https://badexample.com", false},
+		{"localhost:3000", "http://localhost:3000", true},
+		{"localhost:3000", "http://localhost:4000", false},
+		{"evil.com, games.example.com", "https://games.example.com", true},
+	}
+
+	for i, d := range data {
+		allowedOrigins = newAllowedOrigins(d.allowed)
+		header := http.Header{}
+		if d.origin != "" {
+			header.Set("Origin", d.origin)
+		}
+		ws, resp, err := dialWith(serv, "/origins.room", "ORIG", -1, nil, header)
+		switch {
+		case d.ok && err != nil:
+			t.Errorf("%d: Origin %q allowed %q gave error %s",
+				i, d.origin, d.allowed, err)
+		case d.ok:
+			tws := newTConn(ws, "ORIG")
+			if err := tws.swallow("Welcome"); err != nil {
+				t.Errorf("%d: Origin %q allowed %q: %s",
+					i, d.origin, d.allowed, err)
+			}
+			tws.close()
+		case err == nil:
+			ws.Close()
+			t.Errorf("%d: Origin %q allowed %q: Expected error but got none",
+				i, d.origin, d.allowed)
+		case resp == nil || resp.StatusCode != http.StatusForbidden:
+			t.Errorf("%d: Origin %q allowed %q: Expected 403 but got %v",
+				i, d.origin, d.allowed, resp)
+		}
+	}
+
+	// Check everything in the main app finishes
+	WG.Wait()
+}
+
+func TestOrigins_OnlyAllowedOriginsGetCORSHeaders(t *testing.T) {
+	oldAllowedOrigins := allowedOrigins
+	defer func() {
+		allowedOrigins = oldAllowedOrigins
+	}()
+
+	serv := newTestServer(bounceHandler)
+	defer serv.Close()
+
+	data := []struct {
+		allowed string
+		origin  string
+		method  string
+		code    int
+		ok      bool
+	}{
+		{"", "https://anywhere.com", "GET", http.StatusOK, true},
+		{"games.example.com", "", "GET", http.StatusOK, false},
+		{"games.example.com", "https://games.example.com", "GET",
+			http.StatusOK, true},
+		{"games.example.com", "https://evil.com", "GET",
+			http.StatusOK, false},
+		{"*.example.com", "https://a.example.com", "OPTIONS",
+			http.StatusNoContent, true},
+		{"*.example.com", "https://evil.com", "OPTIONS",
+			http.StatusForbidden, false},
+		{"games.example.com", "", "OPTIONS", http.StatusForbidden, false},
+	}
+
+	for i, d := range data {
+		allowedOrigins = newAllowedOrigins(d.allowed)
+		req, err := http.NewRequest(d.method, serv.URL+"/origins.cors", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d.origin != "" {
+			req.Header.Set("Origin", d.origin)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		got := resp.Header.Get("Access-Control-Allow-Origin")
+		switch {
+		case resp.StatusCode != d.code:
+			t.Errorf("%d: %s from %q allowed %q: Expected %d but got %d",
+				i, d.method, d.origin, d.allowed, d.code, resp.StatusCode)
+		case d.ok && got != d.origin:
+			t.Errorf("%d: %s from %q allowed %q: Expected origin allowed "+
+				"but got %q", i, d.method, d.origin, d.allowed, got)
+		case !d.ok && got != "":
+			t.Errorf("%d: %s from %q allowed %q: Expected no origin "+
+				"allowed but got %q", i, d.method, d.origin, d.allowed, got)
+		}
+	}
+
+	// A preflight says which methods and headers can be used
+
+	allowedOrigins = newAllowedOrigins("games.example.com")
+	req := httptest.NewRequest("OPTIONS", "/new", nil)
+	req.Header.Set("Origin", "https://games.example.com")
+	req.Header.Set("Access-Control-Request-Method", "POST")
+	w := httptest.NewRecorder()
+	withCORS(newRoomHandler, http.MethodPost)(w, req)
+	if w.Code != http.StatusNoContent ||
+		w.Header().Get("Access-Control-Allow-Methods") != "POST, OPTIONS" ||
+		w.Header().Get("Access-Control-Allow-Headers") != "Content-Type" ||
+		w.Header().Get("Access-Control-Max-Age") == "" {
+		t.Errorf("Got unexpected preflight response %d, %#v",
+			w.Code, w.Header())
+	}
+
+	// Check everything in the main app finishes
+	WG.Wait()
+}
@@ -0,0 +1,395 @@
+// Copyright 2020 Nik Silver
+//
+// Licensed under the GPL v3.0. See file LICENCE.txt for details.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Longest display name a client can have, in characters
+var maxNameLength = 40
+
+// Longest client ID a client can give, in bytes
+var maxIDLength = 64
+
+// Client IDs starting with this are kept for things on the server side,
+// such as a service sending a message into a room, so no client can
+// pretend to be one of them
+const reservedIDPrefix = "#"
+
+// Largest metadata a client can have, in bytes of JSON
+var maxMetaSize = 1024
+
+// ConnectionParams are what a client tells us about itself when it
+// connects, in the query string of its URL.
+type ConnectionParams struct {
+	// Client ID, or a new one if the client didn't give one. No more
+	// than maxIDLength of letters, digits, and . _ - or ~, so it's safe
+	// to show and to put in a list.
+	ID string
+	// Display name for the other players to see, or empty if none. No
+	// more than maxNameLength characters, without control characters
+	// or surrounding space.
+	Name string
+	// Metadata for the other players to see, such as an avatar or
+	// colour, as JSON, or nil if none. No more than maxMetaSize bytes.
+	Meta json.RawMessage
+	// Num of the last envelope the client received, or -1 if none
+	LastNum int
+	// Protocol version the client asked for, 0 if it didn't ask, or
+	// -1 if it's not an integer (and so is certainly not a version
+	// we can speak).
+	Version int
+	// If the client can handle compression. True unless it says
+	// compress=0.
+	Compress bool
+	// If the client wants receipts for its own peer messages. True
+	// unless it says receipts=off.
+	Receipts bool
+	// If the client wants the Joiner message about itself, after its
+	// Welcome. Only if it says selfjoin=1.
+	SelfJoin bool
+	// If the client is happy to reconnect having missed some envelopes.
+	// Only if it says resume=best-effort; otherwise resume=strict.
+	BestEffort bool
+	// How often the client wants pings, or 0 for the default. Given
+	// in seconds, and kept between minPingFreq and maxPingFreq.
+	PingFreq time.Duration
+	// How long the client wants us to wait for a pong, or 0 for the
+	// default. Given in seconds, and kept between minPongTimeout and
+	// maxPongTimeout.
+	PongTimeout time.Duration
+	// Largest message allowed in the room, if the client is creating it,
+	// or 0 for the default. No more than maxReadLimit.
+	MaxMsg int
+	// If the room's leader may give one client another's ID, if the
+	// client is creating it. Only if it says reassign=on.
+	Reassign bool
+	// How long a client has to reconnect, if the client is creating the
+	// room, or -1 for the default. Given in milliseconds, and no more
+	// than maxReconnect.
+	Reconnect time.Duration
+	// How long a player may go without sending a peer message before
+	// it's warned, and then closed, if the client is creating the room,
+	// or 0 if it may idle forever. Given in seconds, and no more than
+	// maxClientIdle.
+	ClientIdle time.Duration
+	// If a client joining the room with the ID of a client already
+	// joined is refused, unless it gives a lastnum, if the client is
+	// creating it. Otherwise it replaces the old client. Only if it
+	// says strictid=on.
+	StrictID bool
+	// If the client plays or only watches. A player unless it says
+	// role=observer.
+	Role role
+	// If anyone can see the room listed, if the client is creating it.
+	// Only if it says public=1.
+	Public bool
+	// Most clients allowed in the room, if the client is creating it,
+	// or 0 for the default. From 1 to MaxClients.
+	MaxClients int
+	// How many recent peer messages the room keeps to show new joiners,
+	// if the client is creating it. From 0 to maxHistory. Or if it
+	// keeps them all, if it says history=all.
+	History     int
+	FullHistory bool
+	// Join token, or empty if none. It's needed if the server has a
+	// join secret.
+	JoinToken string
+	// Spectator link token, or empty if none. A client with one is
+	// always an observer.
+	Link string
+	// Password for the room, or empty if none. It's what the room is
+	// created with, and what anyone joining it must give. This must
+	// never be logged or sent to any client.
+	Pass string
+}
+
+// ParseConnectionParams gets the connection parameters from a URL
+// query string. It returns an error if the query string can't be
+// parsed, the id isn't a valid client ID, the name is too long, the
+// meta isn't JSON or is too big, the lastnum isn't an envelope num we
+// could ever have sent, compress isn't 0 or 1, receipts isn't on or
+// off, selfjoin isn't 0 or 1, resume isn't strict or best-effort,
+// ping or pong isn't an integer, maxmsg isn't a positive integer,
+// reconnect or clientidle isn't an integer, reassign isn't on or off,
+// strictid isn't on or off, public isn't 0 or 1, maxclients isn't
+// from 1 to MaxClients, history isn't all or from 0 to maxHistory, or
+// role isn't player or observer.
+func ParseConnectionParams(query string) (*ConnectionParams, error) {
+	v, err := url.ParseQuery(query)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't parse query string")
+	}
+
+	p := &ConnectionParams{
+		ID:        v.Get("id"),
+		Pass:      v.Get("pass"),
+		Link:      v.Get("link"),
+		JoinToken: v.Get("token"),
+		LastNum:   -1,
+		Reconnect: -1,
+		Version:   0,
+		Compress:  true,
+		Receipts:  true,
+	}
+	if p.ID == "" {
+		p.ID = newClientID()
+	} else if !validID(p.ID) {
+		return nil, fmt.Errorf("Bad id")
+	}
+
+	p.Name = cleanName(v.Get("name"))
+	if utf8.RuneCountInString(p.Name) > maxNameLength {
+		return nil, fmt.Errorf("Bad name")
+	}
+
+	if mStr := v.Get("meta"); mStr != "" {
+		if len(mStr) > maxMetaSize || !json.Valid([]byte(mStr)) {
+			return nil, fmt.Errorf("Bad meta")
+		}
+		p.Meta = json.RawMessage(mStr)
+	}
+
+	if lnStr := v.Get("lastnum"); lnStr != "" {
+		num, err := strconv.Atoi(lnStr)
+		// We expect the next num to be lastnum + 1, so that mustn't
+		// overflow
+		if err != nil || num < 0 || num == math.MaxInt {
+			return nil, fmt.Errorf("Bad lastnum")
+		}
+		p.LastNum = num
+	}
+
+	if vStr := v.Get("version"); vStr != "" {
+		ver, err := strconv.Atoi(vStr)
+		if err != nil {
+			aLog.Warn("version not an integer", "version", vStr)
+			ver = -1
+		}
+		p.Version = ver
+	}
+
+	switch v.Get("compress") {
+	case "", "1":
+		p.Compress = true
+	case "0":
+		p.Compress = false
+	default:
+		return nil, fmt.Errorf("Bad compress")
+	}
+
+	switch v.Get("selfjoin") {
+	case "", "0":
+		p.SelfJoin = false
+	case "1":
+		p.SelfJoin = true
+	default:
+		return nil, fmt.Errorf("Bad selfjoin")
+	}
+
+	switch v.Get("receipts") {
+	case "", "on":
+		p.Receipts = true
+	case "off":
+		p.Receipts = false
+	default:
+		return nil, fmt.Errorf("Bad receipts")
+	}
+
+	switch v.Get("resume") {
+	case "", "strict":
+		p.BestEffort = false
+	case "best-effort":
+		p.BestEffort = true
+	default:
+		return nil, fmt.Errorf("Bad resume")
+	}
+
+	if pStr := v.Get("ping"); pStr != "" {
+		secs, err := strconv.Atoi(pStr)
+		if err != nil {
+			return nil, fmt.Errorf("Bad ping")
+		}
+		switch {
+		case secs < int(minPingFreq/time.Second):
+			p.PingFreq = minPingFreq
+		case secs > int(maxPingFreq/time.Second):
+			p.PingFreq = maxPingFreq
+		default:
+			p.PingFreq = time.Duration(secs) * time.Second
+		}
+	}
+
+	if pStr := v.Get("pong"); pStr != "" {
+		secs, err := strconv.Atoi(pStr)
+		if err != nil {
+			return nil, fmt.Errorf("Bad pong")
+		}
+		switch {
+		case secs < int(minPongTimeout/time.Second):
+			p.PongTimeout = minPongTimeout
+		case secs > int(maxPongTimeout/time.Second):
+			p.PongTimeout = maxPongTimeout
+		default:
+			p.PongTimeout = time.Duration(secs) * time.Second
+		}
+	}
+
+	if mmStr := v.Get("maxmsg"); mmStr != "" {
+		mm, err := strconv.Atoi(mmStr)
+		if err != nil || mm < 1 {
+			return nil, fmt.Errorf("Bad maxmsg")
+		}
+		if mm > maxReadLimit {
+			mm = maxReadLimit
+		}
+		p.MaxMsg = mm
+	}
+
+	if rStr := v.Get("reconnect"); rStr != "" {
+		ms, err := strconv.Atoi(rStr)
+		if err != nil {
+			return nil, fmt.Errorf("Bad reconnect")
+		}
+		switch {
+		case ms < 0:
+			p.Reconnect = 0
+		case ms > int(maxReconnect/time.Millisecond):
+			p.Reconnect = maxReconnect
+		default:
+			p.Reconnect = time.Duration(ms) * time.Millisecond
+		}
+	}
+
+	if ciStr := v.Get("clientidle"); ciStr != "" {
+		secs, err := strconv.Atoi(ciStr)
+		if err != nil {
+			return nil, fmt.Errorf("Bad clientidle")
+		}
+		switch {
+		case secs < 0:
+			p.ClientIdle = 0
+		case secs > int(maxClientIdle/time.Second):
+			p.ClientIdle = maxClientIdle
+		default:
+			p.ClientIdle = time.Duration(secs) * time.Second
+		}
+	}
+
+	if mcStr := v.Get("maxclients"); mcStr != "" {
+		mc, err := strconv.Atoi(mcStr)
+		if err != nil || mc < 1 || mc > MaxClients {
+			return nil, fmt.Errorf("Bad maxclients")
+		}
+		p.MaxClients = mc
+	}
+
+	if hStr := v.Get("history"); hStr == "all" {
+		p.FullHistory = true
+	} else if hStr != "" {
+		hist, err := strconv.Atoi(hStr)
+		if err != nil || hist < 0 || hist > maxHistory {
+			return nil, fmt.Errorf("Bad history")
+		}
+		p.History = hist
+	}
+
+	switch v.Get("role") {
+	case "", "player":
+		p.Role = PLAYER
+	case "observer":
+		p.Role = OBSERVER
+	default:
+		return nil, fmt.Errorf("Bad role")
+	}
+	if p.Link != "" {
+		p.Role = OBSERVER
+	}
+
+	switch v.Get("reassign") {
+	case "", "off":
+		p.Reassign = false
+	case "on":
+		p.Reassign = true
+	default:
+		return nil, fmt.Errorf("Bad reassign")
+	}
+
+	switch v.Get("strictid") {
+	case "", "off":
+		p.StrictID = false
+	case "on":
+		p.StrictID = true
+	default:
+		return nil, fmt.Errorf("Bad strictid")
+	}
+
+	switch v.Get("public") {
+	case "", "0":
+		p.Public = false
+	case "1":
+		p.Public = true
+	default:
+		return nil, fmt.Errorf("Bad public")
+	}
+
+	return p, nil
+}
+
+// validID says if a client ID is one we'll take: not empty, not too
+// long, and only letters, digits, and . _ - or ~. IDs we make ourselves
+// are always valid.
+func validID(id string) bool {
+	if id == "" || len(id) > maxIDLength || reservedID(id) {
+		return false
+	}
+	for _, r := range id {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case r == '.' || r == '_' || r == '-' || r == '~':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// reservedID says if an ID is kept for the server side, so no client
+// can have it.
+func reservedID(id string) bool {
+	return strings.HasPrefix(id, reservedIDPrefix)
+}
+
+// systemID gives the reserved ID for something on the server side,
+// such as "server", so it can't be mistaken for a client.
+func systemID(name string) string {
+	if reservedID(name) {
+		return name
+	}
+	return reservedIDPrefix + name
+}
+
+// cleanName makes a display name safe to show, by dropping anything
+// that isn't valid text or is a control character, and any space
+// around it.
+func cleanName(name string) string {
+	name = strings.ToValidUTF8(name, "")
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || unicode.Is(unicode.Cf, r) {
+			return -1
+		}
+		return r
+	}, name)
+	return strings.TrimSpace(name)
+}
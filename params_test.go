@@ -0,0 +1,627 @@
+// Copyright 2020 Nik Silver
+//
+// Licensed under the GPL v3.0. See file LICENCE.txt for details.
+
+package main
+
+import (
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParams_ParsesGoodQueries(t *testing.T) {
+	data := []struct {
+		query   string
+		id      string // Empty if we expect a new one
+		lastNum int
+		version int
+	}{
+		{"", "", -1, 0},
+		{"id=abc", "abc", -1, 0},
+		{"id=", "", -1, 0},
+		{"id=a_b&lastnum=0", "a_b", 0, 0},
+		{"lastnum=12", "", 12, 0},
+		{"lastnum=", "", -1, 0},
+		{"id=xyz&lastnum=7&version=1", "xyz", 7, 1},
+		{"version=2", "", -1, 2},
+		{"version=x", "", -1, -1},
+		{"id=abc&other=thing", "abc", -1, 0},
+	}
+
+	for _, d := range data {
+		p, err := ParseConnectionParams(d.query)
+		if err != nil {
+			t.Errorf("Query '%s' gave error: %s", d.query, err)
+			continue
+		}
+		if d.id != "" && p.ID != d.id {
+			t.Errorf("Query '%s' gave ID '%s'", d.query, p.ID)
+		}
+		if d.id == "" && p.ID == "" {
+			t.Errorf("Query '%s' gave no ID", d.query)
+		}
+		if p.LastNum != d.lastNum {
+			t.Errorf("Query '%s' gave lastnum %d", d.query, p.LastNum)
+		}
+		if p.Version != d.version {
+			t.Errorf("Query '%s' gave version %d", d.query, p.Version)
+		}
+	}
+}
+
+func TestParams_RejectsBadQueries(t *testing.T) {
+	data := []string{
+		"id=%zz",
+		"id=a%20b",
+		"id=%20",
+		"id=a,b",
+		"id=%23server",
+		"id=a%0Ab",
+		"id=%C3%A9",
+		"id=" + strings.Repeat("x", maxIDLength+1),
+		"lastnum=x",
+		"lastnum=-1",
+		"lastnum=-12",
+		"lastnum=1.5",
+		"lastnum=%203",
+		"lastnum=99999999999999999999999",
+		"lastnum=" + strconv.Itoa(math.MaxInt),
+		"compress=2",
+		"compress=no",
+		"name=" + strings.Repeat("x", maxNameLength+1),
+		"meta=%7Bcolour",
+		"meta=red",
+		"meta=" + url.QueryEscape(`"`+strings.Repeat("x", maxMetaSize-1)+`"`),
+		"ping=x",
+		"reconnect=soon",
+		"reconnect=2.5",
+		"clientidle=soon",
+		"clientidle=1.5",
+		"pong=2s",
+		"ping=1.5",
+		"selfjoin=on",
+		"selfjoin=yes",
+		"receipts=0",
+		"receipts=yes",
+		"resume=best",
+		"resume=loose",
+		"maxmsg=0",
+		"maxmsg=-5",
+		"maxmsg=big",
+		"reassign=yes",
+		"reassign=1",
+		"strictid=1",
+		"strictid=yes",
+		"public=on",
+		"public=yes",
+		"maxclients=0",
+		"maxclients=-1",
+		"maxclients=" + strconv.Itoa(MaxClients+1),
+		"maxclients=two",
+		"history=-1",
+		"history=" + strconv.Itoa(maxHistory+1),
+		"history=lots",
+		"history=All",
+		"role=watcher",
+		"role=Observer",
+	}
+
+	for _, query := range data {
+		if p, err := ParseConnectionParams(query); err == nil {
+			t.Errorf("Query '%s' should have given error but gave %#v",
+				query, p)
+		}
+	}
+}
+
+func TestParams_IDsAreValid(t *testing.T) {
+	for _, id := range []string{
+		"a",
+		"Player-1",
+		"x.y_z~",
+		strings.Repeat("x", maxIDLength),
+		newClientID(),
+	} {
+		p, err := ParseConnectionParams("id=" + id)
+		if err != nil {
+			t.Errorf("ID %q gave error: %s", id, err)
+			continue
+		}
+		if p.ID != id {
+			t.Errorf("ID %q came back as %q", id, p.ID)
+		}
+	}
+
+	// IDs we make are valid, too
+	p, err := ParseConnectionParams("")
+	if err != nil || !validID(p.ID) {
+		t.Errorf("New ID %q isn't valid (error %v)", p.ID, err)
+	}
+}
+
+func TestParams_CompressUnlessAskedNotTo(t *testing.T) {
+	data := []struct {
+		query    string
+		compress bool
+	}{
+		{"", true},
+		{"id=abc", true},
+		{"compress=", true},
+		{"compress=1", true},
+		{"compress=0", false},
+		{"id=abc&compress=0&lastnum=3", false},
+	}
+
+	for _, d := range data {
+		p, err := ParseConnectionParams(d.query)
+		if err != nil {
+			t.Errorf("Query '%s' gave error: %s", d.query, err)
+			continue
+		}
+		if p.Compress != d.compress {
+			t.Errorf("Query '%s' gave compress %v", d.query, p.Compress)
+		}
+	}
+}
+
+func TestParams_ReceiptsUnlessAskedNotTo(t *testing.T) {
+	data := []struct {
+		query    string
+		receipts bool
+	}{
+		{"", true},
+		{"id=abc", true},
+		{"receipts=", true},
+		{"receipts=on", true},
+		{"receipts=off", false},
+		{"id=abc&receipts=off&lastnum=3", false},
+	}
+
+	for _, d := range data {
+		p, err := ParseConnectionParams(d.query)
+		if err != nil {
+			t.Errorf("Query '%s' gave error: %s", d.query, err)
+			continue
+		}
+		if p.Receipts != d.receipts {
+			t.Errorf("Query '%s' gave receipts %v", d.query, p.Receipts)
+		}
+	}
+}
+
+func TestParams_NamesAreCleaned(t *testing.T) {
+	data := []struct {
+		query string
+		name  string
+	}{
+		{"", ""},
+		{"name=Alice", "Alice"},
+		{"name=%20Bob%20", "Bob"},
+		{"name=Car%0Aol%00", "Carol"},
+		{"name=D%E2%80%AEave", "Dave"},
+		{"name=Ev%FFe", "Eve"},
+		{"name=Zo%C3%AB", "Zoë"},
+		{"name=" + strings.Repeat("é", maxNameLength),
+			strings.Repeat("é", maxNameLength)},
+		{"name=" + strings.Repeat("x", maxNameLength) + "%0A",
+			strings.Repeat("x", maxNameLength)},
+	}
+
+	for _, d := range data {
+		p, err := ParseConnectionParams(d.query)
+		if err != nil {
+			t.Errorf("Query '%s' gave error: %s", d.query, err)
+			continue
+		}
+		if p.Name != d.name {
+			t.Errorf("Query '%s' gave name %q", d.query, p.Name)
+		}
+	}
+}
+
+func TestParams_MetaIsKeptAsJSON(t *testing.T) {
+	data := []struct {
+		query string
+		meta  string
+	}{
+		{"", ""},
+		{"meta=", ""},
+		{"meta=%7B%22colour%22%3A%22red%22%7D", `{"colour":"red"}`},
+		{"meta=" + url.QueryEscape(`"`+strings.Repeat("x", maxMetaSize-2)+`"`),
+			`"` + strings.Repeat("x", maxMetaSize-2) + `"`},
+	}
+
+	for _, d := range data {
+		p, err := ParseConnectionParams(d.query)
+		if err != nil {
+			t.Errorf("Query '%s' gave error: %s", d.query, err)
+			continue
+		}
+		if string(p.Meta) != d.meta {
+			t.Errorf("Query '%s' gave meta %q", d.query, p.Meta)
+		}
+	}
+}
+
+func TestParams_PingIsClamped(t *testing.T) {
+	data := []struct {
+		query    string
+		pingFreq time.Duration
+	}{
+		{"", 0},
+		{"ping=", 0},
+		{"ping=30", 30 * time.Second},
+		{"ping=0", minPingFreq},
+		{"ping=-4", minPingFreq},
+		{"ping=1", 1 * time.Second},
+		{"ping=99999999999999", maxPingFreq},
+	}
+
+	for _, d := range data {
+		p, err := ParseConnectionParams(d.query)
+		if err != nil {
+			t.Errorf("Query '%s' gave error: %s", d.query, err)
+			continue
+		}
+		if p.PingFreq != d.pingFreq {
+			t.Errorf("Query '%s' gave ping freq %s", d.query, p.PingFreq)
+		}
+	}
+}
+
+func TestParams_PongIsClamped(t *testing.T) {
+	data := []struct {
+		query       string
+		pongTimeout time.Duration
+	}{
+		{"", 0},
+		{"pong=90", 90 * time.Second},
+		{"pong=0", minPongTimeout},
+		{"pong=99999999999999", maxPongTimeout},
+		{"ping=10&pong=300", 300 * time.Second},
+	}
+
+	for _, d := range data {
+		p, err := ParseConnectionParams(d.query)
+		if err != nil {
+			t.Errorf("Query '%s' gave error: %s", d.query, err)
+			continue
+		}
+		if p.PongTimeout != d.pongTimeout {
+			t.Errorf("Query '%s' gave pong timeout %s",
+				d.query, p.PongTimeout)
+		}
+	}
+}
+
+func TestParams_ReconnectIsClamped(t *testing.T) {
+	data := []struct {
+		query     string
+		reconnect time.Duration
+	}{
+		{"", -1},
+		{"reconnect=", -1},
+		{"reconnect=0", 0},
+		{"reconnect=-5", 0},
+		{"reconnect=1500", 1500 * time.Millisecond},
+		{"reconnect=99999999999999", maxReconnect},
+	}
+
+	for _, d := range data {
+		p, err := ParseConnectionParams(d.query)
+		if err != nil {
+			t.Errorf("Query '%s' gave error: %s", d.query, err)
+			continue
+		}
+		if p.Reconnect != d.reconnect {
+			t.Errorf("Query '%s' gave reconnect %s", d.query, p.Reconnect)
+		}
+	}
+}
+
+func TestParams_ClientIdleIsClamped(t *testing.T) {
+	data := []struct {
+		query      string
+		clientIdle time.Duration
+	}{
+		{"", 0},
+		{"clientidle=", 0},
+		{"clientidle=0", 0},
+		{"clientidle=-5", 0},
+		{"clientidle=600", 10 * time.Minute},
+		{"clientidle=99999999999999", maxClientIdle},
+	}
+
+	for _, d := range data {
+		p, err := ParseConnectionParams(d.query)
+		if err != nil {
+			t.Errorf("Query '%s' gave error: %s", d.query, err)
+			continue
+		}
+		if p.ClientIdle != d.clientIdle {
+			t.Errorf("Query '%s' gave client idle %s",
+				d.query, p.ClientIdle)
+		}
+	}
+}
+
+func TestParams_SelfJoinOnlyIfAsked(t *testing.T) {
+	data := []struct {
+		query    string
+		selfJoin bool
+	}{
+		{"", false},
+		{"selfjoin=", false},
+		{"selfjoin=0", false},
+		{"selfjoin=1", true},
+		{"id=abc&selfjoin=1&lastnum=3", true},
+	}
+
+	for _, d := range data {
+		p, err := ParseConnectionParams(d.query)
+		if err != nil {
+			t.Errorf("Query '%s' gave error: %s", d.query, err)
+			continue
+		}
+		if p.SelfJoin != d.selfJoin {
+			t.Errorf("Query '%s' gave selfjoin %v", d.query, p.SelfJoin)
+		}
+	}
+}
+
+func TestParams_BestEffortOnlyIfAsked(t *testing.T) {
+	data := []struct {
+		query      string
+		bestEffort bool
+	}{
+		{"", false},
+		{"resume=", false},
+		{"resume=strict", false},
+		{"resume=best-effort", true},
+		{"id=abc&lastnum=3&resume=best-effort", true},
+	}
+
+	for _, d := range data {
+		p, err := ParseConnectionParams(d.query)
+		if err != nil {
+			t.Errorf("Query '%s' gave error: %s", d.query, err)
+			continue
+		}
+		if p.BestEffort != d.bestEffort {
+			t.Errorf("Query '%s' gave best effort %v", d.query, p.BestEffort)
+		}
+	}
+}
+
+func TestParams_ReassignOnlyIfAsked(t *testing.T) {
+	data := []struct {
+		query    string
+		reassign bool
+	}{
+		{"", false},
+		{"reassign=", false},
+		{"reassign=off", false},
+		{"reassign=on", true},
+		{"id=abc&reassign=on&lastnum=3", true},
+	}
+
+	for _, d := range data {
+		p, err := ParseConnectionParams(d.query)
+		if err != nil {
+			t.Errorf("Query '%s' gave error: %s", d.query, err)
+			continue
+		}
+		if p.Reassign != d.reassign {
+			t.Errorf("Query '%s' gave reassign %v", d.query, p.Reassign)
+		}
+	}
+}
+
+func TestParams_StrictIDOnlyIfAsked(t *testing.T) {
+	data := []struct {
+		query    string
+		strictID bool
+	}{
+		{"", false},
+		{"strictid=", false},
+		{"strictid=off", false},
+		{"strictid=on", true},
+		{"id=abc&strictid=on&lastnum=3", true},
+	}
+
+	for _, d := range data {
+		p, err := ParseConnectionParams(d.query)
+		if err != nil {
+			t.Errorf("Query '%s' gave error: %s", d.query, err)
+			continue
+		}
+		if p.StrictID != d.strictID {
+			t.Errorf("Query '%s' gave strictid %v", d.query, p.StrictID)
+		}
+	}
+}
+
+func TestParams_PublicOnlyIfAsked(t *testing.T) {
+	data := []struct {
+		query  string
+		public bool
+	}{
+		{"", false},
+		{"public=", false},
+		{"public=0", false},
+		{"public=1", true},
+		{"id=abc&public=1&lastnum=3", true},
+	}
+
+	for _, d := range data {
+		p, err := ParseConnectionParams(d.query)
+		if err != nil {
+			t.Errorf("Query '%s' gave error: %s", d.query, err)
+			continue
+		}
+		if p.Public != d.public {
+			t.Errorf("Query '%s' gave public %v", d.query, p.Public)
+		}
+	}
+}
+
+func TestParams_PlayerUnlessObserver(t *testing.T) {
+	data := []struct {
+		query string
+		role  role
+	}{
+		{"", PLAYER},
+		{"role=", PLAYER},
+		{"role=player", PLAYER},
+		{"role=observer", OBSERVER},
+		{"id=abc&role=observer&lastnum=3", OBSERVER},
+	}
+
+	for _, d := range data {
+		p, err := ParseConnectionParams(d.query)
+		if err != nil {
+			t.Errorf("Query '%s' gave error: %s", d.query, err)
+			continue
+		}
+		if p.Role != d.role {
+			t.Errorf("Query '%s' gave role %v", d.query, p.Role)
+		}
+	}
+}
+
+func TestParams_MaxMsgIsBounded(t *testing.T) {
+	data := []struct {
+		query  string
+		maxMsg int
+	}{
+		{"", 0},
+		{"maxmsg=", 0},
+		{"maxmsg=1", 1},
+		{"maxmsg=1024", 1024},
+		{"maxmsg=" + strconv.Itoa(maxReadLimit), maxReadLimit},
+		{"maxmsg=" + strconv.Itoa(maxReadLimit+1), maxReadLimit},
+		{"maxmsg=99999999999", maxReadLimit},
+	}
+
+	for _, d := range data {
+		p, err := ParseConnectionParams(d.query)
+		if err != nil {
+			t.Errorf("Query '%s' gave error: %s", d.query, err)
+			continue
+		}
+		if p.MaxMsg != d.maxMsg {
+			t.Errorf("Query '%s' gave maxmsg %d", d.query, p.MaxMsg)
+		}
+	}
+}
+
+func TestParams_MaxClientsIsInRange(t *testing.T) {
+	data := []struct {
+		query      string
+		maxClients int
+	}{
+		{"", 0},
+		{"maxclients=", 0},
+		{"maxclients=1", 1},
+		{"maxclients=4", 4},
+		{"maxclients=" + strconv.Itoa(MaxClients), MaxClients},
+	}
+
+	for _, d := range data {
+		p, err := ParseConnectionParams(d.query)
+		if err != nil {
+			t.Errorf("Query '%s' gave error: %s", d.query, err)
+			continue
+		}
+		if p.MaxClients != d.maxClients {
+			t.Errorf("Query '%s' gave maxclients %d", d.query, p.MaxClients)
+		}
+	}
+}
+
+func TestParams_HistoryIsInRange(t *testing.T) {
+	data := []struct {
+		query   string
+		history int
+	}{
+		{"", 0},
+		{"history=", 0},
+		{"history=0", 0},
+		{"history=20", 20},
+		{"history=" + strconv.Itoa(maxHistory), maxHistory},
+	}
+
+	for _, d := range data {
+		p, err := ParseConnectionParams(d.query)
+		if err != nil {
+			t.Errorf("Query '%s' gave error: %s", d.query, err)
+			continue
+		}
+		if p.History != d.history || p.FullHistory {
+			t.Errorf("Query '%s' gave history %d, full %v",
+				d.query, p.History, p.FullHistory)
+		}
+	}
+
+	p, err := ParseConnectionParams("history=all")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.FullHistory || p.History != 0 {
+		t.Errorf("history=all gave history %d, full %v",
+			p.History, p.FullHistory)
+	}
+}
+
+func FuzzParseConnectionParams(f *testing.F) {
+	f.Add("")
+	f.Add("id=abc&lastnum=3&version=1")
+	f.Add("lastnum=" + strconv.Itoa(math.MaxInt))
+	f.Add("id=%zz")
+
+	f.Fuzz(func(t *testing.T, query string) {
+		p, err := ParseConnectionParams(query)
+		p2, err2 := ParseConnectionParams(query)
+
+		// Invalid queries should always be invalid, and the same way
+		if (err == nil) != (err2 == nil) {
+			t.Fatalf("Query %q gave errors %v then %v", query, err, err2)
+		}
+		if err != nil {
+			if err.Error() != err2.Error() {
+				t.Errorf("Query %q gave errors %v then %v", query, err, err2)
+			}
+			return
+		}
+		if p.LastNum != p2.LastNum || p.Version != p2.Version {
+			t.Errorf("Query %q gave %#v then %#v", query, p, p2)
+		}
+
+		// Valid queries should give usable values
+		if p.ID == "" {
+			t.Errorf("Query %q gave no ID", query)
+		}
+		if p.LastNum < -1 || p.LastNum == math.MaxInt {
+			t.Errorf("Query %q gave lastnum %d", query, p.LastNum)
+		}
+		if p.Version < -1 {
+			t.Errorf("Query %q gave version %d", query, p.Version)
+		}
+		if p.MaxMsg < 0 || p.MaxMsg > maxReadLimit {
+			t.Errorf("Query %q gave maxmsg %d", query, p.MaxMsg)
+		}
+		if p.MaxClients < 0 || p.MaxClients > MaxClients {
+			t.Errorf("Query %q gave maxclients %d", query, p.MaxClients)
+		}
+
+		// Any ID given should be the one we use, and nothing bigger
+		v, _ := url.ParseQuery(query)
+		if id := v.Get("id"); id != "" && (p.ID != id || len(id) > len(query)) {
+			t.Errorf("Query %q gave ID %q", query, p.ID)
+		}
+	})
+}
@@ -0,0 +1,196 @@
+// Copyright 2020 Nik Silver
+//
+// Licensed under the GPL v3.0. See file LICENCE.txt for details.
+
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+)
+
+// Directory to keep each room's buffer in, so clients can carry on
+// after the server restarts. If empty, buffers are only kept in memory.
+var persistDir = ""
+
+// How many changes to a buffer can wait to be written before we start
+// losing them
+var persistQueue = 1024
+
+// store writes the changes to a room's buffer to an append-only file,
+// one JSON record per line, so the buffer can be restored when the
+// room is next needed. Writing is done by its own goroutine, so a hub
+// never waits for the disk. If the file falls too far behind, changes
+// are lost, but a restored buffer only ever carries on after a gap.
+type store struct {
+	room string
+	path string
+	recs chan *storeRecord
+	keep bool // If the file should be kept once it's closed
+}
+
+// storeRecord is one change to a buffer: an envelope added for a
+// client ID, counting as sent at the given time, or, if there's no
+// envelope, all the entries for the client ID removed.
+type storeRecord struct {
+	ID  string
+	At  int64     `json:",omitempty"`
+	Env *Envelope `json:",omitempty"`
+}
+
+// storePath gives the file a room's buffer is kept in.
+func storePath(room string) string {
+	name := base64.RawURLEncoding.EncodeToString([]byte(room))
+	return filepath.Join(persistDir, name+".jsonl")
+}
+
+// openStore restores any buffer kept for the given room into b, then
+// has b write its changes out from now on. It does nothing if we're
+// not keeping buffers. Only what's still within the buffer's window is
+// restored, and the file is rewritten with just that.
+func openStore(room string, b *Buffer) {
+	if persistDir == "" {
+		return
+	}
+	fLog := aLog.New("fn", "openStore", "room", room)
+	path := storePath(room)
+
+	if f, err := os.Open(path); err == nil {
+		count := 0
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), maxBufferedBytes+64*1024)
+		for scanner.Scan() {
+			rec := &storeRecord{}
+			if err := json.Unmarshal(scanner.Bytes(), rec); err != nil {
+				fLog.Warn("Skipping bad record", "error", err)
+				continue
+			}
+			if rec.Env == nil {
+				b.Remove(rec.ID)
+			} else {
+				b.restore(rec.ID, rec.Env, rec.At)
+				count++
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			fLog.Warn("Couldn't read all of buffer", "error", err)
+		}
+		f.Close()
+		b.Clean()
+		fLog.Info("Restored buffer", "records", count)
+	}
+
+	if err := os.MkdirAll(persistDir, 0700); err != nil {
+		fLog.Warn("Can't keep buffer", "error", err)
+		return
+	}
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		fLog.Warn("Can't keep buffer", "error", err)
+		return
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for id, es := range b.buf {
+		first := b.first(id)
+		for i, e := range es {
+			if e.env != nil {
+				env := *e.env
+				env.Num = first + i
+				enc.Encode(&storeRecord{ID: id, At: e.at, Env: &env})
+			}
+		}
+	}
+	err = w.Flush()
+	if err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		fLog.Warn("Can't keep buffer", "error", err)
+		os.Remove(tmp)
+		return
+	}
+
+	st := &store{
+		room: room,
+		path: path,
+		recs: make(chan *storeRecord, persistQueue),
+	}
+	WG.Add(1)
+	go st.write()
+	b.store = st
+}
+
+// add says an envelope has been added for a client ID, counting as
+// sent at the given time. It never waits. The envelope's copied, as
+// the hub may still change it.
+func (st *store) add(id string, env *Envelope, at int64) {
+	e := *env
+	st.put(&storeRecord{ID: id, At: at, Env: &e})
+}
+
+// remove says all the entries for a client ID have been removed. It
+// never waits.
+func (st *store) remove(id string) {
+	st.put(&storeRecord{ID: id})
+}
+
+// put a record in line to be written, unless too many are waiting.
+func (st *store) put(rec *storeRecord) {
+	select {
+	case st.recs <- rec:
+	default:
+		aLog.Warn("Buffer file falling behind, losing a change",
+			"fn", "store.put", "room", st.room, "id", rec.ID)
+	}
+}
+
+// close stops the writing, and says if the file should be kept for
+// when the room's next needed.
+func (st *store) close(keep bool) {
+	st.keep = keep
+	close(st.recs)
+}
+
+// write is a goroutine that appends records to the file until the
+// store's closed.
+func (st *store) write() {
+	fLog := aLog.New("fn", "store.write", "room", st.room)
+	defer WG.Done()
+
+	flags := os.O_APPEND | os.O_CREATE | os.O_WRONLY
+	f, err := os.OpenFile(st.path, flags, 0600)
+	if err != nil {
+		fLog.Warn("Can't keep buffer", "error", err)
+		for range st.recs {
+		}
+		return
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	failed := false
+	for rec := range st.recs {
+		if err := enc.Encode(rec); err != nil && !failed {
+			fLog.Warn("Can't write to buffer file", "error", err)
+			failed = true
+		}
+		if len(st.recs) == 0 {
+			w.Flush()
+		}
+	}
+	w.Flush()
+	f.Close()
+
+	if !st.keep {
+		os.Remove(st.path)
+	}
+}
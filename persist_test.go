@@ -0,0 +1,180 @@
+// Copyright 2020 Nik Silver
+//
+// Licensed under the GPL v3.0. See file LICENCE.txt for details.
+
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestPersist_BufferIsRestored(t *testing.T) {
+	oldPersistDir := persistDir
+	persistDir = t.TempDir()
+	defer func() {
+		persistDir = oldPersistDir
+	}()
+
+	// Changes to a buffer are written out, and kept when we say
+
+	now := nowMs()
+	b := NewBufferFor(time.Hour)
+	openStore("/persist.room", b)
+	for i := 0; i < 3; i++ {
+		b.Add("A", &Envelope{Intent: "Peer", Body: []byte(`"a"`), Time: now})
+	}
+	b.Add("B", &Envelope{Intent: "Peer", Time: now})
+	b.Remove("B")
+	b.Add("B", &Envelope{Intent: "Peer", Time: now})
+	b.Add("C", &Envelope{Intent: "Peer", Time: now - 2*time.Hour.Milliseconds()})
+	b.Add("C", &Envelope{Intent: "Peer", Time: now})
+	b.Keep()
+	b.Close()
+	WG.Wait()
+
+	// A new buffer for the room carries on, except from anything that's
+	// too old
+
+	b2 := NewBufferFor(time.Hour)
+	openStore("/persist.room", b2)
+	for _, d := range []struct {
+		id     string
+		next   int
+		oldest int
+	}{
+		{"A", 3, 0},
+		{"B", 1, 0},
+		{"C", 2, 1},
+	} {
+		if b2.Next(d.id) != d.next || b2.Oldest(d.id) != d.oldest {
+			t.Errorf("%s restored with next %d, oldest %d, expected %d, %d",
+				d.id, b2.Next(d.id), b2.Oldest(d.id), d.next, d.oldest)
+		}
+	}
+	q := b2.Queue("A", 1)
+	if q.Len() != 2 {
+		t.Fatalf("Restored A has %d envelopes from 1", q.Len())
+	}
+	env, _ := q.Get()
+	if env.Num != 1 || env.Intent != "Peer" || string(env.Body) != `"a"` {
+		t.Errorf("Restored A has first envelope %#v", env)
+	}
+
+	// New envelopes carry on, and once the buffer's finished with
+	// there's nothing left
+
+	if env := b2.Add("A", &Envelope{Time: nowMs()}); env.Num != 3 {
+		t.Errorf("New envelope for A has num %d", env.Num)
+	}
+	b2.Close()
+	WG.Wait()
+	if _, err := os.Stat(storePath("/persist.room")); !os.IsNotExist(err) {
+		t.Errorf("Buffer file still there: %v", err)
+	}
+}
+
+func TestPersist_ClientsCarryOnAfterRestart(t *testing.T) {
+	// Just for this test, keep buffers, lower the reconnection timeout
+	// so that a Leaver message is triggered reasonably quickly, and use
+	// superhubs of our own, as they won't give out any more hubs once
+	// shut down
+	useSuperhub(t, 250*time.Millisecond)
+	oldPersistDir := persistDir
+	persistDir = t.TempDir()
+	defer func() {
+		persistDir = oldPersistDir
+	}()
+
+	serv := newTestServer(bounceHandler)
+	defer serv.Close()
+
+	// Two clients join, and one sends some messages
+
+	room := "/persist.restart"
+	ws1, _, err := dial(serv, room, "PER1", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws1 := newTConn(ws1, "PER1")
+	defer tws1.close()
+	if err := tws1.swallow("Welcome"); err != nil {
+		t.Fatal(err)
+	}
+	ws2, _, err := dial(serv, room, "PER2", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws2 := newTConn(ws2, "PER2")
+	defer tws2.close()
+	if err = swallowMany(
+		intentExp{"PER2 joining, ws2", tws2, "Welcome"},
+		intentExp{"PER2 joining, ws1", tws1, "Joiner"},
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	nums := make([]int, 0)
+	for _, body := range []string{`"one"`, `"two"`, `"three"`} {
+		if err := ws1.WriteMessage(websocket.TextMessage, []byte(body)); err != nil {
+			t.Fatal(err)
+		}
+		if err := tws1.swallow("Peer"); err != nil {
+			t.Fatal(err)
+		}
+		env, err := tws2.readEnvelope(500, "PER2 expecting %s", body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nums = append(nums, env.Num)
+	}
+
+	// The server shuts down and everything finishes
+
+	Shub.Shutdown()
+	for _, tws := range []*tConn{tws1, tws2} {
+		if err := tws.swallow("Closing"); err != nil {
+			t.Fatal(err)
+		}
+		if err := tws.expectClose(websocket.CloseGoingAway, 500); err != nil {
+			t.Error(err)
+		}
+		tws.close()
+	}
+	WG.Wait()
+
+	// After a restart, PER2 can carry on from after the first message,
+	// getting what it missed before its Welcome
+
+	useSuperhub(t, 250*time.Millisecond)
+	ws3, _, err := dial(serv, room, "PER2", nums[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws3 := newTConn(ws3, "PER2")
+	defer tws3.close()
+	for i, body := range []string{`"two"`, `"three"`} {
+		env, err := tws3.readEnvelope(500, "PER2 expecting %s again", body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if env.Intent != "Peer" || env.Num != nums[i+1] ||
+			string(env.Body) != body {
+			t.Errorf("PER2 got unexpected envelope: %#v", env)
+		}
+	}
+	env, err := tws3.readEnvelope(500, "PER2 expecting Welcome")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Intent != "Welcome" || env.Num != nums[2]+1 {
+		t.Errorf("PER2 got unexpected envelope: %#v", env)
+	}
+
+	// Tidy up, and check everything in the main app finishes
+	tws3.close()
+	WG.Wait()
+}
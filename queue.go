@@ -0,0 +1,184 @@
+// Copyright 2020 Nik Silver
+//
+// Licensed under the GPL v3.0. See file LICENCE.txt for details.
+
+package main
+
+import (
+	"fmt"
+)
+
+// Queue holds a queue of envelopes from some num onwards. It may be
+// bounded, in which case adding to a full queue is handled according to
+// a policy. There is also a priority lane, whose envelopes come out
+// before any others.
+type Queue struct {
+	q        []*Envelope // The main queue
+	pri      []*Envelope // The priority lane
+	cap      int         // Maximum length, or 0 if unbounded
+	dropped  int         // Count of envelopes dropped to make room
+	rejected int         // Count of envelopes rejected for lack of room
+}
+
+// What to do when adding to a full queue
+type policy int
+
+// Various policies for a full queue
+const (
+	// Drop the oldest envelope to make room for the new one
+	DROPOLDEST policy = 1
+	// Reject the new envelope
+	REJECT policy = 2
+)
+
+// NewQueue returns a new, empty and unbounded queue.
+func NewQueue() *Queue {
+	return NewBoundedQueue(0)
+}
+
+// NewBoundedQueue returns a new and empty queue which can hold at most
+// cap envelopes. A cap of 0 means it's unbounded.
+func NewBoundedQueue(cap int) *Queue {
+	return &Queue{
+		q:   []*Envelope{},
+		pri: []*Envelope{},
+		cap: cap,
+	}
+}
+
+// Get the first item in the queue, or return an error.
+func (q *Queue) Get() (*Envelope, error) {
+	if len(q.pri) > 0 {
+		e := q.pri[0]
+		q.pri = q.pri[1:]
+		return e, nil
+	}
+	if len(q.q) == 0 {
+		return nil, fmt.Errorf("Queue is empty")
+	}
+	e := q.q[0]
+	q.q = q.q[1:]
+	return e, nil
+}
+
+// Oldest gives the time of the oldest envelope in the queue, in
+// milliseconds since the epoch, or 0 if there's none. Each lane is in
+// order, so only the front of each needs looking at.
+func (q *Queue) Oldest() int64 {
+	oldest := int64(0)
+	for _, lane := range [][]*Envelope{q.pri, q.q} {
+		if len(lane) > 0 && lane[0].Time > 0 &&
+			(oldest == 0 || lane[0].Time < oldest) {
+			oldest = lane[0].Time
+		}
+	}
+	return oldest
+}
+
+// GetBatch gets up to max items from the front of the queue. It returns
+// an empty slice if the queue is empty.
+func (q *Queue) GetBatch(max int) []*Envelope {
+	es := make([]*Envelope, 0, max)
+	for len(es) < max && !q.Empty() {
+		e, _ := q.Get()
+		es = append(es, e)
+	}
+	return es
+}
+
+// Add an envelope to the back of the queue. If the queue is full
+// the oldest envelope is dropped to make room.
+func (q *Queue) Add(e *Envelope) {
+	q.AddWithPolicy(e, DROPOLDEST)
+}
+
+// AddWithPolicy adds an envelope to the back of the queue, using
+// the given policy if the queue is full. Returns an error if the
+// envelope is rejected.
+func (q *Queue) AddWithPolicy(e *Envelope, p policy) error {
+	if q.full() {
+		switch p {
+		case REJECT:
+			q.rejected++
+			aLog.Debug("Rejecting envelope from full queue", "fn", "Queue.Add",
+				"cap", q.cap, "rejected", q.rejected)
+			return fmt.Errorf("Queue is full")
+		case DROPOLDEST:
+			q.dropOldest()
+		}
+	}
+	q.q = append(q.q, e)
+	return nil
+}
+
+// PriorityAdd adds an envelope to the back of the priority lane, so it
+// comes out before anything in the main queue. If the queue is full
+// the oldest envelope in the main queue is dropped to make room,
+// or the oldest in the priority lane if there's nothing else.
+func (q *Queue) PriorityAdd(e *Envelope) {
+	if q.full() {
+		q.dropOldest()
+	}
+	q.pri = append(q.pri, e)
+}
+
+// RemoveFrom removes envelopes from the main queue with nums from num
+// onwards, because they're going to be added again. Envelopes without
+// a num, and those in the priority lane, are left alone.
+func (q *Queue) RemoveFrom(num int) {
+	kept := q.q[:0]
+	for _, e := range q.q {
+		if e.Num < num {
+			kept = append(kept, e)
+		}
+	}
+	q.q = kept
+}
+
+// dropOldest drops the oldest envelope, preferring to keep the priority
+// lane intact.
+func (q *Queue) dropOldest() {
+	switch {
+	case len(q.q) > 0:
+		q.q = q.q[1:]
+	case len(q.pri) > 0:
+		q.pri = q.pri[1:]
+	default:
+		return
+	}
+	q.dropped++
+	aLog.Debug("Dropped oldest envelope from full queue", "fn", "Queue.Add",
+		"cap", q.cap, "dropped", q.dropped)
+}
+
+// full says if the queue is bounded and has no more room.
+func (q *Queue) full() bool {
+	return q.cap > 0 && q.Len() >= q.cap
+}
+
+// Empty tests if the queue is empty
+func (q *Queue) Empty() bool {
+	return q.Len() == 0
+}
+
+// Len gives the number of envelopes in the queue
+func (q *Queue) Len() int {
+	return len(q.pri) + len(q.q)
+}
+
+// Cap gives the maximum number of envelopes the queue can hold,
+// or 0 if it's unbounded.
+func (q *Queue) Cap() int {
+	return q.cap
+}
+
+// Dropped gives the number of envelopes dropped to make room.
+func (q *Queue) Dropped() int {
+	return q.dropped
+}
+
+// Rejected gives the number of envelopes rejected because the queue
+// was full.
+func (q *Queue) Rejected() int {
+	return q.rejected
+}
@@ -0,0 +1,211 @@
+// Copyright 2020 Nik Silver
+//
+// Licensed under the GPL v3.0. See file LICENCE.txt for details.
+
+package main
+
+import (
+	"testing"
+)
+
+// nums gives the nums of the given envelopes
+func nums(es []*Envelope) []int {
+	out := make([]int, len(es))
+	for i, e := range es {
+		out[i] = e.Num
+	}
+	return out
+}
+
+// drain gets all the nums from a queue, in order
+func drain(q *Queue) []int {
+	out := []int{}
+	for !q.Empty() {
+		e, err := q.Get()
+		if err != nil {
+			break
+		}
+		out = append(out, e.Num)
+	}
+	return out
+}
+
+// sameInts says if two int slices are the same, in order
+func sameInts(a []int, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestQueue_UnboundedQueueKeepsEverything(t *testing.T) {
+	q := NewQueue()
+	if q.Cap() != 0 {
+		t.Errorf("Expected cap 0 but got %d", q.Cap())
+	}
+	for i := 0; i < 100; i++ {
+		if err := q.AddWithPolicy(&Envelope{Num: i}, REJECT); err != nil {
+			t.Fatalf("i=%d: Got error adding: %s", i, err)
+		}
+	}
+	if q.Len() != 100 {
+		t.Errorf("Expected length 100 but got %d", q.Len())
+	}
+	got := drain(q)
+	for i := 0; i < 100; i++ {
+		if got[i] != i {
+			t.Fatalf("Expected num %d at position %d, got %d", i, i, got[i])
+		}
+	}
+	if q.Dropped() != 0 || q.Rejected() != 0 {
+		t.Errorf("Expected nothing dropped or rejected, but got %d and %d",
+			q.Dropped(), q.Rejected())
+	}
+}
+
+func TestQueue_GetFromEmptyQueueIsError(t *testing.T) {
+	q := NewQueue()
+	if _, err := q.Get(); err == nil {
+		t.Errorf("Expected error getting from empty queue")
+	}
+	if es := q.GetBatch(5); len(es) != 0 {
+		t.Errorf("Expected empty batch from empty queue, got %v", nums(es))
+	}
+}
+
+func TestQueue_DropOldestPolicyDropsOldest(t *testing.T) {
+	q := NewBoundedQueue(3)
+	if q.Cap() != 3 {
+		t.Errorf("Expected cap 3 but got %d", q.Cap())
+	}
+	for i := 0; i < 5; i++ {
+		if err := q.AddWithPolicy(&Envelope{Num: i}, DROPOLDEST); err != nil {
+			t.Fatalf("i=%d: Got error adding: %s", i, err)
+		}
+	}
+	if q.Len() != 3 {
+		t.Errorf("Expected length 3 but got %d", q.Len())
+	}
+	if q.Dropped() != 2 {
+		t.Errorf("Expected 2 dropped but got %d", q.Dropped())
+	}
+	if got := drain(q); !sameInts(got, []int{2, 3, 4}) {
+		t.Errorf("Expected nums [2 3 4] but got %v", got)
+	}
+}
+
+func TestQueue_RejectPolicyRejectsNewest(t *testing.T) {
+	q := NewBoundedQueue(3)
+	for i := 0; i < 5; i++ {
+		err := q.AddWithPolicy(&Envelope{Num: i}, REJECT)
+		if i < 3 && err != nil {
+			t.Errorf("i=%d: Got error adding: %s", i, err)
+		}
+		if i >= 3 && err == nil {
+			t.Errorf("i=%d: Expected error adding to full queue", i)
+		}
+	}
+	if q.Rejected() != 2 {
+		t.Errorf("Expected 2 rejected but got %d", q.Rejected())
+	}
+	if q.Dropped() != 0 {
+		t.Errorf("Expected 0 dropped but got %d", q.Dropped())
+	}
+	if got := drain(q); !sameInts(got, []int{0, 1, 2}) {
+		t.Errorf("Expected nums [0 1 2] but got %v", got)
+	}
+}
+
+func TestQueue_PriorityLaneComesFirst(t *testing.T) {
+	q := NewQueue()
+	q.Add(&Envelope{Num: 0})
+	q.Add(&Envelope{Num: 1})
+	q.PriorityAdd(&Envelope{Num: 100})
+	q.Add(&Envelope{Num: 2})
+	q.PriorityAdd(&Envelope{Num: 101})
+
+	if q.Len() != 5 {
+		t.Errorf("Expected length 5 but got %d", q.Len())
+	}
+	if got := drain(q); !sameInts(got, []int{100, 101, 0, 1, 2}) {
+		t.Errorf("Expected nums [100 101 0 1 2] but got %v", got)
+	}
+}
+
+func TestQueue_PriorityAddToFullQueueDropsFromMainQueue(t *testing.T) {
+	q := NewBoundedQueue(3)
+	q.Add(&Envelope{Num: 0})
+	q.Add(&Envelope{Num: 1})
+	q.PriorityAdd(&Envelope{Num: 100})
+	q.PriorityAdd(&Envelope{Num: 101})
+	q.PriorityAdd(&Envelope{Num: 102})
+	q.PriorityAdd(&Envelope{Num: 103})
+
+	if q.Dropped() != 3 {
+		t.Errorf("Expected 3 dropped but got %d", q.Dropped())
+	}
+	if got := drain(q); !sameInts(got, []int{101, 102, 103}) {
+		t.Errorf("Expected nums [101 102 103] but got %v", got)
+	}
+}
+
+func TestQueue_OldestLooksAtBothLanes(t *testing.T) {
+	q := NewQueue()
+	if q.Oldest() != 0 {
+		t.Errorf("Empty queue gave oldest %d", q.Oldest())
+	}
+	q.Add(&Envelope{Num: 1, Time: 2000})
+	q.Add(&Envelope{Num: 2, Time: 3000})
+	if q.Oldest() != 2000 {
+		t.Errorf("Expected oldest 2000 but got %d", q.Oldest())
+	}
+	q.PriorityAdd(&Envelope{Num: 0, Time: 1000})
+	if q.Oldest() != 1000 {
+		t.Errorf("Expected oldest 1000 but got %d", q.Oldest())
+	}
+	q.GetBatch(2)
+	if q.Oldest() != 3000 {
+		t.Errorf("Expected oldest 3000 but got %d", q.Oldest())
+	}
+}
+
+func TestQueue_GetBatchGetsUpToMax(t *testing.T) {
+	q := NewQueue()
+	q.PriorityAdd(&Envelope{Num: 100})
+	for i := 0; i < 5; i++ {
+		q.Add(&Envelope{Num: i})
+	}
+
+	if got := nums(q.GetBatch(4)); !sameInts(got, []int{100, 0, 1, 2}) {
+		t.Errorf("First batch expected [100 0 1 2] but got %v", got)
+	}
+	if q.Len() != 2 {
+		t.Errorf("Expected length 2 but got %d", q.Len())
+	}
+	if got := nums(q.GetBatch(4)); !sameInts(got, []int{3, 4}) {
+		t.Errorf("Second batch expected [3 4] but got %v", got)
+	}
+	if !q.Empty() {
+		t.Errorf("Expected queue to be empty")
+	}
+}
+
+func TestQueue_RemoveFromKeepsEarlierAndUnnumbered(t *testing.T) {
+	q := NewQueue()
+	q.PriorityAdd(&Envelope{Num: 4})
+	q.Add(&Envelope{Num: 2})
+	q.Add(&Envelope{Num: 3})
+	q.Add(&Envelope{Num: -1})
+	q.Add(&Envelope{Num: 4})
+	q.Add(&Envelope{Num: 5})
+
+	q.RemoveFrom(3)
+	if got := drain(q); !sameInts(got, []int{4, 2, -1}) {
+		t.Errorf("Expected nums [4 2 -1] but got %v", got)
+	}
+}
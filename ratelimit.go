@@ -0,0 +1,48 @@
+// Copyright 2020 Nik Silver
+//
+// Licensed under the GPL v3.0. See file LICENCE.txt for details.
+
+package main
+
+import (
+	"time"
+)
+
+// bucket is a token bucket for limiting how fast messages come. It
+// fills at some rate, up to some burst, and each message takes a token.
+// It starts full.
+type bucket struct {
+	tokens float64
+	last   time.Time // When it was last filled
+}
+
+// fill tops up the bucket for the time since it was last filled.
+func (b *bucket) fill(rate float64, burst float64, now time.Time) {
+	if b.last.IsZero() {
+		b.tokens = burst
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * rate
+		if b.tokens > burst {
+			b.tokens = burst
+		}
+	}
+	b.last = now
+}
+
+// take uses up a token if there is one, and says if there was.
+func (b *bucket) take(rate float64, burst float64) bool {
+	b.fill(rate, burst, time.Now())
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// wait says how long until the bucket will have a token.
+func (b *bucket) wait(rate float64) time.Duration {
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / rate * float64(time.Second))
+}
@@ -0,0 +1,317 @@
+// Copyright 2020 Nik Silver
+//
+// Licensed under the GPL v3.0. See file LICENCE.txt for details.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Redis to keep buffers in, so a client can reconnect to any server
+// sharing it. If nil, buffers are kept in memory.
+var redisClient *redis.Client
+
+// What all our Redis keys start with
+var redisPrefix = "bgf:buf:"
+
+// How long to wait for Redis before giving up
+var redisTimeout = time.Second
+
+// Least time between cleaning a buffer in Redis, as it means a trip
+// there for every client
+var redisCleanFreq = time.Second
+
+// redisBuffer is a BufferStore kept in Redis. Each client ID in a room
+// has four keys: the next num, the lowest num it can continue from,
+// its envelopes sorted by num, and their nums sorted by the time they
+// count as sent. Each change is a script, so it's atomic, and all the
+// keys expire together once they're too old for a reconnection to
+// need them. If Redis fails we log it, and carry on as if the
+// envelopes were gone; an envelope that can't be added is unnumbered.
+type redisBuffer struct {
+	room    string
+	window  time.Duration
+	ids     map[string]bool // Client IDs we've added envelopes for
+	cleaned time.Time       // When we last cleaned
+}
+
+// redisRecord is how an envelope is kept in Redis, preceded by its
+// num and a space.
+type redisRecord struct {
+	At  int64
+	Env *Envelope
+}
+
+// newRedisBuffer creates a buffer in Redis for the given room, for
+// clients who have the given time to reconnect.
+func newRedisBuffer(room string, window time.Duration) *redisBuffer {
+	return &redisBuffer{
+		room:   room,
+		window: window,
+		ids:    make(map[string]bool),
+	}
+}
+
+// keys gives the four keys for some client ID: next num, lowest num,
+// envelopes and times.
+func (rb *redisBuffer) keys(id string) []string {
+	base := redisPrefix + rb.room + ":" + id + ":"
+	return []string{base + "next", base + "floor", base + "envs", base + "ats"}
+}
+
+// ttl is how long in milliseconds a client ID's keys last after it's
+// last given an envelope.
+func (rb *redisBuffer) ttl() int64 {
+	return (rb.window * 11 / 10).Milliseconds() + 1
+}
+
+// failed logs an error from Redis.
+func (rb *redisBuffer) failed(fn string, id string, err error) {
+	aLog.Warn("Redis error", "fn", fn, "room", rb.room, "id", id,
+		"error", err)
+}
+
+// redisAdd numbers and adds an envelope, trims the oldest if there
+// are too many, refreshes the expiry and gives the num.
+var redisAdd = redis.NewScript(`
+local num = redis.call('INCR', KEYS[1]) - 1
+redis.call('ZADD', KEYS[3], num, num .. ' ' .. ARGV[1])
+redis.call('ZADD', KEYS[4], ARGV[2], num)
+local over = redis.call('ZCARD', KEYS[3]) - tonumber(ARGV[3])
+if over > 0 then
+	local gone = redis.call('ZRANGE', KEYS[3], 0, over - 1, 'WITHSCORES')
+	for i = 2, #gone, 2 do
+		redis.call('ZREM', KEYS[4], gone[i])
+	end
+	redis.call('ZREMRANGEBYRANK', KEYS[3], 0, over - 1)
+	redis.call('SET', KEYS[2], tonumber(gone[#gone]) + 1)
+end
+for i = 1, 4 do
+	redis.call('PEXPIRE', KEYS[i], ARGV[4])
+end
+return num
+`)
+
+// redisClean drops envelopes counting as sent before the given time,
+// and any before them, so nothing can continue from before what's
+// left.
+var redisClean = redis.NewScript(`
+local old = redis.call('ZRANGEBYSCORE', KEYS[4], '-inf', '(' .. ARGV[1])
+if #old == 0 then
+	return 0
+end
+local top = -1
+for _, n in ipairs(old) do
+	top = math.max(top, tonumber(n))
+end
+local gone = redis.call('ZRANGEBYSCORE', KEYS[3], '-inf', top, 'WITHSCORES')
+for i = 2, #gone, 2 do
+	redis.call('ZREM', KEYS[4], gone[i])
+end
+redis.call('ZREMRANGEBYSCORE', KEYS[3], '-inf', top)
+local floor = tonumber(redis.call('GET', KEYS[2]) or '0')
+if top + 1 > floor then
+	redis.call('SET', KEYS[2], top + 1)
+	local ttl = redis.call('PTTL', KEYS[1])
+	if ttl > 0 then
+		redis.call('PEXPIRE', KEYS[2], ttl)
+	end
+end
+return #gone / 2
+`)
+
+// redisResent has envelopes from a given num count as sent no earlier
+// than the given time.
+var redisResent = redis.NewScript(`
+local ms = redis.call('ZRANGEBYSCORE', KEYS[3], ARGV[1], '+inf', 'WITHSCORES')
+for i = 2, #ms, 2 do
+	local at = redis.call('ZSCORE', KEYS[4], ms[i])
+	if at and tonumber(at) < tonumber(ARGV[2]) then
+		redis.call('ZADD', KEYS[4], ARGV[2], ms[i])
+	end
+end
+return 0
+`)
+
+// Add an envelope for a given client, numbered next in that client's
+// sequence, and return the numbered copy.
+func (rb *redisBuffer) Add(id string, e *Envelope) *Envelope {
+	return rb.AddAt(id, e, e.Time)
+}
+
+// AddAt is like Add, but the envelope counts as sent at the given
+// time, in milliseconds since the epoch, rather than its own time.
+func (rb *redisBuffer) AddAt(id string, e *Envelope, at int64) *Envelope {
+	eNum := *e
+	eNum.Num = -1
+	payload, err := json.Marshal(&redisRecord{At: at, Env: &eNum})
+	if err != nil {
+		rb.failed("redisBuffer.AddAt", id, err)
+		return &eNum
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	num, err := redisAdd.Run(ctx, redisClient, rb.keys(id),
+		string(payload), at, maxBuffered, rb.ttl()).Int()
+	if err != nil {
+		rb.failed("redisBuffer.AddAt", id, err)
+		return &eNum
+	}
+	rb.ids[id] = true
+	eNum.Num = num
+	return &eNum
+}
+
+// Resent says the envelopes for some client ID from the given num
+// onwards count as sent at the given time, in milliseconds since the
+// epoch, so they're not cleaned away too soon.
+func (rb *redisBuffer) Resent(id string, num int, at int64) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	err := redisResent.Run(ctx, redisClient, rb.keys(id), num, at).Err()
+	if err != nil {
+		rb.failed("redisBuffer.Resent", id, err)
+	}
+}
+
+// Next gives the num the next envelope for some client ID will have.
+func (rb *redisBuffer) Next(id string) int {
+	return rb.get(id, 0)
+}
+
+// Oldest gives the lowest num some client ID can continue from.
+func (rb *redisBuffer) Oldest(id string) int {
+	return rb.get(id, 1)
+}
+
+// get the number in one of the keys for some client ID, or 0 if it's
+// not there.
+func (rb *redisBuffer) get(id string, key int) int {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	n, err := redisClient.Get(ctx, rb.keys(id)[key]).Int()
+	if err != nil && err != redis.Nil {
+		rb.failed("redisBuffer.get", id, err)
+	}
+	return n
+}
+
+// Available says if a client can continue from a specific num.
+func (rb *redisBuffer) Available(id string, num int) bool {
+	return rb.Oldest(id) <= num && num < rb.Next(id)
+}
+
+// Clean the buffer of all envelopes older than the time clients have
+// to reconnect (plus a bit for safety). Expired envelopes are just left
+// out of queues. It's only done every so often.
+func (rb *redisBuffer) Clean() {
+	if len(rb.ids) == 0 || time.Since(rb.cleaned) < redisCleanFreq {
+		return
+	}
+	rb.cleaned = time.Now()
+	keepMs := time.Now().Add(rb.window*-11/10).UnixNano() / 1000000
+
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	pipe := redisClient.Pipeline()
+	for id := range rb.ids {
+		redisClean.Eval(ctx, pipe, rb.keys(id), keepMs)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		rb.failed("redisBuffer.Clean", "", err)
+	}
+}
+
+// Queue extracts a queue from a given num onwards, for some client ID,
+// leaving out any envelopes that have expired.
+func (rb *redisBuffer) Queue(id string, num int) *Queue {
+	q := NewQueue()
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	members, err := redisClient.ZRangeByScore(ctx, rb.keys(id)[2],
+		&redis.ZRangeBy{Min: strconv.Itoa(num), Max: "+inf"}).Result()
+	if err != nil {
+		rb.failed("redisBuffer.Queue", id, err)
+		return q
+	}
+
+	now := nowMs()
+	for _, m := range members {
+		numStr, payload, _ := strings.Cut(m, " ")
+		n, err := strconv.Atoi(numStr)
+		rec := &redisRecord{}
+		if err == nil {
+			err = json.Unmarshal([]byte(payload), rec)
+		}
+		if err != nil || rec.Env == nil {
+			rb.failed("redisBuffer.Queue", id, err)
+			continue
+		}
+		rec.Env.Num = n
+		if !rec.Env.expired(now) {
+			q.Add(rec.Env)
+		}
+	}
+	return q
+}
+
+// Remove all the entries of a given client ID, and start its nums again.
+func (rb *redisBuffer) Remove(id string) {
+	delete(rb.ids, id)
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	if err := redisClient.Del(ctx, rb.keys(id)...).Err(); err != nil {
+		rb.failed("redisBuffer.Remove", id, err)
+	}
+}
+
+// Stats says what's in the buffer for the clients we know of here.
+// Each client has its own copy of an envelope in Redis, and their bytes
+// aren't counted.
+func (rb *redisBuffer) Stats() BufferStats {
+	st := BufferStats{}
+	if len(rb.ids) == 0 {
+		return st
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	pipe := redisClient.Pipeline()
+	counts := make([]*redis.IntCmd, 0, len(rb.ids))
+	oldest := make([]*redis.ZSliceCmd, 0, len(rb.ids))
+	for id := range rb.ids {
+		keys := rb.keys(id)
+		counts = append(counts, pipe.ZCard(ctx, keys[2]))
+		oldest = append(oldest, pipe.ZRangeWithScores(ctx, keys[3], 0, 0))
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		rb.failed("redisBuffer.Stats", "", err)
+		return st
+	}
+	for i := range counts {
+		st.Envelopes += int(counts[i].Val())
+		for _, z := range oldest[i].Val() {
+			if at := int64(z.Score); st.OldestAt == 0 || at < st.OldestAt {
+				st.OldestAt = at
+			}
+		}
+	}
+	return st
+}
+
+// Keep does nothing, as Redis keeps everything anyway.
+func (rb *redisBuffer) Keep() {
+}
+
+// Close forgets about the buffer here, but leaves it in Redis until it
+// expires, in case a client reconnects to another server.
+func (rb *redisBuffer) Close() {
+	rb.ids = make(map[string]bool)
+}
@@ -0,0 +1,196 @@
+// Copyright 2020 Nik Silver
+//
+// Licensed under the GPL v3.0. See file LICENCE.txt for details.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gorilla/websocket"
+	"github.com/redis/go-redis/v9"
+)
+
+// useRedis has buffers kept in a fresh Redis for the rest of a test.
+func useRedis(t *testing.T) {
+	mr := miniredis.RunT(t)
+	oldRedisClient := redisClient
+	redisClient = redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() {
+		redisClient.Close()
+		redisClient = oldRedisClient
+	})
+}
+
+func TestRedisBuffer_NumsCarryOnAndOldOnesGo(t *testing.T) {
+	useRedis(t)
+	oldMaxBuffered := maxBuffered
+	oldRedisCleanFreq := redisCleanFreq
+	maxBuffered = 5
+	redisCleanFreq = 0
+	defer func() {
+		maxBuffered = oldMaxBuffered
+		redisCleanFreq = oldRedisCleanFreq
+	}()
+
+	// Each client ID has its own nums, and they're shared by every
+	// buffer for the room
+
+	now := nowMs()
+	b := newRedisBuffer("/redis.room", time.Minute)
+	for i := 0; i < 3; i++ {
+		if env := b.Add("A", &Envelope{Intent: "Peer", Time: now}); env.Num != i {
+			t.Errorf("A's envelope %d has num %d", i, env.Num)
+		}
+	}
+	if env := b.Add("B", &Envelope{Intent: "Peer", Time: now}); env.Num != 0 {
+		t.Errorf("B's first envelope has num %d", env.Num)
+	}
+	b2 := newRedisBuffer("/redis.room", time.Minute)
+	if next := b2.Next("A"); next != 3 {
+		t.Errorf("Other buffer says A's next is %d", next)
+	}
+	if env := b2.Add("A", &Envelope{Intent: "Peer", Body: []byte(`"x"`),
+		Time: now}); env.Num != 3 {
+		t.Errorf("Other buffer gave A num %d", env.Num)
+	}
+	if !b.Available("A", 1) || b.Available("A", 4) {
+		t.Errorf("A has wrong envelopes available")
+	}
+	q := b.Queue("A", 2)
+	if q.Len() != 2 {
+		t.Fatalf("A's queue from 2 has %d envelopes", q.Len())
+	}
+	q.Get()
+	env, _ := q.Get()
+	if env.Num != 3 || env.Intent != "Peer" || string(env.Body) != `"x"` {
+		t.Errorf("A's last envelope is %#v", env)
+	}
+
+	// Too many, and the oldest go
+
+	for i := 0; i < 3; i++ {
+		b.Add("A", &Envelope{Time: now})
+	}
+	if oldest := b.Oldest("A"); oldest != 2 {
+		t.Errorf("A's oldest is %d, expected 2", oldest)
+	}
+	if b.Available("A", 1) || !b.Available("A", 2) {
+		t.Errorf("A has wrong envelopes available after trimming")
+	}
+
+	// Too old, and they go, or they're kept if they're resent
+
+	b.Add("C", &Envelope{Time: now - time.Hour.Milliseconds()})
+	b.Add("C", &Envelope{Time: now - time.Hour.Milliseconds()})
+	b.Add("C", &Envelope{Time: now})
+	b.Add("D", &Envelope{Time: now - time.Hour.Milliseconds()})
+	b.Resent("D", 0, now)
+	b.Clean()
+	if oldest := b.Oldest("C"); oldest != 2 {
+		t.Errorf("C's oldest is %d, expected 2", oldest)
+	}
+	if !b.Available("D", 0) {
+		t.Errorf("D's resent envelope has gone")
+	}
+
+	// It says what it has
+
+	if st := b.Stats(); st.Envelopes != 8 || st.OldestAt != now {
+		t.Errorf("Buffer has stats %#v", st)
+	}
+
+	// Removing a client ID starts it again
+
+	b.Remove("A")
+	if next := b2.Next("A"); next != 0 {
+		t.Errorf("A's next is %d after removing", next)
+	}
+}
+
+func TestRedisBuffer_ClientCanReconnectToAnotherServer(t *testing.T) {
+	// Just for this test, keep buffers in Redis, lower the
+	// reconnection timeout so that a Leaver message is triggered
+	// reasonably quickly, and use superhubs of our own, so the second
+	// is like another server
+	useRedis(t)
+	useSuperhub(t, 250*time.Millisecond)
+
+	serv := newTestServer(bounceHandler)
+	defer serv.Close()
+
+	// Two clients join, and one sends some messages
+
+	room := "/redis.reconnect"
+	ws1, _, err := dial(serv, room, "RED1", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws1 := newTConn(ws1, "RED1")
+	defer tws1.close()
+	if err := tws1.swallow("Welcome"); err != nil {
+		t.Fatal(err)
+	}
+	ws2, _, err := dial(serv, room, "RED2", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws2 := newTConn(ws2, "RED2")
+	defer tws2.close()
+	if err = swallowMany(
+		intentExp{"RED2 joining, ws2", tws2, "Welcome"},
+		intentExp{"RED2 joining, ws1", tws1, "Joiner"},
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	nums := make([]int, 0)
+	for _, body := range []string{`"one"`, `"two"`} {
+		if err := ws1.WriteMessage(websocket.TextMessage, []byte(body)); err != nil {
+			t.Fatal(err)
+		}
+		if err := tws1.swallow("Peer"); err != nil {
+			t.Fatal(err)
+		}
+		env, err := tws2.readEnvelope(500, "RED2 expecting %s", body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nums = append(nums, env.Num)
+	}
+
+	// RED2 reconnects to another server, carrying on from after the
+	// first message, and gets what it missed before its Welcome. The
+	// first server's still running, so we don't wait for it.
+
+	Shub = NewSuperhubWith(SuperhubConfig{Reconnection: 250 * time.Millisecond})
+	ws3, _, err := dial(serv, room, "RED2", nums[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws3 := newTConn(ws3, "RED2")
+	defer tws3.close()
+	env, err := tws3.readEnvelope(500, "RED2 expecting message again")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Intent != "Peer" || env.Num != nums[1] ||
+		string(env.Body) != `"two"` {
+		t.Errorf("RED2 got unexpected envelope: %#v", env)
+	}
+	env, err = tws3.readEnvelope(500, "RED2 expecting Welcome")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Intent != "Welcome" || env.Num != nums[1]+1 {
+		t.Errorf("RED2 got unexpected envelope: %#v", env)
+	}
+
+	// Tidy up, and check everything in the main app finishes
+	tws1.close()
+	tws2.close()
+	tws3.close()
+	WG.Wait()
+}
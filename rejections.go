@@ -0,0 +1,149 @@
+// Copyright 2020 Nik Silver
+//
+// Licensed under the GPL v3.0. See file LICENCE.txt for details.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Global counts of why clients have been refused a connection
+var Rejections = NewRejectionCounter()
+
+// Reasons for rejecting a client
+const (
+	REJECTBADPARAMS   = "bad params"
+	REJECTBADVERSION  = "unsupported version"
+	REJECTROOMFULL    = "room full"
+	REJECTSUBPROTOCOL = "unsupported subprotocol"
+	REJECTPASSWORD    = "wrong password"
+	REJECTBADLINK     = "bad spectator link"
+	REJECTSHUTDOWN    = "shutting down"
+	REJECTSERVERFULL  = "server full"
+	REJECTJOINTOKEN   = "bad join token"
+	REJECTAUTH        = "not authorised"
+	REJECTORIGIN      = "origin not allowed"
+)
+
+// rejection is what a client gets back when it's refused a connection.
+type rejection struct {
+	Error     string   // What went wrong
+	Reason    string   // Why the client was rejected, for counting
+	Supported []string `json:",omitempty"` // Subprotocols we can speak
+}
+
+// reject refuses a client a connection, counting the reason and telling
+// the client why. Every rejection should come through here.
+func reject(w http.ResponseWriter, r *http.Request, status int, rej *rejection) {
+	Rejections.Add(rej.Reason)
+	Counters.rejected(rej.Reason)
+	aLog.Warn("Rejected client", "path", r.URL.Path,
+		"reason", rej.Reason, "error", rej.Error)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(rej)
+}
+
+// rejectConnected refuses a client that already has a websocket, counting
+// the reason and closing the websocket with the given code. Every
+// rejection after the upgrade should come through here.
+func rejectConnected(c *Client, code int, rej *rejection) {
+	Rejections.Add(rej.Reason)
+	Counters.rejected(rej.Reason)
+	aLog.Warn("Rejected client", "id", c.ID, "c", c.Ref,
+		"reason", rej.Reason, "error", rej.Error)
+	c.closeWith(rej.Error, code)
+}
+
+// rejectUpgraded refuses a client by upgrading its connection to a
+// websocket and closing that with the given code, counting the reason.
+// It's for when a client should be able to see why it's been refused,
+// which a browser can't if it's refused before the upgrade.
+func rejectUpgraded(w http.ResponseWriter, r *http.Request, code int, rej *rejection) {
+	Rejections.Add(rej.Reason)
+	Counters.rejected(rej.Reason)
+	aLog.Warn("Rejected client", "path", r.URL.Path,
+		"reason", rej.Reason, "error", rej.Error)
+	ws, err := upgrader.Upgrade(w, r, make(http.Header))
+	if err != nil {
+		aLog.Warn("Upgrade error", "error", err)
+		return
+	}
+	closeWebsocket(ws, rej.Error, code)
+}
+
+// How many minutes of rejections we count
+const rejectionMinutes = 60
+
+// RejectionCounter keeps rolling counts of rejections by reason, minute
+// by minute, for the last hour.
+type RejectionCounter struct {
+	mins [rejectionMinutes]rejectionMinute
+	now  func() time.Time // For testing
+	mux  sync.Mutex
+}
+
+// rejectionMinute is the count of rejections in one minute.
+type rejectionMinute struct {
+	min    int64 // Minutes since the epoch
+	counts map[string]int
+}
+
+// RejectionCounts are the counts of rejections by reason, over the
+// last 5 and 60 minutes.
+type RejectionCounts struct {
+	Last5  map[string]int
+	Last60 map[string]int
+}
+
+// NewRejectionCounter creates a counter with no rejections.
+func NewRejectionCounter() *RejectionCounter {
+	return &RejectionCounter{
+		now: time.Now,
+		mux: sync.Mutex{},
+	}
+}
+
+// Add counts one rejection for the given reason.
+func (rc *RejectionCounter) Add(reason string) {
+	rc.mux.Lock()
+	defer rc.mux.Unlock()
+
+	min := rc.now().Unix() / 60
+	m := &rc.mins[min%rejectionMinutes]
+	if m.min != min || m.counts == nil {
+		m.min = min
+		m.counts = make(map[string]int)
+	}
+	m.counts[reason]++
+}
+
+// Counts gives a snapshot of the rejections over the last 5 and 60 minutes,
+// including the current minute.
+func (rc *RejectionCounter) Counts() *RejectionCounts {
+	rc.mux.Lock()
+	defer rc.mux.Unlock()
+
+	now := rc.now().Unix() / 60
+	counts := &RejectionCounts{
+		Last5:  make(map[string]int),
+		Last60: make(map[string]int),
+	}
+	for _, m := range rc.mins {
+		age := now - m.min
+		if age < 0 || age >= rejectionMinutes {
+			continue
+		}
+		for reason, n := range m.counts {
+			counts.Last60[reason] += n
+			if age < 5 {
+				counts.Last5[reason] += n
+			}
+		}
+	}
+	return counts
+}
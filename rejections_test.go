@@ -0,0 +1,129 @@
+// Copyright 2020 Nik Silver
+//
+// Licensed under the GPL v3.0. See file LICENCE.txt for details.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRejections_CountsRollOverTime(t *testing.T) {
+	now := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	rc := NewRejectionCounter()
+	rc.now = func() time.Time { return now }
+
+	// Some rejections now, and some over the next 10 minutes
+	rc.Add("room full")
+	rc.Add("room full")
+	rc.Add("bad params")
+	now = now.Add(10 * time.Minute)
+	rc.Add("room full")
+
+	counts := rc.Counts()
+	if counts.Last5["room full"] != 1 || counts.Last5["bad params"] != 0 {
+		t.Errorf("After 10 mins, last 5 mins counts were %v", counts.Last5)
+	}
+	if counts.Last60["room full"] != 3 || counts.Last60["bad params"] != 1 {
+		t.Errorf("After 10 mins, last 60 mins counts were %v", counts.Last60)
+	}
+
+	// After an hour the first ones should drop out
+	now = now.Add(55 * time.Minute)
+	counts = rc.Counts()
+	if len(counts.Last5) != 0 {
+		t.Errorf("After 65 mins, last 5 mins counts were %v", counts.Last5)
+	}
+	if counts.Last60["room full"] != 1 || counts.Last60["bad params"] != 0 {
+		t.Errorf("After 65 mins, last 60 mins counts were %v", counts.Last60)
+	}
+
+	// A new rejection in a reused minute shouldn't include the old counts
+	now = now.Add(55 * time.Minute)
+	rc.Add("bad params")
+	counts = rc.Counts()
+	if counts.Last60["room full"] != 0 || counts.Last60["bad params"] != 1 {
+		t.Errorf("After 120 mins, last 60 mins counts were %v", counts.Last60)
+	}
+}
+
+func TestRejections_StatusPageCountsRejectedClients(t *testing.T) {
+	serv := newTestServer(bounceHandler)
+	defer serv.Close()
+
+	before := statusRejections(t)
+
+	// Reject a client for unsupported subprotocols, two for bad params,
+	// and one for an unsupported version
+
+	header := http.Header{"Sec-Websocket-Protocol": {"foo"}}
+	ws, _, err := dialWith(serv, "/rej.status", "REJ1", -1, nil, header)
+	if err == nil {
+		ws.Close()
+		t.Fatal("Expected error dialling with bad subprotocol")
+	}
+	for _, ln := range []string{"x", "-2"} {
+		params := url.Values{"lastnum": {ln}}
+		ws, _, err := dialWith(serv, "/rej.status", "REJ2", -1, params, nil)
+		if err == nil {
+			ws.Close()
+			t.Fatalf("Expected error dialling with lastnum %s", ln)
+		}
+	}
+	params := url.Values{"version": {strconv.Itoa(ProtocolVersion + 1)}}
+	ws, _, err = dialWith(serv, "/rej.status", "REJ3", -1, params, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws := newTConn(ws, "REJ3")
+	if err := tws.expectClose(CloseBadVersion, 500); err != nil {
+		t.Error(err)
+	}
+	tws.close()
+	WG.Wait()
+
+	after := statusRejections(t)
+	for _, counts := range []struct {
+		desc          string
+		before, after map[string]int
+	}{
+		{"Last 5 mins", before.Last5, after.Last5},
+		{"Last 60 mins", before.Last60, after.Last60},
+	} {
+		if n := counts.after[REJECTSUBPROTOCOL] - counts.before[REJECTSUBPROTOCOL]; n != 1 {
+			t.Errorf("%s: Expected 1 more subprotocol rejection, got %d",
+				counts.desc, n)
+		}
+		if n := counts.after[REJECTBADPARAMS] - counts.before[REJECTBADPARAMS]; n != 2 {
+			t.Errorf("%s: Expected 2 more bad params rejections, got %d",
+				counts.desc, n)
+		}
+		if n := counts.after[REJECTBADVERSION] - counts.before[REJECTBADVERSION]; n != 1 {
+			t.Errorf("%s: Expected 1 more version rejection, got %d",
+				counts.desc, n)
+		}
+	}
+}
+
+// statusRejections gets the rejection counts from the status page.
+func statusRejections(t *testing.T) *RejectionCounts {
+	w := httptest.NewRecorder()
+	statusHandler(w, httptest.NewRequest("GET", "/status", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Status page gave status %d", w.Code)
+	}
+	status := struct {
+		Rejections *RejectionCounts
+	}{}
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+		t.Fatalf("Couldn't unmarshal status page '%s': %s",
+			w.Body.String(), err)
+	}
+	return status.Rejections
+}
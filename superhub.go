@@ -5,58 +5,270 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// Most clients any room can allow
 const MaxClients = 50
 
+// Most observers any room can allow, as well as its clients
+const MaxObservers = 20
+
+// Why the superhub might not give a client a hub
+var (
+	errRoomFull      = fmt.Errorf("Maximum number of clients in game")
+	errObserversFull = fmt.Errorf("Maximum number of observers in game")
+	errWrongPassword = fmt.Errorf("Wrong password")
+	errShuttingDown  = fmt.Errorf("Server shutting down")
+	errServerFull    = fmt.Errorf("Maximum number of clients on server")
+	errRoomTaken     = fmt.Errorf("Room already taken")
+)
+
+// How long clients should wait before trying again when the server
+// has as many clients as it allows
+var serverFullRetry = 10 * time.Second
+
+// How long clients should wait before reconnecting when the server
+// shuts down, and how long we wait for everything to finish
+var shutdownRetry = 10 * time.Second
+var shutdownDeadline = 20 * time.Second
+
+// How many shards a superhub splits its rooms between, so clients
+// coming and going in one room rarely wait for those in another
+var superhubShards = 64
+
+// Least time between checks that all the buffers together are within
+// their budget
+var budgetCheckFreq = 100 * time.Millisecond
+
+// SuperhubConfig says how a superhub sets up the hubs it gives out.
+type SuperhubConfig struct {
+	// How long clients have to reconnect, unless the room says otherwise
+	Reconnection time.Duration
+	// If set, it can override that for a new hub for the given room,
+	// saying true if it does. The room can still say otherwise.
+	RoomReconnection func(room string) (time.Duration, bool)
+	// Most clients all the rooms together can have, including those
+	// that may still reconnect, or 0 if there's no limit
+	MaxTotalClients int
+}
+
 // Superhub gives a hub to a client. The client needs to
 // release the hub when it's done with it.
 type Superhub struct {
-	hubs   map[string]*Hub    // From game room (path) to hub
-	counts map[*Hub]int       // Count of clients using each hub
-	rooms  map[*Hub]string    // From hub pointer to game rooms
-	tOut   map[*Hub][]*Client // Clients timing out per hub
-	mux    sync.RWMutex       // To ensure concurrency-safety
+	config SuperhubConfig
+	shards []*shard    // The rooms, split up by their names
+	total  int64       // Count of clients using any hub
+	down   int32       // 1 if the server is shutting down
+	hooks  *hookCaller // To tell about rooms and clients
+
+	// Every hub's buffer, with its room, for keeping them all within
+	// budget. These have their own lock, as hubs check the budget.
+	buffers map[*Buffer]string
+	checked time.Time // When the budget was last checked
+	bufMux  sync.Mutex
+}
+
+// shard holds some of a superhub's rooms, and everything about them,
+// with its own lock. A room is always in the same shard, as are its
+// hubs and their clients.
+type shard struct {
+	hubs   map[string]*Hub         // From game room (path) to hub
+	counts map[*Hub]int            // Count of clients using each hub
+	obs    map[*Hub]int            // How many of those are observers
+	coming map[*Hub]int            // Players given a hub but not yet in it
+	rooms  map[*Hub]string         // From hub pointer to game rooms
+	timers map[*Client]*time.Timer // Reconnection timers running
+	fresh  map[string]bool         // Rooms to start afresh, after closing
+	// Rooms made but not yet joined, and what their creators asked for
+	reserved map[string]*reservation
+	mux      sync.RWMutex // To ensure concurrency-safety
+}
+
+// reservation is what the creator of a room asked for before anyone
+// joined it, and until when it's kept for them.
+type reservation struct {
+	params *ConnectionParams
+	until  time.Time
 }
 
-// newSuperhub creates an empty superhub, which will hold many hubs.
+// NewSuperhub creates an empty superhub, which will hold many hubs,
+// with the default configuration.
 func NewSuperhub() *Superhub {
+	return NewSuperhubWith(SuperhubConfig{Reconnection: defaultReconnection})
+}
+
+// NewSuperhubWith creates an empty superhub with the given
+// configuration.
+func NewSuperhubWith(config SuperhubConfig) *Superhub {
+	shards := make([]*shard, superhubShards)
+	for i := range shards {
+		shards[i] = &shard{
+			hubs:     make(map[string]*Hub),         // From game room to hub
+			counts:   make(map[*Hub]int),            // Count of cl's using a hub
+			obs:      make(map[*Hub]int),            // Count of observers
+			coming:   make(map[*Hub]int),            // Count of players to come
+			rooms:    make(map[*Hub]string),         // From hub ptr to game room
+			timers:   make(map[*Client]*time.Timer), // Reconnection timers
+			fresh:    make(map[string]bool),         // Rooms to start afresh
+			reserved: make(map[string]*reservation), // Rooms made, not joined
+			mux:      sync.RWMutex{},                // For concurrency-safety
+		}
+	}
 	return &Superhub{
-		hubs:   make(map[string]*Hub),    // From game room to hub
-		counts: make(map[*Hub]int),       // Count of cl's using a hub
-		rooms:  make(map[*Hub]string),    // From hub ptr to game room
-		tOut:   make(map[*Hub][]*Client), // Clients timing out per hub
-		mux:    sync.RWMutex{},           // For concurrency-safety
+		config: config,
+		shards: shards,
+		hooks:  newHookCaller(), // Doing nothing for now
+
+		buffers: make(map[*Buffer]string), // From buffer to game room
+		bufMux:  sync.Mutex{},
+	}
+}
+
+// shardFor gives the shard that holds the given game room.
+func (sh *Superhub) shardFor(room string) *shard {
+	f := fnv.New32a()
+	f.Write([]byte(room))
+	return sh.shards[f.Sum32()%uint32(len(sh.shards))]
+}
+
+// Hub gets the hub for the given game room, for a client connecting
+// with the given params. If necessary a new hub will be created with
+// settings from the params and start processing messages; otherwise the
+// settings are ignored, except that the password must match the room's.
+// Will return errRoomFull if there are too many clients in the room,
+// errObserversFull if there are too many observers and the client would
+// be one, or errWrongPassword if the password is wrong. Observers don't
+// count against the room's limit of clients, and nor do connections
+// that are only reconnecting: the limit is on the players joined, by
+// ID, whether connected or not, and those on their way to join. If the server already has
+// as many clients as it allows, counting everyone until they've finally
+// been released, it will return errServerFull.
+//
+// A client with a spectator link needn't give the password, but the link
+// must be for this room, while its hub lasts. It will return errBadLink,
+// errLinkExpired or errLinkUsedUp if not. Once the server is shutting
+// down it will only return errShuttingDown.
+//
+// Only the room's own shard is locked, so clients joining one room
+// needn't wait for those coming and going in most others.
+func (sh *Superhub) Hub(room string, p *ConnectionParams) (*Hub, error) {
+	if atomic.LoadInt32(&sh.down) == 1 {
+		return nil, errShuttingDown
+	}
+	if !sh.reserve() {
+		return nil, errServerFull
+	}
+	h, err := sh.hub(room, p)
+	if err != nil {
+		atomic.AddInt64(&sh.total, -1)
+	}
+	return h, err
+}
+
+// reserve a place for one more client on the server, if there's room.
+func (sh *Superhub) reserve() bool {
+	limit := int64(sh.config.MaxTotalClients)
+	for {
+		n := atomic.LoadInt64(&sh.total)
+		if limit > 0 && n >= limit {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&sh.total, n, n+1) {
+			return true
+		}
 	}
 }
 
-// Hub gets the hub for the given game room. If necessary a new hub
-// will be created and start processing messages.
-// Will return an error if there are too many clients in the room.
-func (sh *Superhub) Hub(room string) (*Hub, error) {
+// hub gets the hub for the given game room, as Hub does, once the
+// client has a place on the server.
+func (sh *Superhub) hub(room string, p *ConnectionParams) (*Hub, error) {
 	aLog.Debug("superhub.Hub, Entering", "room", room)
-	sh.mux.Lock()
-	defer sh.mux.Unlock()
+	sd := sh.shardFor(room)
+	sd.mux.Lock()
+	defer sd.mux.Unlock()
 	aLog.Debug("superhub.Hub, giving hub", "room", room)
 
-	if h, okay := sh.hubs[room]; okay {
-		if sh.counts[h] >= MaxClients {
-			return nil, fmt.Errorf("Maximum number of clients in game")
+	// Checked again under the lock, so anyone draining the rooms
+	// will see any hub we give out
+	if atomic.LoadInt32(&sh.down) == 1 {
+		return nil, errShuttingDown
+	}
+
+	settings := newRoomSettings(p, sh.reconnectionFor(room))
+	r := p.Role
+	var link *spectatorLink
+	if p.Link != "" {
+		var err error
+		if link, err = parseLink(p.Link, nowMs()); err != nil {
+			return nil, err
+		}
+		h, okay := sd.hubs[room]
+		if !okay || link.Room != room || link.Hub != h.linkID {
+			return nil, errBadLink
+		}
+		if h.linkUses[link.Nonce] >= link.Uses {
+			return nil, errLinkUsedUp
+		}
+	}
+
+	if h, okay := sd.hubs[room]; okay && !h.stopped() {
+		if link == nil && !h.settings.admits(settings) {
+			return nil, errWrongPassword
+		}
+		if r == PLAYER && !h.HasPlayer(p.ID) &&
+			h.Players()+sd.coming[h] >= h.settings.MaxClients {
+			return nil, errRoomFull
+		}
+		if r == OBSERVER && sd.obs[h] >= MaxObservers {
+			return nil, errObserversFull
+		}
+		sd.counts[h]++
+		if r == OBSERVER {
+			sd.obs[h]++
+		} else {
+			sd.coming[h]++
+		}
+		if link != nil {
+			h.linkUses[link.Nonce]++
 		}
-		sh.counts[h]++
 		aLog.Debug("superhub.Hub, existing hub",
-			"room", room, "count", sh.counts[h])
+			"room", room, "count", sd.counts[h])
 		return h, nil
 	}
 
 	aLog.Debug("superhub.Hub, new hub", "room", room)
-	h := NewHub(room)
-	sh.hubs[room] = h
-	sh.counts[h] = 1
-	sh.rooms[h] = room
+	if res, okay := sd.reserved[room]; okay {
+		delete(sd.reserved, room)
+		if time.Now().Before(res.until) {
+			res.apply(&settings)
+		}
+	}
+	h := NewHub(room, settings)
+	sd.hubs[room] = h
+	sd.counts[h] = 1
+	if r == OBSERVER {
+		sd.obs[h] = 1
+	} else {
+		sd.coming[h] = 1
+	}
+	sd.rooms[h] = room
+	h.restarted = sd.fresh[room]
+	delete(sd.fresh, room)
+	h.shub = sh
+	h.hooks = sh.hooks
+	sh.hooks.roomCreated(room)
+	if b, okay := h.buffer.(*Buffer); okay {
+		sh.register(b, room)
+		openStore(room, b)
+	}
 	aLog.Debug("superhub.Hub, starting hub", "room", room)
 	h.Start()
 	aLog.Debug("superhub.Hub, exiting", "room", room)
@@ -64,69 +276,564 @@ func (sh *Superhub) Hub(room string) (*Hub, error) {
 	return h, nil
 }
 
+// Reserve a new room for a short time, so it's not given out again
+// before its creator joins it, with the settings the creator wants that
+// a client can choose. Whoever joins it first gets those settings.
+// Will return errRoomTaken if the room is in use or already reserved,
+// or errShuttingDown once the server is shutting down. Reservations
+// that have run out are tidied away as we go.
+func (sh *Superhub) Reserve(room string, p *ConnectionParams, ttl time.Duration) error {
+	sd := sh.shardFor(room)
+	sd.mux.Lock()
+	defer sd.mux.Unlock()
+
+	if atomic.LoadInt32(&sh.down) == 1 {
+		return errShuttingDown
+	}
+	now := time.Now()
+	for r, res := range sd.reserved {
+		if !now.Before(res.until) {
+			delete(sd.reserved, r)
+		}
+	}
+	if _, okay := sd.hubs[room]; okay {
+		return errRoomTaken
+	}
+	if _, okay := sd.reserved[room]; okay {
+		return errRoomTaken
+	}
+	sd.reserved[room] = &reservation{params: p, until: now.Add(ttl)}
+	return nil
+}
+
+// apply what the room's creator asked for to the settings for its hub.
+func (res *reservation) apply(settings *RoomSettings) {
+	p := res.params
+	if p.MaxClients > 0 {
+		settings.MaxClients = p.MaxClients
+	}
+	settings.Public = p.Public
+	settings.History = p.History
+	settings.FullHistory = p.FullHistory
+}
+
+// SetHooks has the superhub and its hubs tell the given hooks about
+// rooms and clients coming and going from now on. If they're nil
+// no-one is told.
+func (sh *Superhub) SetHooks(hooks Hooks) {
+	sh.hooks.set(hooks)
+}
+
+// reconnectionFor says how long clients have to reconnect to a new hub
+// for the given room, unless the room says otherwise.
+func (sh *Superhub) reconnectionFor(room string) time.Duration {
+	if sh.config.RoomReconnection != nil {
+		if d, ok := sh.config.RoomReconnection(room); ok {
+			return d
+		}
+	}
+	return sh.config.Reconnection
+}
+
 // Release allows a client to say it is no longer using the given hub.
-// A reconnection timer will start and eventually alert the hub.
+// A reconnection timer will start and eventually alert the hub, unless
+// another client with the same ID takes over first. If the client has
+// said goodbye there's no reconnection to wait for, so the hub is
+// alerted straight away. If it's already been taken over there's
+// nothing to do.
 func (sh *Superhub) Release(h *Hub, c *Client) {
-	sh.mux.Lock()
-	defer sh.mux.Unlock()
+	sd := sh.shardFor(h.room)
+	sd.mux.Lock()
+	defer sd.mux.Unlock()
 
-	fLog := aLog.New("fn", "superhub.Release", "hubroom", sh.rooms[h],
-		"cid", c.ID, "cref", c.Ref)
-	fLog.Debug("Starting reconnection timeout")
+	fLog := aLog.New("fn", "superhub.Release", "hubroom", sd.rooms[h],
+		"cid", c.currentID(), "cref", c.Ref)
+	if c.superseded {
+		fLog.Debug("Client taken over; no reconnection to wait for")
+		return
+	}
+	fLog.Debug("Starting reconnection timeout", "gone", c.gone)
+	sd.arrive(h, c)
+	c.released = true
 
-	// Put the client in the timing-out list
-	sh.tOut[h] = append(sh.tOut[h], c)
+	// The hub has already sent any leaver messages for a client that's
+	// gone, so the timeout will only tidy up
+	timeout := h.settings.Reconnection
+	if c.gone {
+		timeout = 0
+	}
 
 	// Send a possible message to the hub after timeout
-	time.AfterFunc(reconnectionTimeout,
-		func() {
-			sh.mux.Lock()
-			defer sh.mux.Unlock()
-
-			fLog := aLog.New("fn", "superhub.Release.AfterFunc",
-				"hubroom", sh.rooms[h], "cid", c.ID, "cref", c.Ref)
-			fLog.Debug("Entering")
-			// Delete the client from the list
-			sh.tOut[h] = remove(sh.tOut[h], c)
-			sh.decrement(h)
-			// Send a timeout message to the hub
-			h.Timeout <- c
-			// For testing only...
-			fLog.Debug("Sent timeout for client")
-		})
+	sd.timers[c] = time.AfterFunc(timeout, func() {
+		sh.timedOut(h, c)
+	})
 
 	fLog.Debug("Exiting")
 }
 
-// Decrement the count of clients for a hub, and remove the hub if necessary
-func (sh *Superhub) decrement(h *Hub) {
-	sh.counts[h]--
-	if sh.counts[h] == 0 {
-		aLog.Debug("superhub.decrement, deleting hub", "room", sh.rooms[h])
-		delete(sh.hubs, sh.rooms[h])
-		delete(sh.counts, h)
-		delete(sh.rooms, h)
-		delete(sh.tOut, h)
+// timedOut is when a client's reconnection timer fires. It's no longer
+// counted, and the hub is told, unless it's since been taken over. We
+// don't hold the lock while we wait for the hub, as the hub may need
+// the superhub too, and we don't wait for a hub that's finished.
+func (sh *Superhub) timedOut(h *Hub, c *Client) {
+	sd := sh.shardFor(h.room)
+	sd.mux.Lock()
+	fLog := aLog.New("fn", "superhub.timedOut",
+		"hubroom", sd.rooms[h], "cid", c.currentID(), "cref", c.Ref)
+	fLog.Debug("Entering")
+	if _, okay := sd.timers[c]; !okay {
+		sd.mux.Unlock()
+		fLog.Debug("Client taken over; no timeout to send")
+		return
+	}
+	delete(sd.timers, c)
+	sh.decrement(sd, h, c.Role)
+	sd.mux.Unlock()
+
+	select {
+	case h.Timeout <- c:
+		fLog.Debug("Sent timeout for client")
+	case <-h.done:
+		fLog.Debug("Hub finished before timeout")
 	}
 }
 
-// Remove one client from a slice of clients
-func remove(cs []*Client, c *Client) []*Client {
-	for i, c2 := range cs {
-		if c == c2 {
-			return append(cs[:i], cs[i+1:]...)
+// Superseded says a client has been taken over by another with the same
+// ID, so there's no reconnection to wait for. Its reconnection timer is
+// stopped if it's running, and it's no longer counted. The hub should
+// forget the client itself, as it won't be told of a timeout.
+func (sh *Superhub) Superseded(h *Hub, c *Client) {
+	sd := sh.shardFor(h.room)
+	sd.mux.Lock()
+	defer sd.mux.Unlock()
+
+	if c.superseded {
+		return
+	}
+	c.superseded = true
+	if t, okay := sd.timers[c]; okay {
+		t.Stop()
+		delete(sd.timers, c)
+		sh.decrement(sd, h, c.Role)
+	} else if !c.released {
+		sh.decrement(sd, h, c.Role)
+	}
+}
+
+// arrived says the hub has had a client's Joiner, and now counts it
+// among its players if it's joined, so we needn't count it as one
+// still to come. It's safe to call on a nil superhub, which does
+// nothing.
+func (sh *Superhub) arrived(h *Hub, c *Client) {
+	if sh == nil {
+		return
+	}
+	sd := sh.shardFor(h.room)
+	sd.mux.Lock()
+	defer sd.mux.Unlock()
+
+	sd.arrive(h, c)
+}
+
+// arrive stops counting a client as a player still to come, if it was
+// one. The shard's lock must be held.
+func (sd *shard) arrive(h *Hub, c *Client) {
+	if c.arrived {
+		return
+	}
+	c.arrived = true
+	if c.Role == PLAYER && sd.coming[h] > 0 {
+		sd.coming[h]--
+	}
+}
+
+// Timers says how many reconnection timers are running.
+func (sh *Superhub) Timers() int {
+	n := 0
+	for _, sd := range sh.shards {
+		sd.mux.RLock()
+		n += len(sd.timers)
+		sd.mux.RUnlock()
+	}
+	return n
+}
+
+// Announce sends a JSON body to every client in every room, as an
+// Announcement. It returns how many rooms it went to. A hub may finish
+// while we're sending to it, so we don't wait for one that has.
+func (sh *Superhub) Announce(body []byte) int {
+	count := 0
+	for _, h := range sh.allHubs() {
+		if h.post(&Message{Intent: "Announcement", Body: body}) {
+			count++
 		}
 	}
-	return cs
+	return count
+}
+
+// RoomStats says how every room is doing, by name. A hub may finish
+// while we're asking it, so we don't wait for one that has.
+func (sh *Superhub) RoomStats() map[string]*Stats {
+	out := make(map[string]*Stats)
+	for _, h := range sh.allHubs() {
+		reply := make(chan *Stats, 1)
+		if !h.post(&Message{Intent: "RoomStats", Reply: reply}) {
+			continue
+		}
+		select {
+		case st := <-reply:
+			out[h.room] = st
+		case <-h.done:
+		}
+	}
+	return out
+}
+
+// ForceClose closes a room straight away, such as if it's got into a
+// bad state, and says if there was such a room. Its clients are told
+// and thrown out, and nothing is kept for them. Anyone joining the room
+// from now on gets a new hub, where clients carrying on from before
+// start again rather than being refused. We don't wait for the old hub.
+func (sh *Superhub) ForceClose(room string) bool {
+	sd := sh.shardFor(room)
+	sd.mux.Lock()
+	h, okay := sd.hubs[room]
+	if !okay || h.stopped() {
+		sd.mux.Unlock()
+		return false
+	}
+	delete(sd.hubs, room)
+	sd.fresh[room] = true
+	sd.mux.Unlock()
+
+	WG.Add(1)
+	go func() {
+		defer WG.Done()
+		h.post(&Message{Intent: "ForceClose"})
+	}()
+	return true
+}
+
+// RoomClients says how every client a room's tracking is doing, or
+// false if there's no such room. A hub may finish while we're asking
+// it, so we don't wait for one that has.
+func (sh *Superhub) RoomClients(room string) ([]*ClientStats, bool) {
+	h := sh.Existing(room)
+	if h == nil {
+		return nil, false
+	}
+	reply := make(chan []*ClientStats, 1)
+	if !h.post(&Message{Intent: "ClientStats", ClientsReply: reply}) {
+		return nil, false
+	}
+	select {
+	case cs := <-reply:
+		return cs, true
+	case <-h.done:
+		return nil, false
+	}
+}
+
+// RoomListing describes a public room, for anyone looking for one
+// to join.
+type RoomListing struct {
+	Room     string // Name of the room
+	Members  int    // How many players are in it now
+	Capacity int    // Most players it allows
+}
+
+// PublicRooms lists the public rooms, in order of name. Private rooms
+// are never listed.
+func (sh *Superhub) PublicRooms() []RoomListing {
+	out := make([]RoomListing, 0)
+	for _, sd := range sh.shards {
+		sd.mux.RLock()
+		for room, h := range sd.hubs {
+			if !h.settings.Public {
+				continue
+			}
+			out = append(out, RoomListing{
+				Room:     room,
+				Members:  h.Players() + sd.coming[h],
+				Capacity: h.settings.MaxClients,
+			})
+		}
+		sd.mux.RUnlock()
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Room < out[j].Room
+	})
+	return out
+}
+
+// RoomInfo describes a room for anyone thinking of joining it, before
+// they connect.
+type RoomInfo struct {
+	Exists   bool // If the room's open now
+	Members  int  // How many players are in it now
+	Capacity int  // Most players it allows
+	Locked   bool // If joining it needs a password
+	Full     bool // If it has as many players as it allows
+}
+
+// RoomInfo describes the given room. A room that isn't open yet allows
+// as many players as its creator asked for, if it's been reserved, or
+// otherwise the most any room can.
+func (sh *Superhub) RoomInfo(room string) RoomInfo {
+	sd := sh.shardFor(room)
+	sd.mux.RLock()
+	defer sd.mux.RUnlock()
+
+	h, okay := sd.hubs[room]
+	if !okay || h.stopped() {
+		settings := RoomSettings{MaxClients: MaxClients}
+		if res, okay := sd.reserved[room]; okay &&
+			time.Now().Before(res.until) {
+			res.apply(&settings)
+		}
+		return RoomInfo{Capacity: settings.MaxClients}
+	}
+	members := h.Players() + sd.coming[h]
+	return RoomInfo{
+		Exists:   true,
+		Members:  members,
+		Capacity: h.settings.MaxClients,
+		Locked:   h.settings.PassHash != nil,
+		Full:     members >= h.settings.MaxClients,
+	}
+}
+
+// Shutdown tells every room the server is shutting down, so they
+// close, and stops giving out hubs. It returns how many rooms it told.
+func (sh *Superhub) Shutdown() int {
+	atomic.StoreInt32(&sh.down, 1)
+
+	count := 0
+	for _, h := range sh.allHubs() {
+		if h.post(&Message{Intent: "Shutdown"}) {
+			count++
+		}
+	}
+	return count
+}
+
+// Drain stops giving out hubs, has every room close as it does when the
+// server's shutting down, and waits for all the hubs to finish, or for
+// the context to be done. If some hubs didn't finish it gives an error
+// naming their rooms. Hubs that are already closing are waited for too.
+func (sh *Superhub) Drain(ctx context.Context) error {
+	atomic.StoreInt32(&sh.down, 1)
+	hubs := make([]*Hub, 0)
+	for _, sd := range sh.shards {
+		sd.mux.RLock()
+		for h := range sd.rooms {
+			hubs = append(hubs, h)
+		}
+		sd.mux.RUnlock()
+	}
+
+	for _, h := range hubs {
+		select {
+		case h.Pending <- &Message{Intent: "Shutdown"}:
+		case <-h.done:
+		case <-ctx.Done():
+		}
+	}
+
+	rooms := make([]string, 0)
+	for _, h := range hubs {
+		select {
+		case <-h.done:
+		case <-ctx.Done():
+			select {
+			case <-h.done:
+			default:
+				rooms = append(rooms, h.room)
+			}
+		}
+	}
+	if len(rooms) > 0 {
+		sort.Strings(rooms)
+		return fmt.Errorf("Rooms didn't drain: %s", strings.Join(rooms, ", "))
+	}
+	return nil
+}
+
+// allHubs gives all the hubs we have now.
+func (sh *Superhub) allHubs() []*Hub {
+	hubs := make([]*Hub, 0)
+	for _, sd := range sh.shards {
+		sd.mux.RLock()
+		for _, h := range sd.hubs {
+			hubs = append(hubs, h)
+		}
+		sd.mux.RUnlock()
+	}
+	return hubs
+}
+
+// Existing gets the hub for the given game room, or nil if there isn't
+// one. It never creates a hub.
+func (sh *Superhub) Existing(room string) *Hub {
+	sd := sh.shardFor(room)
+	sd.mux.RLock()
+	defer sd.mux.RUnlock()
+
+	return sd.hubs[room]
+}
+
+// forget a hub that's closing, so anyone trying to join its room gets a
+// new one. We still count its clients until they've gone.
+func (sh *Superhub) forget(h *Hub) {
+	sd := sh.shardFor(h.room)
+	sd.mux.Lock()
+	defer sd.mux.Unlock()
+
+	if room, okay := sd.rooms[h]; okay && sd.hubs[room] == h {
+		aLog.Debug("superhub.forget, forgetting hub", "room", room)
+		delete(sd.hubs, room)
+	}
+}
+
+// finished says if the superhub has no more clients for a hub, so it
+// can stop. Until then a client may have been given the hub but not
+// yet joined it. A hub that no superhub gave out is always finished.
+func (sh *Superhub) finished(h *Hub) bool {
+	if sh == nil {
+		return true
+	}
+	sd := sh.shardFor(h.room)
+	sd.mux.RLock()
+	defer sd.mux.RUnlock()
+
+	_, okay := sd.counts[h]
+	return !okay
+}
+
+// Decrement the count of clients for a hub in the given shard, given the
+// role of the client that's gone, and remove the hub if necessary. The
+// shard's lock must be held.
+func (sh *Superhub) decrement(sd *shard, h *Hub, r role) {
+	sd.counts[h]--
+	atomic.AddInt64(&sh.total, -1)
+	if r == OBSERVER {
+		sd.obs[h]--
+	}
+	if sd.counts[h] == 0 {
+		aLog.Debug("superhub.decrement, deleting hub", "room", sd.rooms[h])
+		h.settings.PassHash = nil
+		if sd.hubs[sd.rooms[h]] == h {
+			delete(sd.hubs, sd.rooms[h])
+		}
+		delete(sd.counts, h)
+		delete(sd.obs, h)
+		delete(sd.coming, h)
+		delete(sd.rooms, h)
+		if b, okay := h.buffer.(*Buffer); okay {
+			sh.unregister(b)
+		}
+	}
+}
+
+// register a hub's buffer for the given room, so it's kept within the
+// budget for all buffers. The buffer asks this superhub to check it.
+// This must be done before the buffer's hub starts using it.
+func (sh *Superhub) register(b *Buffer, room string) {
+	sh.bufMux.Lock()
+	defer sh.bufMux.Unlock()
+
+	sh.buffers[b] = room
+	b.shub = sh
+}
+
+// unregister a buffer that's no longer needed.
+func (sh *Superhub) unregister(b *Buffer) {
+	sh.bufMux.Lock()
+	defer sh.bufMux.Unlock()
+
+	delete(sh.buffers, b)
+}
+
+// checkBudget sees if all the buffers together have more than their
+// budget, and if so asks those with the oldest envelopes to trim them.
+// Everything older than halfway between the oldest envelope and now
+// should go. Only a buffer's own hub may change it, so it does the
+// trimming when it next cleans its buffer. If that's not enough we'll
+// ask again, but not more often than budgetCheckFreq.
+func (sh *Superhub) checkBudget() {
+	sh.bufMux.Lock()
+	defer sh.bufMux.Unlock()
+
+	total := atomic.LoadInt64(&bufferedTotal)
+	if total <= int64(maxBufferedTotal) ||
+		time.Since(sh.checked) < budgetCheckFreq {
+		return
+	}
+	sh.checked = time.Now()
+
+	now := nowMs()
+	oldest := now
+	for b := range sh.buffers {
+		if at := atomic.LoadInt64(&b.oldestAt); at > 0 && at < oldest {
+			oldest = at
+		}
+	}
+	before := oldest + (now-oldest)/2 + 1
+
+	rooms := make([]string, 0)
+	for b, room := range sh.buffers {
+		if at := atomic.LoadInt64(&b.oldestAt); at > 0 && at < before {
+			atomic.StoreInt64(&b.trimBefore, before)
+			rooms = append(rooms, room)
+		}
+	}
+	sort.Strings(rooms)
+	aLog.Warn("Buffers over budget, trimming", "fn", "superhub.checkBudget",
+		"bytes", total, "budget", maxBufferedTotal, "rooms", rooms)
+}
+
+// Clients returns the number of clients using any hub, including those
+// that may still reconnect.
+func (sh *Superhub) Clients() int {
+	return int(atomic.LoadInt64(&sh.total))
 }
 
 // Count returns the number of hubs in the superhub
 func (sh *Superhub) Count() int {
-	sh.mux.RLock()
-	defer sh.mux.RUnlock()
+	n := 0
+	for _, sd := range sh.shards {
+		sd.mux.RLock()
+		n += len(sd.rooms)
+		sd.mux.RUnlock()
+	}
+	return n
+}
 
-	for _, room := range sh.rooms {
-		aLog.Debug("superhub.count, counting", "room", room)
+// RoomSnapshot describes one of the superhub's hubs at some moment.
+type RoomSnapshot struct {
+	Room    string // Name of the room
+	Clients int    // How many clients are using it, including observers
+	AgeMs   int64  // How long it's been open, in milliseconds
+}
+
+// Snapshot describes every hub the superhub has, in order of room name.
+// A room may appear twice if it's closing and a new hub has been
+// started for it.
+func (sh *Superhub) Snapshot() []RoomSnapshot {
+	out := make([]RoomSnapshot, 0)
+	for _, sd := range sh.shards {
+		sd.mux.RLock()
+		for h, room := range sd.rooms {
+			out = append(out, RoomSnapshot{
+				Room:    room,
+				Clients: sd.counts[h],
+				AgeMs:   time.Since(h.created).Milliseconds(),
+			})
+		}
+		sd.mux.RUnlock()
 	}
-	return len(sh.rooms)
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Room < out[j].Room
+	})
+	return out
 }
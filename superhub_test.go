@@ -5,9 +5,16 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -23,14 +30,10 @@ func TestSuperhub_LotsOfActivityEndsWithEmptySuperHub(t *testing.T) {
 	cSlice := make([]string, 0)
 	consumed := 0
 
-	// Just for this test, lower the reconnectionTimeout so that a
+	// Just for this test, lower the reconnection timeout so that a
 	// Leaver message is triggered reasonably quickly.
 
-	oldReconnectionTimeout := reconnectionTimeout
-	reconnectionTimeout = 250 * time.Millisecond
-	defer func() {
-		reconnectionTimeout = oldReconnectionTimeout
-	}()
+	useSuperhub(t, 250*time.Millisecond)
 
 	// Start a web server
 	serv := newTestServer(bounceHandler)
@@ -110,3 +113,874 @@ func TestSuperhub_LotsOfActivityEndsWithEmptySuperHub(t *testing.T) {
 		t.Errorf("Expected no hubs in superhub, got %d", count)
 	}
 }
+
+func TestSuperhub_AnnounceSkipsFinishedHubs(t *testing.T) {
+	// One hub has finished, and the other is still taking messages
+
+	sh := NewSuperhub()
+	hDone := NewHub("/done", newRoomSettings(&ConnectionParams{}, defaultReconnection))
+	close(hDone.done)
+	hLive := NewHub("/live", newRoomSettings(&ConnectionParams{}, defaultReconnection))
+	sh.shardFor("/done").hubs["/done"] = hDone
+	sh.shardFor("/live").hubs["/live"] = hLive
+
+	got := make(chan *Message)
+	go func() {
+		got <- <-hLive.Pending
+	}()
+
+	// This mustn't block on the finished hub
+
+	if count := sh.Announce([]byte(`"Hello"`)); count != 1 {
+		t.Errorf("Expected announcement to go to 1 hub but got %d", count)
+	}
+	msg := <-got
+	if msg.Intent != "Announcement" || string(msg.Body) != `"Hello"` {
+		t.Errorf("Live hub got unexpected message: %#v", msg)
+	}
+}
+
+func TestSuperhub_ListsOnlyPublicRooms(t *testing.T) {
+	// Just for this test, lower the reconnection timeout so that a
+	// Leaver message is triggered reasonably quickly.
+	useSuperhub(t, 250*time.Millisecond)
+
+	serv := newTestServer(bounceHandler)
+	defer serv.Close()
+
+	// Two players and an observer in a public room, and one player
+	// in a private room
+
+	twss := make([]*tConn, 0)
+	for _, d := range []struct {
+		room   string
+		id     string
+		params url.Values
+	}{
+		{"/superhub.public", "PUB1",
+			url.Values{"public": {"1"}, "maxclients": {"4"}}},
+		{"/superhub.public", "PUB2", nil},
+		{"/superhub.public", "PUBO", url.Values{"role": {"observer"}}},
+		{"/superhub.private", "PRV1", nil},
+	} {
+		ws, _, err := dialWith(serv, d.room, d.id, -1, d.params, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tws := newTConn(ws, d.id)
+		defer tws.close()
+		if err := tws.swallow("Welcome"); err != nil {
+			t.Fatal(err)
+		}
+		twss = append(twss, tws)
+	}
+
+	// Only the public room is listed, counting just its players
+
+	w := httptest.NewRecorder()
+	publicRoomsHandler(w, httptest.NewRequest("GET", "/rooms/public", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200 but got %d", w.Code)
+	}
+	got := struct {
+		Rooms []RoomListing
+	}{}
+	if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	exp := RoomListing{Room: "/superhub.public", Members: 2, Capacity: 4}
+	if len(got.Rooms) != 1 || got.Rooms[0] != exp {
+		t.Errorf("Expected just %#v but got %#v", exp, got.Rooms)
+	}
+
+	// Only GET is allowed
+
+	w = httptest.NewRecorder()
+	publicRoomsHandler(w, httptest.NewRequest("POST", "/rooms/public", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected status 405 but got %d", w.Code)
+	}
+
+	// Tidy up, and check everything in the main app finishes
+	for _, tws := range twss {
+		tws.close()
+	}
+	WG.Wait()
+}
+
+func TestSuperhub_DescribesRoomWithoutConnecting(t *testing.T) {
+	// Just for this test, lower the reconnection timeout so that a
+	// Leaver message is triggered reasonably quickly.
+	sh := useSuperhub(t, 250*time.Millisecond)
+
+	serv := newTestServer(bounceHandler)
+	defer serv.Close()
+
+	get := func(room string) RoomInfo {
+		resp, err := http.Get(serv.URL + room)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Getting %s expected status 200 but got %d",
+				room, resp.StatusCode)
+		}
+		info := RoomInfo{}
+		if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+			t.Fatal(err)
+		}
+		return info
+	}
+
+	// A room no-one's in doesn't exist, but a reserved one has the
+	// capacity its creator asked for
+
+	room := "/superhub.info"
+	exp := RoomInfo{Capacity: MaxClients}
+	if info := get(room); info != exp {
+		t.Errorf("Expected %#v but got %#v", exp, info)
+	}
+	err := sh.Reserve("/superhub.info.new", &ConnectionParams{MaxClients: 3},
+		time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp = RoomInfo{Capacity: 3}
+	if info := get("/superhub.info.new"); info != exp {
+		t.Errorf("Reserved: Expected %#v but got %#v", exp, info)
+	}
+
+	// A room for one, with a password, is locked and full once
+	// someone's in it
+
+	ws, _, err := dialWith(serv, room, "RI1", -1,
+		url.Values{"maxclients": {"1"}, "pass": {"s3cret"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws := newTConn(ws, "RI1")
+	defer tws.close()
+	if err := tws.swallow("Welcome"); err != nil {
+		t.Fatal(err)
+	}
+	exp = RoomInfo{
+		Exists:   true,
+		Members:  1,
+		Capacity: 1,
+		Locked:   true,
+		Full:     true,
+	}
+	if info := get(room); info != exp {
+		t.Errorf("In use: Expected %#v but got %#v", exp, info)
+	}
+
+	// Only GET is allowed
+
+	resp, err := http.Post(serv.URL+room, "text/plain", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("Expected status 405 but got %d", resp.StatusCode)
+	}
+
+	// Tidy up, and check everything in the main app finishes
+	tws.close()
+	WG.Wait()
+}
+
+func TestSuperhub_ShutdownClosesEveryRoom(t *testing.T) {
+	// Just for this test, lower the reconnection timeout so that a
+	// Leaver message is triggered reasonably quickly, and use a
+	// superhub of our own, as it won't give out any more hubs
+	useSuperhub(t, 250*time.Millisecond)
+
+	serv := newTestServer(bounceHandler)
+	defer serv.Close()
+
+	// Connect a client to each of two rooms
+
+	twss := make([]*tConn, 0)
+	for _, d := range []struct {
+		room string
+		id   string
+	}{
+		{"/superhub.shutdown.1", "SHUT1"},
+		{"/superhub.shutdown.2", "SHUT2"},
+	} {
+		ws, _, err := dial(serv, d.room, d.id, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tws := newTConn(ws, d.id)
+		defer tws.close()
+		if err := tws.swallow("Welcome"); err != nil {
+			t.Fatal(err)
+		}
+		twss = append(twss, tws)
+	}
+
+	// When the server shuts down each client is told when to come back,
+	// and its connection is closed as going away
+
+	if rooms := Shub.Shutdown(); rooms != 2 {
+		t.Errorf("Expected shutdown to tell 2 rooms but told %d", rooms)
+	}
+	for _, tws := range twss {
+		env, err := tws.readEnvelope(500, "%s expecting Closing", tws.id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if env.Intent != "Closing" || env.Reason != "shutdown" ||
+			env.RetryMs != shutdownRetry.Milliseconds() || env.Num != -1 {
+			t.Errorf("%s got unexpected envelope: %#v", tws.id, env)
+		}
+		if err := tws.expectClose(websocket.CloseGoingAway, 500); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// No-one else can connect
+
+	ws, resp, err := dial(serv, "/superhub.shutdown.1", "SHUT3", -1)
+	if err == nil {
+		ws.Close()
+		t.Error("Expected error connecting during shutdown, but didn't get one")
+	} else if resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 but got %v", resp)
+	}
+
+	// Tidy up, and check everything in the main app finishes
+	for _, tws := range twss {
+		tws.close()
+	}
+	WG.Wait()
+	if count := Shub.Count(); count != 0 {
+		t.Errorf("Expected no hubs left but there are %d", count)
+	}
+}
+
+func TestSuperhub_SnapshotDescribesEveryHub(t *testing.T) {
+	// Just for this test, lower the reconnection timeout so that hubs are
+	// released reasonably quickly, and use a superhub of our own
+	useSuperhub(t, 250*time.Millisecond)
+
+	serv := newTestServer(bounceHandler)
+	defer serv.Close()
+
+	// Lots of clients join a few rooms at once, while we keep taking
+	// snapshots
+
+	rooms := []string{"/snap.a", "/snap.b", "/snap.c"}
+	stop := make(chan struct{})
+	snapped := make(chan int)
+	go func() {
+		count := 0
+		for {
+			select {
+			case <-stop:
+				snapped <- count
+				return
+			default:
+				Shub.Snapshot()
+				count++
+			}
+		}
+	}()
+
+	twss := make(chan *tConn, 30)
+	w := sync.WaitGroup{}
+	for i := 0; i < 30; i++ {
+		w.Add(1)
+		go func(i int) {
+			defer w.Done()
+			id := "SNAP" + strconv.Itoa(i)
+			ws, _, err := dial(serv, rooms[i%3], id, -1)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			tws := newTConn(ws, id)
+			twss <- tws
+			if err := tws.swallow("Welcome"); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	w.Wait()
+	close(twss)
+
+	snap := Shub.Snapshot()
+	if len(snap) != 3 {
+		t.Errorf("Expected 3 rooms but got %#v", snap)
+	}
+	for i, rs := range snap {
+		if i >= len(rooms) || rs.Room != rooms[i] || rs.Clients != 10 ||
+			rs.AgeMs < 0 {
+			t.Errorf("Room %d has unexpected snapshot %#v", i, rs)
+		}
+	}
+
+	// Tidy up, and once everything in the main app finishes there's
+	// nothing left
+
+	for tws := range twss {
+		tws.close()
+	}
+	WG.Wait()
+	close(stop)
+	if count := <-snapped; count == 0 {
+		t.Error("Never took a snapshot while hubs were being created")
+	}
+	if snap := Shub.Snapshot(); len(snap) != 0 {
+		t.Errorf("Expected no rooms but got %#v", snap)
+	}
+}
+
+func TestSuperhub_TakeoverStopsReconnectionTimer(t *testing.T) {
+	// Just for this test, lower the reconnection timeout so that a
+	// Leaver message would be triggered reasonably quickly, and use a
+	// superhub of our own, so we only count its timers
+	useSuperhub(t, 250*time.Millisecond)
+
+	serv := newTestServer(bounceHandler)
+	defer serv.Close()
+
+	// waitForTimers waits a while for the superhub to have some number
+	// of reconnection timers running
+	waitForTimers := func(n int, desc string) {
+		for i := 0; i < 20; i++ {
+			if Shub.Timers() == n {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Errorf("%s: expected %d timers, got %d", desc, n, Shub.Timers())
+	}
+
+	// Two clients join
+
+	room := "/superhub.takeover.timer"
+	ws1a, _, err := dial(serv, room, "STT1", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws1a := newTConn(ws1a, "STT1")
+	defer tws1a.close()
+	if err := tws1a.swallow("Welcome"); err != nil {
+		t.Fatal(err)
+	}
+	ws2, _, err := dial(serv, room, "STT2", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws2 := newTConn(ws2, "STT2")
+	defer tws2.close()
+	if err := tws2.swallow("Welcome"); err != nil {
+		t.Fatal(err)
+	}
+	env, err := tws1a.readEnvelope(500, "ws1a expecting Joiner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	num := env.Num
+
+	// The first client drops, so its timer starts, then it reconnects
+	// and takes over, so its timer stops
+
+	tws1a.close()
+	waitForTimers(1, "After dropping")
+	ws1b, _, err := dial(serv, room, "STT1", num)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws1b := newTConn(ws1b, "STT1")
+	defer tws1b.close()
+	waitForTimers(0, "After reconnecting")
+
+	// It takes over again while it's still connected, and the old
+	// connection never needs a timer
+
+	ws1c, _, err := dial(serv, room, "STT1", num)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws1c := newTConn(ws1c, "STT1")
+	defer tws1c.close()
+	if err := tws1b.expectClose(CloseSuperseded, 500); err != nil {
+		t.Error(err)
+	}
+	tws1b.close()
+	waitForTimers(0, "After superseding")
+
+	// The second client never hears of a leaver, even after the
+	// reconnection timeout
+
+	for {
+		env, err := tws2.readEnvelope(500,
+			"STT2 expecting no leaver")
+		if err != nil {
+			break
+		}
+		if env.Intent == "Leaver" {
+			t.Errorf("STT2 got unexpected envelope: %#v", env)
+		}
+	}
+
+	// Tidy up, and once everything in the main app finishes there are
+	// no timers left
+	tws1c.close()
+	tws2.close()
+	WG.Wait()
+	if n := Shub.Timers(); n != 0 {
+		t.Errorf("Expected no timers left but there are %d", n)
+	}
+	if count := Shub.Count(); count != 0 {
+		t.Errorf("Expected no hubs left but there are %d", count)
+	}
+}
+
+func TestSuperhub_DrainClosesEveryRoom(t *testing.T) {
+	// Just for this test, use a superhub of our own, as it won't give
+	// out any more hubs once drained
+	useSuperhub(t, defaultReconnection)
+
+	serv := newTestServer(bounceHandler)
+	defer serv.Close()
+
+	// Clients join two rooms
+
+	twss := make([]*tConn, 0)
+	for _, d := range []struct {
+		room string
+		id   string
+	}{
+		{"/superhub.drain.1", "DRN1"},
+		{"/superhub.drain.2", "DRN2"},
+	} {
+		ws, _, err := dial(serv, d.room, d.id, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tws := newTConn(ws, d.id)
+		defer tws.close()
+		if err := tws.swallow("Welcome"); err != nil {
+			t.Fatal(err)
+		}
+		twss = append(twss, tws)
+	}
+
+	// Draining closes every room, and only finishes once all the hubs
+	// have
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := Shub.Drain(ctx); err != nil {
+		t.Error(err)
+	}
+	if count := Shub.Count(); count != 0 {
+		t.Errorf("Expected no hubs left but there are %d", count)
+	}
+	for _, tws := range twss {
+		if err := tws.swallow("Closing"); err != nil {
+			t.Fatal(err)
+		}
+		if err := tws.expectClose(websocket.CloseGoingAway, 500); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// No-one else can get a hub
+
+	if _, err := Shub.Hub("/superhub.drain.3", &ConnectionParams{}); err != errShuttingDown {
+		t.Errorf("Expected errShuttingDown but got %v", err)
+	}
+
+	// Tidy up, and check everything in the main app finishes
+	for _, tws := range twss {
+		tws.close()
+	}
+	WG.Wait()
+}
+
+func TestSuperhub_DrainSaysWhichRoomsDidntFinish(t *testing.T) {
+	// A hub with a client that never lets go can't finish
+
+	sh := NewSuperhub()
+	h, err := sh.Hub("/superhub.drain.stuck", &ConnectionParams{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(),
+		100*time.Millisecond)
+	defer cancel()
+	err = sh.Drain(ctx)
+	if err == nil || !strings.Contains(err.Error(), "/superhub.drain.stuck") {
+		t.Errorf("Expected error naming stuck room but got %v", err)
+	}
+
+	// Once the client lets go the hub can finish
+	sh.Release(h, &Client{gone: true})
+	WG.Wait()
+	if count := sh.Count(); count != 0 {
+		t.Errorf("Expected no hubs left but there are %d", count)
+	}
+}
+
+func TestSuperhub_RoomsCanHaveTheirOwnReconnectionTime(t *testing.T) {
+	// The superhub gives most rooms its own time, but can override that,
+	// and a room can still say otherwise
+
+	sh := NewSuperhubWith(SuperhubConfig{
+		Reconnection: time.Second,
+		RoomReconnection: func(room string) (time.Duration, bool) {
+			return 2 * time.Second, room == "/recon.slow"
+		},
+	})
+	for _, d := range []struct {
+		room      string
+		reconnect time.Duration
+		expected  time.Duration
+	}{
+		{"/recon.usual", -1, time.Second},
+		{"/recon.slow", -1, 2 * time.Second},
+		{"/recon.own", 3 * time.Second, 3 * time.Second},
+	} {
+		h, err := sh.Hub(d.room, &ConnectionParams{Reconnect: d.reconnect})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h.settings.Reconnection != d.expected {
+			t.Errorf("Room %s has reconnection %s, expected %s",
+				d.room, h.settings.Reconnection, d.expected)
+		}
+		sh.Release(h, &Client{gone: true})
+	}
+
+	// Tidy up, and check everything in the main app finishes
+	WG.Wait()
+	if count := sh.Count(); count != 0 {
+		t.Errorf("Expected no hubs left but there are %d", count)
+	}
+}
+
+func TestSuperhub_ServerCanBeFull(t *testing.T) {
+	// Just for this test, lower the reconnection timeout so that
+	// clients are released reasonably quickly, and only let the server
+	// have two clients
+	sh := useSuperhub(t, 250*time.Millisecond)
+	sh.config.MaxTotalClients = 2
+
+	serv := newTestServer(bounceHandler)
+	defer serv.Close()
+
+	// Two clients join different rooms
+
+	twss := make([]*tConn, 0)
+	for _, d := range []struct {
+		room string
+		id   string
+	}{
+		{"/superhub.full.1", "FULL1"},
+		{"/superhub.full.2", "FULL2"},
+	} {
+		ws, _, err := dial(serv, d.room, d.id, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tws := newTConn(ws, d.id)
+		defer tws.close()
+		if err := tws.swallow("Welcome"); err != nil {
+			t.Fatal(err)
+		}
+		twss = append(twss, tws)
+	}
+
+	// Another client is told to come back later, even once one of the
+	// others has gone, until it's finally released
+
+	expectFull := func(desc string) {
+		ws, resp, err := dial(serv, "/superhub.full.3", "FULL3", -1)
+		if err == nil {
+			ws.Close()
+			t.Fatalf("%s: expected error dialling", desc)
+		}
+		if resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+			t.Fatalf("%s: expected 503 but got %v", desc, resp)
+		}
+		if retry := resp.Header.Get("Retry-After"); retry != "10" {
+			t.Errorf("%s: expected Retry-After 10 but got %q", desc, retry)
+		}
+		if err := responseContains(resp, REJECTSERVERFULL); err != nil {
+			t.Errorf("%s: %s", desc, err)
+		}
+	}
+	expectFull("Full")
+	twss[0].close()
+	expectFull("After one's gone")
+
+	for i := 0; i < 50 && sh.Clients() > 1; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	ws, _, err := dial(serv, "/superhub.full.3", "FULL3", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws := newTConn(ws, "FULL3")
+	defer tws.close()
+	if err := tws.swallow("Welcome"); err != nil {
+		t.Fatal(err)
+	}
+	twss = append(twss, tws)
+
+	// Tidy up, and check everything in the main app finishes
+	for _, tws := range twss {
+		tws.close()
+	}
+	WG.Wait()
+	if n := sh.Clients(); n != 0 {
+		t.Errorf("Expected no clients left but there are %d", n)
+	}
+}
+
+func TestSuperhub_RoomCanEmptyAndBeRejoinedStraightAway(t *testing.T) {
+	// Just for this test, have a tiny reconnection timeout, so a room
+	// empties just as the next client is given its hub
+	sh := useSuperhub(t, 5*time.Millisecond)
+
+	serv := newTestServer(bounceHandler)
+	defer serv.Close()
+
+	// Each client leaves just as the next joins, and the next is
+	// always welcomed, to the old hub or a new one
+
+	room := "/superhub.rejoin"
+	for i := 0; i < 100; i++ {
+		id := "REJ" + strconv.Itoa(i)
+		ws, _, err := dial(serv, room, id, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tws := newTConn(ws, id)
+		if err := tws.swallow("Welcome"); err != nil {
+			tws.close()
+			t.Fatalf("Client %d: %s", i, err)
+		}
+		if i%2 == 1 {
+			time.Sleep(time.Duration(i%7) * time.Millisecond)
+		}
+		tws.close()
+	}
+
+	// Tidy up, and check everything in the main app finishes
+	WG.Wait()
+	if count := sh.Count(); count != 0 {
+		t.Errorf("Expected no hubs left but there are %d", count)
+	}
+}
+
+func TestSuperhub_HubWaitsForClientsItsGiven(t *testing.T) {
+	// A hub's last client times out just after another's been given the
+	// hub, but before it's joined, so the hub must carry on for it
+
+	sh := NewSuperhub()
+	h, err := sh.Hub("/superhub.waits", &ConnectionParams{Reconnect: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h2, err := sh.Hub("/superhub.waits", &ConnectionParams{Reconnect: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h2 != h {
+		t.Fatal("Second client got a different hub")
+	}
+	sh.Release(h, &Client{gone: true})
+	time.Sleep(50 * time.Millisecond)
+	if h.stopped() {
+		t.Fatal("Hub stopped while a client was still to join")
+	}
+
+	// Once the other client's done with it, it stops
+
+	sh.Release(h, &Client{gone: true})
+	WG.Wait()
+	if !h.stopped() {
+		t.Error("Hub didn't stop after its clients had gone")
+	}
+	if count := sh.Count(); count != 0 {
+		t.Errorf("Expected no hubs left but there are %d", count)
+	}
+}
+
+func TestSuperhub_ReconnectionsDontCountAgainstRoomLimit(t *testing.T) {
+	// Make the reconnection timeout long enough that every dropped
+	// connection may still reconnect while the players keep coming back
+
+	sh := useSuperhub(t, 2*time.Second)
+
+	serv := newTestServer(bounceHandler)
+	defer serv.Close()
+
+	// Fill a room for three
+
+	room := "/superhub.churn"
+	ids := []string{"CH1", "CH2", "CH3"}
+	twss := make([]*tConn, len(ids))
+	defer func() {
+		for _, tws := range twss {
+			if tws != nil {
+				tws.close()
+			}
+		}
+	}()
+	for i, id := range ids {
+		ws, _, err := dialWith(serv, room, id, -1,
+			url.Values{"maxclients": {"3"}}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		twss[i] = newTConn(ws, id)
+		if err := twss[i].swallow("Welcome"); err != nil {
+			t.Fatalf("%s: %s", id, err)
+		}
+	}
+
+	// Each player drops its connection and comes back with a new one,
+	// again and again, so there are many more connections than players.
+	// They should all be let back in.
+
+	for round := 0; round < 3; round++ {
+		for i, id := range ids {
+			twss[i].close()
+			ws, _, err := dial(serv, room, id, -1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			twss[i] = newTConn(ws, id)
+			env, err := twss[i].readEnvelope(500,
+				"%s expecting Welcome in round %d", id, round)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if env.Intent != "Welcome" {
+				t.Fatalf("%s in round %d expected Welcome, got %#v",
+					id, round, env)
+			}
+		}
+	}
+
+	// The room is still full for a new player
+
+	ws4, _, err := dial(serv, room, "CH4", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws4 := newTConn(ws4, "CH4")
+	defer tws4.close()
+	if err := tws4.expectClose(CloseRoomFull, 500); err != nil {
+		t.Fatal(err)
+	}
+	tws4.close()
+
+	// Once a player really leaves there's a place
+
+	err = twss[0].ws.WriteMessage(
+		websocket.TextMessage, []byte(`{"intent":"Goodbye"}`),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := sh.Existing(room)
+	for i := 0; h.Players() != 2; i++ {
+		if i == 50 {
+			t.Fatalf("Expected 2 players after goodbye, got %d", h.Players())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	ws5, _, err := dial(serv, room, "CH5", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws5 := newTConn(ws5, "CH5")
+	defer tws5.close()
+	if err := tws5.swallow("Welcome"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Tidy up, and check everything in the main app finishes
+	for _, tws := range twss {
+		tws.close()
+	}
+	tws5.close()
+	WG.Wait()
+}
+
+// useSuperhub has a new superhub, whose clients have the given time to
+// reconnect, give out hubs for the rest of a test, and returns it.
+// Hubs from earlier tests are left to finish first, so the test can
+// change any settings they might otherwise still be reading.
+func useSuperhub(t *testing.T, reconnection time.Duration) *Superhub {
+	WG.Wait()
+	oldShub := Shub
+	Shub = NewSuperhubWith(SuperhubConfig{Reconnection: reconnection})
+	t.Cleanup(func() {
+		Shub = oldShub
+	})
+	return Shub
+}
+
+func BenchmarkSuperhub_ChurningRooms(b *testing.B) {
+	for _, shards := range []int{1, superhubShards} {
+		b.Run(strconv.Itoa(shards)+"Shards", func(b *testing.B) {
+			churnRooms(b, shards)
+		})
+	}
+}
+
+// churnRooms has clients come and go in many rooms at once, each one
+// leaving a reconnection timer to fire, in a superhub split into the
+// given number of shards.
+func churnRooms(b *testing.B, shards int) {
+	oldShards := superhubShards
+	superhubShards = shards
+	sh := NewSuperhubWith(SuperhubConfig{Reconnection: time.Millisecond})
+	superhubShards = oldShards
+
+	// Each room keeps one client throughout, so its hub carries on
+
+	rooms := 1000
+	hubs := make([]*Hub, rooms)
+	for i := range hubs {
+		h, err := sh.Hub("/churn."+strconv.Itoa(i), &ConnectionParams{})
+		if err != nil {
+			b.Fatal(err)
+		}
+		hubs[i] = h
+	}
+
+	var next int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			n := int(atomic.AddInt64(&next, 1))
+			room := "/churn." + strconv.Itoa(n%rooms)
+			h, err := sh.Hub(room, &ConnectionParams{})
+			if err != nil {
+				b.Error(err)
+				return
+			}
+			sh.Release(h, &Client{})
+		}
+	})
+	b.StopTimer()
+
+	// Tidy up, and check everything finishes
+	for _, h := range hubs {
+		sh.Release(h, &Client{gone: true})
+	}
+	WG.Wait()
+}
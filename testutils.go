@@ -10,6 +10,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"sort"
 	"strconv"
 	"strings"
@@ -17,6 +18,7 @@ import (
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack"
 )
 
 // tConn is a websocket.Conn whose ReadMessage can time out safely
@@ -66,6 +68,62 @@ func dial(serv *httptest.Server, path string, clientID string, num int) (
 	resp *http.Response,
 	err error,
 ) {
+	return dialWith(serv, path, clientID, num, nil, nil)
+}
+
+// dialWith is like dial, but also sends the given extra query
+// parameters and request headers, either of which may be nil.
+func dialWith(
+	serv *httptest.Server,
+	path string,
+	clientID string,
+	num int,
+	params url.Values,
+	header http.Header,
+) (
+	ws *websocket.Conn,
+	resp *http.Response,
+	err error,
+) {
+	if header == nil {
+		header = make(http.Header)
+	}
+
+	// Connect to the server
+	url := wsURL(serv, path, clientID, num, params)
+	return websocket.DefaultDialer.Dial(url, header)
+}
+
+// dialCompressed is like dialWith, but offers to compress messages.
+func dialCompressed(
+	serv *httptest.Server,
+	path string,
+	clientID string,
+	num int,
+	params url.Values,
+) (
+	ws *websocket.Conn,
+	resp *http.Response,
+	err error,
+) {
+	dialer := *websocket.DefaultDialer
+	dialer.EnableCompression = true
+
+	// Connect to the server
+	url := wsURL(serv, path, clientID, num, params)
+	return dialer.Dial(url, make(http.Header))
+}
+
+// wsURL gives the websocket URL for a path on the test server, sending
+// a clientID (if non-empty), last num received (if non-negative), and
+// any other parameters (if non-nil).
+func wsURL(
+	serv *httptest.Server,
+	path string,
+	clientID string,
+	num int,
+	params url.Values,
+) string {
 	// Convert http://a.b.c.d to ws://a.b.c.d
 	// and add the given path
 	url := "ws" + strings.TrimPrefix(serv.URL, "http") + path
@@ -86,8 +144,17 @@ func dial(serv *httptest.Server, path string, clientID string, num int) (
 	}
 	url = url + qry + idStr + amp + lastnumStr
 
-	// Connect to the server
-	return websocket.DefaultDialer.Dial(url, make(http.Header))
+	// Add any other parameters
+	if len(params) > 0 {
+		if qry == "" {
+			url = url + "?"
+		} else {
+			url = url + "&"
+		}
+		url = url + params.Encode()
+	}
+
+	return url
 }
 
 // newTConn creates a new timeoutable connection from the given one.
@@ -163,13 +230,22 @@ func (c *tConn) readEnvelope(timeout int, trace string, a ...interface{}) (*Enve
 		return nil, fmt.Errorf("Read error%s: %s", trace, rr.err.Error())
 	}
 	env := Envelope{}
-	err := json.Unmarshal(rr.msg, &env)
+	err := decodeEnvelope(rr.mType, rr.msg, &env)
 	if err != nil {
 		return nil, fmt.Errorf("Unmarshalling error%s: %s", trace, err.Error())
 	}
 	return &env, nil
 }
 
+// decodeEnvelope reads an envelope sent in a websocket message of the
+// given type. The server sends JSON as text and MessagePack as binary.
+func decodeEnvelope(mType int, msg []byte, env *Envelope) error {
+	if mType == websocket.BinaryMessage {
+		return msgpack.Unmarshal(msg, env)
+	}
+	return json.Unmarshal(msg, env)
+}
+
 // close the `tConn`. Always use this to close the connection, instead
 // of the `Conn.Close()`.
 func (c *tConn) close() {
@@ -218,7 +294,7 @@ func (ws *tConn) swallow(intent string) error {
 	if rr.err != nil {
 		return rr.err
 	}
-	err := json.Unmarshal(rr.msg, &env)
+	err := decodeEnvelope(rr.mType, rr.msg, &env)
 	if err != nil {
 		return err
 	}
@@ -271,7 +347,7 @@ func (ws *tConn) readPeerMessage(timeout int) (int, []byte, error) {
 		if rr.err != nil {
 			return rr.mType, rr.msg, rr.err
 		}
-		err := json.Unmarshal(rr.msg, &env)
+		err := decodeEnvelope(rr.mType, rr.msg, &env)
 		if err != nil {
 			return 0, []byte{}, err
 		}
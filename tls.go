@@ -0,0 +1,125 @@
+// Copyright 2020 Nik Silver
+//
+// Licensed under the GPL v3.0. See file LICENCE.txt for details.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// Where certificates we get automatically are kept, unless we're told
+// otherwise, so we needn't ask for them again after a restart
+var defaultCertCache = "certs"
+
+// tlsSettings say how the server uses TLS, if it does. Either it's
+// given a certificate and its key, or it gets certificates from Let's
+// Encrypt for the hosts it's allowed to.
+type tlsSettings struct {
+	certFile string   // File with the certificate, and any chain
+	keyFile  string   // File with its private key
+	hosts    []string // Hosts to get certificates for automatically
+	cacheDir string   // Where to keep those certificates
+	email    string   // Who Let's Encrypt can contact, if anyone
+}
+
+// tlsSettingsFromEnv gets the TLS settings from environment variables.
+// AUTOCERT_HOSTS is a comma-separated list.
+func tlsSettingsFromEnv() tlsSettings {
+	ts := tlsSettings{
+		certFile: os.Getenv("TLS_CERT_FILE"),
+		keyFile:  os.Getenv("TLS_KEY_FILE"),
+		hosts:    make([]string, 0),
+		cacheDir: os.Getenv("AUTOCERT_CACHE_DIR"),
+		email:    os.Getenv("AUTOCERT_EMAIL"),
+	}
+	for _, h := range strings.Split(os.Getenv("AUTOCERT_HOSTS"), ",") {
+		if h = strings.ToLower(strings.TrimSpace(h)); h != "" {
+			ts.hosts = append(ts.hosts, h)
+		}
+	}
+	if ts.cacheDir == "" {
+		ts.cacheDir = defaultCertCache
+	}
+	return ts
+}
+
+// check says what's wrong with the settings, if anything.
+func (ts tlsSettings) check() error {
+	if (ts.certFile == "") != (ts.keyFile == "") {
+		return fmt.Errorf("TLS needs both a certificate and a key file")
+	}
+	if ts.certFile != "" && ts.auto() {
+		return fmt.Errorf("TLS can't use a certificate file and get " +
+			"certificates automatically")
+	}
+	return nil
+}
+
+// enabled says if the server uses TLS.
+func (ts tlsSettings) enabled() bool {
+	return ts.certFile != "" || ts.auto()
+}
+
+// auto says if the server gets its certificates automatically.
+func (ts tlsSettings) auto() bool {
+	return len(ts.hosts) > 0
+}
+
+// servers gives a server for HTTPS at one address, for everything the
+// handler handles, and a server for plain HTTP at the other that only
+// redirects to it. If we're getting certificates automatically the
+// plain one also answers Let's Encrypt's challenges.
+func (ts tlsSettings) servers(
+	httpsAddr string,
+	httpAddr string,
+	handler http.Handler,
+) (secure *http.Server, plain *http.Server) {
+	secure = &http.Server{Addr: httpsAddr, Handler: handler}
+	redirect := http.Handler(redirectHandler(httpsAddr))
+	if ts.auto() {
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(ts.hosts...),
+			Cache:      autocert.DirCache(ts.cacheDir),
+			Email:      ts.email,
+		}
+		secure.TLSConfig = m.TLSConfig()
+		redirect = m.HTTPHandler(redirect)
+	}
+	plain = &http.Server{Addr: httpAddr, Handler: redirect}
+	return secure, plain
+}
+
+// listen has the HTTPS server from servers accept connections, and
+// only returns when it stops.
+func (ts tlsSettings) listen(secure *http.Server) error {
+	if ts.auto() {
+		// The certificates come from its TLS config
+		return secure.ListenAndServeTLS("", "")
+	}
+	return secure.ListenAndServeTLS(ts.certFile, ts.keyFile)
+}
+
+// redirectHandler sends any request to the same place over HTTPS, on
+// the port of the given address, if it's not the usual one.
+func redirectHandler(httpsAddr string) http.HandlerFunc {
+	_, port, _ := net.SplitHostPort(httpsAddr)
+	return func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		target := "https://" + host + r.URL.RequestURI()
+		http.Redirect(w, r, target, http.StatusMovedPermanently)
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright 2020 Nik Silver
+//
+// Licensed under the GPL v3.0. See file LICENCE.txt for details.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTLS_SettingsComeFromEnvironment(t *testing.T) {
+	// Nothing set means no TLS
+
+	t.Setenv("TLS_CERT_FILE", "")
+	t.Setenv("TLS_KEY_FILE", "")
+	t.Setenv("AUTOCERT_HOSTS", "")
+	t.Setenv("AUTOCERT_CACHE_DIR", "")
+	ts := tlsSettingsFromEnv()
+	if ts.enabled() || ts.auto() || ts.check() != nil {
+		t.Errorf("Expected no TLS but got %#v", ts)
+	}
+
+	// Hosts to get certificates for are tidied up, and certificates
+	// are kept in the default place
+
+	t.Setenv("AUTOCERT_HOSTS", " Games.Example.com, ,www.example.com")
+	ts = tlsSettingsFromEnv()
+	if !ts.enabled() || !ts.auto() || ts.check() != nil ||
+		len(ts.hosts) != 2 || ts.hosts[0] != "games.example.com" ||
+		ts.hosts[1] != "www.example.com" || ts.cacheDir != defaultCertCache {
+		t.Errorf("Expected automatic TLS but got %#v", ts)
+	}
+
+	// A certificate file can't be used as well
+
+	t.Setenv("TLS_CERT_FILE", "cert.pem")
+	t.Setenv("TLS_KEY_FILE", "key.pem")
+	if err := tlsSettingsFromEnv().check(); err == nil {
+		t.Error("Expected error for certificate file and automatic TLS")
+	}
+
+	// A certificate file needs its key
+
+	t.Setenv("AUTOCERT_HOSTS", "")
+	ts = tlsSettingsFromEnv()
+	if !ts.enabled() || ts.auto() || ts.check() != nil {
+		t.Errorf("Expected TLS from files but got %#v", ts)
+	}
+	t.Setenv("TLS_KEY_FILE", "")
+	if err := tlsSettingsFromEnv().check(); err == nil {
+		t.Error("Expected error for certificate file without key file")
+	}
+}
+
+func TestTLS_PlainHTTPRedirectsToHTTPS(t *testing.T) {
+	data := []struct {
+		httpsAddr string
+		host      string
+		exp       string
+	}{
+		{":443", "games.example.com", "https://games.example.com/g/room?x=1"},
+		{":443", "games.example.com:80",
+			"https://games.example.com/g/room?x=1"},
+		{":8443", "games.example.com:8080",
+			"https://games.example.com:8443/g/room?x=1"},
+	}
+
+	for i, d := range data {
+		req := httptest.NewRequest("GET", "/g/room?x=1", nil)
+		req.Host = d.host
+		w := httptest.NewRecorder()
+		redirectHandler(d.httpsAddr)(w, req)
+		if w.Code != http.StatusMovedPermanently ||
+			w.Header().Get("Location") != d.exp {
+			t.Errorf("%d: Expected redirect to %s but got %d to %s",
+				i, d.exp, w.Code, w.Header().Get("Location"))
+		}
+	}
+}
+
+func TestTLS_AutomaticCertificatesNeedChallengesAnswered(t *testing.T) {
+	ts := tlsSettings{
+		hosts:    []string{"games.example.com"},
+		cacheDir: t.TempDir(),
+	}
+	secure, plain := ts.servers(":8443", ":8080", http.NotFoundHandler())
+	if secure.Addr != ":8443" || plain.Addr != ":8080" {
+		t.Errorf("Got servers at %s and %s", secure.Addr, plain.Addr)
+	}
+	if secure.TLSConfig == nil || secure.TLSConfig.GetCertificate == nil {
+		t.Fatal("Expected HTTPS server to get its certificates")
+	}
+
+	// Let's Encrypt's challenges are answered, for hosts we can have
+	// certificates for, and everything else is redirected
+
+	get := func(host string, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Host = host
+		w := httptest.NewRecorder()
+		plain.Handler.ServeHTTP(w, req)
+		return w
+	}
+	w := get("games.example.com", "/.well-known/acme-challenge/tok")
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Unknown challenge: Expected 404 but got %d", w.Code)
+	}
+	w = get("evil.com", "/.well-known/acme-challenge/tok")
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Other host's challenge: Expected 403 but got %d", w.Code)
+	}
+	w = get("games.example.com", "/rooms/public")
+	if w.Code != http.StatusMovedPermanently ||
+		w.Header().Get("Location") !=
+			"https://games.example.com:8443/rooms/public" {
+		t.Errorf("Expected redirect but got %d to %s",
+			w.Code, w.Header().Get("Location"))
+	}
+}
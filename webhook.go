@@ -0,0 +1,111 @@
+// Copyright 2020 Nik Silver
+//
+// Licensed under the GPL v3.0. See file LICENCE.txt for details.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Where to tell another service about clients joining and leaving
+// rooms. If it's empty no-one is told.
+var webhookURL = ""
+
+// How many events can wait to be delivered before we start dropping
+// them, how many times to retry a failed delivery, and how long to
+// wait before the first retry. Each retry waits twice as long.
+var webhookQueueSize = 100
+var webhookRetries = 3
+var webhookRetryDelay = time.Second
+
+// How long to wait for the webhook to respond
+var webhookTimeout = 5 * time.Second
+
+// Global webhook that all hubs tell about their events
+var Webhooks = NewWebhook()
+
+// HookEvent is what's posted to the webhook, as JSON.
+type HookEvent struct {
+	Room    string // Name of the room
+	ID      string // ID of the client joining or leaving
+	Event   string // Joiner or Leaver
+	Members int    // How many players are in the room now
+}
+
+// Webhook delivers events to the webhook URL one at a time, in order,
+// without ever holding up whoever wants them delivered.
+type Webhook struct {
+	queue  chan *HookEvent
+	client *http.Client
+	once   sync.Once
+}
+
+// NewWebhook creates a webhook with nothing to deliver. It only starts
+// delivering when it's first given something.
+func NewWebhook() *Webhook {
+	return &Webhook{
+		queue:  make(chan *HookEvent, webhookQueueSize),
+		client: &http.Client{Timeout: webhookTimeout},
+	}
+}
+
+// Notify queues an event for delivery, if there's a webhook URL. If
+// the queue is full the event is dropped.
+func (wh *Webhook) Notify(ev *HookEvent) {
+	if webhookURL == "" {
+		return
+	}
+	wh.once.Do(func() {
+		go wh.deliverAll()
+	})
+
+	select {
+	case wh.queue <- ev:
+	default:
+		aLog.Warn("Webhook queue full, dropping event", "room", ev.Room,
+			"id", ev.ID, "event", ev.Event)
+	}
+}
+
+// deliverAll delivers queued events forever.
+func (wh *Webhook) deliverAll() {
+	for ev := range wh.queue {
+		wh.deliver(ev)
+	}
+}
+
+// deliver posts one event to the webhook, retrying if it fails, and
+// giving up after the last retry.
+func (wh *Webhook) deliver(ev *HookEvent) {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		aLog.Error("Couldn't marshal webhook event", "error", err)
+		return
+	}
+
+	delay := webhookRetryDelay
+	for try := 0; try <= webhookRetries; try++ {
+		if try > 0 {
+			time.Sleep(delay)
+			delay *= 2
+		}
+		resp, err := wh.client.Post(webhookURL, "application/json",
+			bytes.NewReader(body))
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+				return
+			}
+		}
+		aLog.Warn("Webhook delivery failed", "room", ev.Room,
+			"id", ev.ID, "event", ev.Event, "try", try, "error", err,
+			"resp", resp)
+	}
+	aLog.Warn("Giving up on webhook delivery", "room", ev.Room,
+		"id", ev.ID, "event", ev.Event)
+}
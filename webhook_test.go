@@ -0,0 +1,110 @@
+// Copyright 2020 Nik Silver
+//
+// Licensed under the GPL v3.0. See file LICENCE.txt for details.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWebhook_HearsJoinersAndLeaversDespiteFailures(t *testing.T) {
+	// Just for this test, lower the reconnection timeout so that a
+	// Leaver message is triggered reasonably quickly, retry webhooks
+	// quickly, and have a webhook which fails the first time
+	events := make(chan *HookEvent, 10)
+	mux := sync.Mutex{}
+	calls := 0
+	hook := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			mux.Lock()
+			calls++
+			first := calls == 1
+			mux.Unlock()
+			if first {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			ev := &HookEvent{}
+			if err := json.NewDecoder(r.Body).Decode(ev); err != nil {
+				t.Errorf("Webhook got bad body: %s", err)
+			}
+			events <- ev
+		}))
+	defer hook.Close()
+
+	useSuperhub(t, 250*time.Millisecond)
+	oldWebhookURL := webhookURL
+	oldWebhookRetryDelay := webhookRetryDelay
+	webhookURL = hook.URL
+	webhookRetryDelay = 50 * time.Millisecond
+	defer func() {
+		webhookURL = oldWebhookURL
+		webhookRetryDelay = oldWebhookRetryDelay
+	}()
+
+	serv := newTestServer(bounceHandler)
+	defer serv.Close()
+
+	// Two clients join, and one leaves
+
+	room := "/webhook.room"
+	ws1, _, err := dial(serv, room, "WHK1", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws1 := newTConn(ws1, "WHK1")
+	defer tws1.close()
+	if err := tws1.swallow("Welcome"); err != nil {
+		t.Fatal(err)
+	}
+
+	ws2, _, err := dial(serv, room, "WHK2", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tws2 := newTConn(ws2, "WHK2")
+	defer tws2.close()
+	if err = swallowMany(
+		intentExp{"WHK2 joining, ws2", tws2, "Welcome"},
+		intentExp{"WHK2 joining, ws1", tws1, "Joiner"},
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	tws2.close()
+	if err := tws1.swallow("Away"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tws1.swallow("Leaver"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The webhook should hear all of it, in order, even though the
+	// first delivery failed
+
+	exps := []HookEvent{
+		{room, "WHK1", "Joiner", 1},
+		{room, "WHK2", "Joiner", 2},
+		{room, "WHK2", "Leaver", 1},
+	}
+	for i, exp := range exps {
+		select {
+		case ev := <-events:
+			if *ev != exp {
+				t.Errorf("Event %d: Expected %#v but got %#v", i, exp, *ev)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Event %d: Timed out waiting for %#v", i, exp)
+		}
+	}
+
+	// Tidy up, and check everything in the main app finishes
+	tws1.close()
+	WG.Wait()
+}